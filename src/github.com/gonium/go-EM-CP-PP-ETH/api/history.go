@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+)
+
+const (
+	// Samples kept in memory without a store, one hour at the default
+	// polling interval.
+	MAX_MEMORY_SAMPLES = 1800
+	// Time range of GET history without from.
+	DEFAULT_HISTORY_RANGE = time.Hour
+)
+
+// sampleDocument is a compact form of a status sample for charts.
+type sampleDocument struct {
+	Time     time.Time  `json:"time"`
+	EVState  string     `json:"ev_state"`
+	Power    float32    `json:"active_power_w"`
+	Energy   float32    `json:"energy_kwh"`
+	Voltages [3]float32 `json:"voltages_v"`
+	Currents [3]float32 `json:"currents_a"`
+}
+
+type historyDocument struct {
+	Samples []sampleDocument `json:"samples"`
+}
+
+func newSampleDocument(s EM_CP_PP_ETH.Status, t time.Time) sampleDocument {
+	return sampleDocument{
+		Time:     t,
+		EVState:  s.EVStatus.String(),
+		Power:    s.ActivePower,
+		Energy:   s.Energy,
+		Voltages: [3]float32{s.L1Voltage, s.L2Voltage, s.L3Voltage},
+		Currents: [3]float32{s.L1Current, s.L2Current, s.L3Current},
+	}
+}
+
+// remember keeps a sample in memory. The caller holds s.mu.
+func (s *Server) remember(snapshot EM_CP_PP_ETH.Snapshot) {
+	s.samples = append(s.samples, newSampleDocument(snapshot.Status,
+		snapshot.Time))
+	if len(s.samples) > MAX_MEMORY_SAMPLES {
+		s.samples = s.samples[len(s.samples)-MAX_MEMORY_SAMPLES:]
+	}
+}
+
+// handleHistory lists the samples between the from and to parameters
+// (RFC 3339), the last hour by default. With a store, the samples
+// stored at its sample interval are returned, otherwise every poll
+// since the start of the server, up to MAX_MEMORY_SAMPLES.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	q := store.Query{From: time.Now().Add(-DEFAULT_HISTORY_RANGE)}
+	for name, target := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf(
+				"Invalid %s '%s', expected RFC 3339", name, value))
+			return
+		}
+		*target = t
+	}
+
+	doc := historyDocument{Samples: []sampleDocument{}}
+	if s.Recorder != nil {
+		q.Station = s.Recorder.Tracker.Station
+		samples, err := s.Recorder.Store.Samples(q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, sample := range samples {
+			doc.Samples = append(doc.Samples, newSampleDocument(
+				sample.Status, sample.Time))
+		}
+	} else {
+		s.mu.Lock()
+		for _, sample := range s.samples {
+			if !sample.Time.Before(q.From) &&
+				(q.To.IsZero() || sample.Time.Before(q.To)) {
+				doc.Samples = append(doc.Samples, sample)
+			}
+		}
+		s.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
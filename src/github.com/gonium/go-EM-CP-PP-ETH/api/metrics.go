@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// Prefix of all metric names.
+const METRIC_PREFIX = "em_cp_pp_eth_"
+
+// metricsWriter formats the Prometheus text exposition format. Every
+// sample carries the station label.
+type metricsWriter struct {
+	buf     bytes.Buffer
+	station string
+}
+
+// family starts a metric family.
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s%s %s\n", METRIC_PREFIX, name, help)
+	fmt.Fprintf(&m.buf, "# TYPE %s%s %s\n", METRIC_PREFIX, name, typ)
+}
+
+// sample adds a sample with labels given as name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	pairs := []string{`station="` + escapeLabel(m.station) + `"`}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	fmt.Fprintf(&m.buf, "%s%s{%s} %s\n", METRIC_PREFIX, name,
+		strings.Join(pairs, ","), formatMetric(value))
+}
+
+// gauge writes a family with a single sample.
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help)
+	m.sample(name, value)
+}
+
+// phases writes a family with a sample per phase.
+func (m *metricsWriter) phases(name, help string, l1, l2, l3 float32) {
+	m.family(name, "gauge", help)
+	for i, v := range []float32{l1, l2, l3} {
+		m.sample(name, EM_CP_PP_ETH.Float32Value(v), "phase", fmt.Sprintf("L%d", i+1))
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// handleMetrics exports the cached status and the Modbus statistics.
+// It never talks to the controller, so scrapes cost nothing.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	m := &metricsWriter{station: s.station}
+	snapshot := s.Cache.Snapshot()
+	st := snapshot.Status
+
+	m.gauge("up", "1 if the most recent poll of the controller succeeded",
+		boolMetric(snapshot.Err == nil && !snapshot.Time.IsZero()))
+	if snapshot.Time.IsZero() {
+		// Without a successful poll the status values are meaningless.
+		s.writeModbusMetrics(m)
+		writeMetrics(w, m)
+		return
+	}
+	m.gauge("last_poll_timestamp_seconds", "Time of the most recent"+
+		" successful poll", float64(snapshot.Time.UnixNano())/1e9)
+
+	m.family("ev_state", "gauge", "Vehicle state according to IEC 61851,"+
+		" 1 for the current state")
+	for state := EM_CP_PP_ETH.EVStateA; state <= EM_CP_PP_ETH.EVStateF; state++ {
+		m.sample("ev_state", boolMetric(st.EVStatus == state), "state",
+			state.String())
+	}
+	m.gauge("error_code", "Raw error code bit field", float64(st.Errorcode))
+	m.family("error", "gauge", "1 if the error bit is set")
+	for _, f := range EM_CP_PP_ETH.Faults {
+		m.sample("error", boolMetric(st.Errorcode.Has(f)), "fault", f.Name,
+			"severity", f.Severity.String())
+	}
+	m.gauge("charging_enabled", "1 if the charging station is available",
+		boolMetric(st.ChargingEnabled))
+
+	m.gauge("proximity_current_amperes", "Current carrying capacity of"+
+		" the cable (PP)", float64(st.ProximityCurrent))
+	m.gauge("charge_time_seconds", "Charging time of the charge sequence",
+		float64(st.ChargeTimeHours)*3600+float64(st.ChargeTimeMinutes)*60)
+	m.gauge("dip_configuration", "DIP switch configuration",
+		float64(st.DIPConfiguration))
+	m.gauge("firmware_version", "Firmware version", float64(st.FirmwareVersion))
+	m.phases("voltage_volts", "Phase voltage", st.L1Voltage, st.L2Voltage,
+		st.L3Voltage)
+	m.phases("current_amperes", "Phase current", st.L1Current, st.L2Current,
+		st.L3Current)
+	m.gauge("active_power_watts", "Active power", EM_CP_PP_ETH.Float32Value(st.ActivePower))
+	m.gauge("reactive_power_var", "Reactive power",
+		EM_CP_PP_ETH.Float32Value(st.ReactivePower))
+	m.gauge("apparent_power_voltamperes", "Apparent power",
+		EM_CP_PP_ETH.Float32Value(st.ApparentPower))
+	m.gauge("power_factor", "Power factor", EM_CP_PP_ETH.Float32Value(st.PowerFactor))
+	m.family("energy_kilowatthours_total", "counter", "Energy meter reading")
+	m.sample("energy_kilowatthours_total", EM_CP_PP_ETH.Float32Value(st.Energy))
+	m.gauge("charge_sequence_max_power_watts", "Maximum power of the"+
+		" charge sequence", EM_CP_PP_ETH.Float32Value(st.MaxPower))
+	m.gauge("charge_sequence_energy_kilowatthours", "Energy of the"+
+		" charge sequence", EM_CP_PP_ETH.Float32Value(st.CurrentChargePower))
+	m.gauge("frequency_hertz", "Grid frequency", EM_CP_PP_ETH.Float32Value(st.Frequency))
+	m.phases("charge_sequence_max_current_amperes", "Maximum phase"+
+		" current of the charge sequence", st.L1MaxCurrent, st.L2MaxCurrent,
+		st.L3MaxCurrent)
+	m.gauge("overcurrent_protection", "Overcurrent protection",
+		float64(st.OverCurrentProtection))
+
+	inputs := st.DigitalInputStates
+	m.family("digital_input", "gauge", "State of the digital inputs")
+	for _, in := range []struct {
+		name  string
+		state bool
+	}{{"EN", inputs.EN}, {"XR", inputs.XR}, {"LD", inputs.LD}, {"ML", inputs.ML}} {
+		m.sample("digital_input", boolMetric(in.state), "input", in.name)
+	}
+	outputs := st.DigitalOutputStates
+	m.family("digital_output", "gauge", "State of the digital outputs")
+	for _, out := range []struct {
+		name  string
+		state bool
+	}{{"CR", outputs.CR}, {"LR", outputs.LR}, {"VR", outputs.VR}, {"ER", outputs.ER}} {
+		m.sample("digital_output", boolMetric(out.state), "output", out.name)
+	}
+
+	s.writeModbusMetrics(m)
+	writeMetrics(w, m)
+}
+
+// writeModbusMetrics exports the request statistics per function code.
+func (s *Server) writeModbusMetrics(m *metricsWriter) {
+	if s.Stats == nil {
+		return
+	}
+	functions := s.Stats.Functions()
+	m.family("modbus_requests_total", "counter", "Modbus requests")
+	for _, f := range functions {
+		m.sample("modbus_requests_total", float64(f.Requests), "function",
+			EM_CP_PP_ETH.ModbusFunctionName(f.Code), "code",
+			strconv.Itoa(int(f.Code)))
+	}
+	m.family("modbus_errors_total", "counter", "Failed Modbus requests by"+
+		" kind: exception responses, timeouts and transport errors")
+	for _, f := range functions {
+		for _, kind := range []string{EM_CP_PP_ETH.MODBUS_ERROR_EXCEPTION,
+			EM_CP_PP_ETH.MODBUS_ERROR_TIMEOUT, EM_CP_PP_ETH.MODBUS_ERROR_TRANSPORT} {
+			m.sample("modbus_errors_total", float64(f.Errors[kind]),
+				"function", EM_CP_PP_ETH.ModbusFunctionName(f.Code), "code",
+				strconv.Itoa(int(f.Code)), "kind", kind)
+		}
+	}
+	m.family("modbus_request_duration_seconds", "histogram", "Latency of"+
+		" Modbus requests")
+	for _, f := range functions {
+		name := EM_CP_PP_ETH.ModbusFunctionName(f.Code)
+		code := strconv.Itoa(int(f.Code))
+		cumulative := uint64(0)
+		for i, bound := range EM_CP_PP_ETH.MODBUS_LATENCY_BUCKETS {
+			cumulative += f.Buckets[i]
+			m.sample("modbus_request_duration_seconds_bucket",
+				float64(cumulative), "function", name, "code", code, "le",
+				formatMetric(bound))
+		}
+		m.sample("modbus_request_duration_seconds_bucket", float64(f.Requests),
+			"function", name, "code", code, "le", "+Inf")
+		m.sample("modbus_request_duration_seconds_sum", f.Duration.Seconds(),
+			"function", name, "code", code)
+		m.sample("modbus_request_duration_seconds_count", float64(f.Requests),
+			"function", name, "code", code)
+	}
+}
+
+func writeMetrics(w http.ResponseWriter, m *metricsWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.buf.Bytes())
+}
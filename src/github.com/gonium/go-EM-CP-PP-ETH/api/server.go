@@ -0,0 +1,498 @@
+// Package api serves a REST interface for a single charge controller.
+// All requests share one Modbus connection; the status is polled in the
+// background and answered from the cache.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+)
+
+const (
+	// Prefix of all API paths.
+	API_PREFIX = "/api/v1/"
+	// Completed sessions kept in memory without a store.
+	MAX_MEMORY_SESSIONS = 100
+	// Largest accepted request body.
+	MAX_BODY_SIZE = 1024
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Server answers API requests for one station.
+type Server struct {
+	Cache     *EM_CP_PP_ETH.StatusCache
+	Commander *EM_CP_PP_ETH.Commander
+	// Host of the web interface, used by POST reset.
+	WebHost string
+	// Options of the verified reset.
+	Reset EM_CP_PP_ETH.ResetOptions
+	// Recorder stores samples and sessions. Without it, sessions are
+	// only kept in memory.
+	Recorder *store.Recorder
+	// Time budget of a request to the controller,
+	// EM_CP_PP_ETH.DEFAULT_REQUEST_TIMEOUT unless set.
+	Timeout time.Duration
+	// Default time between status messages of the event streams.
+	StreamInterval time.Duration
+	// Stats of the Modbus requests, exported on /metrics if set.
+	Stats *EM_CP_PP_ETH.ModbusStats
+	// Token clients must send as "Authorization: Bearer <token>", if
+	// set.
+	Token  string
+	Logger *log.Logger
+
+	station  string
+	mu       sync.Mutex
+	tracker  *EM_CP_PP_ETH.SessionTracker
+	sessions []EM_CP_PP_ETH.Session
+	// Copy of the active session of the tracker, updated by record.
+	active *EM_CP_PP_ETH.Session
+	// Session events of the tracker, published by record. Only the
+	// goroutine of Run uses them.
+	pending   []EM_CP_PP_ETH.Event
+	samples   []sampleDocument
+	resetting bool
+	// Events of the cache, forwarded to the subscribers.
+	events      <-chan EM_CP_PP_ETH.Event
+	subscribers map[chan streamMessage]map[string]bool
+}
+
+// NewServer returns a server for the station behind client. Long
+// running servers should wrap client with EM_CP_PP_ETH.WithReconnect.
+func NewServer(client modbus.Client, station string) *Server {
+	return &Server{
+		Cache:     EM_CP_PP_ETH.NewStatusCache(client),
+		Commander: EM_CP_PP_ETH.NewCommander(client),
+		station:   station,
+		tracker:   EM_CP_PP_ETH.NewSessionTracker(station),
+	}
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return EM_CP_PP_ETH.DEFAULT_REQUEST_TIMEOUT
+}
+
+// Run polls the controller every interval and feeds the sessions until
+// ctx is canceled, which is returned. Each poll may take up to the
+// request timeout.
+func (s *Server) Run(ctx context.Context, interval time.Duration) error {
+	s.mu.Lock()
+	s.events = s.Cache.Subscribe(ctx, STREAM_BUFFER)
+	tracker := s.sessionTracker()
+	tracker.OnEvent = func(e EM_CP_PP_ETH.Event) {
+		s.pending = append(s.pending, e)
+	}
+	if active, ok := tracker.Active(); ok {
+		s.active = &active
+	}
+	s.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, s.timeout())
+		err := s.Cache.RefreshContext(refreshCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			s.logf("Poll failed: %s", err.Error())
+		}
+		s.forward()
+		if snapshot := s.Cache.Snapshot(); snapshot.Time.After(last) {
+			last = snapshot.Time
+			s.record(snapshot)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionTracker returns the tracker of the recorder, or the one in
+// memory without a recorder. Only Run uses it after the start.
+func (s *Server) sessionTracker() *EM_CP_PP_ETH.SessionTracker {
+	if s.Recorder != nil {
+		return s.Recorder.Tracker
+	}
+	return s.tracker
+}
+
+// record updates the history and the sessions with a new snapshot and
+// publishes the sessions that ended or started. The recorder writes to
+// disk without holding s.mu, so requests are not blocked by it.
+func (s *Server) record(snapshot EM_CP_PP_ETH.Snapshot) {
+	if s.Recorder != nil {
+		if _, err := s.Recorder.Record(snapshot.Status, snapshot.Time); err != nil {
+			s.logf("Failed to record status: %s", err.Error())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Recorder == nil {
+		s.remember(snapshot)
+		if completed, ok := s.tracker.Update(snapshot.Status, snapshot.Time); ok {
+			s.sessions = append(s.sessions, completed)
+			if len(s.sessions) > MAX_MEMORY_SESSIONS {
+				s.sessions = s.sessions[1:]
+			}
+		}
+	}
+	s.active = nil
+	if active, ok := s.sessionTracker().Active(); ok {
+		s.active = &active
+	}
+	for _, e := range s.pending {
+		s.publish(e)
+	}
+	s.pending = nil
+}
+
+// Handler returns the routes of the API below API_PREFIX.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(API_PREFIX+"status", s.handleStatus)
+	mux.HandleFunc(API_PREFIX+"current", s.handleCurrent)
+	mux.HandleFunc(API_PREFIX+"availability", s.handleAvailability)
+	mux.HandleFunc(API_PREFIX+"digimode", s.handleDigimode)
+	mux.HandleFunc(API_PREFIX+"reset", s.handleReset)
+	mux.HandleFunc(API_PREFIX+"sessions", s.handleSessions)
+	mux.HandleFunc(API_PREFIX+"history", s.handleHistory)
+	mux.HandleFunc(API_PREFIX+"events", s.handleEvents)
+	mux.HandleFunc(API_PREFIX+"ws", s.handleWebSocket)
+	mux.HandleFunc(API_PREFIX+"openapi.json", s.handleSpec)
+	mux.HandleFunc(API_PREFIX, func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s",
+			r.URL.Path))
+	})
+	return s.authenticate(mux)
+}
+
+// MetricsHandler returns the Prometheus metrics, usually served at
+// /metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.authenticate(http.HandlerFunc(s.handleMetrics))
+}
+
+// authenticate checks the bearer token. Browsers cannot set headers on
+// EventSource and WebSocket requests, so the token is also accepted in
+// the access_token parameter. The specification stays public.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" && r.URL.Path != API_PREFIX+"openapi.json" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" {
+				token = r.URL.Query().Get("access_token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized,
+					errors.New("Missing or invalid bearer token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorDocument is the body of all error responses.
+type errorDocument struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, doc interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(doc)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorDocument{err.Error()})
+}
+
+// writeControllerError maps errors of the controller to status codes:
+// 422 for rejected setpoints, 504 for timeouts and 502 otherwise.
+func writeControllerError(w http.ResponseWriter, err error) {
+	var limitErr *EM_CP_PP_ETH.CurrentLimitError
+	switch {
+	case errors.As(err, &limitErr), errors.Is(err, EM_CP_PP_ETH.ErrNoSafeCurrent):
+		writeError(w, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err)
+	default:
+		writeError(w, http.StatusBadGateway, err)
+	}
+}
+
+// allow answers 405 unless the request uses one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf(
+		"Method %s not allowed", r.Method))
+	return false
+}
+
+// valueRequest is the body of the PUT requests.
+type valueRequest struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeValue reads {"value": ...} into target.
+func decodeValue(r *http.Request, target interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, MAX_BODY_SIZE))
+	decoder.DisallowUnknownFields()
+	var body valueRequest
+	if err := decoder.Decode(&body); err != nil {
+		return fmt.Errorf("Invalid request body: %s", err.Error())
+	}
+	if body.Value == nil {
+		return errors.New("Invalid request body: missing value")
+	}
+	if err := json.Unmarshal(body.Value, target); err != nil {
+		return fmt.Errorf("Invalid value %s", string(body.Value))
+	}
+	return nil
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, EM_CP_PP_ETH.NewStatusDocument(s.Cache.Snapshot()))
+}
+
+// refresh updates the cache after a write, so the status reflects it.
+func (s *Server) refresh(ctx context.Context) {
+	if err := s.Cache.RefreshContext(ctx); err != nil {
+		s.logf("Refresh after write failed: %s", err.Error())
+	}
+	s.forward()
+}
+
+func (s *Server) handleCurrent(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	setting, _ := EM_CP_PP_ETH.LookupConfigRegister("ActualChargingCurrent")
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout())
+	defer cancel()
+	var current uint16
+	var err error
+	if r.Method == http.MethodPut {
+		var requested uint16
+		if err := decodeValue(r, &requested); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		current, err = s.Commander.WriteActualChargingCurrentContext(ctx, requested)
+		if err == nil {
+			s.logf("Charging current set to %d A", current)
+			s.refresh(ctx)
+		}
+	} else {
+		current, err = s.Commander.ReadActualChargingCurrentContext(ctx)
+	}
+	if err != nil {
+		writeControllerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, EM_CP_PP_ETH.NewValueDocument(setting,
+		current, time.Now()))
+}
+
+// handleSwitch serves GET and PUT of a coil setting.
+func (s *Server) handleSwitch(w http.ResponseWriter, r *http.Request,
+	name string, read func(context.Context) (bool, error),
+	write func(context.Context, bool) error) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	setting, _ := EM_CP_PP_ETH.LookupConfigRegister(name)
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout())
+	defer cancel()
+	var state bool
+	var err error
+	if r.Method == http.MethodPut {
+		if err := decodeValue(r, &state); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = write(ctx, state); err == nil {
+			s.logf("%s set to %t", name, state)
+			s.refresh(ctx)
+		}
+	} else {
+		state, err = read(ctx)
+	}
+	if err != nil {
+		writeControllerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, EM_CP_PP_ETH.NewValueDocument(setting,
+		state, time.Now()))
+}
+
+func (s *Server) handleAvailability(w http.ResponseWriter, r *http.Request) {
+	s.handleSwitch(w, r, "ChargingEnabled",
+		s.Commander.ReadChargingEnabledContext,
+		s.Commander.WriteChargingEnabledContext)
+}
+
+func (s *Server) handleDigimode(w http.ResponseWriter, r *http.Request) {
+	s.handleSwitch(w, r, "DigimodeEnabled",
+		s.Commander.ReadDigimodeEnabledContext,
+		s.Commander.WriteDigimodeEnabledContext)
+}
+
+// resetDocument is the response of POST reset.
+type resetDocument struct {
+	Sent            time.Time                    `json:"sent"`
+	Down            *time.Time                   `json:"down,omitempty"`
+	Up              *time.Time                   `json:"up,omitempty"`
+	DowntimeSeconds float64                      `json:"downtime_seconds,omitempty"`
+	Status          *EM_CP_PP_ETH.StatusDocument `json:"status,omitempty"`
+}
+
+// handleReset resets the controller. Unless verify=false is given, it
+// answers after the controller came back, which may take minutes.
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	verify := r.URL.Query().Get("verify") != "false"
+	s.mu.Lock()
+	busy := s.resetting
+	s.resetting = true
+	s.mu.Unlock()
+	if busy {
+		writeError(w, http.StatusConflict, errors.New("A reset is in progress"))
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		s.resetting = false
+		s.mu.Unlock()
+	}()
+	s.logf("Resetting %s", s.WebHost)
+
+	if !verify {
+		sent := time.Now()
+		if err := s.Commander.HTTPHardResetContext(r.Context(), s.WebHost); err != nil {
+			writeControllerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, resetDocument{Sent: sent})
+		return
+	}
+	report, err := s.Commander.ResetAndVerifyContext(r.Context(), s.WebHost, s.Reset)
+	if err != nil {
+		writeControllerError(w, err)
+		return
+	}
+	status := EM_CP_PP_ETH.NewStatusDocument(EM_CP_PP_ETH.Snapshot{
+		Status: report.Status, Time: report.Up})
+	writeJSON(w, http.StatusOK, resetDocument{
+		Sent:            report.Sent,
+		Down:            &report.Down,
+		Up:              &report.Up,
+		DowntimeSeconds: report.Downtime().Seconds(),
+		Status:          &status,
+	})
+}
+
+// sessionsDocument is the response of GET sessions.
+type sessionsDocument struct {
+	Active   *EM_CP_PP_ETH.Session  `json:"active"`
+	Sessions []EM_CP_PP_ETH.Session `json:"sessions"`
+}
+
+// handleSessions lists the completed sessions that overlap the range
+// of the from and to parameters (RFC 3339) and the active session.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	var q store.Query
+	for name, target := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf(
+				"Invalid %s '%s', expected RFC 3339", name, value))
+			return
+		}
+		*target = t
+	}
+
+	doc := sessionsDocument{Sessions: []EM_CP_PP_ETH.Session{}}
+	s.mu.Lock()
+	if s.active != nil {
+		active := *s.active
+		doc.Active = &active
+	}
+	for _, session := range s.sessions {
+		if matchSession(q, session) {
+			doc.Sessions = append(doc.Sessions, session)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.Recorder != nil {
+		q.Station = s.Recorder.Tracker.Station
+		sessions, err := s.Recorder.Store.Sessions(q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		doc.Sessions = append(doc.Sessions, sessions...)
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// matchSession applies the time range of q to a session kept in memory.
+func matchSession(q store.Query, s EM_CP_PP_ETH.Session) bool {
+	return (q.From.IsZero() || !s.Unplugged.Before(q.From)) &&
+		(q.To.IsZero() || s.PluggedIn.Before(q.To))
+}
+
+func (s *Server) handleSpec(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
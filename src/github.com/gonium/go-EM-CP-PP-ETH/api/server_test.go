@@ -0,0 +1,444 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/api"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+	"github.com/gorilla/websocket"
+)
+
+// startAPI serves the API of a new simulated station named garage.
+// configure is called before the server starts polling every 20 ms if
+// poll is set. It returns the device, the server and its base URL.
+func startAPI(t *testing.T, poll bool, configure func(*api.Server)) (*simulator.Device, *api.Server, string) {
+	t.Helper()
+	station := simulatortest.Start(t)
+	stats := EM_CP_PP_ETH.NewModbusStats()
+	client := EM_CP_PP_ETH.WithReconnect(
+		stats.Instrument(modbus.NewClient(station.Handler)), station.Handler)
+
+	server := api.NewServer(client, "garage")
+	server.Stats = stats
+	server.StreamInterval = 50 * time.Millisecond
+	if configure != nil {
+		configure(server)
+	}
+	if poll {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			server.Run(ctx, 20*time.Millisecond)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+	}
+	mux := http.NewServeMux()
+	mux.Handle(api.API_PREFIX, server.Handler())
+	mux.Handle("/metrics", server.MetricsHandler())
+	web := httptest.NewServer(mux)
+	t.Cleanup(web.Close)
+	return station.Device, server, web.URL
+}
+
+// request sends a request with an optional JSON body and returns the
+// status code and the body.
+func request(t *testing.T, method, url, token, body string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err.Error())
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err.Error())
+	}
+	return resp.StatusCode, data
+}
+
+func TestAuthentication(t *testing.T) {
+	_, _, url := startAPI(t, false, func(s *api.Server) {
+		s.Token = "secret"
+	})
+	for _, tc := range []struct {
+		name, path, token string
+		code              int
+	}{
+		{"missing token", "/api/v1/status", "", http.StatusUnauthorized},
+		{"wrong token", "/api/v1/status", "guess", http.StatusUnauthorized},
+		{"bearer token", "/api/v1/status", "secret", http.StatusOK},
+		{"token parameter", "/api/v1/status?access_token=secret", "", http.StatusOK},
+		{"wrong token parameter", "/api/v1/status?access_token=guess", "",
+			http.StatusUnauthorized},
+		{"public specification", "/api/v1/openapi.json", "", http.StatusOK},
+		{"metrics without token", "/metrics", "", http.StatusUnauthorized},
+		{"metrics", "/metrics", "secret", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body := request(t, http.MethodGet, url+tc.path, tc.token, "")
+			if code != tc.code {
+				t.Errorf("Got %d %s, want %d", code, body, tc.code)
+			}
+		})
+	}
+}
+
+func TestPutCurrent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		guard EM_CP_PP_ETH.CurrentGuard
+		body  string
+		code  int
+		// Value of the response if ok, otherwise part of the error.
+		result string
+		stored uint16
+	}{
+		{"accepted", EM_CP_PP_ETH.CurrentGuard{}, `{"value": 12}`,
+			http.StatusOK, "12", 12},
+		{"above the cable rating", EM_CP_PP_ETH.CurrentGuard{},
+			`{"value": 40}`, http.StatusUnprocessableEntity,
+			"exceeds the cable rating of 32 A", 16},
+		{"below the minimum", EM_CP_PP_ETH.CurrentGuard{}, `{"value": 5}`,
+			http.StatusUnprocessableEntity, "below the IEC 61851 minimum", 16},
+		{"configured limit", EM_CP_PP_ETH.CurrentGuard{MaxCurrent: 10},
+			`{"value": 12}`, http.StatusUnprocessableEntity,
+			"exceeds the configured limit of 10 A", 16},
+		{"clamped", EM_CP_PP_ETH.CurrentGuard{Clamp: true}, `{"value": 40}`,
+			http.StatusOK, "32", 32},
+		{"forced", EM_CP_PP_ETH.CurrentGuard{Force: true}, `{"value": 40}`,
+			http.StatusOK, "40", 40},
+		{"not a number", EM_CP_PP_ETH.CurrentGuard{}, `{"value": "ten"}`,
+			http.StatusBadRequest, `Invalid value "ten"`, 16},
+		{"missing value", EM_CP_PP_ETH.CurrentGuard{}, `{}`,
+			http.StatusBadRequest, "missing value", 16},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			device, _, url := startAPI(t, false, func(s *api.Server) {
+				s.Commander.Guard = tc.guard
+			})
+			code, body := request(t, http.MethodPut, url+"/api/v1/current",
+				"", tc.body)
+			if code != tc.code {
+				t.Errorf("Got %d %s, want %d", code, body, tc.code)
+			}
+			var doc struct {
+				Value json.Number `json:"value"`
+				Error string      `json:"error"`
+			}
+			if err := json.Unmarshal(body, &doc); err != nil {
+				t.Fatalf("Invalid response %s: %s", body, err.Error())
+			}
+			if tc.code == http.StatusOK && doc.Value.String() != tc.result {
+				t.Errorf("Response %s, want the value %s", body, tc.result)
+			} else if tc.code != http.StatusOK && !strings.Contains(doc.Error, tc.result) {
+				t.Errorf("Response %s, want an error with '%s'", body, tc.result)
+			}
+			got, _ := device.HoldingRegister(EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT)
+			if got != tc.stored {
+				t.Errorf("Register holds %d, want %d", got, tc.stored)
+			}
+		})
+	}
+}
+
+type historyResponse struct {
+	Samples []struct {
+		Time     time.Time  `json:"time"`
+		EVState  string     `json:"ev_state"`
+		Voltages [3]float32 `json:"voltages_v"`
+	} `json:"samples"`
+}
+
+func getHistory(t *testing.T, url string) historyResponse {
+	t.Helper()
+	code, body := request(t, http.MethodGet, url, "", "")
+	if code != http.StatusOK {
+		t.Fatalf("Got %d %s", code, body)
+	}
+	var doc historyResponse
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("Invalid response %s: %s", body, err.Error())
+	}
+	return doc
+}
+
+func TestHistory(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(*testing.T) func(*api.Server)
+	}{
+		{"memory", func(*testing.T) func(*api.Server) { return nil }},
+		{"store", func(t *testing.T) func(*api.Server) {
+			data, err := store.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder, err := store.NewRecorder(data, "garage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func(s *api.Server) { s.Recorder = recorder }
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			_, _, url := startAPI(t, true, tc.configure(t))
+			var doc historyResponse
+			simulatortest.WaitFor(t, "two samples", func() bool {
+				doc = getHistory(t, url+"/api/v1/history")
+				return len(doc.Samples) >= 2
+			})
+			for _, s := range doc.Samples {
+				if s.EVState != "A" || s.Voltages != [3]float32{230, 230, 230} ||
+					s.Time.Before(start.Truncate(time.Second)) {
+					t.Errorf("Sample %+v, want state A at 230 V after %s", s, start)
+				}
+			}
+
+			future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			if doc := getHistory(t, url+"/api/v1/history?from="+future); len(doc.Samples) != 0 {
+				t.Errorf("Got %d samples from the future", len(doc.Samples))
+			}
+			if code, body := request(t, http.MethodGet,
+				url+"/api/v1/history?from=yesterday", "", ""); code != http.StatusBadRequest {
+				t.Errorf("Invalid from: got %d %s, want 400", code, body)
+			}
+		})
+	}
+}
+
+func TestSessionsWhileRecording(t *testing.T) {
+	data, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := store.NewRecorder(data, "garage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, _, url := startAPI(t, true, func(s *api.Server) {
+		s.Recorder = recorder
+	})
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB})
+	simulatortest.WaitFor(t, "the active session", func() bool {
+		_, body := request(t, http.MethodGet, url+"/api/v1/sessions", "", "")
+		var doc struct {
+			Active *EM_CP_PP_ETH.Session `json:"active"`
+		}
+		return json.Unmarshal(body, &doc) == nil && doc.Active != nil &&
+			doc.Active.Station == "garage"
+	})
+	if _, ok, err := data.LoadActive("garage"); err != nil || !ok {
+		t.Errorf("Active session not saved: %t, %v", ok, err)
+	}
+}
+
+// checkTypeFilter plugs in a vehicle that starts charging, which raises
+// an ev_state and io events, and checks that a stream of status and
+// ev_state messages, whose types arrive on types, leaves out the io
+// events.
+func checkTypeFilter(t *testing.T, device *simulator.Device, types <-chan string) {
+	t.Helper()
+	next := func() string {
+		select {
+		case typ := <-types:
+			return typ
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for a message")
+			return ""
+		}
+	}
+	if typ := next(); typ != api.EVENT_STATUS {
+		t.Fatalf("First message is %s, want status", typ)
+	}
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC,
+		DigitalOutputStates: EM_CP_PP_ETH.DigiOutputs{CR: true}})
+	for typ := next(); typ != api.EVENT_EV_STATE; typ = next() {
+		if typ != api.EVENT_STATUS {
+			t.Fatalf("Got a %s message, want status or ev_state", typ)
+		}
+	}
+	// The io event is published right after the ev_state event
+	deadline := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case typ := <-types:
+			if typ != api.EVENT_STATUS {
+				t.Errorf("Got a %s message, want status", typ)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func TestEventsTypeFilter(t *testing.T) {
+	device, _, url := startAPI(t, true, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		url+"/api/v1/events?types=status,ev_state", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if typ := resp.Header.Get("Content-Type"); typ != "text/event-stream" {
+		t.Fatalf("Content-Type %s, want text/event-stream", typ)
+	}
+	types := make(chan string, 64)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if name := strings.TrimPrefix(scanner.Text(), "event: "); name != scanner.Text() {
+				types <- name
+			}
+		}
+	}()
+	checkTypeFilter(t, device, types)
+
+	if code, body := request(t, http.MethodGet, url+"/api/v1/events?types=status,bogus",
+		"", ""); code != http.StatusBadRequest {
+		t.Errorf("Unknown type: got %d %s, want 400", code, body)
+	}
+}
+
+func TestWebSocketTypeFilter(t *testing.T) {
+	device, _, url := startAPI(t, true, nil)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url,
+		"http")+"/api/v1/ws?types=status,ev_state", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	types := make(chan string, 64)
+	go func() {
+		for {
+			var doc struct {
+				Type string `json:"type"`
+			}
+			if err := conn.ReadJSON(&doc); err != nil {
+				return
+			}
+			types <- doc.Type
+		}
+	}()
+	checkTypeFilter(t, device, types)
+}
+
+var (
+	metricFamily = regexp.MustCompile(`^# (HELP|TYPE) (em_cp_pp_eth_[a-z_]+) (.+)$`)
+	metricSample = regexp.MustCompile(`^(em_cp_pp_eth_[a-z_]+)\{station="garage"(,[a-z]+="[^"\\]*")*\} (\S+)$`)
+)
+
+// checkMetrics checks the text exposition format of body: every family
+// has a HELP and a TYPE line before its samples, every sample belongs
+// to a family and carries the station label. It returns the samples.
+func checkMetrics(t *testing.T, body string) map[string]string {
+	t.Helper()
+	types := map[string]string{}
+	samples := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if m := metricFamily.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				switch m[3] {
+				case "gauge", "counter", "histogram":
+				default:
+					t.Errorf("Invalid type in %q", line)
+				}
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := metricSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("Invalid line %q", line)
+			continue
+		}
+		family := m[1]
+		if _, ok := types[family]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				family = strings.TrimSuffix(family, suffix)
+			}
+			if types[family] != "histogram" {
+				t.Errorf("Sample %q before the TYPE of its family", line)
+			}
+		}
+		samples[strings.TrimSuffix(line, " "+m[3])] = m[3]
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	_, server, url := startAPI(t, false, nil)
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if typ := resp.Header.Get("Content-Type"); !strings.HasPrefix(typ, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %s, want the text format 0.0.4", typ)
+	}
+	// Without a poll, only up and the Modbus statistics are exported
+	samples := checkMetrics(t, string(body))
+	if samples[`em_cp_pp_eth_up{station="garage"}`] != "0" || len(samples) != 1 {
+		t.Errorf("Metrics before the first poll:\n%s", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Cache.RefreshContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, body = request(t, http.MethodGet, url+"/metrics", "", "")
+	samples = checkMetrics(t, string(body))
+	for sample, want := range map[string]string{
+		`em_cp_pp_eth_up{station="garage"}`:                                        "1",
+		`em_cp_pp_eth_ev_state{station="garage",state="A"}`:                        "1",
+		`em_cp_pp_eth_ev_state{station="garage",state="C"}`:                        "0",
+		`em_cp_pp_eth_voltage_volts{station="garage",phase="L2"}`:                  "230",
+		`em_cp_pp_eth_frequency_hertz{station="garage"}`:                           "50",
+		`em_cp_pp_eth_error{station="garage",fault="Cable13A",severity="warning"}`: "0",
+	} {
+		if got, ok := samples[sample]; !ok || got != want {
+			t.Errorf("%s is %q, want %s", sample, got, want)
+		}
+	}
+
+	// The histogram counts every request
+	labels := `{station="garage",function="read_input_registers",code="4"`
+	requests := samples[`em_cp_pp_eth_modbus_requests_total`+labels+`}`]
+	if requests == "" || requests == "0" ||
+		samples[`em_cp_pp_eth_modbus_request_duration_seconds_count`+labels+`}`] != requests ||
+		samples[`em_cp_pp_eth_modbus_request_duration_seconds_bucket`+labels+`,le="+Inf"}`] != requests {
+		t.Errorf("Histogram of %s requests does not match:\n%s", requests, body)
+	}
+}
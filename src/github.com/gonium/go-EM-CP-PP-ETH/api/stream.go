@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gorilla/websocket"
+)
+
+// Types of the streamed messages, used by the types filter.
+const (
+	EVENT_STATUS       = "status"
+	EVENT_EV_STATE     = EM_CP_PP_ETH.EVENT_EV_STATE
+	EVENT_ERROR        = EM_CP_PP_ETH.EVENT_ERROR
+	EVENT_AVAILABILITY = EM_CP_PP_ETH.EVENT_AVAILABILITY
+	EVENT_IO           = EM_CP_PP_ETH.EVENT_IO
+	EVENT_SESSION      = EM_CP_PP_ETH.EVENT_SESSION
+	EVENT_OTHER        = EM_CP_PP_ETH.EVENT_OTHER
+)
+
+var eventTypes = []string{EVENT_STATUS, EVENT_EV_STATE, EVENT_ERROR,
+	EVENT_AVAILABILITY, EVENT_IO, EVENT_SESSION, EVENT_OTHER}
+
+const (
+	// Shortest status interval a client may request.
+	MIN_STREAM_INTERVAL = 500 * time.Millisecond
+	// Status interval if neither the client nor Server.StreamInterval
+	// set one.
+	DEFAULT_STREAM_INTERVAL = 2 * time.Second
+	// Events buffered per client, further events are dropped.
+	STREAM_BUFFER = 64
+	// Time between keepalives of idle streams.
+	STREAM_KEEPALIVE = 15 * time.Second
+	// Time budget of a WebSocket write.
+	WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// streamMessage is a document ready to be sent to clients.
+type streamMessage struct {
+	Type string
+	Doc  interface{}
+}
+
+type statusEventDocument struct {
+	Type string `json:"type"`
+	EM_CP_PP_ETH.StatusDocument
+}
+
+func statusMessage(snapshot EM_CP_PP_ETH.Snapshot) streamMessage {
+	return streamMessage{EVENT_STATUS, statusEventDocument{EVENT_STATUS,
+		EM_CP_PP_ETH.NewStatusDocument(snapshot)}}
+}
+
+// eventMessage converts an event into its document.
+func eventMessage(e EM_CP_PP_ETH.Event) streamMessage {
+	typ, doc := EM_CP_PP_ETH.NewEventDocument(e)
+	return streamMessage{typ, doc}
+}
+
+// subscribe returns a channel that receives the events of the given
+// types until ctx is canceled. Events are dropped while the buffer is
+// full.
+func (s *Server) subscribe(ctx context.Context, types map[string]bool) <-chan streamMessage {
+	ch := make(chan streamMessage, STREAM_BUFFER)
+	s.mu.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan streamMessage]map[string]bool)
+	}
+	s.subscribers[ch] = types
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// publish sends an event to the subscribers. The caller holds s.mu.
+func (s *Server) publish(e EM_CP_PP_ETH.Event) {
+	if len(s.subscribers) == 0 {
+		return
+	}
+	msg := eventMessage(e)
+	for ch, types := range s.subscribers {
+		if !types[msg.Type] {
+			continue
+		}
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// forward publishes the events of the refreshes so far.
+func (s *Server) forward() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.events = nil
+				return
+			}
+			s.publish(e)
+		default:
+			return
+		}
+	}
+}
+
+// streamOptions are the query parameters of the streams: types, a
+// comma separated list of event types, and interval, the time between
+// status messages.
+type streamOptions struct {
+	types    map[string]bool
+	interval time.Duration
+}
+
+func (s *Server) parseStreamOptions(r *http.Request) (streamOptions, error) {
+	opts := streamOptions{types: make(map[string]bool),
+		interval: s.StreamInterval}
+	if opts.interval <= 0 {
+		opts.interval = DEFAULT_STREAM_INTERVAL
+	}
+	if text := r.URL.Query().Get("interval"); text != "" {
+		interval, err := time.ParseDuration(text)
+		if err != nil || interval < MIN_STREAM_INTERVAL {
+			return opts, fmt.Errorf("Invalid interval '%s', expected a"+
+				" duration of at least %s", text, MIN_STREAM_INTERVAL)
+		}
+		opts.interval = interval
+	}
+	text := r.URL.Query().Get("types")
+	if text == "" {
+		text = strings.Join(eventTypes, ",")
+	}
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, t := range eventTypes {
+			known = known || t == name
+		}
+		if !known {
+			return opts, fmt.Errorf("Unknown event type '%s', expected %s",
+				name, strings.Join(eventTypes, ", "))
+		}
+		opts.types[name] = true
+	}
+	return opts, nil
+}
+
+// stream calls send with the current status, every opts.interval with
+// the status and immediately with every event, until ctx is canceled
+// or send fails. keepalive is called on idle streams.
+func (s *Server) stream(ctx context.Context, opts streamOptions,
+	send func(streamMessage) error, keepalive func() error) {
+	events := s.subscribe(ctx, opts.types)
+	var status <-chan time.Time
+	if opts.types[EVENT_STATUS] {
+		if err := send(statusMessage(s.Cache.Snapshot())); err != nil {
+			return
+		}
+		ticker := time.NewTicker(opts.interval)
+		defer ticker.Stop()
+		status = ticker.C
+	}
+	idle := time.NewTimer(STREAM_KEEPALIVE)
+	defer idle.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-events:
+			if !ok {
+				return
+			}
+			err = send(msg)
+		case <-status:
+			err = send(statusMessage(s.Cache.Snapshot()))
+		case <-idle.C:
+			err = keepalive()
+		}
+		if err != nil {
+			return
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(STREAM_KEEPALIVE)
+	}
+}
+
+// handleEvents streams Server-Sent Events. The event name is the type
+// of the message, the data its JSON document.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	opts, err := s.parseStreamOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError,
+			fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(msg streamMessage) error {
+		data, err := json.Marshal(msg.Doc)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type,
+			data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	keepalive := func() error {
+		if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	s.stream(r.Context(), opts, send, keepalive)
+}
+
+var upgrader = websocket.Upgrader{}
+
+// handleWebSocket streams the same documents as handleEvents as
+// WebSocket text messages. Messages from the client are ignored.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	opts, err := s.parseStreamOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request.
+		return
+	}
+	defer conn.Close()
+
+	// Reading processes pings and the close message of the client.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg streamMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+		return conn.WriteJSON(msg.Doc)
+	}
+	keepalive := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil,
+			time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	}
+	s.stream(ctx, opts, send, keepalive)
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+}
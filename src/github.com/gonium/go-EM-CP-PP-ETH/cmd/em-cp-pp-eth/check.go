@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// Exit codes and states of the monitoring plugin API.
+const (
+	CHECK_OK       = 0
+	CHECK_WARNING  = 1
+	CHECK_CRITICAL = 2
+	CHECK_UNKNOWN  = 3
+)
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkRange is a threshold in the range syntax of the monitoring
+// plugin guidelines: "10" alerts outside 0..10, "10:" below 10, "~:10"
+// above 10, "10:20" outside 10..20 and "@10:20" inside 10..20.
+type checkRange struct {
+	text       string
+	start, end float64
+	inside     bool
+}
+
+func parseCheckRange(text string) (*checkRange, error) {
+	if text == "" {
+		return nil, nil
+	}
+	r := &checkRange{text: text, start: 0, end: math.Inf(1)}
+	s := text
+	if strings.HasPrefix(s, "@") {
+		r.inside = true
+		s = s[1:]
+	}
+	var err error
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		r.end, err = strconv.ParseFloat(parts[0], 64)
+	} else {
+		if parts[0] == "~" {
+			r.start = math.Inf(-1)
+		} else if parts[0] != "" {
+			r.start, err = strconv.ParseFloat(parts[0], 64)
+		}
+		if err == nil && parts[1] != "" {
+			r.end, err = strconv.ParseFloat(parts[1], 64)
+		}
+	}
+	if err != nil || r.start > r.end {
+		return nil, fmt.Errorf("Invalid range '%s'", text)
+	}
+	return r, nil
+}
+
+// alert reports whether value violates the threshold.
+func (r *checkRange) alert(value float64) bool {
+	if r == nil {
+		return false
+	}
+	outside := value < r.start || value > r.end
+	return outside != r.inside
+}
+
+func (r *checkRange) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.text
+}
+
+// checkResult collects the problems found by the check.
+type checkResult struct {
+	state    int
+	problems []string
+	perfdata []string
+}
+
+// raise adds a problem. CRITICAL outranks UNKNOWN, which outranks
+// WARNING.
+func (c *checkResult) raise(state int, format string, v ...interface{}) {
+	if checkRank(state) > checkRank(c.state) {
+		c.state = state
+	}
+	c.problems = append(c.problems, fmt.Sprintf(format, v...))
+}
+
+func checkRank(state int) int {
+	switch state {
+	case CHECK_UNKNOWN:
+		return 2
+	case CHECK_CRITICAL:
+		return 3
+	}
+	return state
+}
+
+// threshold raises the state of the first violated range.
+func (c *checkResult) threshold(label string, value float64, unit string,
+	warning, critical *checkRange) {
+	if critical.alert(value) {
+		c.raise(CHECK_CRITICAL, "%s %s %s outside %s", label,
+			formatCheckValue(value), unit, critical)
+	} else if warning.alert(value) {
+		c.raise(CHECK_WARNING, "%s %s %s outside %s", label,
+			formatCheckValue(value), unit, warning)
+	}
+}
+
+// perf adds a performance data item: 'label'=value[unit];warn;crit
+func (c *checkResult) perf(label string, value float64, unit string,
+	warning, critical *checkRange) {
+	item := fmt.Sprintf("%s=%s%s", label, formatCheckValue(value), unit)
+	if warning != nil || critical != nil {
+		item += fmt.Sprintf(";%s;%s", warning, critical)
+	}
+	c.perfdata = append(c.perfdata, item)
+}
+
+func formatCheckValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 32)
+}
+
+// write prints the plugin output: the state and a summary, the
+// performance data after a pipe and one problem per line.
+func (c *checkResult) write(out io.Writer, summary string) {
+	line := fmt.Sprintf("EM-CP-PP-ETH %s - ", checkStateNames[c.state])
+	if len(c.problems) > 0 {
+		line += strings.Join(c.problems, ", ")
+	} else {
+		line += summary
+	}
+	if len(c.perfdata) > 0 {
+		line += " | " + strings.Join(c.perfdata, " ")
+	}
+	fmt.Fprintln(out, line)
+	if len(c.problems) > 1 {
+		for _, p := range c.problems {
+			fmt.Fprintln(out, p)
+		}
+	}
+}
+
+// exitCheck prints a result without status and exits.
+func exitCheck(state int, format string, v ...interface{}) {
+	result := &checkResult{}
+	result.raise(state, format, v...)
+	result.write(os.Stdout, "")
+	os.Exit(state)
+}
+
+// runCheck reads the status once and exits with the plugin state.
+// Setup errors are UNKNOWN, an unreachable controller is CRITICAL.
+func runCheck(ctx context.Context) {
+	thresholds := map[string]*checkRange{}
+	for name, text := range map[string]string{
+		"voltage-warning":    *checkvoltwarn,
+		"voltage-critical":   *checkvoltcrit,
+		"frequency-warning":  *checkfreqwarn,
+		"frequency-critical": *checkfreqcrit,
+	} {
+		r, err := parseCheckRange(text)
+		if err != nil {
+			exitCheck(CHECK_UNKNOWN, "--%s: %s", name, err.Error())
+		}
+		thresholds[name] = r
+	}
+	ignored := EM_CP_PP_ETH.Errorcode(0)
+	for _, name := range *checkignore {
+		fault, err := EM_CP_PP_ETH.LookupFault(name)
+		if err != nil {
+			exitCheck(CHECK_UNKNOWN, "--ignore-fault: %s", err.Error())
+		}
+		ignored |= EM_CP_PP_ETH.Errorcode(fault.Mask)
+	}
+	critStates, err := parseCheckStates(*checkstatecrit)
+	if err != nil {
+		exitCheck(CHECK_UNKNOWN, "--state-critical: %s", err.Error())
+	}
+	warnStates, err := parseCheckStates(*checkstatewarn)
+	if err != nil {
+		exitCheck(CHECK_UNKNOWN, "--state-warning: %s", err.Error())
+	}
+
+	st, err := resolveStation()
+	if err != nil {
+		exitCheck(CHECK_UNKNOWN, "%s", err.Error())
+	}
+	handler, err := st.connect()
+	if err != nil {
+		exitCheck(CHECK_CRITICAL, "Failed to connect to %s: %s",
+			st.Address(), err.Error())
+	}
+	ctx, cancel := context.WithTimeout(ctx, st.CommandTimeout)
+	defer cancel()
+	cache := EM_CP_PP_ETH.NewStatusCache(
+		EM_CP_PP_ETH.WithReconnect(modbus.NewClient(handler), handler))
+	err = cache.RefreshContext(ctx)
+	var stateErr *EM_CP_PP_ETH.UnknownEVStateError
+	if err != nil && !errors.As(err, &stateErr) {
+		exitCheck(CHECK_CRITICAL, "Failed to read status of %s: %s",
+			st.Address(), err.Error())
+	}
+	s := cache.Snapshot().Status
+
+	result := evaluateCheck(s, thresholds, ignored, warnStates, critStates)
+	if err != nil {
+		result.raise(CHECK_UNKNOWN, "%s", err.Error())
+	}
+	summary := fmt.Sprintf("EV state %s (%s), errors: %s", s.EVStatus,
+		s.EVStatus.Description(), s.Errorcode)
+	cancel()
+	handler.Close()
+	result.write(os.Stdout, summary)
+	os.Exit(result.state)
+}
+
+// evaluateCheck applies the thresholds to a status.
+func evaluateCheck(s EM_CP_PP_ETH.Status, thresholds map[string]*checkRange,
+	ignored EM_CP_PP_ETH.Errorcode, warnStates,
+	critStates []EM_CP_PP_ETH.EVState) *checkResult {
+	result := &checkResult{}
+	if stateIn(s.EVStatus, critStates) {
+		result.raise(CHECK_CRITICAL, "EV state %s (%s)", s.EVStatus,
+			s.EVStatus.Description())
+	} else if stateIn(s.EVStatus, warnStates) {
+		result.raise(CHECK_WARNING, "EV state %s (%s)", s.EVStatus,
+			s.EVStatus.Description())
+	}
+	// Undocumented bits are WARNING, so a firmware that adds a bit does
+	// not page anybody until its meaning is known.
+	for _, f := range (s.Errorcode &^ ignored).Faults() {
+		if f.Severity == EM_CP_PP_ETH.SeverityBlocking {
+			result.raise(CHECK_CRITICAL, "%s: %s", f.Name, f.Description)
+		} else {
+			result.raise(CHECK_WARNING, "%s: %s", f.Name, f.Description)
+		}
+	}
+
+	// Without any voltage the meter is missing or measures behind the
+	// open contactor, so the grid cannot be judged.
+	voltages := []float32{s.L1Voltage, s.L2Voltage, s.L3Voltage}
+	measured := 0
+	for _, v := range voltages {
+		if v > 0 {
+			measured++
+		}
+	}
+	voltWarn, voltCrit := thresholds["voltage-warning"], thresholds["voltage-critical"]
+	present := 0
+	for i, v := range voltages {
+		if float64(v) >= *checkphasevolt {
+			present++
+			result.threshold(fmt.Sprintf("L%d voltage", i+1), float64(v), "V",
+				voltWarn, voltCrit)
+		}
+	}
+	if measured > 0 && present < *checkphases {
+		result.raise(CHECK_CRITICAL, "%d of %d phases present", present,
+			*checkphases)
+	}
+	freqWarn, freqCrit := thresholds["frequency-warning"], thresholds["frequency-critical"]
+	if s.Frequency > 0 {
+		result.threshold("Frequency", float64(s.Frequency), "Hz", freqWarn,
+			freqCrit)
+	}
+
+	for i, v := range voltages {
+		result.perf(fmt.Sprintf("l%d_voltage", i+1), float64(v), "V",
+			voltWarn, voltCrit)
+	}
+	for i, c := range []float32{s.L1Current, s.L2Current, s.L3Current} {
+		result.perf(fmt.Sprintf("l%d_current", i+1), float64(c), "A", nil, nil)
+	}
+	result.perf("active_power", float64(s.ActivePower), "W", nil, nil)
+	// The plugin format knows seconds, percent, bytes and counters
+	// (c) as units, so the meter reading is a counter in Wh
+	result.perf("energy", math.Round(float64(s.Energy)*1000), "c", nil, nil)
+	result.perf("frequency", float64(s.Frequency), "Hz", freqWarn, freqCrit)
+	return result
+}
+
+func parseCheckStates(text string) ([]EM_CP_PP_ETH.EVState, error) {
+	var states []EM_CP_PP_ETH.EVState
+	for _, name := range strings.Split(text, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		state, err := EM_CP_PP_ETH.ParseEVState(strings.ToUpper(name))
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func stateIn(state EM_CP_PP_ETH.EVState, states []EM_CP_PP_ETH.EVState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
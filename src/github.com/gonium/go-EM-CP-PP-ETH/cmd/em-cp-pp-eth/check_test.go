@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+func TestParseCheckRange(t *testing.T) {
+	for _, tc := range []struct {
+		text       string
+		start, end float64
+		inside     bool
+		// Values that alert and values that do not.
+		alert, ok []float64
+	}{
+		{"10", 0, 10, false, []float64{-1, 10.5}, []float64{0, 5, 10}},
+		{"10:", 10, math.Inf(1), false, []float64{9.9, -1}, []float64{10, 1e6}},
+		{"~:10", math.Inf(-1), 10, false, []float64{10.1}, []float64{-1e6, 10}},
+		{"10:20", 10, 20, false, []float64{9, 21}, []float64{10, 15, 20}},
+		{"@10:20", 10, 20, true, []float64{10, 15, 20}, []float64{9, 21}},
+		{"207:253", 207, 253, false, []float64{206.9, 253.1}, []float64{230}},
+		{"49.8:50.2", 49.8, 50.2, false, []float64{49.7, 50.3}, []float64{50}},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			r, err := parseCheckRange(tc.text)
+			if err != nil {
+				t.Fatalf("parseCheckRange: %s", err.Error())
+			}
+			if r.start != tc.start || r.end != tc.end || r.inside != tc.inside {
+				t.Errorf("Range %v to %v, inside %t, want %v to %v, inside %t",
+					r.start, r.end, r.inside, tc.start, tc.end, tc.inside)
+			}
+			if r.String() != tc.text {
+				t.Errorf("String %s, want %s", r, tc.text)
+			}
+			for _, v := range tc.alert {
+				if !r.alert(v) {
+					t.Errorf("%v does not alert", v)
+				}
+			}
+			for _, v := range tc.ok {
+				if r.alert(v) {
+					t.Errorf("%v alerts", v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCheckRangeInvalid(t *testing.T) {
+	for _, text := range []string{"ten", "20:10", "10:x", "@", "~"} {
+		if r, err := parseCheckRange(text); err == nil {
+			t.Errorf("parseCheckRange(%q) returned %+v, want an error", text, r)
+		}
+	}
+	r, err := parseCheckRange("")
+	if r != nil || err != nil {
+		t.Errorf("parseCheckRange(\"\") returned %+v, %v, want no range", r, err)
+	}
+	if r.alert(0) {
+		t.Error("A missing range alerts")
+	}
+}
+
+func TestEvaluateCheck(t *testing.T) {
+	*checkphases = 3
+	*checkphasevolt = 100
+	thresholds := map[string]*checkRange{}
+	for name, text := range map[string]string{
+		"voltage-warning":    "207:253",
+		"voltage-critical":   "195:265",
+		"frequency-warning":  "49.8:50.2",
+		"frequency-critical": "49.5:50.5",
+	} {
+		r, err := parseCheckRange(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thresholds[name] = r
+	}
+	grid := EM_CP_PP_ETH.Status{
+		EVStatus:  EM_CP_PP_ETH.EVStateC,
+		L1Voltage: 230,
+		L2Voltage: 230,
+		L3Voltage: 230,
+		Frequency: 50,
+	}
+	with := func(change func(*EM_CP_PP_ETH.Status)) EM_CP_PP_ETH.Status {
+		s := grid
+		change(&s)
+		return s
+	}
+	critStates := []EM_CP_PP_ETH.EVState{EM_CP_PP_ETH.EVStateE, EM_CP_PP_ETH.EVStateF}
+	warnStates := []EM_CP_PP_ETH.EVState{EM_CP_PP_ETH.EVStateD}
+
+	for _, tc := range []struct {
+		name     string
+		status   EM_CP_PP_ETH.Status
+		ignored  EM_CP_PP_ETH.Errorcode
+		state    int
+		problems []string
+	}{
+		{"ok", grid, 0, CHECK_OK, nil},
+		{"critical state", with(func(s *EM_CP_PP_ETH.Status) {
+			s.EVStatus = EM_CP_PP_ETH.EVStateF
+		}), 0, CHECK_CRITICAL, []string{"EV state F"}},
+		{"warning state", with(func(s *EM_CP_PP_ETH.Status) {
+			s.EVStatus = EM_CP_PP_ETH.EVStateD
+		}), 0, CHECK_WARNING, []string{"EV state D"}},
+		{"warning fault", with(func(s *EM_CP_PP_ETH.Status) {
+			s.Errorcode = EM_CP_PP_ETH.ERROR_CABLE_13A
+		}), 0, CHECK_WARNING, []string{"Cable13A"}},
+		{"blocking fault outranks warning", with(func(s *EM_CP_PP_ETH.Status) {
+			s.Errorcode = EM_CP_PP_ETH.ERROR_CABLE_13A | EM_CP_PP_ETH.ERROR_OVERCURRENT
+		}), 0, CHECK_CRITICAL, []string{"Cable13A", "Overcurrent"}},
+		{"undocumented bit", with(func(s *EM_CP_PP_ETH.Status) {
+			s.Errorcode = 1 << 14
+		}), 0, CHECK_WARNING, []string{"Bit14"}},
+		{"ignored fault", with(func(s *EM_CP_PP_ETH.Status) {
+			s.Errorcode = EM_CP_PP_ETH.ERROR_OVERCURRENT
+		}), EM_CP_PP_ETH.ERROR_OVERCURRENT, CHECK_OK, nil},
+		{"voltage warning", with(func(s *EM_CP_PP_ETH.Status) {
+			s.L2Voltage = 200
+		}), 0, CHECK_WARNING, []string{"L2 voltage 200 V outside 207:253"}},
+		{"voltage critical", with(func(s *EM_CP_PP_ETH.Status) {
+			s.L3Voltage = 270
+		}), 0, CHECK_CRITICAL, []string{"L3 voltage 270 V outside 195:265"}},
+		{"missing phase", with(func(s *EM_CP_PP_ETH.Status) {
+			s.L3Voltage = 0
+		}), 0, CHECK_CRITICAL, []string{"2 of 3 phases present"}},
+		{"no meter", with(func(s *EM_CP_PP_ETH.Status) {
+			s.L1Voltage, s.L2Voltage, s.L3Voltage, s.Frequency = 0, 0, 0, 0
+		}), 0, CHECK_OK, nil},
+		{"frequency critical", with(func(s *EM_CP_PP_ETH.Status) {
+			s.Frequency = 49.4
+		}), 0, CHECK_CRITICAL, []string{"Frequency 49.4 Hz outside 49.5:50.5"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := evaluateCheck(tc.status, thresholds, tc.ignored,
+				warnStates, critStates)
+			if result.state != tc.state {
+				t.Errorf("State %s, want %s", checkStateNames[result.state],
+					checkStateNames[tc.state])
+			}
+			if len(result.problems) != len(tc.problems) {
+				t.Fatalf("Problems %q, want %q", result.problems, tc.problems)
+			}
+			for i, p := range result.problems {
+				if !strings.HasPrefix(p, tc.problems[i]) {
+					t.Errorf("Problem %q, want %q", p, tc.problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateCheckPerfdata(t *testing.T) {
+	*checkphases = 3
+	*checkphasevolt = 100
+	warning, _ := parseCheckRange("207:253")
+	status := EM_CP_PP_ETH.Status{
+		L1Voltage:   230,
+		L2Voltage:   231,
+		L3Voltage:   229.5,
+		L1Current:   16,
+		ActivePower: 3680,
+		Energy:      1234.5678,
+		Frequency:   50,
+	}
+	result := evaluateCheck(status, map[string]*checkRange{
+		"voltage-warning": warning}, 0, nil, nil)
+	want := []string{
+		"l1_voltage=230V;207:253;",
+		"l2_voltage=231V;207:253;",
+		"l3_voltage=229.5V;207:253;",
+		"l1_current=16A",
+		"l2_current=0A",
+		"l3_current=0A",
+		"active_power=3680W",
+		// The meter reading in kWh is a counter in Wh
+		"energy=1234568c",
+		"frequency=50Hz",
+	}
+	if !reflect.DeepEqual(result.perfdata, want) {
+		t.Errorf("Performance data\n%q\nwant\n%q", result.perfdata, want)
+	}
+}
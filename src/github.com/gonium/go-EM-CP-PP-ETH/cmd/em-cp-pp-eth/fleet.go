@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const FLEET_SCHEMA = "em-cp-pp-eth/fleet/v1"
+
+// fleetResult is the outcome of a command on one station of a group.
+type fleetResult struct {
+	station  station
+	snapshot EM_CP_PP_ETH.Snapshot
+	// Value read or written by the command, nil for status.
+	value interface{}
+	err   error
+}
+
+// fleetOperation runs a command on one station. It returns the value to
+// show next to the status.
+type fleetOperation func(ctx context.Context, st station,
+	commander *EM_CP_PP_ETH.Commander) (interface{}, error)
+
+// fleetDocument is the json and yaml output of a group command.
+type fleetDocument struct {
+	Schema     string                 `json:"schema" yaml:"schema"`
+	Time       time.Time              `json:"time" yaml:"time"`
+	Group      string                 `json:"group" yaml:"group"`
+	Stations   []fleetStationDocument `json:"stations" yaml:"stations"`
+	TotalPower EM_CP_PP_ETH.Quantity  `json:"total_power" yaml:"total_power"`
+}
+
+type fleetStationDocument struct {
+	Station string                       `json:"station" yaml:"station"`
+	Address string                       `json:"address" yaml:"address"`
+	Error   string                       `json:"error,omitempty" yaml:"error,omitempty"`
+	Value   interface{}                  `json:"value,omitempty" yaml:"value,omitempty"`
+	Status  *EM_CP_PP_ETH.StatusDocument `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+// runFleet runs cmd on every station of the group concurrently and
+// prints a table of the results to out. Each station gets its own
+// connection and time budget, so unreachable stations do not hold up the
+// others. It reports whether the command succeeded everywhere.
+func runFleet(ctx context.Context, out io.Writer, cmd string, group []station) bool {
+	var op fleetOperation
+	var column string
+	// Writes have no --output flag and print the table.
+	var output *outputOptions
+	switch cmd {
+	case status.FullCommand():
+		output = &statusoutput
+	case getavail.FullCommand():
+		column, output = "AVAILABLE", &getavailoutput
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return c.ReadChargingEnabledContext(ctx)
+		}
+	case getcurrent.FullCommand():
+		column, output = "CURRENT", &getcurrentoutput
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return c.ReadActualChargingCurrentContext(ctx)
+		}
+	case setavail.FullCommand():
+		column = "AVAILABLE"
+		if !confirm(fmt.Sprintf("Make %s %s?", stationNames(group),
+			availability(*newavail))) {
+			log.Fatal("Not confirmed, writing to a group requires --yes")
+		}
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return *newavail, c.WriteChargingEnabledContext(ctx, *newavail)
+		}
+	case setcurrent.FullCommand():
+		column = "CURRENT"
+		if !confirm(fmt.Sprintf("Set the charging current of %s to %d A?",
+			stationNames(group), *chargecurrent)) {
+			log.Fatal("Not confirmed, writing to a group requires --yes")
+		}
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return c.WriteActualChargingCurrentContext(ctx, *chargecurrent)
+		}
+	case getdigimode.FullCommand():
+		column, output = "DIGIMODE", &getdigimodeoutput
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return c.ReadDigimodeEnabledContext(ctx)
+		}
+	case setdigimode.FullCommand():
+		column = "DIGIMODE"
+		if !confirm(fmt.Sprintf("Set the digital communication mode of %s"+
+			" to %t?", stationNames(group), *newdigimode)) {
+			log.Fatal("Not confirmed, writing to a group requires --yes")
+		}
+		op = func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return *newdigimode, c.WriteDigimodeEnabledContext(ctx, *newdigimode)
+		}
+	default:
+		log.Fatalf("--group is not supported by %s", cmd)
+	}
+
+	results := make([]fleetResult, len(group))
+	var wg sync.WaitGroup
+	for i := range group {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runStation(ctx, group[i], op)
+		}(i)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, r := range results {
+		if r.err != nil {
+			ok = false
+		}
+	}
+	switch {
+	case output == nil || output.Text() || *output.format == "table":
+		writeFleetTable(out, results, column)
+	case *output.format == "csv":
+		writeOutput(writeFleetCSV(out, results))
+	default:
+		writeOutput(output.write(out, newFleetDocument(results), nil))
+	}
+	return ok
+}
+
+// runStation connects to a station, runs op and reads the status
+// afterwards, so writes are reflected in it.
+func runStation(ctx context.Context, st station, op fleetOperation) fleetResult {
+	result := fleetResult{station: st}
+	ctx, cancel := context.WithTimeout(ctx, st.CommandTimeout)
+	defer cancel()
+	handler, err := st.connect()
+	if err != nil {
+		result.err = fmt.Errorf("Failed to connect: %s", err.Error())
+		return result
+	}
+	defer handler.Close()
+	client := EM_CP_PP_ETH.WithReconnect(modbus.NewClient(handler), handler)
+	if op != nil {
+		if result.value, result.err = op(ctx, st, st.commander(client)); result.err != nil {
+			result.value = nil
+			return result
+		}
+	}
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	err = cache.RefreshContext(ctx)
+	result.snapshot = cache.Snapshot()
+	if err != nil && result.snapshot.Time.IsZero() {
+		result.err = fmt.Errorf("Failed to get status: %s", err.Error())
+	}
+	return result
+}
+
+// writeFleetTable prints a row per station and the total active power
+// of the reachable stations.
+func writeFleetTable(out io.Writer, results []fleetResult, column string) {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	header := "STATION\tADDRESS\tEV STATE\tERRORS\tPOWER\t"
+	if column != "" {
+		header += column + "\t"
+	}
+	fmt.Fprintln(writer, header+"RESULT")
+	total := 0.0
+	for _, r := range results {
+		row := []string{r.station.Name, r.station.Address(), "-", "-", "-"}
+		if !r.snapshot.Time.IsZero() {
+			s := r.snapshot.Status
+			row[2] = s.EVStatus.String()
+			row[3] = s.Errorcode.String()
+			row[4] = formatPower(float64(s.ActivePower))
+			total += float64(s.ActivePower)
+		}
+		if column != "" {
+			row = append(row, formatFleetValue(r.value))
+		}
+		result := "OK"
+		if r.err != nil {
+			result = r.err.Error()
+		} else if r.snapshot.Err != nil {
+			result = "Warning: " + r.snapshot.Err.Error()
+		}
+		fmt.Fprintln(writer, strings.Join(append(row, result), "\t"))
+	}
+	fmt.Fprintf(writer, "TOTAL\t\t\t\t%s\t\n", formatPower(total))
+	writer.Flush()
+}
+
+// writeFleetCSV prints a row per station with the station, the value
+// and the columns of status -o csv.
+func writeFleetCSV(out io.Writer, results []fleetResult) error {
+	writer := csv.NewWriter(out)
+	empty := EM_CP_PP_ETH.NewStatusDocument(EM_CP_PP_ETH.Snapshot{})
+	header := append([]string{"station", "address", "error", "value"},
+		fieldNames(statusFields(empty))...)
+	writer.Write(header)
+	for _, r := range results {
+		row := []string{r.station.Name, r.station.Address(), "", ""}
+		if r.err != nil {
+			row[2] = r.err.Error()
+		}
+		if r.value != nil {
+			row[3] = fmt.Sprint(r.value)
+		}
+		if !r.snapshot.Time.IsZero() {
+			doc := EM_CP_PP_ETH.NewStatusDocument(r.snapshot)
+			row = append(row, fieldValues(statusFields(doc))...)
+		} else {
+			row = append(row, make([]string, len(header)-len(row))...)
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func newFleetDocument(results []fleetResult) fleetDocument {
+	doc := fleetDocument{
+		Schema: FLEET_SCHEMA,
+		Time:   time.Now(),
+		Group:  *groupname,
+	}
+	total := 0.0
+	for _, r := range results {
+		station := fleetStationDocument{
+			Station: r.station.Name,
+			Address: r.station.Address(),
+			Value:   r.value,
+		}
+		if r.err != nil {
+			station.Error = r.err.Error()
+		}
+		if !r.snapshot.Time.IsZero() {
+			status := EM_CP_PP_ETH.NewStatusDocument(r.snapshot)
+			station.Status = &status
+			total += float64(r.snapshot.Status.ActivePower)
+		}
+		doc.Stations = append(doc.Stations, station)
+	}
+	doc.TotalPower = EM_CP_PP_ETH.Quantity{Value: total, Unit: "W"}
+	return doc
+}
+
+func formatPower(watts float64) string {
+	return strconv.FormatFloat(watts/1000, 'f', 2, 64) + " kW"
+}
+
+func formatFleetValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "-"
+	case uint16:
+		return fmt.Sprintf("%d A", v)
+	}
+	return fmt.Sprint(value)
+}
+
+func availability(available bool) string {
+	if available {
+		return "available"
+	}
+	return "unavailable"
+}
+
+func stationNames(group []station) string {
+	names := make([]string, len(group))
+	for i, st := range group {
+		names[i] = st.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// confirm asks on the terminal unless --yes was given. Without a
+// terminal, only --yes confirms.
+func confirm(question string) bool {
+	if *confirmed {
+		return true
+	}
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+// fleetBudget is the command timeout of the test stations.
+const fleetBudget = 500 * time.Millisecond
+
+// testStation returns a station for address with the test time budget.
+func testStation(t *testing.T, name, address string) station {
+	t.Helper()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := station{Name: name, Host: host, Port: uint16(p),
+		Timeout: 2 * time.Second, CommandTimeout: fleetBudget}
+	st.applyDefaults()
+	return st
+}
+
+// startStation serves a simulated station that charges with power.
+func startStation(t *testing.T, name string, power float32) (*simulator.Device, station) {
+	t.Helper()
+	sim := simulatortest.Start(t)
+	err := sim.Device.SetStatus(EM_CP_PP_ETH.Status{
+		EVStatus:    EM_CP_PP_ETH.EVStateC,
+		L1Voltage:   230,
+		L2Voltage:   230,
+		L3Voltage:   230,
+		Frequency:   50,
+		ActivePower: power,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim.Device, testStation(t, name, sim.Address)
+}
+
+// startSilentStation accepts connections and never answers, like a
+// controller that hangs.
+func startSilentStation(t *testing.T, name string) station {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return testStation(t, name, listener.Addr().String())
+}
+
+// fleetRows returns the rows of the fleet table by station name.
+func fleetRows(t *testing.T, table string) map[string]string {
+	t.Helper()
+	rows := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(table), "\n") {
+		rows[strings.Fields(line)[0]] = line
+	}
+	return rows
+}
+
+func TestRunStation(t *testing.T) {
+	device, st := startStation(t, "garage", 3680)
+	result := runStation(context.Background(), st,
+		func(ctx context.Context, st station,
+			c *EM_CP_PP_ETH.Commander) (interface{}, error) {
+			return true, c.WriteDigimodeEnabledContext(ctx, true)
+		})
+	if result.err != nil {
+		t.Fatalf("runStation: %s", result.err.Error())
+	}
+	if result.value != true || result.snapshot.Status.ActivePower != 3680 {
+		t.Errorf("Value %v and power %v, want true and 3680", result.value,
+			result.snapshot.Status.ActivePower)
+	}
+	if state, _ := device.Coil(EM_CP_PP_ETH.COIL_DIGIMODE_ENABLED); !state {
+		t.Error("The operation was not run")
+	}
+
+	result = runStation(context.Background(), startSilentStation(t, "silent"), nil)
+	if result.err == nil || !result.snapshot.Time.IsZero() {
+		t.Errorf("Silent station returned %v and a status of %s, want an error"+
+			" and no status", result.err, result.snapshot.Time)
+	}
+}
+
+func TestRunFleet(t *testing.T) {
+	_, garage := startStation(t, "garage", 3680)
+	_, carport := startStation(t, "carport", 7360)
+	group := []station{garage, startSilentStation(t, "silent"),
+		startSilentStation(t, "hung"), carport}
+
+	// The flags are not parsed in tests
+	*statusoutput.format = "table"
+	var out bytes.Buffer
+	start := time.Now()
+	if runFleet(context.Background(), &out, status.FullCommand(), group) {
+		t.Error("runFleet succeeded with silent stations")
+	}
+	// The silent stations use their budgets at the same time
+	if elapsed := time.Since(start); elapsed >= 2*fleetBudget {
+		t.Errorf("runFleet took %s, want less than %s", elapsed, 2*fleetBudget)
+	}
+
+	rows := fleetRows(t, out.String())
+	// EV state, errors, power and the start of the result
+	for name, want := range map[string]string{
+		"garage":  "C OK 3.68 kW OK",
+		"carport": "C OK 7.36 kW OK",
+		"silent":  "- - - Failed to get status: ",
+		"hung":    "- - - Failed to get status: ",
+	} {
+		fields := strings.Fields(rows[name])
+		if len(fields) < 2 || !strings.HasPrefix(strings.Join(fields[2:], " "), want) {
+			t.Errorf("Row of %s is %q, want %q", name, rows[name], want)
+		}
+	}
+	// The total load of the site counts the reachable stations
+	if total := strings.Fields(rows["TOTAL"]); len(total) != 3 ||
+		total[1] != "11.04" || total[2] != "kW" {
+		t.Errorf("Total row %q, want 11.04 kW", rows["TOTAL"])
+	}
+}
+
+func TestRunFleetDigimode(t *testing.T) {
+	garageDevice, garage := startStation(t, "garage", 0)
+	carportDevice, carport := startStation(t, "carport", 0)
+	group := []station{garage, carport}
+	*confirmed, *newdigimode = true, true
+	defer func() { *confirmed, *newdigimode = false, false }()
+
+	var out bytes.Buffer
+	if !runFleet(context.Background(), &out, setdigimode.FullCommand(), group) {
+		t.Fatalf("runFleet failed:\n%s", out.String())
+	}
+	for _, device := range []*simulator.Device{garageDevice, carportDevice} {
+		if state, _ := device.Coil(EM_CP_PP_ETH.COIL_DIGIMODE_ENABLED); !state {
+			t.Error("Digital communication mode was not enabled")
+		}
+	}
+
+	*getdigimodeoutput.format = "table"
+	out.Reset()
+	if !runFleet(context.Background(), &out, getdigimode.FullCommand(), group) {
+		t.Fatalf("runFleet failed:\n%s", out.String())
+	}
+	rows := fleetRows(t, out.String())
+	if !strings.Contains(rows["STATION"], "DIGIMODE") {
+		t.Errorf("Header %q has no DIGIMODE column", rows["STATION"])
+	}
+	for _, name := range []string{"garage", "carport"} {
+		if fields := strings.Fields(rows[name]); len(fields) != 8 ||
+			fields[6] != "true" {
+			t.Errorf("Row of %s is %q, want digital communication mode true",
+				name, rows[name])
+		}
+	}
+}
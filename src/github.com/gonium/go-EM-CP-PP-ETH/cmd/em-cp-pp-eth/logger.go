@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// runLog records the status at a fixed interval until ctx is canceled.
+// Polls that fail are reported and skipped. Each poll may take up to
+// pollTimeout.
+func runLog(ctx context.Context, cache *EM_CP_PP_ETH.StatusCache,
+	pollTimeout time.Duration) {
+	header := ""
+	matches := func(line string) bool {
+		return strings.HasPrefix(line, "{")
+	}
+	recordTime := func(record string) (time.Time, bool) {
+		var doc struct {
+			Time time.Time `json:"time"`
+		}
+		err := json.Unmarshal([]byte(record), &doc)
+		return doc.Time, err == nil && !doc.Time.IsZero()
+	}
+	if *logformat == "csv" {
+		empty := EM_CP_PP_ETH.NewStatusDocument(EM_CP_PP_ETH.Snapshot{})
+		header = csvLine(fieldNames(statusFields(empty)))
+		matches = func(line string) bool {
+			return line == header
+		}
+		recordTime = func(record string) (time.Time, bool) {
+			values, err := csv.NewReader(strings.NewReader(record)).Read()
+			if err != nil {
+				return time.Time{}, false
+			}
+			// The time is the first column
+			t, err := time.Parse(TIME_FORMAT, values[0])
+			return t, err == nil
+		}
+	}
+	file, err := openRotatingFile(*logfile, int64(*logmaxsize),
+		*logrotate, *logcompress, *logkeep, header, matches, recordTime)
+	if err != nil {
+		log.Fatalf("Failed to open log file: %s", err.Error())
+	}
+	defer file.Close()
+
+	ticker := time.NewTicker(*loginterval)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, pollTimeout)
+		err := cache.RefreshContext(pollCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		snapshot := cache.Snapshot()
+		if err != nil {
+			log.Printf("Poll failed: %s", err.Error())
+		}
+		if snapshot.Time.After(last) {
+			last = snapshot.Time
+			record := formatRecord(EM_CP_PP_ETH.NewStatusDocument(snapshot))
+			if err := file.Write(record, snapshot.Time); err != nil {
+				log.Fatalf("Failed to write log file: %s", err.Error())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// formatRecord returns the status as one line in the selected format.
+func formatRecord(doc EM_CP_PP_ETH.StatusDocument) []byte {
+	if *logformat == "jsonl" {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			log.Fatalf("Failed to encode status: %s", err.Error())
+		}
+		return append(data, '\n')
+	}
+	return []byte(csvLine(fieldValues(statusFields(doc))))
+}
+
+func fieldNames(fields []field) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+func fieldValues(fields []field) []string {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = f.value
+	}
+	return values
+}
+
+func csvLine(values []string) string {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(values)
+	writer.Flush()
+	return buf.String()
+}
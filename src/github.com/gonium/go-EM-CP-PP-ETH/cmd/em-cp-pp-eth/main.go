@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/goburrow/modbus"
 	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,23 +24,50 @@ var (
 		" Contact EM-CP-PP-ETH charge controller")
 	verbose = app.Flag("verbose", "Verbose mode.").Short('v').Bool()
 	host    = app.Flag("host", "Host to connect to, i.e."+
-		"10.0.0.1").Short('h').String()
+		"10.0.0.1").Short('h').Envar("EM_CP_PP_ETH_HOST").String()
 	port = app.Flag("port", "Port to connect to, i.e."+
-		"502 (default)").Short('p').Default("502").Uint16()
+		"502 (default)").Short('p').Envar("EM_CP_PP_ETH_PORT").Uint16()
 	slaveid = app.Flag("slave", "slave id i.e. "+
-		"180 (default)").Short('s').Default("180").Uint8()
+		"180 (default)").Short('s').Envar("EM_CP_PP_ETH_SLAVE").Uint8()
+	timeout = app.Flag("timeout", "Time budget of the command, or of"+
+		" each poll of watch, i.e. 10s (default)").Envar(
+		"EM_CP_PP_ETH_TIMEOUT").Duration()
+	stationname = app.Flag("station", "Station of the configuration"+
+		" file, i.e. garage").Envar("EM_CP_PP_ETH_STATION").String()
+	groupname = app.Flag("group", "Group of stations of the"+
+		" configuration file, queried concurrently").Envar(
+		"EM_CP_PP_ETH_GROUP").String()
+	confirmed = app.Flag("yes", "Write without asking, to all"+
+		" stations of --group or with raw write").Short('y').Bool()
+	configpath = app.Flag("config-file", "Configuration file, i.e."+
+		" ~/.config/em-cp-pp-eth/config.yaml (default)").Envar(
+		"EM_CP_PP_ETH_CONFIG").String()
 	status = app.Command("status",
 		"query the charge controller state").Default()
-	reset = app.Command("reset",
-		"reset the charge controller via HTTP")
+	statusoutput = addOutputFlags(status)
+	reset        = app.Command("reset",
+		"reset the charge controller via HTTP and wait for it to restart")
+	resetnoverify = reset.Flag("no-verify", "Only send the reset,"+
+		" do not wait for the restart").Bool()
+	resetdown = reset.Flag("down-timeout", "Longest wait for the"+
+		" controller to go down, i.e. 15s (default)").Default(
+		"15s").Duration()
+	resetup = reset.Flag("up-timeout", "Longest wait for the controller"+
+		" to come back, i.e. 90s (default)").Default("90s").Duration()
 	current = app.Command("current", "get and set the "+
 		" actual charging current")
 	getcurrent = current.Command("get",
 		"get the charging current")
-	setcurrent = current.Command("set",
+	getcurrentoutput = addOutputFlags(getcurrent)
+	setcurrent       = current.Command("set",
 		"set the charging current")
 	chargecurrent = setcurrent.Arg("current", "Charge current to set"+
 		" (amps)").Required().Uint16()
+	forcecurrent = app.Flag("force", "Write charging currents without"+
+		" checking them against the limits of cable, phases and"+
+		" installation").Bool()
+	clampcurrent = app.Flag("clamp", "Replace unsafe charging currents"+
+		" by the nearest safe value instead of rejecting them").Bool()
 
 	avail = app.Command("avail", "make the charging station"+
 		" (un)available")
@@ -42,6 +77,7 @@ var (
 		"true: available, false: unavailable").Required().Bool()
 	getavail = avail.Command("get", "get the charging station"+
 		" availability")
+	getavailoutput = addOutputFlags(getavail)
 
 	digimode = app.Command("digimode", "make the charging station"+
 		" (un)available")
@@ -51,6 +87,157 @@ var (
 		"true: enabled, false: disabled").Required().Bool()
 	getdigimode = digimode.Command("get", "get the digital communication"+
 		" mode state")
+	getdigimodeoutput = addOutputFlags(getdigimode)
+
+	config = app.Command("config", "read and write the controller"+
+		" configuration")
+	getconfig = config.Command("get", "print all configuration"+
+		" settings")
+	setconfig = config.Command("set", "change a configuration"+
+		" setting")
+	configname = setconfig.Arg("setting", "Name of the setting, i.e."+
+		" DefaultChargingCurrent").Required().String()
+	configvalue = setconfig.Arg("value", "New value, true/false for"+
+		" switches").Required().String()
+
+	watch = app.Command("watch", "poll the charge controller and"+
+		" redraw the status")
+	watchinterval = watch.Flag("interval", "Polling interval, i.e."+
+		" 2s (default)").Short('n').Default("2s").Duration()
+	watchchanges = watch.Flag("changes-only", "Print a line for every"+
+		" EV state, error and I/O transition instead of redrawing").Bool()
+
+	logcmd = app.Command("log", "record the status at a fixed"+
+		" interval")
+	logfile = logcmd.Flag("file", "File to append to, rotated files"+
+		" get a time stamp").Short('f').Required().String()
+	logformat = logcmd.Flag("format", "Record format: csv (default)"+
+		" or jsonl").Default("csv").Enum("csv", "jsonl")
+	loginterval = logcmd.Flag("interval", "Recording interval, i.e."+
+		" 10s (default)").Short('n').Default("10s").Duration()
+	logmaxsize = logcmd.Flag("max-size", "Rotate when the file grows"+
+		" beyond this size, 0 disables, i.e. 10MB (default)").Default(
+		"10MB").Bytes()
+	logrotate = logcmd.Flag("rotate-every", "Rotate at the start of"+
+		" every period (aligned to UTC), 0 disables, i.e. 24h"+
+		" (default)").Default("24h").Duration()
+	logcompress = logcmd.Flag("compress", "Gzip rotated files,"+
+		" --no-compress disables").Default("true").Bool()
+	logkeep = logcmd.Flag("keep", "Number of rotated files to keep,"+
+		" 0 (default) keeps all").Default("0").Int()
+
+	check = app.Command("check", "check the charge controller as a"+
+		" Nagios, Icinga or Checkmk plugin")
+	checkvoltwarn = check.Flag("voltage-warning", "Phase voltage range,"+
+		" i.e. 207:253 (default)").Default("207:253").String()
+	checkvoltcrit = check.Flag("voltage-critical", "Phase voltage"+
+		" range, i.e. 195:265 (default)").Default("195:265").String()
+	checkfreqwarn = check.Flag("frequency-warning", "Grid frequency"+
+		" range, i.e. 49.8:50.2 (default)").Default("49.8:50.2").String()
+	checkfreqcrit = check.Flag("frequency-critical", "Grid frequency"+
+		" range, i.e. 49.5:50.5 (default)").Default("49.5:50.5").String()
+	checkphases = check.Flag("phases", "Number of phases that must be"+
+		" present, i.e. 3 (default)").Default("3").Int()
+	checkphasevolt = check.Flag("phase-voltage", "Voltage a phase"+
+		" counts as present from, i.e. 100 (default)").Default(
+		"100").Float64()
+	checkstatewarn = check.Flag("state-warning", "EV states that are"+
+		" WARNING, i.e. D").Default("").String()
+	checkstatecrit = check.Flag("state-critical", "EV states that are"+
+		" CRITICAL, i.e. E,F (default)").Default("E,F").String()
+	checkignore = check.Flag("ignore-fault", "Fault to disregard, i.e."+
+		" Cable13A, repeatable").Strings()
+
+	raw = app.Command("raw", "read and write any coil or register,"+
+		" for debugging")
+	rawtype = raw.Flag("type", "Value type of registers: uint16"+
+		" (default), int16, uint32, int32, float32 or hex").Default(
+		"uint16").Enum("uint16", "int16", "uint32", "int32", "float32", "hex")
+	raworder = raw.Flag("word-order", "Word order of 32 bit values:"+
+		" high (default) or low, as the meter values").Default(
+		"high").Enum("high", "low")
+	rawread = raw.Command("read", "read coils, discrete inputs,"+
+		" input or holding registers")
+	rawreadtable = rawread.Arg("table", "coil, discrete, input or"+
+		" holding").Required().Enum("coil", "discrete", "input", "holding")
+	rawreadaddress = rawread.Arg("address", "First address, i.e."+
+		" 100").Required().Uint16()
+	rawreadcount = rawread.Arg("count", "Number of values, i.e. 1"+
+		" (default)").Default("1").Uint16()
+	rawwrite = raw.Command("write", "write coils or holding registers"+
+		" without range checks, charging currents are checked unless"+
+		" --force is given")
+	rawwritetable = rawwrite.Arg("table", "coil or holding").Required().Enum(
+		"coil", "holding")
+	rawwriteaddress = rawwrite.Arg("address", "First address, i.e."+
+		" 300").Required().Uint16()
+	rawwritevalues = rawwrite.Arg("values", "Values to write, true/false"+
+		" for coils").Required().Strings()
+
+	serve = app.Command("serve", "run a REST API for the charge"+
+		" controller on a persistent connection")
+	servelisten = serve.Flag("listen", "Address to listen on, i.e."+
+		" :8080 (default)").Default(":8080").String()
+	serveinterval = serve.Flag("interval", "Polling interval of the"+
+		" status, i.e. 2s (default)").Short('n').Default("2s").Duration()
+	servedatadir = serve.Flag("data-dir", "Directory to store"+
+		" sessions and samples in, sessions are only kept in memory"+
+		" without it").String()
+	servesample = serve.Flag("sample-interval", "Minimum time between"+
+		" stored samples, i.e. 1m (default)").Default("1m").Duration()
+	servestream = serve.Flag("stream-interval", "Default time between"+
+		" status messages of the event streams, i.e. 2s"+
+		" (default)").Default("2s").Duration()
+	servetoken = serve.Flag("api-token", "Bearer token required by"+
+		" the API").Envar("EM_CP_PP_ETH_API_TOKEN").String()
+
+	mqttcmd = app.Command("mqtt", "publish the status to an MQTT"+
+		" broker and accept commands from it")
+	mqttbroker = mqttcmd.Flag("broker", "URL of the broker, i.e."+
+		" tcp://localhost:1883 or ssl://broker:8883").Default(
+		"tcp://localhost:1883").Envar("EM_CP_PP_ETH_MQTT_BROKER").String()
+	mqttclientid = mqttcmd.Flag("client-id", "Client id, i.e."+
+		" em-cp-pp-eth-garage (default)").String()
+	mqttuser = mqttcmd.Flag("user", "User name at the broker").Envar(
+		"EM_CP_PP_ETH_MQTT_USER").String()
+	mqttpassword = mqttcmd.Flag("password", "Password at the"+
+		" broker").Envar("EM_CP_PP_ETH_MQTT_PASSWORD").String()
+	mqttprefix = mqttcmd.Flag("topic-prefix", "Prefix of all topics,"+
+		" i.e. em-cp-pp-eth/garage (default)").String()
+	mqttqos = mqttcmd.Flag("qos", "QoS of the messages: 0, 1 (default)"+
+		" or 2").Default("1").Enum("0", "1", "2")
+	mqttinterval = mqttcmd.Flag("interval", "Polling interval of the"+
+		" status, i.e. 10s (default)").Short('n').Default("10s").Duration()
+	mqttca = mqttcmd.Flag("tls-ca", "CA certificate file to verify the"+
+		" broker, the system pool if not set").ExistingFile()
+	mqttcert = mqttcmd.Flag("tls-cert", "Client certificate file for"+
+		" TLS authentication").ExistingFile()
+	mqttkey = mqttcmd.Flag("tls-key", "Key file of the client"+
+		" certificate").ExistingFile()
+	mqttinsecure = mqttcmd.Flag("tls-insecure", "Do not verify the"+
+		" certificate of the broker").Bool()
+
+	registers = app.Command("registers", "print the register map"+
+		" as Markdown")
+
+	stations = app.Command("stations", "list the stations of the"+
+		" configuration file")
+
+	simulate = app.Command("simulate", "run a simulated charge"+
+		" controller on the local machine")
+	simlisten = simulate.Flag("listen", "Address to listen on, i.e."+
+		" :5020 (default)").Default(":5020").String()
+	simscenario = simulate.Flag("scenario", "Scenario file to"+
+		" replay").ExistingFile()
+	simspeed = simulate.Flag("speed", "Time compression of the"+
+		" scenario, i.e. 60 plays one minute per second").Default("1").Float64()
+	simloop = simulate.Flag("loop", "Restart the scenario after"+
+		" the last step").Bool()
+	simhttp = simulate.Flag("http", "Address to emulate the reset of"+
+		" the web interface on, i.e. :8080").String()
+	simdowntime = simulate.Flag("reset-downtime", "Time the simulator"+
+		" is offline after a reset, i.e. 5s (default)").Default(
+		"5s").Duration()
 )
 
 func main() {
@@ -60,57 +247,144 @@ func main() {
 	kingpin.CommandLine.Help = "An interface to the Phoenix Contact" +
 		" EM-CP-PP-ETH charge controller"
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
-	if *host == "" {
-		log.Fatal("Please specify the host to connect to, i.e." +
-			" em-cp-pp-eth -h 10.0.0.1")
+	switch cmd {
+	case simulate.FullCommand():
+		runSimulator()
+		return
+	case registers.FullCommand():
+		EM_CP_PP_ETH.WriteRegisterDocumentation(os.Stdout)
+		return
+	case stations.FullCommand():
+		config, err := loadConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeStations(os.Stdout, config)
+		return
 	}
-	url := fmt.Sprintf("%s:%d", *host, *port)
 
-	// Build a Modbus TCP connection to the controller
-	handler := modbus.NewTCPClientHandler(url)
-	handler.Timeout = 3 * time.Second
-	handler.SlaveId = *slaveid
-	if *verbose {
-		handler.Logger = log.New(os.Stdout, "DEBUG ", log.LstdFlags)
+	// Stop in-flight requests on Ctrl-C
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+
+	if cmd == check.FullCommand() {
+		runCheck(runCtx)
+		return
+	}
+	if cmd == serve.FullCommand() {
+		runServe(runCtx)
+		return
+	}
+	if cmd == mqttcmd.FullCommand() {
+		runMQTT(runCtx)
+		return
+	}
+
+	if *groupname != "" {
+		group, err := resolveGroup()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !runFleet(runCtx, os.Stdout, cmd, group) {
+			stop()
+			os.Exit(1)
+		}
+		return
 	}
-	err := handler.Connect()
+
+	st, err := resolveStation()
+	if err != nil {
+		log.Fatal(err)
+	}
+	url := st.Address()
+
+	// Build a Modbus TCP connection to the controller
+	handler, err := st.connect()
 	if err != nil {
 		log.Fatalf("Failed to connect: %s", err.Error())
 	}
 	defer handler.Close()
-	modbusClient := modbus.NewClient(handler)
+	// Reconnecting lets the time budget abort a hanging request
+	modbusClient := EM_CP_PP_ETH.WithReconnect(modbus.NewClient(handler), handler)
+
+	// Enforce the time budget
+	ctx, cancel := context.WithTimeout(runCtx, st.CommandTimeout)
+	defer cancel()
 
 	// Initialize internal handlers
 	// TODO: This might need to be refactored into a nice facade
 	statusCache := EM_CP_PP_ETH.NewStatusCache(modbusClient)
-	commander := EM_CP_PP_ETH.NewCommander(modbusClient)
+	commander := st.commander(modbusClient)
 
 	switch cmd {
 	case status.FullCommand():
-		err := statusCache.Refresh()
-		if err != nil {
-			log.Fatal("Failed to get status: %s", err.Error())
+		err := statusCache.RefreshContext(ctx)
+		var stateErr *EM_CP_PP_ETH.UnknownEVStateError
+		if errors.As(err, &stateErr) {
+			log.Printf("Warning: %s", err.Error())
+		} else if err != nil {
+			log.Fatalf("Failed to get status: %s", err.Error())
+		}
+		if statusoutput.Text() {
+			statusCache.WriteFormattedStatus(os.Stdout)
+		} else {
+			doc := EM_CP_PP_ETH.NewStatusDocument(statusCache.Snapshot())
+			writeOutput(statusoutput.writeStatus(os.Stdout, doc))
 		}
-		statusCache.WriteFormattedStatus(os.Stdout)
+
+	case watch.FullCommand():
+		runWatch(runCtx, statusCache, url, st.CommandTimeout)
+
+	case logcmd.FullCommand():
+		runLog(runCtx, statusCache, st.CommandTimeout)
 
 	case reset.FullCommand():
-		log.Printf("Resetting host %s\n", *host)
-		err := commander.HTTPHardReset(*host)
+		log.Printf("Resetting host %s\n", st.Host)
+		if *resetnoverify {
+			err := commander.HTTPHardResetContext(ctx, st.WebAddress())
+			if err != nil {
+				log.Fatalf("Failed to reset charge controller: %s", err.Error())
+			}
+			log.Printf("Reset sent")
+			break
+		}
+		// The restart takes longer than the time budget of a command
+		report, err := commander.ResetAndVerifyContext(runCtx,
+			st.WebAddress(), EM_CP_PP_ETH.ResetOptions{
+				Connection:  handler,
+				DownTimeout: *resetdown,
+				UpTimeout:   *resetup,
+			})
+		if err != nil {
+			log.Fatalf("Failed to reset charge controller: %s", err.Error())
+		}
+		log.Printf("Charge controller restarted, down for %s",
+			report.Downtime().Round(time.Second/10))
+		log.Printf("EV status %s, errors: %s", report.Status.EVStatus,
+			report.Status.Errorcode)
+		readCtx, cancel := context.WithTimeout(runCtx, st.CommandTimeout)
+		defer cancel()
+		current, err := commander.ReadActualChargingCurrentContext(readCtx)
 		if err != nil {
-			log.Fatal("Failed to reset charge controller: %s", err.Error())
+			log.Fatalf("Failed to read charging current: %s", err.Error())
 		}
-		log.Printf("Reset sent")
+		log.Printf("Charging current after the restart: %d A", current)
 
 	case getcurrent.FullCommand():
-		result, err := commander.ReadActualChargingCurrent()
+		result, err := commander.ReadActualChargingCurrentContext(ctx)
 		if err != nil {
 			log.Fatalf("Failed to read charging current: %s", err.Error())
-		} else {
+		} else if getcurrentoutput.Text() {
 			log.Printf("Actual charging current: %d A", result)
+		} else {
+			writeOutput(getcurrentoutput.writeValue(os.Stdout,
+				EM_CP_PP_ETH.NewValueDocument(configSetting(
+					"ActualChargingCurrent"), result, time.Now())))
 		}
 
 	case setcurrent.FullCommand():
-		result, err := commander.WriteActualChargingCurrent(*chargecurrent)
+		result, err := commander.WriteActualChargingCurrentContext(ctx, *chargecurrent)
 		if err != nil {
 			log.Fatalf("Failed to write charging current: %s", err.Error())
 		} else {
@@ -118,7 +392,7 @@ func main() {
 		}
 
 	case setavail.FullCommand():
-		err := commander.WriteChargingEnabled(*newavail)
+		err := commander.WriteChargingEnabledContext(ctx, *newavail)
 		if err != nil {
 			log.Fatalf("Failed to update availability: %s", err.Error())
 		} else {
@@ -126,29 +400,168 @@ func main() {
 		}
 
 	case getavail.FullCommand():
-		result, err := commander.ReadChargingEnabled()
+		result, err := commander.ReadChargingEnabledContext(ctx)
 		if err != nil {
 			log.Fatalf("Failed to read availability: %s", err.Error())
-		} else {
+		} else if getavailoutput.Text() {
 			log.Printf("Charging station available is %t", result)
+		} else {
+			writeOutput(getavailoutput.writeValue(os.Stdout,
+				EM_CP_PP_ETH.NewValueDocument(configSetting(
+					"ChargingEnabled"), result, time.Now())))
 		}
 
 	case setdigimode.FullCommand():
-		err := commander.WriteDigimodeEnabled(*newdigimode)
+		err := commander.WriteDigimodeEnabledContext(ctx, *newdigimode)
 		if err != nil {
 			log.Fatalf("Failed to update availability: %s", err.Error())
 		} else {
 			log.Printf("Digital communication mode is %t", *newdigimode)
 		}
 
+	case getconfig.FullCommand():
+		result, err := commander.ReadConfigurationContext(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read configuration: %s", err.Error())
+		}
+		EM_CP_PP_ETH.WriteFormattedConfiguration(os.Stdout, result)
+
+	case setconfig.FullCommand():
+		setting, err := EM_CP_PP_ETH.LookupConfigRegister(*configname)
+		if err != nil {
+			log.Fatal(err)
+		}
+		value, err := parseConfigValue(*configvalue)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = commander.WriteConfigValueContext(ctx, setting, value)
+		if err != nil {
+			log.Fatalf("Failed to update %s: %s", setting.Field, err.Error())
+		}
+		// Read back, charging currents may have been clamped
+		value, err = commander.ReadConfigValueContext(ctx, setting)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %s", setting.Field, err.Error())
+		}
+		if setting.Coil {
+			log.Printf("New %s: %t", setting.Field, value == 1)
+		} else {
+			log.Printf("New %s: %d %s", setting.Field, value, setting.Unit)
+		}
+
+	case rawread.FullCommand():
+		err := runRawRead(ctx, os.Stdout, modbusClient,
+			rawTable(*rawreadtable), *rawreadaddress, *rawreadcount,
+			*rawtype, parseWordOrder(*raworder))
+		if err != nil {
+			log.Fatalf("Failed to read %s %d: %s", *rawreadtable,
+				*rawreadaddress, err.Error())
+		}
+
+	case rawwrite.FullCommand():
+		if !confirm(fmt.Sprintf("Write %s to %s %d of %s?",
+			strings.Join(*rawwritevalues, " "), *rawwritetable,
+			*rawwriteaddress, url)) {
+			log.Fatal("Not confirmed, raw writes require --yes")
+		}
+		err := runRawWrite(ctx, modbusClient, commander,
+			rawTable(*rawwritetable), *rawwriteaddress, *rawwritevalues,
+			*rawtype, parseWordOrder(*raworder))
+		if err != nil {
+			log.Fatalf("Failed to write %s %d: %s", *rawwritetable,
+				*rawwriteaddress, err.Error())
+		}
+		log.Printf("Wrote %s %d", *rawwritetable, *rawwriteaddress)
+
 	case getdigimode.FullCommand():
-		result, err := commander.ReadDigimodeEnabled()
+		result, err := commander.ReadDigimodeEnabledContext(ctx)
 		if err != nil {
 			log.Fatalf("Failed to read digital communication mode state: %s", err.Error())
-		} else {
+		} else if getdigimodeoutput.Text() {
 			log.Printf("Digital communication mode is %t", result)
+		} else {
+			writeOutput(getdigimodeoutput.writeValue(os.Stdout,
+				EM_CP_PP_ETH.NewValueDocument(configSetting(
+					"DigimodeEnabled"), result, time.Now())))
 		}
 
 	}
 
 }
+
+// writeOutput stops with an error message if printing failed.
+func writeOutput(err error) {
+	if err != nil {
+		log.Fatalf("Failed to print output: %s", err.Error())
+	}
+}
+
+// configSetting returns the configuration map entry of a setting that
+// is known to exist.
+func configSetting(name string) EM_CP_PP_ETH.ConfigRegister {
+	setting, err := EM_CP_PP_ETH.LookupConfigRegister(name)
+	if err != nil {
+		panic(err)
+	}
+	return setting
+}
+
+// parseConfigValue accepts numbers and, for coils, true and false.
+func parseConfigValue(value string) (uint16, error) {
+	switch strings.ToLower(value) {
+	case "true", "on":
+		return 1, nil
+	case "false", "off":
+		return 0, nil
+	}
+	result, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value '%s'", value)
+	}
+	return uint16(result), nil
+}
+
+func runSimulator() {
+	device := simulator.NewDevice()
+	server := simulator.NewServer(device)
+	if *verbose {
+		server.Logger = log.New(os.Stdout, "DEBUG ", log.LstdFlags)
+	}
+	if *simscenario != "" {
+		scenario, err := simulator.LoadScenario(*simscenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+		player, err := simulator.NewPlayer(device, scenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+		player.Loop = *simloop
+		player.Logger = log.New(os.Stdout, "SCENARIO ", log.LstdFlags)
+		go func() {
+			err := player.Run(context.Background(), *simspeed,
+				500*time.Millisecond)
+			if err != nil {
+				log.Fatalf("Scenario failed: %s", err.Error())
+			}
+			log.Printf("Scenario '%s' finished", scenario.Name)
+		}()
+	}
+	log.Printf("Starting %s on %s", server, *simlisten)
+	if _, err := server.Start(*simlisten); err != nil {
+		log.Fatalf("Simulator failed: %s", err.Error())
+	}
+	if *simhttp != "" {
+		go func() {
+			err := http.ListenAndServe(*simhttp,
+				server.ResetHandler(*simdowntime))
+			log.Fatalf("Web interface failed: %s", err.Error())
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	server.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/mqtt"
+)
+
+// runMQTT bridges the station to the broker until ctx is canceled. The
+// bridge also starts while the controller is unreachable and connects
+// with a later poll.
+func runMQTT(ctx context.Context) {
+	st, err := resolveStation()
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := st.handler()
+	if err := handler.Connect(); err != nil {
+		log.Printf("Failed to connect, retrying with every poll: %s",
+			err.Error())
+	}
+	defer handler.Close()
+	client := EM_CP_PP_ETH.WithReconnect(modbus.NewClient(handler), handler)
+
+	name := st.Name
+	if name == "" {
+		name = st.Host
+	}
+	bridge := mqtt.NewBridge(client, name)
+	bridge.Commander = st.commander(client)
+	bridge.Timeout = st.CommandTimeout
+	bridge.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	if *mqttprefix != "" {
+		bridge.Prefix = *mqttprefix
+	}
+	qos, _ := strconv.Atoi(*mqttqos)
+	bridge.QoS = byte(qos)
+
+	options := paho.NewClientOptions().AddBroker(*mqttbroker)
+	clientID := *mqttclientid
+	if clientID == "" {
+		clientID = "em-cp-pp-eth-" + name
+	}
+	options.SetClientID(clientID)
+	options.SetUsername(*mqttuser)
+	options.SetPassword(*mqttpassword)
+	tlsConfig, err := mqttTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	options.SetTLSConfig(tlsConfig)
+
+	log.Printf("Bridging %s to %s below %s", st.Address(), *mqttbroker,
+		bridge.Prefix)
+	err = bridge.Run(ctx, options, *mqttinterval)
+	if !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// mqttTLSConfig builds the TLS settings of ssl:// and wss:// brokers
+// from the flags.
+func mqttTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: *mqttinsecure}
+	if *mqttca != "" {
+		pem, err := os.ReadFile(*mqttca)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate: %s",
+				err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", *mqttca)
+		}
+	}
+	if (*mqttcert == "") != (*mqttkey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if *mqttcert != "" {
+		cert, err := tls.LoadX509KeyPair(*mqttcert, *mqttkey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s",
+				err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alecthomas/template"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Time stamps of the csv and table formats.
+const TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+// outputOptions are the --output and --template flags of a command.
+type outputOptions struct {
+	format   *string
+	template *string
+}
+
+func addOutputFlags(cmd *kingpin.CmdClause) outputOptions {
+	return outputOptions{
+		format: cmd.Flag("output", "Output format: text (default),"+
+			" json, yaml, csv, table or template").Short('o').Default(
+			"text").Enum("text", "json", "yaml", "csv", "table", "template"),
+		template: cmd.Flag("template", "Go template for --output"+
+			" template, i.e. '{{.EVState.State}}'").String(),
+	}
+}
+
+// Text reports whether the human readable default format is selected.
+func (o outputOptions) Text() bool {
+	return *o.format == "text"
+}
+
+// field is a single column of the csv and table formats.
+type field struct {
+	name, value, unit string
+}
+
+// write prints doc in the selected format. fields lists the columns for
+// csv and table. The text format is printed by the caller.
+func (o outputOptions) write(out io.Writer, doc interface{}, fields []field) error {
+	switch *o.format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	case "yaml":
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write(fieldNames(fields))
+		writer.Write(fieldValues(fields))
+		writer.Flush()
+		return writer.Error()
+	case "table":
+		writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, f := range fields {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", f.name, f.value, f.unit)
+		}
+		return writer.Flush()
+	case "template":
+		if *o.template == "" {
+			return fmt.Errorf("--output template requires --template")
+		}
+		tmpl, err := template.New("output").Parse(*o.template)
+		if err != nil {
+			return fmt.Errorf("Invalid template: %s", err.Error())
+		}
+		return tmpl.Execute(out, doc)
+	}
+	return fmt.Errorf("Unknown output format '%s'", *o.format)
+}
+
+// writeStatus prints a status document.
+func (o outputOptions) writeStatus(out io.Writer, doc EM_CP_PP_ETH.StatusDocument) error {
+	return o.write(out, doc, statusFields(doc))
+}
+
+// writeValue prints a single value document.
+func (o outputOptions) writeValue(out io.Writer, doc EM_CP_PP_ETH.ValueDocument) error {
+	return o.write(out, doc, []field{
+		{"time", doc.Time.Format(TIME_FORMAT), ""},
+		{doc.Name, fmt.Sprint(doc.Value), doc.Unit},
+	})
+}
+
+// statusFields flattens a status document into columns, in register
+// map order.
+func statusFields(doc EM_CP_PP_ETH.StatusDocument) []field {
+	var faults []string
+	for _, f := range doc.Errors.Faults {
+		faults = append(faults, f.Name)
+	}
+	fields := []field{
+		{"time", doc.Time.Format(TIME_FORMAT), ""},
+		{"stale", strconv.FormatBool(doc.Stale), ""},
+		{"ev_state", doc.EVState.State, ""},
+		{"error_code", strconv.Itoa(int(doc.Errors.Code)), ""},
+		{"faults", strings.Join(faults, ";"), ""},
+		{"charging_enabled", strconv.FormatBool(doc.ChargingEnabled), ""},
+	}
+	for _, r := range EM_CP_PP_ETH.StatusRegisters() {
+		name := EM_CP_PP_ETH.SnakeCase(r.Field)
+		if q, ok := doc.Values[name]; ok {
+			fields = append(fields, field{name,
+				strconv.FormatFloat(q.Value, 'f', -1, 64), q.Unit})
+		}
+	}
+	for _, d := range EM_CP_PP_ETH.DiscreteInputMap {
+		parts := strings.Split(d.Field, ".")
+		name := parts[len(parts)-1]
+		if state, ok := doc.DigitalInputs[name]; ok {
+			fields = append(fields, field{"input_" + strings.ToLower(name),
+				strconv.FormatBool(state), ""})
+		}
+		if state, ok := doc.DigitalOutputs[name]; ok {
+			fields = append(fields, field{"output_" + strings.ToLower(name),
+				strconv.FormatBool(state), ""})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+func testOutput(format, template string) outputOptions {
+	return outputOptions{format: &format, template: &template}
+}
+
+func testStatusDocument() EM_CP_PP_ETH.StatusDocument {
+	return EM_CP_PP_ETH.NewStatusDocument(EM_CP_PP_ETH.Snapshot{
+		Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Status: EM_CP_PP_ETH.Status{
+			EVStatus:           EM_CP_PP_ETH.EVStateC,
+			Errorcode:          EM_CP_PP_ETH.ERROR_CABLE_13A | EM_CP_PP_ETH.ERROR_LOCKING,
+			DIPConfiguration:   5,
+			L1Voltage:          230.01,
+			L1Current:          15.9,
+			ActivePower:        3657,
+			DigitalInputStates: EM_CP_PP_ETH.DigiInputs{EN: true},
+			ChargingEnabled:    true,
+		},
+	})
+}
+
+func TestWriteStatusCSV(t *testing.T) {
+	var out bytes.Buffer
+	if err := testOutput("csv", "").writeStatus(&out, testStatusDocument()); err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid csv: %s", err.Error())
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want the header and one row", len(records))
+	}
+	columns := map[string]string{}
+	for i, name := range records[0] {
+		columns[name] = records[1][i]
+	}
+	for name, want := range map[string]string{
+		"time":              "2024-05-01T10:00:00.000Z",
+		"stale":             "false",
+		"ev_state":          "C",
+		"error_code":        "34",
+		"faults":            "Cable13A;Locking",
+		"charging_enabled":  "true",
+		"dip_configuration": "5",
+		"l1_voltage":        "230.01",
+		"l1_current":        "15.9",
+		"active_power":      "3657",
+		"input_en":          "true",
+		"output_cr":         "false",
+	} {
+		if got, ok := columns[name]; !ok || got != want {
+			t.Errorf("Column %s is %q, want %q", name, got, want)
+		}
+	}
+	if records[0][0] != "time" || records[0][2] != "ev_state" {
+		t.Errorf("Header starts with %q, want time, stale and ev_state",
+			records[0][:3])
+	}
+}
+
+func TestWriteStatusTable(t *testing.T) {
+	var out bytes.Buffer
+	if err := testOutput("table", "").writeStatus(&out, testStatusDocument()); err != nil {
+		t.Fatalf("write: %s", err.Error())
+	}
+	rows := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Fields(line)
+		rows[fields[0]] = fields[1:]
+	}
+	for name, want := range map[string]string{
+		"ev_state":     "C",
+		"faults":       "Cable13A;Locking",
+		"l1_voltage":   "230.01 V",
+		"active_power": "3657 W",
+		"input_en":     "true",
+	} {
+		if got := strings.Join(rows[name], " "); got != want {
+			t.Errorf("Row %s is %q, want %q", name, got, want)
+		}
+	}
+	// The columns are aligned
+	lines := strings.Split(out.String(), "\n")
+	if strings.Index(lines[0], "2024") != strings.Index(lines[2], "C") {
+		t.Errorf("Columns are not aligned:\n%s", out.String())
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name, template, want string
+	}{
+		{"state", "{{.EVState.State}}", "C"},
+		{"value", `{{(index .Values "l1_voltage").Value}}` +
+			` {{(index .Values "l1_voltage").Unit}}`, "230.01 V"},
+		{"faults", "{{range .Errors.Faults}}{{.Name}}={{.Severity}} {{end}}",
+			"Cable13A=warning Locking=blocking "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := testOutput("template", tc.template).writeStatus(&out,
+				testStatusDocument())
+			if err != nil {
+				t.Fatalf("write: %s", err.Error())
+			}
+			if out.String() != tc.want {
+				t.Errorf("Output %q, want %q", out.String(), tc.want)
+			}
+		})
+	}
+	for _, template := range []string{"", "{{.EVState.State"} {
+		var out bytes.Buffer
+		if err := testOutput("template", template).writeStatus(&out,
+			testStatusDocument()); err == nil {
+			t.Errorf("Template %q printed %q, want an error", template,
+				out.String())
+		}
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	doc := EM_CP_PP_ETH.ValueDocument{
+		Name:  "ActualChargingCurrent",
+		Value: uint16(16),
+		Unit:  "A",
+		Time:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	}
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{"csv", "time,ActualChargingCurrent\n2024-05-01T10:00:00.000Z,16\n"},
+		{"table", "time                   2024-05-01T10:00:00.000Z  \n" +
+			"ActualChargingCurrent  16                        A\n"},
+	} {
+		var out bytes.Buffer
+		if err := testOutput(tc.format, "").writeValue(&out, doc); err != nil {
+			t.Fatalf("write %s: %s", tc.format, err.Error())
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s output\n%q\nwant\n%q", tc.format, out.String(), tc.want)
+		}
+	}
+}
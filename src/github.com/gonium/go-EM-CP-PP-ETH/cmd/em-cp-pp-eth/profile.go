@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DEFAULT_PORT            = 502
+	DEFAULT_SLAVE_ID        = 180
+	DEFAULT_MODBUS_TIMEOUT  = 3 * time.Second
+	DEFAULT_COMMAND_TIMEOUT = 10 * time.Second
+)
+
+// station holds the connection settings of a charge controller, either
+// from the configuration file or from the command line.
+type station struct {
+	Name  string `yaml:"-"`
+	Host  string `yaml:"host"`
+	Port  uint16 `yaml:"port"`
+	Slave uint8  `yaml:"slave"`
+	// Response timeout of a single Modbus request.
+	Timeout time.Duration `yaml:"timeout"`
+	// Time budget of a command, see --timeout.
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+	// Credentials of the web interface, used by reset.
+	HTTP struct {
+		// Port of the web interface, 80 if not set.
+		Port     uint16 `yaml:"port"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+	} `yaml:"http"`
+	Limits stationLimits `yaml:"limits"`
+}
+
+type stationLimits struct {
+	// Highest charging current that may be set, in A. Zero leaves the
+	// range of the controller.
+	MaxCurrent uint16 `yaml:"max_current"`
+}
+
+// configFile is the layout of config.yaml:
+//
+//	default: garage
+//	stations:
+//	  garage:
+//	    host: 10.0.0.1
+//	    limits:
+//	      max_current: 16
+//	groups:
+//	  home: [garage, carport]
+type configFile struct {
+	// Station used if neither --station nor --host is given.
+	Default  string              `yaml:"default"`
+	Stations map[string]*station `yaml:"stations"`
+	// Named lists of stations for --group.
+	Groups map[string][]string `yaml:"groups"`
+}
+
+// defaultConfigPath returns ~/.config/em-cp-pp-eth/config.yaml or its
+// equivalent on the platform.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "em-cp-pp-eth", "config.yaml")
+}
+
+// loadConfig reads the configuration file. A missing file is only an
+// error if it was named explicitly.
+func loadConfig() (*configFile, error) {
+	path, explicit := *configpath, true
+	if path == "" {
+		path, explicit = defaultConfigPath(), false
+	}
+	config := &configFile{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read configuration: %s", err.Error())
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid configuration %s: %s", path,
+			err.Error())
+	}
+	for name, s := range config.Stations {
+		if s == nil {
+			return nil, fmt.Errorf("Station '%s' has no settings", name)
+		}
+		s.Name = name
+	}
+	if config.Default != "" && config.Stations[config.Default] == nil {
+		return nil, fmt.Errorf("Unknown default station '%s'", config.Default)
+	}
+	for group, members := range config.Groups {
+		for _, name := range members {
+			if config.Stations[name] == nil {
+				return nil, fmt.Errorf("Unknown station '%s' in group '%s'",
+					name, group)
+			}
+		}
+	}
+	return config, nil
+}
+
+// lookup returns a copy of the named station.
+func (c *configFile) lookup(name string) (station, error) {
+	s, ok := c.Stations[name]
+	if !ok {
+		return station{}, fmt.Errorf("Unknown station '%s'", name)
+	}
+	return *s, nil
+}
+
+// resolveStation selects the station to talk to. Flags and their
+// environment variables override the settings of the configuration
+// file, which override the defaults.
+func resolveStation() (station, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return station{}, err
+	}
+	s := station{}
+	name := *stationname
+	if name == "" && *host == "" {
+		name = config.Default
+	}
+	if name != "" {
+		if s, err = config.lookup(name); err != nil {
+			return s, err
+		}
+	}
+	if *host != "" {
+		s.Host = *host
+	}
+	if *port != 0 {
+		s.Port = *port
+	}
+	if *slaveid != 0 {
+		s.Slave = *slaveid
+	}
+	if *timeout != 0 {
+		s.CommandTimeout = *timeout
+	}
+	s.applyDefaults()
+	if s.Host == "" {
+		return s, fmt.Errorf("Please specify the host to connect to, i.e." +
+			" em-cp-pp-eth -h 10.0.0.1, or a station of the configuration file")
+	}
+	return s, nil
+}
+
+// resolveGroup returns the stations of the group selected by --group.
+// Only --timeout applies to the members, the other connection flags
+// name a single station.
+func resolveGroup() ([]station, error) {
+	if *host != "" || *stationname != "" {
+		return nil, fmt.Errorf("--group cannot be combined with --host" +
+			" or --station")
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	members, ok := config.Groups[*groupname]
+	if !ok {
+		return nil, fmt.Errorf("Unknown group '%s'", *groupname)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("Group '%s' has no stations", *groupname)
+	}
+	group := make([]station, len(members))
+	for i, name := range members {
+		group[i], _ = config.lookup(name)
+		if *timeout != 0 {
+			group[i].CommandTimeout = *timeout
+		}
+		group[i].applyDefaults()
+	}
+	return group, nil
+}
+
+func (s *station) applyDefaults() {
+	if s.Port == 0 {
+		s.Port = DEFAULT_PORT
+	}
+	if s.Slave == 0 {
+		s.Slave = DEFAULT_SLAVE_ID
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DEFAULT_MODBUS_TIMEOUT
+	}
+	if s.CommandTimeout == 0 {
+		s.CommandTimeout = DEFAULT_COMMAND_TIMEOUT
+	}
+}
+
+// Address returns host:port.
+func (s station) Address() string {
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
+
+// WebAddress returns the host and, if configured, the port of the web
+// interface.
+func (s station) WebAddress() string {
+	if s.HTTP.Port == 0 {
+		return s.Host
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(int(s.HTTP.Port)))
+}
+
+// handler returns a Modbus TCP handler for the station, which connects
+// with the first request.
+func (s station) handler() *EM_CP_PP_ETH.TCPClientHandler {
+	handler := EM_CP_PP_ETH.NewTCPClientHandler(s.Address())
+	handler.Timeout = s.Timeout
+	handler.SlaveId = s.Slave
+	if *verbose {
+		handler.Logger = log.New(os.Stdout, "DEBUG ", log.LstdFlags)
+	}
+	return handler
+}
+
+// connect opens the Modbus TCP connection to the station.
+func (s station) connect() (*EM_CP_PP_ETH.TCPClientHandler, error) {
+	handler := s.handler()
+	if err := handler.Connect(); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// commander returns a Commander with the credentials and current limit
+// of the station. --force and --clamp select how setpoints are checked.
+func (s station) commander(client modbus.Client) *EM_CP_PP_ETH.Commander {
+	commander := EM_CP_PP_ETH.NewCommander(client)
+	commander.HTTPUser = s.HTTP.User
+	commander.HTTPPassword = s.HTTP.Password
+	commander.Guard = EM_CP_PP_ETH.CurrentGuard{
+		Force:      *forcecurrent,
+		Clamp:      *clampcurrent,
+		MaxCurrent: s.Limits.MaxCurrent,
+		OnClamp: func(e *EM_CP_PP_ETH.CurrentLimitError) {
+			log.Printf("%s: %s", s.Address(), e.Error())
+		},
+	}
+	return commander
+}
+
+// writeStations lists the stations of the configuration file.
+func writeStations(out io.Writer, config *configFile) {
+	var names []string
+	for name := range config.Stations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "STATION\tADDRESS\tSLAVE\tMAX CURRENT\t\n")
+	for _, name := range names {
+		s := *config.Stations[name]
+		s.applyDefaults()
+		limit := "-"
+		if s.Limits.MaxCurrent != 0 {
+			limit = fmt.Sprintf("%d A", s.Limits.MaxCurrent)
+		}
+		marker := ""
+		if name == config.Default {
+			marker = "(default)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", name, s.Address(),
+			s.Slave, limit, marker)
+	}
+	writer.Flush()
+	var groups []string
+	for group := range config.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		fmt.Fprintf(out, "Group %s: %s\n", group,
+			strings.Join(config.Groups[group], ", "))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `default: garage
+stations:
+  garage:
+    host: 10.0.0.1
+    port: 5020
+    slave: 1
+    command_timeout: 20s
+  carport:
+    host: 10.0.0.2
+    limits:
+      max_current: 16
+groups:
+  home: [garage, carport]
+`
+
+// writeConfig writes a configuration file to a temporary directory and
+// returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parseFlags parses args after the environment env, starting from unset
+// connection flags as a new process does.
+func parseFlags(t *testing.T, env map[string]string, args ...string) {
+	t.Helper()
+	for _, name := range []string{"HOST", "PORT", "SLAVE", "TIMEOUT",
+		"STATION", "GROUP", "CONFIG"} {
+		t.Setenv("EM_CP_PP_ETH_"+name, env["EM_CP_PP_ETH_"+name])
+	}
+	reset := func() {
+		*host, *port, *slaveid, *timeout = "", 0, 0, 0
+		*stationname, *groupname, *configpath = "", "", ""
+	}
+	reset()
+	t.Cleanup(reset)
+	if _, err := app.Parse(append(args, "status")); err != nil {
+		t.Fatalf("Parse: %s", err.Error())
+	}
+}
+
+func TestResolveStation(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	garage := station{Name: "garage", Host: "10.0.0.1", Port: 5020,
+		Slave: 1, Timeout: DEFAULT_MODBUS_TIMEOUT,
+		CommandTimeout: 20 * time.Second}
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want func(*station)
+	}{
+		{
+			name: "default station",
+			want: func(s *station) {},
+		},
+		{
+			name: "environment over configuration file",
+			env:  map[string]string{"EM_CP_PP_ETH_PORT": "5021"},
+			want: func(s *station) { s.Port = 5021 },
+		},
+		{
+			name: "flag over environment",
+			env: map[string]string{"EM_CP_PP_ETH_PORT": "5021",
+				"EM_CP_PP_ETH_TIMEOUT": "30s"},
+			args: []string{"--port", "5022", "--timeout", "40s"},
+			want: func(s *station) {
+				s.Port = 5022
+				s.CommandTimeout = 40 * time.Second
+			},
+		},
+		{
+			name: "station from the environment",
+			env:  map[string]string{"EM_CP_PP_ETH_STATION": "carport"},
+			want: func(s *station) {
+				*s = station{Name: "carport", Host: "10.0.0.2",
+					Port: DEFAULT_PORT, Slave: DEFAULT_SLAVE_ID,
+					Timeout:        DEFAULT_MODBUS_TIMEOUT,
+					CommandTimeout: DEFAULT_COMMAND_TIMEOUT}
+				s.Limits.MaxCurrent = 16
+			},
+		},
+		{
+			name: "host replaces the default station",
+			args: []string{"--host", "10.0.0.9"},
+			want: func(s *station) {
+				*s = station{Host: "10.0.0.9", Port: DEFAULT_PORT,
+					Slave: DEFAULT_SLAVE_ID, Timeout: DEFAULT_MODBUS_TIMEOUT,
+					CommandTimeout: DEFAULT_COMMAND_TIMEOUT}
+			},
+		},
+		{
+			name: "host overrides the named station",
+			args: []string{"--station", "garage", "-h", "10.0.0.9",
+				"--slave", "2"},
+			want: func(s *station) {
+				s.Host = "10.0.0.9"
+				s.Slave = 2
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parseFlags(t, tc.env, append([]string{"--config-file", path},
+				tc.args...)...)
+			got, err := resolveStation()
+			if err != nil {
+				t.Fatalf("resolveStation: %s", err.Error())
+			}
+			want := garage
+			tc.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Station\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestResolveStationErrors(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	noDefault := writeConfig(t, "stations:\n  garage:\n    host: 10.0.0.1\n")
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown station", []string{"--config-file", path, "--station",
+			"shed"}, "Unknown station 'shed'"},
+		{"no host", []string{"--config-file", noDefault},
+			"Please specify the host"},
+		{"missing configuration file", []string{"--config-file",
+			filepath.Join(t.TempDir(), "missing.yaml")},
+			"Failed to read configuration"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parseFlags(t, nil, tc.args...)
+			if _, err := resolveStation(); err == nil ||
+				!strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("resolveStation returned %v, want %s", err, tc.want)
+			}
+		})
+	}
+
+	// Without a configuration file, only the flags count
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	parseFlags(t, map[string]string{"EM_CP_PP_ETH_HOST": "10.0.0.3"})
+	if s, err := resolveStation(); err != nil || s.Address() != "10.0.0.3:502" {
+		t.Errorf("resolveStation returned %+v, %v, want 10.0.0.3:502", s, err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"unknown key", "default: garage\nstations:\n  garage:\n" +
+			"    host: 10.0.0.1\n    hots: 10.0.0.2\n", "Invalid configuration"},
+		{"unknown top level key", "station:\n  garage:\n    host: 10.0.0.1\n",
+			"Invalid configuration"},
+		{"empty station", "stations:\n  garage:\n",
+			"Station 'garage' has no settings"},
+		{"unknown default", "default: shed\nstations:\n  garage:\n" +
+			"    host: 10.0.0.1\n", "Unknown default station 'shed'"},
+		{"unknown group member", "stations:\n  garage:\n    host: 10.0.0.1\n" +
+			"groups:\n  home: [garage, shed]\n",
+			"Unknown station 'shed' in group 'home'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parseFlags(t, nil, "--config-file", writeConfig(t, tc.content))
+			if _, err := loadConfig(); err == nil ||
+				!strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("loadConfig returned %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveGroup(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	parseFlags(t, nil, "--config-file", path, "--group", "home",
+		"--timeout", "5s")
+	group, err := resolveGroup()
+	if err != nil {
+		t.Fatalf("resolveGroup: %s", err.Error())
+	}
+	var addresses []string
+	for _, st := range group {
+		addresses = append(addresses, st.Address())
+		if st.CommandTimeout != 5*time.Second {
+			t.Errorf("Station %s has the timeout %s, want 5s", st.Name,
+				st.CommandTimeout)
+		}
+	}
+	if want := []string{"10.0.0.1:5020", "10.0.0.2:502"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("Group %v, want %v", addresses, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"with host", nil, []string{"--group", "home", "--host", "10.0.0.9"},
+			"--group cannot be combined"},
+		{"with station", nil, []string{"--group", "home", "--station",
+			"garage"}, "--group cannot be combined"},
+		{"with station from the environment",
+			map[string]string{"EM_CP_PP_ETH_STATION": "garage"},
+			[]string{"--group", "home"}, "--group cannot be combined"},
+		{"unknown group", nil, []string{"--group", "work"},
+			"Unknown group 'work'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parseFlags(t, tc.env, append([]string{"--config-file", path},
+				tc.args...)...)
+			if group, err := resolveGroup(); err == nil ||
+				!strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("resolveGroup returned %v, %v, want %s", group, err,
+					tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// rawTable is one of the four Modbus data tables.
+type rawTable string
+
+const (
+	RAW_COIL     rawTable = "coil"
+	RAW_DISCRETE rawTable = "discrete"
+	RAW_INPUT    rawTable = "input"
+	RAW_HOLDING  rawTable = "holding"
+)
+
+// Quantities of one request, from the Modbus application protocol.
+const (
+	RAW_MAX_READ_BITS       = 2000
+	RAW_MAX_READ_REGISTERS  = 125
+	RAW_MAX_WRITE_BITS      = 1968
+	RAW_MAX_WRITE_REGISTERS = 123
+)
+
+func (t rawTable) bits() bool {
+	return t == RAW_COIL || t == RAW_DISCRETE
+}
+
+// rawWords returns the number of registers per value of type typ.
+func rawWords(typ string) uint16 {
+	switch typ {
+	case "uint32", "int32", "float32":
+		return 2
+	}
+	return 1
+}
+
+// parseWordOrder accepts "high" and "low".
+func parseWordOrder(order string) EM_CP_PP_ETH.WordOrder {
+	if order == "low" {
+		return EM_CP_PP_ETH.LowWordFirst
+	}
+	return EM_CP_PP_ETH.HighWordFirst
+}
+
+// checkRawRange returns an error unless quantity coils or registers
+// from address are at most max and end at the last address 65535.
+func checkRawRange(address uint16, quantity, max int) error {
+	if quantity < 1 || quantity > max {
+		return fmt.Errorf("Invalid quantity %d, a request covers 1 to %d",
+			quantity, max)
+	}
+	if last := int(address) + quantity - 1; last > math.MaxUint16 {
+		return fmt.Errorf("Quantity %d from address %d ends at %d, after"+
+			" the last address %d", quantity, address, last, math.MaxUint16)
+	}
+	return nil
+}
+
+// runRawRead reads count values starting at address and prints one
+// line per value with the raw registers and the decoded value.
+func runRawRead(ctx context.Context, out io.Writer, client modbus.Client,
+	table rawTable, address, count uint16, typ string,
+	order EM_CP_PP_ETH.WordOrder) error {
+	client = EM_CP_PP_ETH.WithContext(ctx, client)
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if table.bits() {
+		if err := checkRawRange(address, int(count), RAW_MAX_READ_BITS); err != nil {
+			return err
+		}
+		var results []byte
+		var err error
+		if table == RAW_COIL {
+			results, err = client.ReadCoils(address, count)
+		} else {
+			results, err = client.ReadDiscreteInputs(address, count)
+		}
+		if err != nil {
+			return err
+		}
+		if len(results) < (int(count)+7)/8 {
+			return fmt.Errorf("Invalid response length %d", len(results))
+		}
+		fmt.Fprintln(writer, "ADDRESS\tSTATE")
+		for i := uint16(0); i < count; i++ {
+			state := results[i/8]&(1<<(i%8)) != 0
+			fmt.Fprintf(writer, "%d\t%t\n", address+i, state)
+		}
+		return writer.Flush()
+	}
+
+	words := rawWords(typ)
+	if err := checkRawRange(address, int(count)*int(words),
+		RAW_MAX_READ_REGISTERS); err != nil {
+		return err
+	}
+	var results []byte
+	var err error
+	if table == RAW_INPUT {
+		results, err = client.ReadInputRegisters(address, count*words)
+	} else {
+		results, err = client.ReadHoldingRegisters(address, count*words)
+	}
+	if err != nil {
+		return err
+	}
+	if len(results) != 2*int(count*words) {
+		return fmt.Errorf("Invalid response length %d", len(results))
+	}
+	fmt.Fprintf(writer, "ADDRESS\tRAW\t%s\n", strings.ToUpper(typ))
+	for i := uint16(0); i < count; i++ {
+		data := results[2*i*words : 2*(i+1)*words]
+		var raw []string
+		for w := 0; w < len(data); w += 2 {
+			raw = append(raw, fmt.Sprintf("%04x", binary.BigEndian.Uint16(data[w:])))
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\n", address+i*words,
+			strings.Join(raw, " "), decodeRaw(data, typ, order))
+	}
+	return writer.Flush()
+}
+
+// decodeRaw interprets one value of one or two registers.
+func decodeRaw(data []byte, typ string, order EM_CP_PP_ETH.WordOrder) string {
+	if len(data) == 2 {
+		value := binary.BigEndian.Uint16(data)
+		switch typ {
+		case "int16":
+			return strconv.Itoa(int(int16(value)))
+		case "hex":
+			return fmt.Sprintf("0x%04x", value)
+		}
+		return strconv.Itoa(int(value))
+	}
+	high, low := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+	if order == EM_CP_PP_ETH.LowWordFirst {
+		high, low = low, high
+	}
+	value := uint32(high)<<16 | uint32(low)
+	switch typ {
+	case "int32":
+		return strconv.Itoa(int(int32(value)))
+	case "float32":
+		return strconv.FormatFloat(float64(math.Float32frombits(value)), 'g', -1, 32)
+	}
+	return strconv.FormatUint(uint64(value), 10)
+}
+
+// encodeRaw converts values to registers. Integers may be given in hex
+// with a 0x prefix.
+func encodeRaw(values []string, typ string, order EM_CP_PP_ETH.WordOrder) ([]uint16, error) {
+	var words []uint16
+	for _, text := range values {
+		var value uint32
+		switch typ {
+		case "uint16", "hex":
+			v, err := strconv.ParseUint(text, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s value '%s'", typ, text)
+			}
+			words = append(words, uint16(v))
+			continue
+		case "int16":
+			v, err := strconv.ParseInt(text, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s value '%s'", typ, text)
+			}
+			words = append(words, uint16(int16(v)))
+			continue
+		case "uint32":
+			v, err := strconv.ParseUint(text, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s value '%s'", typ, text)
+			}
+			value = uint32(v)
+		case "int32":
+			v, err := strconv.ParseInt(text, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s value '%s'", typ, text)
+			}
+			value = uint32(int32(v))
+		case "float32":
+			v, err := strconv.ParseFloat(text, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s value '%s'", typ, text)
+			}
+			value = math.Float32bits(float32(v))
+		}
+		high, low := uint16(value>>16), uint16(value)
+		if order == EM_CP_PP_ETH.LowWordFirst {
+			high, low = low, high
+		}
+		words = append(words, high, low)
+	}
+	return words, nil
+}
+
+// runRawWrite writes values starting at address, with the single write
+// function codes if one register or coil is written. Charging currents
+// are checked by the guard of commander.
+func runRawWrite(ctx context.Context, client modbus.Client,
+	commander *EM_CP_PP_ETH.Commander, table rawTable, address uint16,
+	values []string, typ string, order EM_CP_PP_ETH.WordOrder) error {
+	client = EM_CP_PP_ETH.WithContext(ctx, client)
+	switch table {
+	case RAW_COIL:
+		states := make([]bool, len(values))
+		for i, text := range values {
+			state, err := strconv.ParseBool(text)
+			if err != nil {
+				return fmt.Errorf("Invalid coil state '%s'", text)
+			}
+			states[i] = state
+		}
+		if err := checkRawRange(address, len(states), RAW_MAX_WRITE_BITS); err != nil {
+			return err
+		}
+		if len(states) == 1 {
+			update := uint16(0x0000)
+			if states[0] {
+				update = 0xFF00
+			}
+			_, err := client.WriteSingleCoil(address, update)
+			return err
+		}
+		packed := make([]byte, (len(states)+7)/8)
+		for i, state := range states {
+			if state {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		_, err := client.WriteMultipleCoils(address, uint16(len(states)), packed)
+		return err
+	case RAW_HOLDING:
+		words, err := encodeRaw(values, typ, order)
+		if err != nil {
+			return err
+		}
+		if err := checkRawRange(address, len(words), RAW_MAX_WRITE_REGISTERS); err != nil {
+			return err
+		}
+		if err := guardRawWrite(ctx, commander, address, words); err != nil {
+			return err
+		}
+		if len(words) == 1 {
+			_, err = client.WriteSingleRegister(address, words[0])
+			return err
+		}
+		data := make([]byte, 2*len(words))
+		for i, w := range words {
+			binary.BigEndian.PutUint16(data[2*i:], w)
+		}
+		_, err = client.WriteMultipleRegisters(address, uint16(len(words)), data)
+		return err
+	}
+	return fmt.Errorf("The %s table is read-only", table)
+}
+
+// guardRawWrite checks words written to ActualChargingCurrent and
+// DefaultChargingCurrent against their current limits, unless the
+// guard of commander is forced. Raw writes are never clamped.
+func guardRawWrite(ctx context.Context, commander *EM_CP_PP_ETH.Commander,
+	address uint16, words []uint16) error {
+	if commander.Guard.Force {
+		return nil
+	}
+	var limits *EM_CP_PP_ETH.CurrentLimits
+	for i, word := range words {
+		target := address + uint16(i)
+		if target != EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT &&
+			target != EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT {
+			continue
+		}
+		if limits == nil {
+			read, err := commander.CurrentLimitsContext(ctx)
+			if err != nil {
+				return fmt.Errorf("Failed to read current limits: %w", err)
+			}
+			limits = &read
+		}
+		check := *limits
+		if target == EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT {
+			check = check.ForDefaultCurrent()
+		}
+		if err := check.Check(word); err != nil {
+			return fmt.Errorf("Register %d: %w, --force writes it anyway",
+				target, err)
+		}
+	}
+	return nil
+}
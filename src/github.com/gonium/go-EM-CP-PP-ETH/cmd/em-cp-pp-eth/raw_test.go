@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+func TestDecodeRaw(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		typ   string
+		order EM_CP_PP_ETH.WordOrder
+		want  string
+	}{
+		{"uint16", []byte{0xff, 0xfe}, "uint16", EM_CP_PP_ETH.HighWordFirst, "65534"},
+		{"int16", []byte{0xff, 0xfe}, "int16", EM_CP_PP_ETH.HighWordFirst, "-2"},
+		{"hex", []byte{0x00, 0x2a}, "hex", EM_CP_PP_ETH.HighWordFirst, "0x002a"},
+		{"uint32", []byte{0x00, 0x01, 0x00, 0x02}, "uint32",
+			EM_CP_PP_ETH.HighWordFirst, "65538"},
+		{"uint32 low word first", []byte{0x00, 0x02, 0x00, 0x01}, "uint32",
+			EM_CP_PP_ETH.LowWordFirst, "65538"},
+		{"int32", []byte{0xff, 0xff, 0xff, 0xfe}, "int32",
+			EM_CP_PP_ETH.HighWordFirst, "-2"},
+		{"int32 low word first", []byte{0xff, 0xfe, 0xff, 0xff}, "int32",
+			EM_CP_PP_ETH.LowWordFirst, "-2"},
+		{"float32", []byte{0x43, 0x66, 0x00, 0x00}, "float32",
+			EM_CP_PP_ETH.HighWordFirst, "230"},
+		{"float32 low word first", []byte{0xcc, 0xcd, 0x3f, 0xcc}, "float32",
+			EM_CP_PP_ETH.LowWordFirst, "1.6"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := decodeRaw(tc.data, tc.typ, tc.order); got != tc.want {
+				t.Errorf("decodeRaw(% x) returned %s, want %s", tc.data, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRaw(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		typ    string
+		want   []uint16
+	}{
+		{"uint16", []string{"16", "0x10"}, "uint16", []uint16{16, 16}},
+		{"int16", []string{"-2"}, "int16", []uint16{0xfffe}},
+		{"hex", []string{"0xffff"}, "hex", []uint16{0xffff}},
+		{"int32", []string{"-2"}, "int32", []uint16{0xffff, 0xfffe}},
+		{"float32", []string{"230", "1.6"}, "float32",
+			[]uint16{0x4366, 0x0000, 0x3fcc, 0xcccd}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := encodeRaw(tc.values, tc.typ, EM_CP_PP_ETH.HighWordFirst)
+			if err != nil {
+				t.Fatalf("encodeRaw: %s", err.Error())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("encodeRaw returned %04x, want %04x", got, tc.want)
+			}
+		})
+	}
+	for _, tc := range []struct {
+		value, typ string
+	}{
+		{"65536", "uint16"},
+		{"-32769", "int16"},
+		{"0x10000", "hex"},
+		{"-1", "uint32"},
+		{"2147483648", "int32"},
+		{"ten", "float32"},
+	} {
+		if got, err := encodeRaw([]string{tc.value}, tc.typ,
+			EM_CP_PP_ETH.HighWordFirst); err == nil {
+			t.Errorf("encodeRaw(%s as %s) returned %04x, want an error",
+				tc.value, tc.typ, got)
+		}
+	}
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	for _, order := range []EM_CP_PP_ETH.WordOrder{
+		EM_CP_PP_ETH.HighWordFirst, EM_CP_PP_ETH.LowWordFirst} {
+		for _, tc := range []struct {
+			typ, value string
+		}{
+			{"uint16", "65535"},
+			{"int16", "-32768"},
+			{"hex", "0x00ff"},
+			{"uint32", "4294967295"},
+			{"int32", "-2147483648"},
+			{"float32", "-0.25"},
+			{"float32", "3.4028235e+38"},
+		} {
+			words, err := encodeRaw([]string{tc.value}, tc.typ, order)
+			if err != nil {
+				t.Fatalf("encodeRaw(%s as %s): %s", tc.value, tc.typ, err.Error())
+			}
+			data := make([]byte, 2*len(words))
+			for i, w := range words {
+				data[2*i], data[2*i+1] = byte(w>>8), byte(w)
+			}
+			if got := decodeRaw(data, tc.typ, order); got != tc.value {
+				t.Errorf("%s %s in word order %d decodes to %s", tc.typ,
+					tc.value, order, got)
+			}
+		}
+	}
+}
+
+func TestCheckRawRange(t *testing.T) {
+	for _, tc := range []struct {
+		address  uint16
+		quantity int
+		max      int
+		valid    bool
+	}{
+		{300, 1, RAW_MAX_READ_REGISTERS, true},
+		{0, 125, RAW_MAX_READ_REGISTERS, true},
+		{0, 126, RAW_MAX_READ_REGISTERS, false},
+		{0, 0, RAW_MAX_READ_REGISTERS, false},
+		{0, 2000, RAW_MAX_READ_BITS, true},
+		{0, 2001, RAW_MAX_READ_BITS, false},
+		{65535, 1, RAW_MAX_READ_REGISTERS, true},
+		{65535, 2, RAW_MAX_READ_REGISTERS, false},
+		{65500, 100, RAW_MAX_WRITE_REGISTERS, false},
+	} {
+		err := checkRawRange(tc.address, tc.quantity, tc.max)
+		if (err == nil) != tc.valid {
+			t.Errorf("checkRawRange(%d, %d, %d) returned %v, want valid %t",
+				tc.address, tc.quantity, tc.max, err, tc.valid)
+		}
+	}
+}
+
+func TestRawReadRange(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		table   rawTable
+		address uint16
+		count   uint16
+		typ     string
+	}{
+		{"too many registers", RAW_HOLDING, 0, 126, "uint16"},
+		// 40000 registers overflowed the uint16 quantity to 14464
+		{"quantity overflow", RAW_INPUT, 0, 20000, "float32"},
+		{"after the last address", RAW_HOLDING, 65535, 1, "uint32"},
+		{"too many coils", RAW_COIL, 0, 2001, ""},
+		{"coils after the last address", RAW_DISCRETE, 65000, 1000, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The range is checked before the client is used
+			err := runRawRead(context.Background(), io.Discard, nil, tc.table,
+				tc.address, tc.count, tc.typ, EM_CP_PP_ETH.HighWordFirst)
+			if err == nil {
+				t.Error("runRawRead returned no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+)
+
+// Time stamp in the names of rotated files, without colons.
+const ROTATE_TIME_FORMAT = "2006-01-02T15-04-05"
+
+// rotatingFile appends lines to a file and moves it aside when it grows
+// beyond maxSize or a new period of length every begins. Periods are
+// aligned to UTC, i.e. every 24h rotates at midnight UTC. An existing
+// file is continued, unless it belongs to an earlier period or its
+// first line does not match the format.
+//
+// Rotated files are named after the start of the period they hold, or
+// after their first record if every is 0, i.e. status-2024-05-01T00-00-00.csv.
+// Further files of the same period, rotated because of their size, get
+// a sequence number: status-2024-05-01T00-00-00-1.csv.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	every   time.Duration
+	// Gzip rotated files.
+	compress bool
+	// Number of rotated files to keep, 0 keeps all.
+	keep int
+	// First line of every file, empty for none.
+	header string
+	// matches reports whether an existing file with this first line
+	// has the same format.
+	matches func(firstLine string) bool
+	// recordTime returns the time of a record, which names the
+	// rotated file.
+	recordTime func(record string) (time.Time, bool)
+
+	file   *os.File
+	size   int64
+	period time.Time
+	// Time of the first record in the file, zero while it has none.
+	start time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, every time.Duration,
+	compress bool, keep int, header string,
+	matches func(firstLine string) bool,
+	recordTime func(record string) (time.Time, bool)) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		every:      every,
+		compress:   compress,
+		keep:       keep,
+		header:     header,
+		matches:    matches,
+		recordTime: recordTime,
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.Size() > 0 {
+		current, err := r.sameFormat()
+		if err != nil {
+			return nil, err
+		}
+		if !current || r.periodOf(info.ModTime()) != r.periodOf(time.Now()) {
+			if r.start, err = r.firstRecordTime(info.ModTime()); err != nil {
+				return nil, err
+			}
+			if err := r.rotate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, r.open(time.Now())
+}
+
+func (r *rotatingFile) periodOf(t time.Time) time.Time {
+	if r.every <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(r.every)
+}
+
+// sameFormat checks the first line of the existing file.
+func (r *rotatingFile) sameFormat() (bool, error) {
+	lines, err := r.readLines(1)
+	if err != nil {
+		return false, err
+	}
+	return len(lines) > 0 && r.matches(lines[0]), nil
+}
+
+// firstRecordTime returns the time of the first record of the existing
+// file, or fallback if there is none or it cannot be parsed.
+func (r *rotatingFile) firstRecordTime(fallback time.Time) (time.Time, error) {
+	skip := 0
+	if r.header != "" {
+		skip = 1
+	}
+	lines, err := r.readLines(skip + 1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(lines) > skip {
+		if t, ok := r.recordTime(lines[skip]); ok {
+			return t, nil
+		}
+	}
+	return fallback, nil
+}
+
+// readLines returns up to n lines from the start of the existing file,
+// including their newline.
+func (r *rotatingFile) readLines(n int) ([]string, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var lines []string
+	for len(lines) < n {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+func (r *rotatingFile) open(now time.Time) error {
+	f, err := os.OpenFile(r.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := store.Repair(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to repair %s: %s", r.path, err.Error())
+	}
+	r.file, r.size, r.period = f, size, r.periodOf(now)
+	r.start = time.Time{}
+	if size > int64(len(r.header)) {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if r.start, err = r.firstRecordTime(info.ModTime()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if size == 0 && r.header != "" {
+		return r.append([]byte(r.header))
+	}
+	return nil
+}
+
+// Write appends a record, which must end with a newline, and syncs the
+// file.
+func (r *rotatingFile) Write(record []byte, now time.Time) error {
+	full := r.maxSize > 0 && r.size+int64(len(record)) > r.maxSize
+	if !r.start.IsZero() && (full || r.periodOf(now) != r.period) {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+		if err := r.rotate(); err != nil {
+			return err
+		}
+		if err := r.open(now); err != nil {
+			return err
+		}
+	}
+	if r.start.IsZero() {
+		r.start, r.period = now, r.periodOf(now)
+	}
+	if err := r.append(record); err != nil {
+		return err
+	}
+	return r.file.Sync()
+}
+
+func (r *rotatingFile) append(data []byte) error {
+	n, err := r.file.WriteAt(data, r.size)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+// rotate moves the file aside, compresses it and removes the oldest
+// rotated files. Existing rotated files are never replaced.
+func (r *rotatingFile) rotate() error {
+	start := r.start
+	if r.every > 0 {
+		start = r.periodOf(start)
+	}
+	rotated, err := r.rotatedName(start)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if r.compress {
+		if err := gzipFile(rotated); err != nil {
+			return fmt.Errorf("Failed to compress %s: %s", rotated, err.Error())
+		}
+	}
+	if r.keep <= 0 {
+		return nil
+	}
+	old, err := r.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(old) > r.keep {
+		if err := os.Remove(old[0].path); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// rotatedName returns the first free name for a file starting at start.
+func (r *rotatingFile) rotatedName(start time.Time) (string, error) {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "-" +
+		start.UTC().Format(ROTATE_TIME_FORMAT)
+	for seq := 0; ; seq++ {
+		name := base + ext
+		if seq > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, seq, ext)
+		}
+		free := true
+		for _, candidate := range []string{name, name + ".gz"} {
+			if _, err := os.Lstat(candidate); err == nil {
+				free = false
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		if free {
+			return name, nil
+		}
+	}
+}
+
+// rotatedFile is a file moved aside by rotate.
+type rotatedFile struct {
+	path  string
+	start time.Time
+	seq   int
+}
+
+// rotatedFiles lists the rotated files of the path, oldest first. Other
+// files in the directory are ignored, even if their names start alike.
+func (r *rotatingFile) rotatedFiles() ([]rotatedFile, error) {
+	dir, name := filepath.Dir(r.path), filepath.Base(r.path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, entry := range entries {
+		stamp := strings.TrimSuffix(entry.Name(), ".gz")
+		if !entry.Type().IsRegular() || !strings.HasPrefix(stamp, prefix) ||
+			!strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimPrefix(stamp, prefix), ext)
+		if len(stamp) < len(ROTATE_TIME_FORMAT) {
+			continue
+		}
+		start, err := time.Parse(ROTATE_TIME_FORMAT, stamp[:len(ROTATE_TIME_FORMAT)])
+		if err != nil {
+			continue
+		}
+		seq := 0
+		if suffix := stamp[len(ROTATE_TIME_FORMAT):]; suffix != "" {
+			if !strings.HasPrefix(suffix, "-") {
+				continue
+			}
+			seq, err = strconv.Atoi(suffix[1:])
+			if err != nil || suffix[1] < '1' || suffix[1] > '9' {
+				continue
+			}
+		}
+		files = append(files, rotatedFile{filepath.Join(dir, entry.Name()),
+			start, seq})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].start.Equal(files[j].start) {
+			return files[i].start.Before(files[j].start)
+		}
+		return files[i].seq < files[j].seq
+	})
+	return files, nil
+}
+
+// gzipFile replaces path by path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
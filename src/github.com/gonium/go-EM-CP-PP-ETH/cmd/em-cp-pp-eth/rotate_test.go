@@ -0,0 +1,232 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHeader = "time,value\n"
+
+var testDay = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// testRecord is a line of the test format, testHeader plus 23 bytes.
+func testRecord(t time.Time, value int) string {
+	return fmt.Sprintf("%s,%d\n", t.UTC().Format(time.RFC3339), value)
+}
+
+// openTestFile opens status.csv in dir with the test format.
+func openTestFile(t *testing.T, dir string, maxSize int64, every time.Duration,
+	compress bool, keep int) *rotatingFile {
+	t.Helper()
+	r, err := openRotatingFile(filepath.Join(dir, "status.csv"), maxSize,
+		every, compress, keep, testHeader,
+		func(firstLine string) bool { return firstLine == testHeader },
+		func(record string) (time.Time, bool) {
+			t, err := time.Parse(time.RFC3339, strings.SplitN(record, ",", 2)[0])
+			return t, err == nil
+		})
+	if err != nil {
+		t.Fatalf("openRotatingFile: %s", err.Error())
+	}
+	return r
+}
+
+// writeRecords writes a record per time, numbered from 1.
+func writeRecords(t *testing.T, r *rotatingFile, times ...time.Time) {
+	t.Helper()
+	for i, at := range times {
+		if err := r.Write([]byte(testRecord(at, i+1)), at); err != nil {
+			t.Fatalf("Write: %s", err.Error())
+		}
+	}
+}
+
+// listDir returns the names of the files in dir.
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkFile(t *testing.T, path string, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("%s holds\n%s\nwant\n%s", filepath.Base(path), data, want)
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	// Room for the header and two records
+	r := openTestFile(t, dir, int64(len(testHeader)+2*23), 24*time.Hour, false, 0)
+	var times []time.Time
+	for i := 0; i < 5; i++ {
+		times = append(times, testDay.Add(time.Duration(i)*time.Minute))
+	}
+	writeRecords(t, r, times...)
+	r.Close()
+
+	// Files of the same period are numbered
+	want := []string{"status-2024-05-01T00-00-00-1.csv",
+		"status-2024-05-01T00-00-00.csv", "status.csv"}
+	if got := listDir(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files %v, want %v", got, want)
+	}
+	checkFile(t, filepath.Join(dir, want[1]),
+		testHeader+testRecord(times[0], 1)+testRecord(times[1], 2))
+	checkFile(t, filepath.Join(dir, want[0]),
+		testHeader+testRecord(times[2], 3)+testRecord(times[3], 4))
+	checkFile(t, filepath.Join(dir, "status.csv"),
+		testHeader+testRecord(times[4], 5))
+}
+
+func TestRotatePeriod(t *testing.T) {
+	dir := t.TempDir()
+	r := openTestFile(t, dir, 0, time.Hour, false, 0)
+	before := testDay.Add(59*time.Minute + 59*time.Second)
+	after := testDay.Add(time.Hour)
+	writeRecords(t, r, testDay.Add(time.Minute), before, after)
+	r.Close()
+
+	want := []string{"status-2024-05-01T10-00-00.csv", "status.csv"}
+	if got := listDir(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files %v, want %v", got, want)
+	}
+	checkFile(t, filepath.Join(dir, want[0]),
+		testHeader+testRecord(testDay.Add(time.Minute), 1)+testRecord(before, 2))
+	checkFile(t, filepath.Join(dir, "status.csv"), testHeader+testRecord(after, 3))
+}
+
+func TestRotateResume(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+	r := openTestFile(t, dir, 0, 24*time.Hour, false, 0)
+	writeRecords(t, r, now)
+	r.Close()
+
+	// A file of the current period is continued
+	r = openTestFile(t, dir, 0, 24*time.Hour, false, 0)
+	if err := r.Write([]byte(testRecord(now, 2)), now); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if got := listDir(t, dir); !reflect.DeepEqual(got, []string{"status.csv"}) {
+		t.Fatalf("Files %v, want only status.csv", got)
+	}
+	checkFile(t, filepath.Join(dir, "status.csv"),
+		testHeader+testRecord(now, 1)+testRecord(now, 2))
+}
+
+func TestRotateOnOpen(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		// Modification time of the existing file, relative to now.
+		age time.Duration
+	}{
+		{"earlier period", testHeader + testRecord(testDay, 1), 48 * time.Hour},
+		{"other header", "time,value,unit\n" + testRecord(testDay, 1), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "status.csv")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			modified := time.Now().Add(-tc.age)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+			openTestFile(t, dir, 0, 24*time.Hour, false, 0).Close()
+
+			// The old file is named after the period of its first record
+			rotated := "status-2024-05-01T00-00-00.csv"
+			if got := listDir(t, dir); !reflect.DeepEqual(got, []string{rotated, "status.csv"}) {
+				t.Fatalf("Files %v, want %s and status.csv", got, rotated)
+			}
+			checkFile(t, filepath.Join(dir, rotated), tc.content)
+			checkFile(t, path, testHeader)
+		})
+	}
+}
+
+func TestRotateKeep(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"status-2024-05-01T00-00-00.csv.gz",
+		"status-2024-05-01T00-00-00-1.csv",
+		"status-2024-05-01T00-00-00-2.csv.gz",
+		"status-2024-05-02T00-00-00.csv.gz",
+		// Not rotated files of status.csv
+		"status-notes.csv",
+		"other-2024-04-01T00-00-00.csv",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := openTestFile(t, dir, 0, 24*time.Hour, false, 3)
+	day := testDay.Add(48 * time.Hour)
+	writeRecords(t, r, day, day.Add(24*time.Hour))
+	r.Close()
+
+	want := []string{
+		"other-2024-04-01T00-00-00.csv",
+		"status-2024-05-01T00-00-00-2.csv.gz",
+		"status-2024-05-02T00-00-00.csv.gz",
+		"status-2024-05-03T00-00-00.csv",
+		"status-notes.csv",
+		"status.csv",
+	}
+	if got := listDir(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("Files\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	r := openTestFile(t, dir, 0, time.Hour, true, 0)
+	writeRecords(t, r, testDay, testDay.Add(time.Hour))
+	r.Close()
+
+	rotated := "status-2024-05-01T10-00-00.csv.gz"
+	if got := listDir(t, dir); !reflect.DeepEqual(got, []string{rotated, "status.csv"}) {
+		t.Fatalf("Files %v, want %s and status.csv", got, rotated)
+	}
+	f, err := os.Open(filepath.Join(dir, rotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testHeader + testRecord(testDay, 1); string(data) != want {
+		t.Errorf("Compressed file holds\n%s\nwant\n%s", data, want)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/api"
+	"github.com/gonium/go-EM-CP-PP-ETH/dashboard"
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+)
+
+// runServe answers API requests until ctx is canceled. All requests
+// share one connection, which is opened again after errors, so the
+// server also starts while the controller is unreachable.
+func runServe(ctx context.Context) {
+	st, err := resolveStation()
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := st.handler()
+	if err := handler.Connect(); err != nil {
+		log.Printf("Failed to connect, retrying with every poll: %s",
+			err.Error())
+	}
+	defer handler.Close()
+	stats := EM_CP_PP_ETH.NewModbusStats()
+	client := EM_CP_PP_ETH.WithReconnect(
+		stats.Instrument(modbus.NewClient(handler)), handler)
+
+	name := st.Name
+	if name == "" {
+		name = st.Host
+	}
+	server := api.NewServer(client, name)
+	server.Commander = st.commander(client)
+	server.WebHost = st.WebAddress()
+	server.Reset = EM_CP_PP_ETH.ResetOptions{Connection: handler}
+	server.Timeout = st.CommandTimeout
+	server.Stats = stats
+	server.StreamInterval = *servestream
+	server.Token = *servetoken
+	server.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	if *servedatadir != "" {
+		data, err := store.Open(*servedatadir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data.Logger = server.Logger
+		server.Recorder, err = store.NewRecorder(data, name)
+		if err != nil {
+			log.Fatalf("Failed to resume session: %s", err.Error())
+		}
+		server.Recorder.SampleInterval = *servesample
+	}
+	go server.Run(ctx, *serveinterval)
+
+	mux := http.NewServeMux()
+	mux.Handle(api.API_PREFIX, server.Handler())
+	mux.Handle("/metrics", server.MetricsHandler())
+	mux.Handle("/", dashboard.Handler())
+	web := &http.Server{
+		Addr:    *servelisten,
+		Handler: mux,
+		// End the event streams on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		web.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Serving %s on %s", st.Address(), *servelisten)
+	err = web.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("API server failed: %s", err.Error())
+	}
+}
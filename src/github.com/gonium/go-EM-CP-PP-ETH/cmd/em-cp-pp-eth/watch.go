@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const (
+	ANSI_CLEAR   = "\x1b[H\x1b[2J"
+	ANSI_REVERSE = "\x1b[7m"
+	ANSI_RESET   = "\x1b[0m"
+	// Time stamps of the watch output.
+	WATCH_TIME_FORMAT = "2006-01-02 15:04:05"
+)
+
+// runWatch polls the controller over the open connection until ctx is
+// canceled. Each poll may take up to pollTimeout.
+func runWatch(ctx context.Context, cache *EM_CP_PP_ETH.StatusCache, url string,
+	pollTimeout time.Duration) {
+	terminal := isTerminal(os.Stdout)
+	ticker := time.NewTicker(*watchinterval)
+	defer ticker.Stop()
+	var lines map[string]string
+	var last EM_CP_PP_ETH.Snapshot
+	lastErr := ""
+	for first := true; ; first = false {
+		pollCtx, cancel := context.WithTimeout(ctx, pollTimeout)
+		cache.RefreshContext(pollCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		snapshot := cache.Snapshot()
+		if *watchchanges {
+			lastErr = printChanges(os.Stdout, first, last, snapshot, lastErr)
+		} else {
+			lines = redraw(os.Stdout, terminal, url, cache, snapshot, lines)
+		}
+		last = snapshot
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// redraw prints the status and highlights the lines that differ from
+// the previous output. Lines are matched by their label, the text
+// before the colon, so added fault lines do not shift the comparison.
+// It returns the printed lines by label.
+func redraw(out io.Writer, terminal bool, url string,
+	cache *EM_CP_PP_ETH.StatusCache, snapshot EM_CP_PP_ETH.Snapshot,
+	previous map[string]string) map[string]string {
+	var buf bytes.Buffer
+	cache.WriteFormattedStatus(&buf)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+	if terminal {
+		fmt.Fprint(out, ANSI_CLEAR)
+	} else if previous != nil {
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "Every %s: %s  %s\n", *watchinterval, url,
+		formatWatchTime(time.Now()))
+	if snapshot.Err != nil {
+		fmt.Fprintf(out, "Error: %s\n", snapshot.Err.Error())
+	}
+	if snapshot.Stale {
+		fmt.Fprintf(out, "Status is stale, last update %s\n",
+			formatWatchTime(snapshot.Time))
+	}
+	fmt.Fprintln(out)
+	printed := make(map[string]string)
+	for _, line := range lines {
+		label := strings.SplitN(line, ":", 2)[0]
+		printed[label] = line
+		changed := previous != nil && previous[label] != line
+		switch {
+		case terminal && changed:
+			fmt.Fprintf(out, "%s%s%s\n", ANSI_REVERSE, line, ANSI_RESET)
+		case terminal:
+			fmt.Fprintln(out, line)
+		case changed:
+			fmt.Fprintf(out, "* %s\n", line)
+		default:
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	return printed
+}
+
+// printChanges prints a line per transition between two snapshots and
+// reports failing polls once. It returns the error of the current poll.
+func printChanges(out io.Writer, first bool, last,
+	snapshot EM_CP_PP_ETH.Snapshot, lastErr string) string {
+	pollErr := ""
+	if snapshot.Err != nil {
+		pollErr = snapshot.Err.Error()
+	}
+	now := formatWatchTime(time.Now())
+	if pollErr != lastErr {
+		if pollErr != "" {
+			fmt.Fprintf(out, "%s Error: %s\n", now, pollErr)
+		} else {
+			fmt.Fprintf(out, "%s Polling recovered\n", now)
+		}
+	}
+	if snapshot.Time.IsZero() {
+		return pollErr
+	}
+	status := snapshot.Status
+	if first || last.Time.IsZero() {
+		fmt.Fprintf(out, "%s EV status %s (%s), errors: %s, available: %t\n",
+			formatWatchTime(snapshot.Time), status.EVStatus,
+			status.EVStatus.Description(), status.Errorcode,
+			status.ChargingEnabled)
+		return pollErr
+	}
+	for _, e := range EM_CP_PP_ETH.Diff(last.Status, status, snapshot.Time) {
+		fmt.Fprintf(out, "%s %s\n", formatWatchTime(e.Timestamp()), e)
+	}
+	return pollErr
+}
+
+func formatWatchTime(t time.Time) string {
+	return t.Format(WATCH_TIME_FORMAT)
+}
+
+// isTerminal reports whether f is a character device, so escape
+// sequences can be used.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
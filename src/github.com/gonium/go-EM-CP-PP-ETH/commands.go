@@ -3,16 +3,29 @@ package EM_CP_PP_ETH
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/goburrow/modbus"
 	"net/http"
-	"strings"
+	"net/http/httptrace"
+	"sync"
 	"time"
 )
 
+// ErrResetNotSent is returned by HTTPHardReset if the time budget ended
+// before the reset request was written to the web interface.
+var ErrResetNotSent = errors.New("Reset request was not sent")
+
 type Commander struct {
 	modbusClient modbus.Client
+	// Credentials of the web interface, if it is protected by basic
+	// authentication.
+	HTTPUser     string
+	HTTPPassword string
+	// Guard checks the charging current setpoints ActualChargingCurrent
+	// and DefaultChargingCurrent before they are written.
+	Guard CurrentGuard
 }
 
 func NewCommander(client modbus.Client) *Commander {
@@ -21,7 +34,19 @@ func NewCommander(client modbus.Client) *Commander {
 	}
 }
 
+// client returns the Modbus client bound to ctx.
+func (c *Commander) client(ctx context.Context) modbus.Client {
+	return WithContext(ctx, c.modbusClient)
+}
+
 func (c *Commander) HTTPHardReset(host string) error {
+	return c.HTTPHardResetContext(context.Background(), host)
+}
+
+// HTTPHardResetContext triggers a reset through the web interface of
+// the controller. The controller restarts without answering, so a
+// timeout after the request was written counts as success.
+func (c *Commander) HTTPHardResetContext(ctx context.Context, host string) error {
 	url := fmt.Sprintf("http://%s/config.html?reset=1", host)
 	tr := &http.Transport{
 		MaxIdleConns:          1,
@@ -30,91 +55,114 @@ func (c *Commander) HTTPHardReset(host string) error {
 
 		DisableCompression: true,
 	}
+	// The transport is not reused, close the connection of a reset
+	// that was answered.
+	defer tr.CloseIdleConnections()
 	client := &http.Client{
 		Transport: tr,
 		Timeout:   3 * time.Second,
 	}
-	req, err := http.NewRequest("GET", url, nil)
-	ctx, cancel := context.WithTimeout(context.Background(),
-		1*time.Second)
+	resetCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
-	req = req.WithContext(ctx)
+	req, err := http.NewRequestWithContext(resetCtx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create reset request: %s", err.Error())
+	}
+	if c.HTTPUser != "" {
+		req.SetBasicAuth(c.HTTPUser, c.HTTPPassword)
+	}
+	var mu sync.Mutex
+	wrote := false
+	req = req.WithContext(httptrace.WithClientTrace(resetCtx,
+		&httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				wrote = info.Err == nil
+			},
+		}))
 
 	resp, err := client.Do(req)
 	if err != nil {
+		mu.Lock()
+		sent := wrote
+		mu.Unlock()
 		// The EM-CP-PP-ETH does not return any response to our call.
 		// The client will be canceled. We need to check for this error
-		// and suppress it.
-		if strings.Contains(err.Error(), "context deadline exceeded") {
+		// and suppress it, unless the caller gave up first or the
+		// request never made it to the controller.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if errors.Is(err, context.DeadlineExceeded) && sent {
 			return nil
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %s", ErrResetNotSent, err.Error())
 		} else {
 			// This is unexpected, forward the error.
 			return err
 		}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Reset rejected by the web interface: %s", resp.Status)
+	}
 	return nil
 }
 
 func (c *Commander) ReadChargingEnabled() (result bool, err error) {
-	results, err := c.modbusClient.ReadCoils(402, 1)
-	if err != nil {
-		return false, err
-	}
-	if results[0] == 0 {
-		return false, nil
-	}
-	return true, nil
+	return c.ReadChargingEnabledContext(context.Background())
+}
+
+func (c *Commander) ReadChargingEnabledContext(ctx context.Context) (result bool, err error) {
+	return c.readCoil(ctx, COIL_CHARGING_ENABLED)
 }
 
 func (c *Commander) WriteChargingEnabled(newstate bool) (err error) {
-	var update uint16
-	update = 0x0000
-	if newstate {
-		update = 0xFF00
-	}
-	_, err = c.modbusClient.WriteSingleCoil(402, update)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.WriteChargingEnabledContext(context.Background(), newstate)
+}
+
+func (c *Commander) WriteChargingEnabledContext(ctx context.Context, newstate bool) (err error) {
+	return c.writeCoil(ctx, COIL_CHARGING_ENABLED, newstate)
 }
 
 func (c *Commander) ReadDigimodeEnabled() (result bool, err error) {
-	results, err := c.modbusClient.ReadCoils(401, 1)
-	if err != nil {
-		return false, err
-	}
-	if results[0] == 0 {
-		return false, nil
-	}
-	return true, nil
+	return c.ReadDigimodeEnabledContext(context.Background())
+}
+
+func (c *Commander) ReadDigimodeEnabledContext(ctx context.Context) (result bool, err error) {
+	return c.readCoil(ctx, COIL_DIGIMODE_ENABLED)
 }
 
 func (c *Commander) WriteDigimodeEnabled(newstate bool) (err error) {
-	var update uint16
-	update = 0x0000
-	if newstate {
-		update = 0xFF00
-	}
-	_, err = c.modbusClient.WriteSingleCoil(401, update)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.WriteDigimodeEnabledContext(context.Background(), newstate)
+}
+
+func (c *Commander) WriteDigimodeEnabledContext(ctx context.Context, newstate bool) (err error) {
+	return c.writeCoil(ctx, COIL_DIGIMODE_ENABLED, newstate)
 }
 
 func (c *Commander) ReadActualChargingCurrent() (result uint16, err error) {
-	results, err := c.modbusClient.ReadHoldingRegisters(300, 1)
-	if err != nil {
-		return 0, err
-	}
-	result = binary.BigEndian.Uint16(results)
-	return result, nil
+	return c.ReadActualChargingCurrentContext(context.Background())
+}
+
+func (c *Commander) ReadActualChargingCurrentContext(ctx context.Context) (result uint16, err error) {
+	return c.readHoldingRegister(ctx, HOLDING_ACTUAL_CHARGING_CURRENT)
 }
 
 func (c *Commander) WriteActualChargingCurrent(current uint16) (result uint16, err error) {
-	results, err := c.modbusClient.WriteSingleRegister(300, current)
+	return c.WriteActualChargingCurrentContext(context.Background(), current)
+}
+
+// WriteActualChargingCurrentContext checks the setpoint according to
+// c.Guard, writes it and returns the value confirmed by the controller.
+func (c *Commander) WriteActualChargingCurrentContext(ctx context.Context, current uint16) (result uint16, err error) {
+	current, err = c.guardCurrent(ctx, HOLDING_ACTUAL_CHARGING_CURRENT,
+		current)
+	if err != nil {
+		return 0, err
+	}
+	results, err := c.client(ctx).WriteSingleRegister(
+		HOLDING_ACTUAL_CHARGING_CURRENT, current)
 	if err != nil {
 		return 0, err
 	}
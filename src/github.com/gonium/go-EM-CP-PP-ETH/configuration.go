@@ -0,0 +1,246 @@
+package EM_CP_PP_ETH
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+const (
+	// Holding registers
+	HOLDING_ACTUAL_CHARGING_CURRENT  = 300
+	HOLDING_DEFAULT_CHARGING_CURRENT = 301
+	HOLDING_STATION_MAX_CURRENT      = 302
+
+	// Coils
+	COIL_DIGIMODE_ENABLED = 401
+	COIL_CHARGING_ENABLED = 402
+)
+
+// ConfigRegister describes a configuration setting held in a holding
+// register or a coil.
+type ConfigRegister struct {
+	// Name of the Configuration field.
+	Field   string
+	Address uint16
+	// Coil settings are booleans, all others are holding registers.
+	Coil bool
+	// Valid range of holding register values.
+	Min, Max uint16
+	Unit     string
+	// Initial value of the simulator, not a verified factory setting.
+	Default     uint16
+	Description string
+}
+
+// ConfigurationMap lists the settings of the controller this package
+// reads and writes. Other registers of the configuration space are left
+// out until their addresses and ranges are confirmed; use the raw
+// command to inspect them.
+var ConfigurationMap = []ConfigRegister{
+	{"ActualChargingCurrent", HOLDING_ACTUAL_CHARGING_CURRENT, false, 6, 80, "A", 16, "Charging current signaled to the vehicle"},
+	{"DefaultChargingCurrent", HOLDING_DEFAULT_CHARGING_CURRENT, false, 6, 80, "A", 16, "Charging current after a reset or power cycle"},
+	{"StationMaxCurrent", HOLDING_STATION_MAX_CURRENT, false, 6, 80, "A", 32, "Maximum current of the installation"},
+	{"DigimodeEnabled", COIL_DIGIMODE_ENABLED, true, 0, 1, "", 0, "Digital communication (5% duty cycle)"},
+	{"ChargingEnabled", COIL_CHARGING_ENABLED, true, 0, 1, "", 1, "Charging station available"},
+}
+
+// Configuration holds the settings of ConfigurationMap as returned by
+// Commander.ReadConfiguration.
+type Configuration struct {
+	ActualChargingCurrent  uint16
+	DefaultChargingCurrent uint16
+	StationMaxCurrent      uint16
+	DigimodeEnabled        bool
+	ChargingEnabled        bool
+}
+
+// LookupConfigRegister finds a setting by its field name, ignoring
+// case.
+func LookupConfigRegister(name string) (ConfigRegister, error) {
+	for _, r := range ConfigurationMap {
+		if strings.EqualFold(r.Field, name) {
+			return r, nil
+		}
+	}
+	return ConfigRegister{}, fmt.Errorf("Unknown setting '%s'", name)
+}
+
+// configRegister returns the map entry for address.
+func configRegister(address uint16, coil bool) ConfigRegister {
+	for _, r := range ConfigurationMap {
+		if r.Address == address && r.Coil == coil {
+			return r
+		}
+	}
+	panic(fmt.Sprintf("register %d is not part of the configuration map",
+		address))
+}
+
+// Check verifies that value is within the valid range of the setting.
+func (r ConfigRegister) Check(value uint16) error {
+	if value < r.Min || value > r.Max {
+		return fmt.Errorf("Invalid value %d for %s - must be between %d and %d",
+			value, r.Field, r.Min, r.Max)
+	}
+	return nil
+}
+
+// ReadConfigValue reads a single setting. Coils are returned as 0 or 1.
+func (c *Commander) ReadConfigValue(r ConfigRegister) (uint16, error) {
+	return c.ReadConfigValueContext(context.Background(), r)
+}
+
+func (c *Commander) ReadConfigValueContext(ctx context.Context, r ConfigRegister) (uint16, error) {
+	if r.Coil {
+		state, err := c.readCoil(ctx, r.Address)
+		if state {
+			return 1, err
+		}
+		return 0, err
+	}
+	return c.readHoldingRegister(ctx, r.Address)
+}
+
+// WriteConfigValue writes a single setting after checking its range.
+// Coils accept 0 and 1. The charging current settings are checked by
+// Commander.Guard instead, so they may be clamped or forced.
+func (c *Commander) WriteConfigValue(r ConfigRegister, value uint16) error {
+	return c.WriteConfigValueContext(context.Background(), r, value)
+}
+
+func (c *Commander) WriteConfigValueContext(ctx context.Context, r ConfigRegister, value uint16) error {
+	if r.Coil {
+		if err := r.Check(value); err != nil {
+			return err
+		}
+		return c.writeCoil(ctx, r.Address, value == 1)
+	}
+	return c.writeHoldingRegister(ctx, r.Address, value)
+}
+
+// ReadConfiguration reads all settings of the configuration map.
+func (c *Commander) ReadConfiguration() (config Configuration, err error) {
+	return c.ReadConfigurationContext(context.Background())
+}
+
+func (c *Commander) ReadConfigurationContext(ctx context.Context) (config Configuration, err error) {
+	target := reflect.ValueOf(&config).Elem()
+	for _, r := range ConfigurationMap {
+		value, err := c.ReadConfigValueContext(ctx, r)
+		if err != nil {
+			return config, fmt.Errorf("Failed to read %s: %w", r.Field, err)
+		}
+		field, err := structField(target, r.Field)
+		if err != nil {
+			return config, err
+		}
+		if field.Kind() == reflect.Bool {
+			field.SetBool(value == 1)
+		} else {
+			field.SetUint(uint64(value))
+		}
+	}
+	return config, nil
+}
+
+func (c *Commander) readHoldingRegister(ctx context.Context, address uint16) (uint16, error) {
+	results, err := c.client(ctx).ReadHoldingRegisters(address, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(results) != 2 {
+		return 0, fmt.Errorf("Invalid response length %d", len(results))
+	}
+	return binary.BigEndian.Uint16(results), nil
+}
+
+// writeHoldingRegister writes a setting. Charging current setpoints
+// are left to guardCurrent, which may clamp them or, with Force, write
+// them unchecked; other settings must be within their range.
+func (c *Commander) writeHoldingRegister(ctx context.Context, address, value uint16) error {
+	if address == HOLDING_ACTUAL_CHARGING_CURRENT ||
+		address == HOLDING_DEFAULT_CHARGING_CURRENT {
+		var err error
+		if value, err = c.guardCurrent(ctx, address, value); err != nil {
+			return err
+		}
+	} else if err := configRegister(address, false).Check(value); err != nil {
+		return err
+	}
+	_, err := c.client(ctx).WriteSingleRegister(address, value)
+	return err
+}
+
+func (c *Commander) readCoil(ctx context.Context, address uint16) (bool, error) {
+	results, err := c.client(ctx).ReadCoils(address, 1)
+	if err != nil {
+		return false, err
+	}
+	if len(results) != 1 {
+		return false, fmt.Errorf("Invalid response length %d", len(results))
+	}
+	return results[0]&1 != 0, nil
+}
+
+func (c *Commander) writeCoil(ctx context.Context, address uint16, state bool) error {
+	var update uint16
+	update = 0x0000
+	if state {
+		update = 0xFF00
+	}
+	_, err := c.client(ctx).WriteSingleCoil(address, update)
+	return err
+}
+
+// ReadDefaultChargingCurrent returns the charging current the
+// controller starts with after a reset.
+func (c *Commander) ReadDefaultChargingCurrent() (uint16, error) {
+	return c.ReadDefaultChargingCurrentContext(context.Background())
+}
+
+func (c *Commander) ReadDefaultChargingCurrentContext(ctx context.Context) (uint16, error) {
+	return c.readHoldingRegister(ctx, HOLDING_DEFAULT_CHARGING_CURRENT)
+}
+
+func (c *Commander) WriteDefaultChargingCurrent(current uint16) error {
+	return c.WriteDefaultChargingCurrentContext(context.Background(), current)
+}
+
+func (c *Commander) WriteDefaultChargingCurrentContext(ctx context.Context, current uint16) error {
+	return c.writeHoldingRegister(ctx, HOLDING_DEFAULT_CHARGING_CURRENT, current)
+}
+
+// ReadStationMaxCurrent returns the maximum current of the
+// installation.
+func (c *Commander) ReadStationMaxCurrent() (uint16, error) {
+	return c.ReadStationMaxCurrentContext(context.Background())
+}
+
+func (c *Commander) ReadStationMaxCurrentContext(ctx context.Context) (uint16, error) {
+	return c.readHoldingRegister(ctx, HOLDING_STATION_MAX_CURRENT)
+}
+
+func (c *Commander) WriteStationMaxCurrent(current uint16) error {
+	return c.WriteStationMaxCurrentContext(context.Background(), current)
+}
+
+func (c *Commander) WriteStationMaxCurrentContext(ctx context.Context, current uint16) error {
+	return c.writeHoldingRegister(ctx, HOLDING_STATION_MAX_CURRENT, current)
+}
+
+// WriteFormattedConfiguration prints all settings, one per line.
+func WriteFormattedConfiguration(out io.Writer, config Configuration) {
+	source := reflect.ValueOf(config)
+	for _, r := range ConfigurationMap {
+		field := source.FieldByName(r.Field)
+		unit := ""
+		if r.Unit != "" {
+			unit = " " + r.Unit
+		}
+		fmt.Fprintf(out, "%s: %v%s\n", r.Field, field.Interface(), unit)
+	}
+}
@@ -0,0 +1,175 @@
+package EM_CP_PP_ETH
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Lowest charging current IEC 61851-1 allows to signal on the control
+// pilot.
+const IEC_MIN_CHARGING_CURRENT = 6
+
+// CurrentLimits are the bounds a charging current setpoint must stay
+// within. Zero upper limits are unknown and not enforced. The maximum
+// currents L1MaxCurrent to L3MaxCurrent are peaks measured during the
+// charge sequence, not limits, and are left out.
+type CurrentLimits struct {
+	Min uint16
+	// Current carrying capacity of the plugged cable (ProximityCurrent),
+	// zero without a cable.
+	Cable uint16
+	// StationMaxCurrent of the installation.
+	Station uint16
+	// Additional limit of the caller, see CurrentGuard.MaxCurrent.
+	Configured uint16
+}
+
+// CurrentLimitError explains why a setpoint is unsafe. Limit is the
+// nearest safe value.
+type CurrentLimitError struct {
+	Requested uint16
+	Limit     uint16
+	Reason    string
+	// The setpoint was replaced by Limit instead of being rejected.
+	Clamped bool
+}
+
+func (e *CurrentLimitError) Error() string {
+	if e.Clamped {
+		return fmt.Sprintf("Charging current %d A %s, using %d A instead",
+			e.Requested, e.Reason, e.Limit)
+	}
+	return fmt.Sprintf("Charging current %d A rejected: %s", e.Requested,
+		e.Reason)
+}
+
+// ErrNoSafeCurrent is returned if the upper limits are below the
+// minimum, so no setpoint is safe.
+var ErrNoSafeCurrent = errors.New("No safe charging current, the limits are below the minimum")
+
+// upper returns the lowest known upper limit and its description.
+func (l CurrentLimits) upper() (uint16, string) {
+	limit, reason := uint16(0), ""
+	for _, candidate := range []struct {
+		value  uint16
+		reason string
+	}{
+		{l.Cable, "exceeds the cable rating of %d A (ProximityCurrent)"},
+		{l.Station, "exceeds the installation limit of %d A (StationMaxCurrent)"},
+		{l.Configured, "exceeds the configured limit of %d A"},
+	} {
+		if candidate.value != 0 && (limit == 0 || candidate.value < limit) {
+			limit = candidate.value
+			reason = fmt.Sprintf(candidate.reason, candidate.value)
+		}
+	}
+	return limit, reason
+}
+
+// ForDefaultCurrent returns the limits of DefaultChargingCurrent. It
+// only takes effect after the next reset, when another cable may be
+// plugged in, so the cable rating does not apply.
+func (l CurrentLimits) ForDefaultCurrent() CurrentLimits {
+	l.Cable = 0
+	return l
+}
+
+// Check returns a *CurrentLimitError if current is outside the limits.
+func (l CurrentLimits) Check(current uint16) error {
+	upper, reason := l.upper()
+	if upper != 0 && upper < l.Min {
+		return ErrNoSafeCurrent
+	}
+	if current < l.Min {
+		return &CurrentLimitError{current, l.Min, fmt.Sprintf(
+			"is below the IEC 61851 minimum of %d A", l.Min), false}
+	}
+	if upper != 0 && current > upper {
+		return &CurrentLimitError{current, upper, reason, false}
+	}
+	return nil
+}
+
+// Clamp returns the nearest safe value to current. The error explains
+// the adjustment and has Clamped set.
+func (l CurrentLimits) Clamp(current uint16) (uint16, error) {
+	err := l.Check(current)
+	var limitErr *CurrentLimitError
+	if !errors.As(err, &limitErr) {
+		return current, err
+	}
+	limitErr.Clamped = true
+	return limitErr.Limit, limitErr
+}
+
+// CurrentGuard decides how a Commander checks charging current
+// setpoints before writing them.
+type CurrentGuard struct {
+	// Write setpoints without checking them.
+	Force bool
+	// Replace unsafe setpoints by the nearest safe value instead of
+	// rejecting them.
+	Clamp bool
+	// Additional upper limit, i.e. the rating of the supply line. Zero
+	// leaves the limits of the controller.
+	MaxCurrent uint16
+	// OnClamp is called with the explanation of every clamped setpoint.
+	OnClamp func(*CurrentLimitError)
+}
+
+// CurrentLimits reads the limits a charging current setpoint is
+// checked against.
+func (c *Commander) CurrentLimits() (CurrentLimits, error) {
+	return c.CurrentLimitsContext(context.Background())
+}
+
+func (c *Commander) CurrentLimitsContext(ctx context.Context) (CurrentLimits, error) {
+	limits := CurrentLimits{
+		Min:        IEC_MIN_CHARGING_CURRENT,
+		Configured: c.Guard.MaxCurrent,
+	}
+	results, err := NewStatusCache(c.modbusClient).readInputRegisterStatus(ctx)
+	if err != nil {
+		return limits, err
+	}
+	var status Status
+	var stateErr *UnknownEVStateError
+	if err := parseInputRegisterStatus(results, &status); err != nil &&
+		!errors.As(err, &stateErr) {
+		return limits, err
+	}
+	limits.Cable = status.ProximityCurrent
+	limits.Station, err = c.readHoldingRegister(ctx, HOLDING_STATION_MAX_CURRENT)
+	if err != nil {
+		return limits, fmt.Errorf("Failed to read StationMaxCurrent: %w", err)
+	}
+	return limits, nil
+}
+
+// guardCurrent returns the setpoint to write to the holding register
+// address according to c.Guard.
+func (c *Commander) guardCurrent(ctx context.Context, address, current uint16) (uint16, error) {
+	if c.Guard.Force {
+		return current, nil
+	}
+	limits, err := c.CurrentLimitsContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read current limits: %w", err)
+	}
+	if address == HOLDING_DEFAULT_CHARGING_CURRENT {
+		limits = limits.ForDefaultCurrent()
+	}
+	if !c.Guard.Clamp {
+		return current, limits.Check(current)
+	}
+	allowed, err := limits.Clamp(current)
+	var limitErr *CurrentLimitError
+	if errors.As(err, &limitErr) {
+		if c.Guard.OnClamp != nil {
+			c.Guard.OnClamp(limitErr)
+		}
+		return allowed, nil
+	}
+	return allowed, err
+}
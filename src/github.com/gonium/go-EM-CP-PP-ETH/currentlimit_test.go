@@ -0,0 +1,74 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+func TestCurrentLimits(t *testing.T) {
+	cable := EM_CP_PP_ETH.CurrentLimits{Min: 6, Cable: 20, Station: 32}
+	for _, tc := range []struct {
+		name    string
+		limits  EM_CP_PP_ETH.CurrentLimits
+		current uint16
+		// Expected limit of the *CurrentLimitError, 0 for none, which
+		// is also the value Clamp returns.
+		limit uint16
+	}{
+		{"within limits", cable, 16, 0},
+		{"at the minimum", cable, 6, 0},
+		{"at the cable rating", cable, 20, 0},
+		{"below the minimum", cable, 5, 6},
+		{"zero", cable, 0, 6},
+		{"above the cable rating", cable, 21, 20},
+		{"without cable", EM_CP_PP_ETH.CurrentLimits{Min: 6, Station: 32}, 40, 32},
+		{"configured limit", EM_CP_PP_ETH.CurrentLimits{Min: 6, Cable: 20,
+			Station: 32, Configured: 10}, 12, 10},
+		{"no upper limits", EM_CP_PP_ETH.CurrentLimits{Min: 6}, 80, 0},
+		{"default current", cable.ForDefaultCurrent(), 25, 0},
+		{"default current above the installation", cable.ForDefaultCurrent(), 40, 32},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.Check(tc.current)
+			var limitErr *EM_CP_PP_ETH.CurrentLimitError
+			switch {
+			case tc.limit == 0 && err != nil:
+				t.Errorf("Check %d: %s", tc.current, err.Error())
+			case tc.limit != 0 && !errors.As(err, &limitErr):
+				t.Errorf("Check %d: got %v, want a *CurrentLimitError", tc.current, err)
+			case tc.limit != 0 && (limitErr.Limit != tc.limit ||
+				limitErr.Requested != tc.current || limitErr.Clamped):
+				t.Errorf("Check %d: got %+v, want the limit %d", tc.current,
+					*limitErr, tc.limit)
+			}
+
+			want := tc.current
+			if tc.limit != 0 {
+				want = tc.limit
+			}
+			got, err := tc.limits.Clamp(tc.current)
+			if got != want {
+				t.Errorf("Clamp %d returned %d, want %d", tc.current, got, want)
+			}
+			switch {
+			case tc.limit == 0 && err != nil:
+				t.Errorf("Clamp %d: %s", tc.current, err.Error())
+			case tc.limit != 0 && (!errors.As(err, &limitErr) || !limitErr.Clamped):
+				t.Errorf("Clamp %d: got %v, want a clamped *CurrentLimitError",
+					tc.current, err)
+			}
+		})
+	}
+}
+
+func TestNoSafeCurrent(t *testing.T) {
+	limits := EM_CP_PP_ETH.CurrentLimits{Min: 6, Cable: 20, Configured: 5}
+	if err := limits.Check(5); !errors.Is(err, EM_CP_PP_ETH.ErrNoSafeCurrent) {
+		t.Errorf("Check returned %v, want ErrNoSafeCurrent", err)
+	}
+	if _, err := limits.Clamp(10); !errors.Is(err, EM_CP_PP_ETH.ErrNoSafeCurrent) {
+		t.Errorf("Clamp returned %v, want ErrNoSafeCurrent", err)
+	}
+}
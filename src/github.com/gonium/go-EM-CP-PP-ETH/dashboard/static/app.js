@@ -0,0 +1,316 @@
+// Dashboard of em-cp-pp-eth serve. Live values arrive over the event
+// stream, the controls use the REST API.
+"use strict";
+
+const API = "api/v1/";
+const HISTORY_RANGE = 60 * 60 * 1000;
+const TOKEN_KEY = "em-cp-pp-eth-token";
+
+let recent = [];
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function token() {
+  return localStorage.getItem(TOKEN_KEY) || "";
+}
+
+// api calls the REST API. If the server requires a token, the user is
+// asked for it once and it is kept in the local storage.
+async function api(path, options = {}, retry = true) {
+  options.headers = Object.assign({}, options.headers);
+  if (token()) {
+    options.headers["Authorization"] = "Bearer " + token();
+  }
+  const response = await fetch(API + path, options);
+  if (response.status === 401 && retry) {
+    const entered = prompt("API token");
+    if (entered) {
+      localStorage.setItem(TOKEN_KEY, entered);
+      return api(path, options, false);
+    }
+  }
+  const doc = await response.json();
+  if (!response.ok) {
+    throw new Error(doc.error || response.statusText);
+  }
+  return doc;
+}
+
+function put(path, value) {
+  return api(path, {
+    method: "PUT",
+    headers: {"Content-Type": "application/json"},
+    body: JSON.stringify({value: value}),
+  });
+}
+
+function format(quantity, digits) {
+  if (!quantity) {
+    return "–";
+  }
+  const unit = quantity.unit ? " " + quantity.unit : "";
+  return quantity.value.toFixed(digits) + unit;
+}
+
+function showStatus(doc) {
+  const v = doc.values;
+  const badge = $("connection");
+  badge.textContent = doc.stale ? "stale" : "live";
+  badge.className = "badge " + (doc.stale ? "stale" : "live");
+  $("updated").textContent = doc.error ?
+    "Poll failed: " + doc.error :
+    "Updated " + new Date(doc.time).toLocaleTimeString();
+
+  const state = $("ev-state");
+  state.textContent = doc.ev_state.state;
+  state.className = doc.ev_state.charging ? "charging" :
+    (["E", "F"].includes(doc.ev_state.state) ? "fault" : "");
+  $("ev-description").textContent = doc.ev_state.description;
+  $("proximity-current").textContent = doc.ev_state.vehicle_connected ?
+    format(v.proximity_current, 0) : "–";
+  $("charge-time").textContent = doc.ev_state.vehicle_connected ?
+    v.charge_time_hours.value + " h " + v.charge_time_minutes.value + " min" :
+    "–";
+
+  const power = v.active_power ? v.active_power.value : 0;
+  $("active-power").textContent = (power / 1000).toFixed(2) + " kW";
+  $("energy").textContent = format(v.energy, 2);
+  $("frequency").textContent = format(v.frequency, 2);
+  $("power-factor").textContent = format(v.power_factor, 2);
+  for (const phase of ["l1", "l2", "l3"]) {
+    $(phase + "-voltage").textContent = format(v[phase + "_voltage"], 1);
+    $(phase + "-current").textContent = format(v[phase + "_current"], 2);
+  }
+
+  const faults = $("faults");
+  faults.replaceChildren();
+  if (doc.errors.faults.length === 0) {
+    const item = document.createElement("li");
+    item.className = "ok";
+    item.textContent = "none";
+    faults.appendChild(item);
+  }
+  for (const f of doc.errors.faults) {
+    const item = document.createElement("li");
+    item.className = f.severity;
+    item.textContent = f.name + ": " + f.description;
+    item.title = f.action;
+    faults.appendChild(item);
+  }
+
+  if (document.activeElement !== $("availability")) {
+    $("availability").checked = doc.charging_enabled;
+  }
+  addSample({
+    time: doc.time,
+    active_power_w: power,
+    currents_a: ["l1", "l2", "l3"].map((p) => v[p + "_current"].value),
+  });
+}
+
+async function showSessions() {
+  try {
+    const doc = await api("sessions?from=" +
+      encodeURIComponent(new Date().toISOString()));
+    $("session-energy").textContent = doc.active ?
+      doc.active.energy_kwh.toFixed(2) + " kWh" : "–";
+  } catch (err) {
+    $("session-energy").textContent = "–";
+  }
+}
+
+async function showSettings() {
+  try {
+    const current = await api("current");
+    if (document.activeElement !== $("current")) {
+      $("current").value = current.value;
+    }
+    const digimode = await api("digimode");
+    $("digimode").checked = digimode.value;
+  } catch (err) {
+    message(err.message, true);
+  }
+}
+
+function message(text, error) {
+  const p = $("control-message");
+  p.textContent = text;
+  p.className = "message" + (error ? " error" : "");
+}
+
+function addSample(sample) {
+  const last = recent[recent.length - 1];
+  if (last && new Date(sample.time) <= new Date(last.time)) {
+    return;
+  }
+  recent.push(sample);
+  const start = Date.now() - HISTORY_RANGE;
+  while (recent.length && new Date(recent[0].time) < start) {
+    recent.shift();
+  }
+  drawChart();
+}
+
+async function loadHistory() {
+  try {
+    const doc = await api("history");
+    recent = doc.samples.concat(recent.filter((s) =>
+      !doc.samples.length ||
+      new Date(s.time) > new Date(doc.samples[doc.samples.length - 1].time)));
+    drawChart();
+  } catch (err) {
+    console.log("History unavailable: " + err.message);
+  }
+}
+
+// drawChart plots the power (kW, left axis) and the phase currents (A,
+// right axis) of the last hour.
+function drawChart() {
+  const canvas = $("chart");
+  const ratio = window.devicePixelRatio || 1;
+  const width = canvas.clientWidth;
+  const height = canvas.clientHeight;
+  canvas.width = width * ratio;
+  canvas.height = height * ratio;
+  const ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  ctx.clearRect(0, 0, width, height);
+
+  const style = getComputedStyle(document.documentElement);
+  const color = (name) => style.getPropertyValue(name).trim();
+  const pad = {left: 48, right: 40, top: 10, bottom: 24};
+  const plotWidth = width - pad.left - pad.right;
+  const plotHeight = height - pad.top - pad.bottom;
+  const end = Date.now();
+  const start = end - HISTORY_RANGE;
+
+  let maxPower = 1;
+  let maxCurrent = 6;
+  for (const s of recent) {
+    maxPower = Math.max(maxPower, s.active_power_w / 1000);
+    maxCurrent = Math.max(maxCurrent, ...s.currents_a);
+  }
+  maxPower = Math.ceil(maxPower);
+  maxCurrent = Math.ceil(maxCurrent / 4) * 4;
+
+  const x = (t) => pad.left + (new Date(t) - start) / HISTORY_RANGE * plotWidth;
+  const y = (value, max) => pad.top + plotHeight - value / max * plotHeight;
+
+  ctx.font = "11px system-ui, sans-serif";
+  ctx.fillStyle = color("--muted");
+  ctx.strokeStyle = "#e3e6e8";
+  ctx.lineWidth = 1;
+  for (let i = 0; i <= 4; i++) {
+    const py = pad.top + plotHeight * i / 4;
+    ctx.beginPath();
+    ctx.moveTo(pad.left, py);
+    ctx.lineTo(pad.left + plotWidth, py);
+    ctx.stroke();
+    ctx.textAlign = "right";
+    ctx.fillText((maxPower * (4 - i) / 4).toFixed(1) + " kW", pad.left - 6, py + 4);
+    ctx.textAlign = "left";
+    ctx.fillText((maxCurrent * (4 - i) / 4).toFixed(0) + " A",
+      pad.left + plotWidth + 6, py + 4);
+  }
+  ctx.textAlign = "center";
+  for (let minutes = 60; minutes >= 0; minutes -= 15) {
+    const t = end - minutes * 60 * 1000;
+    ctx.fillText(minutes ? "-" + minutes + " min" : "now", x(t), height - 6);
+  }
+
+  const line = (value, max, stroke, lineWidth) => {
+    ctx.strokeStyle = stroke;
+    ctx.lineWidth = lineWidth;
+    ctx.beginPath();
+    recent.forEach((s, i) => {
+      const px = x(s.time);
+      const py = y(value(s), max);
+      if (i === 0) {
+        ctx.moveTo(px, py);
+      } else {
+        ctx.lineTo(px, py);
+      }
+    });
+    ctx.stroke();
+  };
+  ["--l1", "--l2", "--l3"].forEach((name, phase) => {
+    line((s) => s.currents_a[phase], maxCurrent, color(name), 1);
+  });
+  line((s) => s.active_power_w / 1000, maxPower, color("--power"), 2);
+}
+
+function connect() {
+  let url = API + "events?types=status,ev_state,availability,session";
+  if (token()) {
+    url += "&access_token=" + encodeURIComponent(token());
+  }
+  const events = new EventSource(url);
+  events.addEventListener("status", (e) => showStatus(JSON.parse(e.data)));
+  events.addEventListener("session", showSessions);
+  events.addEventListener("availability", (e) => {
+    $("availability").checked = JSON.parse(e.data).new;
+  });
+  events.onerror = () => {
+    const badge = $("connection");
+    badge.textContent = "offline";
+    badge.className = "badge offline";
+  };
+}
+
+$("availability").addEventListener("change", async (e) => {
+  const state = e.target.checked;
+  try {
+    await put("availability", state);
+    message(state ? "Station available" : "Station unavailable", false);
+  } catch (err) {
+    e.target.checked = !state;
+    message(err.message, true);
+  }
+});
+
+$("digimode").addEventListener("change", async (e) => {
+  const state = e.target.checked;
+  try {
+    await put("digimode", state);
+    message("Digital communication " + (state ? "enabled" : "disabled"), false);
+  } catch (err) {
+    e.target.checked = !state;
+    message(err.message, true);
+  }
+});
+
+$("current-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const requested = parseInt($("current").value, 10);
+  try {
+    const doc = await put("current", requested);
+    $("current").value = doc.value;
+    message(doc.value === requested ?
+      "Charging current set to " + doc.value + " A" :
+      "Charging current limited to " + doc.value + " A", false);
+  } catch (err) {
+    message(err.message, true);
+  }
+});
+
+window.addEventListener("resize", drawChart);
+
+async function start() {
+  // The first request asks for the token if one is needed, before the
+  // event stream is opened with it.
+  try {
+    showStatus(await api("status"));
+  } catch (err) {
+    message(err.message, true);
+  }
+  await loadHistory();
+  showSessions();
+  showSettings();
+  connect();
+  setInterval(showSessions, 60 * 1000);
+  setInterval(drawChart, 60 * 1000);
+}
+
+start();
@@ -0,0 +1,280 @@
+package EM_CP_PP_ETH
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// STATUS_SCHEMA identifies the layout of StatusDocument. It changes
+// only if fields are renamed or removed; new fields may be added.
+const STATUS_SCHEMA = "em-cp-pp-eth/status/v1"
+
+// Quantity is a measured value with its physical unit.
+type Quantity struct {
+	Value float64 `json:"value" yaml:"value"`
+	Unit  string  `json:"unit,omitempty" yaml:"unit,omitempty"`
+}
+
+// StatusDocument is the machine-readable form of a status snapshot, as
+// printed by "status --output json".
+type StatusDocument struct {
+	Schema string    `json:"schema" yaml:"schema"`
+	Time   time.Time `json:"time" yaml:"time"`
+	Stale  bool      `json:"stale" yaml:"stale"`
+	// Error of the refresh, empty if it succeeded.
+	Error           string          `json:"error,omitempty" yaml:"error,omitempty"`
+	EVState         EVStateDocument `json:"ev_state" yaml:"ev_state"`
+	Errors          ErrorsDocument  `json:"errors" yaml:"errors"`
+	ChargingEnabled bool            `json:"charging_enabled" yaml:"charging_enabled"`
+	// All numeric input registers, keyed by the snake case name of the
+	// register map field, i.e. "l1_voltage".
+	Values         map[string]Quantity `json:"values" yaml:"values"`
+	DigitalInputs  map[string]bool     `json:"digital_inputs" yaml:"digital_inputs"`
+	DigitalOutputs map[string]bool     `json:"digital_outputs" yaml:"digital_outputs"`
+}
+
+type EVStateDocument struct {
+	State            string `json:"state" yaml:"state"`
+	Description      string `json:"description" yaml:"description"`
+	VehicleConnected bool   `json:"vehicle_connected" yaml:"vehicle_connected"`
+	Charging         bool   `json:"charging" yaml:"charging"`
+}
+
+type ErrorsDocument struct {
+	Code   uint16          `json:"code" yaml:"code"`
+	Faults []FaultDocument `json:"faults" yaml:"faults"`
+}
+
+type FaultDocument struct {
+	Name        string `json:"name" yaml:"name"`
+	Severity    string `json:"severity" yaml:"severity"`
+	Description string `json:"description" yaml:"description"`
+	Action      string `json:"action" yaml:"action"`
+}
+
+// NewStatusDocument converts a snapshot into its document form.
+func NewStatusDocument(snapshot Snapshot) StatusDocument {
+	s := snapshot.Status
+	doc := StatusDocument{
+		Schema: STATUS_SCHEMA,
+		Time:   snapshot.Time,
+		Stale:  snapshot.Stale,
+		EVState: EVStateDocument{
+			State:            s.EVStatus.String(),
+			Description:      s.EVStatus.Description(),
+			VehicleConnected: s.EVStatus.VehicleConnected(),
+			Charging:         s.EVStatus.Charging(),
+		},
+		Errors: ErrorsDocument{
+			Code:   uint16(s.Errorcode),
+			Faults: []FaultDocument{},
+		},
+		ChargingEnabled: s.ChargingEnabled,
+		Values:          make(map[string]Quantity),
+		DigitalInputs:   make(map[string]bool),
+		DigitalOutputs:  make(map[string]bool),
+	}
+	if snapshot.Err != nil {
+		doc.Error = snapshot.Err.Error()
+	}
+	for _, f := range s.Errorcode.Faults() {
+		doc.Errors.Faults = append(doc.Errors.Faults, FaultDocument{
+			Name:        f.Name,
+			Severity:    f.Severity.String(),
+			Description: f.Description,
+			Action:      f.Action,
+		})
+	}
+	source := reflect.ValueOf(&s).Elem()
+	for _, r := range StatusRegisters() {
+		field, err := structField(source, r.Field)
+		if err != nil {
+			continue
+		}
+		if field.Type().PkgPath() != "" {
+			// Named types such as the vehicle state and the error code
+			// have their own sections.
+			continue
+		}
+		var value float64
+		switch field.Kind() {
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value = float64(field.Uint())
+		case reflect.Float32:
+			value = Float32Value(float32(field.Float()))
+		case reflect.Float64:
+			value = field.Float()
+		default:
+			continue
+		}
+		doc.Values[SnakeCase(r.Field)] = Quantity{Value: value, Unit: r.Unit}
+	}
+	for _, d := range DiscreteInputMap {
+		field, err := structField(source, d.Field)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(d.Field, ".")
+		name := parts[len(parts)-1]
+		if parts[0] == "DigitalOutputStates" {
+			doc.DigitalOutputs[name] = field.Bool()
+		} else {
+			doc.DigitalInputs[name] = field.Bool()
+		}
+	}
+	return doc
+}
+
+// Float32Value converts a register value to the float64 of its shortest
+// decimal, 230.01 instead of 230.00999450683594.
+func Float32Value(value float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return v
+}
+
+// SnakeCase converts a Go field name such as "L1Voltage" or
+// "DIPConfiguration" into "l1_voltage" and "dip_configuration".
+func SnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) ||
+				(unicode.IsUpper(previous) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// VALUE_SCHEMA identifies the layout of ValueDocument.
+const VALUE_SCHEMA = "em-cp-pp-eth/value/v1"
+
+// ValueDocument is the machine-readable form of a single setting, as
+// printed by "current get --output json".
+type ValueDocument struct {
+	Schema string      `json:"schema" yaml:"schema"`
+	Time   time.Time   `json:"time" yaml:"time"`
+	Name   string      `json:"name" yaml:"name"`
+	Value  interface{} `json:"value" yaml:"value"`
+	Unit   string      `json:"unit,omitempty" yaml:"unit,omitempty"`
+}
+
+// NewValueDocument describes the value of the configuration setting r,
+// read at time t.
+func NewValueDocument(r ConfigRegister, value interface{}, t time.Time) ValueDocument {
+	return ValueDocument{
+		Schema: VALUE_SCHEMA,
+		Time:   t,
+		Name:   SnakeCase(r.Field),
+		Value:  value,
+		Unit:   r.Unit,
+	}
+}
+
+// Types of the event documents.
+const (
+	EVENT_EV_STATE     = "ev_state"
+	EVENT_ERROR        = "error"
+	EVENT_AVAILABILITY = "availability"
+	EVENT_IO           = "io"
+	EVENT_SESSION      = "session"
+	// Events without a document of their own.
+	EVENT_OTHER = "other"
+)
+
+type EVStateEventDocument struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Old         string    `json:"old"`
+	New         string    `json:"new"`
+	Description string    `json:"description"`
+}
+
+type ErrorEventDocument struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// "raised" or "cleared"
+	Change string        `json:"change"`
+	Fault  FaultDocument `json:"fault"`
+	// The complete error code after the change.
+	Code uint16 `json:"code"`
+}
+
+type AvailabilityEventDocument struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Old  bool      `json:"old"`
+	New  bool      `json:"new"`
+}
+
+type IOEventDocument struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Output bool      `json:"output"`
+	Old    bool      `json:"old"`
+	New    bool      `json:"new"`
+}
+
+type SessionEventDocument struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// "started" or "ended"
+	Change  string  `json:"change"`
+	Session Session `json:"session"`
+}
+
+// GenericEventDocument describes an event NewEventDocument has no
+// document for.
+type GenericEventDocument struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Description string    `json:"description"`
+}
+
+// NewEventDocument converts an event into its document form. It
+// returns the type of the document, one of the EVENT_ constants, which
+// is also stored in its type field. Unknown events become a
+// GenericEventDocument of type EVENT_OTHER.
+func NewEventDocument(e Event) (string, interface{}) {
+	switch e := e.(type) {
+	case EVStateEvent:
+		return EVENT_EV_STATE, EVStateEventDocument{EVENT_EV_STATE, e.Time,
+			e.Old.String(), e.New.String(), e.New.Description()}
+	case ErrorEvent:
+		change := "cleared"
+		if e.Set {
+			change = "raised"
+		}
+		return EVENT_ERROR, ErrorEventDocument{EVENT_ERROR, e.Time, change,
+			FaultDocument{
+				Name:        e.Fault.Name,
+				Severity:    e.Fault.Severity.String(),
+				Description: e.Fault.Description,
+				Action:      e.Fault.Action,
+			}, uint16(e.New)}
+	case AvailabilityEvent:
+		return EVENT_AVAILABILITY, AvailabilityEventDocument{
+			EVENT_AVAILABILITY, e.Time, e.Old, e.New}
+	case IOEvent:
+		return EVENT_IO, IOEventDocument{EVENT_IO, e.Time, e.Name, e.Output,
+			e.Old, e.New}
+	case SessionEvent:
+		change := "ended"
+		if e.Started {
+			change = "started"
+		}
+		return EVENT_SESSION, SessionEventDocument{EVENT_SESSION, e.Time,
+			change, e.Session}
+	}
+	return EVENT_OTHER, GenericEventDocument{EVENT_OTHER, e.Timestamp(),
+		e.String()}
+}
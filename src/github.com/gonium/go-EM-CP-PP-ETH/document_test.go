@@ -0,0 +1,111 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, got\n%s", path, got)
+	}
+}
+
+func TestStatusDocumentGolden(t *testing.T) {
+	snapshot := EM_CP_PP_ETH.Snapshot{
+		Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Status: EM_CP_PP_ETH.Status{
+			EVStatus:              EM_CP_PP_ETH.EVStateC,
+			ProximityCurrent:      32,
+			ChargeTimeMinutes:     12,
+			ChargeTimeHours:       1,
+			DIPConfiguration:      5,
+			FirmwareVersion:       0x00010002,
+			Errorcode:             EM_CP_PP_ETH.ERROR_CABLE_13A | 1<<14,
+			L1Voltage:             230.01,
+			L2Voltage:             229.5,
+			L3Voltage:             231,
+			L1Current:             15.9,
+			L2Current:             16,
+			L3Current:             16.1,
+			ActivePower:           10950,
+			ReactivePower:         120,
+			ApparentPower:         11000,
+			PowerFactor:           0.99,
+			Energy:                1234.5,
+			MaxPower:              11040,
+			CurrentChargePower:    12.5,
+			Frequency:             50,
+			L1MaxCurrent:          16,
+			L2MaxCurrent:          16,
+			L3MaxCurrent:          16,
+			OverCurrentProtection: 1,
+			DigitalInputStates:    EM_CP_PP_ETH.DigiInputs{EN: true, ML: true},
+			DigitalOutputStates:   EM_CP_PP_ETH.DigiOutputs{CR: true},
+			ChargingEnabled:       true,
+		},
+		Stale: true,
+		Err:   errors.New("Modbus com error"),
+	}
+	doc := EM_CP_PP_ETH.NewStatusDocument(snapshot)
+	if doc.Schema != "em-cp-pp-eth/status/v1" {
+		t.Errorf("Schema %s, want em-cp-pp-eth/status/v1", doc.Schema)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "status.json", append(data, '\n'))
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"L1Voltage":             "l1_voltage",
+		"DIPConfiguration":      "dip_configuration",
+		"EVStatus":              "ev_status",
+		"FirmwareVersion":       "firmware_version",
+		"OverCurrentProtection": "over_current_protection",
+		"Energy":                "energy",
+	} {
+		if got := EM_CP_PP_ETH.SnakeCase(name); got != want {
+			t.Errorf("SnakeCase(%s) returned %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestFloat32Value(t *testing.T) {
+	for value, want := range map[float32]float64{
+		230.01: 230.01,
+		0.95:   0.95,
+		-1.5:   -1.5,
+		16:     16,
+	} {
+		if got := EM_CP_PP_ETH.Float32Value(value); got != want {
+			t.Errorf("Float32Value(%v) returned %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package EM_CP_PP_ETH
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+const (
+	ERROR_CABLE_13A_20A     = 1 << 0
+	ERROR_CABLE_13A         = 1 << 1
+	ERROR_INVALID_PP        = 1 << 2
+	ERROR_INVALID_CP        = 1 << 3
+	ERROR_STATE_F           = 1 << 4
+	ERROR_LOCKING           = 1 << 5
+	ERROR_UNLOCKING         = 1 << 6
+	ERROR_LD_FAILURE        = 1 << 7
+	ERROR_OVERCURRENT       = 1 << 8
+	ERROR_COM_MEASUREMENT   = 1 << 9
+	ERROR_STATE_D_REJECTED  = 1 << 10
+	ERROR_CONTACTOR_FAILURE = 1 << 11
+	ERROR_CP_NO_DIODE       = 1 << 12
+)
+
+// Severity tells whether a fault prevents charging.
+type Severity int
+
+const (
+	// Charging continues, possibly with reduced current.
+	SeverityWarning Severity = iota
+	// Charging is not possible until the fault is cleared.
+	SeverityBlocking
+	// The bit is not documented, so its effect is not known. It is not
+	// counted as blocking: the vehicle state and the availability tell
+	// whether charging is possible.
+	SeverityUnknown
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityBlocking:
+		return "blocking"
+	case SeverityUnknown:
+		return "unknown"
+	}
+	return "warning"
+}
+
+// Fault describes a single bit of the error code register. The
+// predefined faults are sentinel errors: use errors.Is on the result
+// of Errorcode.Err to check for a specific one.
+type Fault struct {
+	Mask        uint16
+	Name        string
+	Description string
+	Severity    Severity
+	Action      string
+}
+
+func (f *Fault) Error() string {
+	return f.Description
+}
+
+var (
+	ErrCable13A20A = &Fault{ERROR_CABLE_13A_20A, "Cable13A_20A",
+		"Cable rated 13 A or 20 A, charging current is limited",
+		SeverityWarning, "Use a cable with a higher current rating for full charging power"}
+	ErrCable13A = &Fault{ERROR_CABLE_13A, "Cable13A",
+		"Cable rated 13 A, charging current is limited",
+		SeverityWarning, "Use a cable with a higher current rating for full charging power"}
+	ErrInvalidPP = &Fault{ERROR_INVALID_PP, "InvalidPP",
+		"Invalid proximity pilot (PP) resistance, cable not recognized",
+		SeverityBlocking, "Check the cable and replug it at both ends"}
+	ErrInvalidCP = &Fault{ERROR_INVALID_CP, "InvalidCP",
+		"Invalid control pilot (CP) signal",
+		SeverityBlocking, "Check the vehicle connection and the CP wiring"}
+	ErrStateF = &Fault{ERROR_STATE_F, "StateF",
+		"Charging station not available (state F)",
+		SeverityBlocking, "Check the other active faults and reset the controller"}
+	ErrLocking = &Fault{ERROR_LOCKING, "Locking",
+		"The plug could not be locked",
+		SeverityBlocking, "Make sure the plug is fully inserted and check the locking actuator"}
+	ErrUnlocking = &Fault{ERROR_UNLOCKING, "Unlocking",
+		"The plug could not be unlocked",
+		SeverityBlocking, "Check the locking actuator, use the emergency release if needed"}
+	ErrFailureLD = &Fault{ERROR_LD_FAILURE, "FailureLD",
+		"Locking detection (input LD) reports an implausible state",
+		SeverityBlocking, "Check the wiring of the locking detection"}
+	ErrOvercurrent = &Fault{ERROR_OVERCURRENT, "Overcurrent",
+		"The vehicle draws more current than signaled",
+		SeverityBlocking, "Replug the vehicle; if it persists, have the on-board charger checked"}
+	ErrComMeasurement = &Fault{ERROR_COM_MEASUREMENT, "ComMeasurementFailure",
+		"Communication with the energy meter failed",
+		SeverityWarning, "Check the meter wiring and the meter selection"}
+	ErrRejectedStateD = &Fault{ERROR_STATE_D_REJECTED, "RejectedStateD",
+		"The vehicle requires ventilation (state D), which is not allowed",
+		SeverityBlocking, "Enable charging in state D if the location is ventilated"}
+	ErrContactorFailure = &Fault{ERROR_CONTACTOR_FAILURE, "ContactorFailure",
+		"Contactor failure, the contactor is welded or does not close",
+		SeverityBlocking, "Disconnect the station from the grid and have the contactor checked by an electrician"}
+	ErrCPNoDiode = &Fault{ERROR_CP_NO_DIODE, "CPNoDiode",
+		"No diode detected in the control pilot circuit of the vehicle",
+		SeverityBlocking, "Check the vehicle inlet or the test adapter"}
+)
+
+// Faults lists all documented bits of the error code register.
+var Faults = []*Fault{
+	ErrCable13A20A,
+	ErrCable13A,
+	ErrInvalidPP,
+	ErrInvalidCP,
+	ErrStateF,
+	ErrLocking,
+	ErrUnlocking,
+	ErrFailureLD,
+	ErrOvercurrent,
+	ErrComMeasurement,
+	ErrRejectedStateD,
+	ErrContactorFailure,
+	ErrCPNoDiode,
+}
+
+// LookupFault finds a documented fault by name, ignoring case.
+func LookupFault(name string) (*Fault, error) {
+	for _, f := range Faults {
+		if strings.EqualFold(f.Name, name) {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown fault '%s'", name)
+}
+
+// Errorcode is the raw content of the error code register. Bits that
+// are not documented, for example from newer firmware, are kept.
+type Errorcode uint16
+
+// OK reports whether no error bit is set.
+func (e Errorcode) OK() bool {
+	return e == 0
+}
+
+// Has reports whether the bit of f is set.
+func (e Errorcode) Has(f *Fault) bool {
+	return uint16(e)&f.Mask != 0
+}
+
+// Unknown returns the bits that are set but not documented.
+func (e Errorcode) Unknown() uint16 {
+	known := uint16(0)
+	for _, f := range Faults {
+		known |= f.Mask
+	}
+	return uint16(e) &^ known
+}
+
+// Faults returns the active faults, in bit order. Undocumented bits
+// are reported as faults named "Bit<n>" with SeverityUnknown.
+func (e Errorcode) Faults() []*Fault {
+	var active []*Fault
+	for _, f := range Faults {
+		if e.Has(f) {
+			active = append(active, f)
+		}
+	}
+	unknown := e.Unknown()
+	for unknown != 0 {
+		bit := bits.TrailingZeros16(unknown)
+		unknown &^= 1 << uint(bit)
+		active = append(active, &Fault{
+			Mask:        1 << uint(bit),
+			Name:        fmt.Sprintf("Bit%d", bit),
+			Description: fmt.Sprintf("Undocumented error bit %d", bit),
+			Severity:    SeverityUnknown,
+			Action:      "Consult the manual of the installed firmware",
+		})
+	}
+	return active
+}
+
+// Blocking reports whether any active fault prevents charging.
+func (e Errorcode) Blocking() bool {
+	for _, f := range e.Faults() {
+		if f.Severity == SeverityBlocking {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Errorcode) String() string {
+	if e.OK() {
+		return "OK"
+	}
+	var names []string
+	for _, f := range e.Faults() {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Err returns nil if no bit is set, or an error that matches every
+// active fault with errors.Is.
+func (e Errorcode) Err() error {
+	if e.OK() {
+		return nil
+	}
+	return &ErrorcodeError{Code: e}
+}
+
+// ErrorcodeError wraps the active faults of an error code register.
+type ErrorcodeError struct {
+	Code Errorcode
+}
+
+func (e *ErrorcodeError) Error() string {
+	return fmt.Sprintf("Charge controller reports errors: %s", e.Code)
+}
+
+func (e *ErrorcodeError) Unwrap() []error {
+	var errs []error
+	for _, f := range e.Code.Faults() {
+		errs = append(errs, f)
+	}
+	return errs
+}
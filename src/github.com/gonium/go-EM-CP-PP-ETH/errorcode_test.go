@@ -0,0 +1,135 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+func TestErrorcodeErr(t *testing.T) {
+	if err := EM_CP_PP_ETH.Errorcode(0).Err(); err != nil {
+		t.Errorf("Err of 0 returned %v, want nil", err)
+	}
+	code := EM_CP_PP_ETH.Errorcode(EM_CP_PP_ETH.ERROR_CABLE_13A |
+		EM_CP_PP_ETH.ERROR_CONTACTOR_FAILURE)
+	err := code.Err()
+	for _, tc := range []struct {
+		fault *EM_CP_PP_ETH.Fault
+		is    bool
+	}{
+		{EM_CP_PP_ETH.ErrCable13A, true},
+		{EM_CP_PP_ETH.ErrContactorFailure, true},
+		{EM_CP_PP_ETH.ErrCable13A20A, false},
+		{EM_CP_PP_ETH.ErrStateF, false},
+	} {
+		if errors.Is(err, tc.fault) != tc.is {
+			t.Errorf("errors.Is(%s, %s) is %t, want %t", err, tc.fault.Name,
+				!tc.is, tc.is)
+		}
+	}
+	var codeErr *EM_CP_PP_ETH.ErrorcodeError
+	if !errors.As(err, &codeErr) || codeErr.Code != code {
+		t.Errorf("errors.As returned %v, want the code %d", codeErr, code)
+	}
+	want := "Charge controller reports errors: Cable13A, ContactorFailure"
+	if err.Error() != want {
+		t.Errorf("Error %q, want %q", err.Error(), want)
+	}
+}
+
+func TestErrorcodeUnknownBits(t *testing.T) {
+	code := EM_CP_PP_ETH.Errorcode(EM_CP_PP_ETH.ERROR_STATE_F | 1<<13 | 1<<15)
+	if got := code.Unknown(); got != 1<<13|1<<15 {
+		t.Errorf("Unknown returned %#x, want %#x", got, 1<<13|1<<15)
+	}
+	if got := EM_CP_PP_ETH.Errorcode(EM_CP_PP_ETH.ERROR_CP_NO_DIODE).Unknown(); got != 0 {
+		t.Errorf("Unknown of a documented bit returned %#x, want 0", got)
+	}
+
+	faults := code.Faults()
+	var names []string
+	for _, f := range faults {
+		names = append(names, f.Name)
+	}
+	if want := []string{"StateF", "Bit13", "Bit15"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Faults %v, want %v", names, want)
+	}
+	bit := faults[1]
+	if bit.Mask != 1<<13 || bit.Severity != EM_CP_PP_ETH.SeverityUnknown ||
+		bit.Severity.String() != "unknown" {
+		t.Errorf("Fault %+v, want mask %#x with unknown severity", *bit, 1<<13)
+	}
+	// The synthetic faults are new values, so only the code matches them
+	if errors.Is(code.Err(), bit) {
+		t.Error("errors.Is matches a synthetic fault of another call")
+	}
+	if !errors.Is(code.Err(), EM_CP_PP_ETH.ErrStateF) {
+		t.Error("errors.Is does not match StateF next to undocumented bits")
+	}
+}
+
+func TestErrorcodeBlocking(t *testing.T) {
+	for _, tc := range []struct {
+		code     EM_CP_PP_ETH.Errorcode
+		blocking bool
+	}{
+		{0, false},
+		{EM_CP_PP_ETH.ERROR_CABLE_13A_20A | EM_CP_PP_ETH.ERROR_COM_MEASUREMENT, false},
+		{EM_CP_PP_ETH.ERROR_CABLE_13A | EM_CP_PP_ETH.ERROR_OVERCURRENT, true},
+		{1 << 14, false},
+	} {
+		if got := tc.code.Blocking(); got != tc.blocking {
+			t.Errorf("Blocking of %s returned %t, want %t", tc.code, got,
+				tc.blocking)
+		}
+	}
+}
+
+func TestErrorcodeString(t *testing.T) {
+	for _, tc := range []struct {
+		code EM_CP_PP_ETH.Errorcode
+		want string
+	}{
+		{0, "OK"},
+		{EM_CP_PP_ETH.ERROR_INVALID_PP, "InvalidPP"},
+		{EM_CP_PP_ETH.ERROR_CABLE_13A_20A | EM_CP_PP_ETH.ERROR_CP_NO_DIODE,
+			"Cable13A_20A, CPNoDiode"},
+		{EM_CP_PP_ETH.ERROR_LOCKING | 1<<15, "Locking, Bit15"},
+	} {
+		if got := tc.code.String(); got != tc.want {
+			t.Errorf("String of %#x returned %q, want %q", uint16(tc.code),
+				got, tc.want)
+		}
+	}
+}
+
+func TestLookupFault(t *testing.T) {
+	for _, f := range EM_CP_PP_ETH.Faults {
+		got, err := EM_CP_PP_ETH.LookupFault(f.Name)
+		if err != nil || got != f {
+			t.Errorf("LookupFault(%s) returned %v, %v", f.Name, got, err)
+		}
+	}
+	if got, err := EM_CP_PP_ETH.LookupFault("contactorfailure"); err != nil ||
+		got != EM_CP_PP_ETH.ErrContactorFailure {
+		t.Errorf("LookupFault ignoring case returned %v, %v", got, err)
+	}
+	for _, name := range []string{"Bit13", "", "Contactor"} {
+		if got, err := EM_CP_PP_ETH.LookupFault(name); err == nil {
+			t.Errorf("LookupFault(%q) returned %v, want an error", name, got)
+		}
+	}
+}
+
+func TestFaultMasks(t *testing.T) {
+	seen := uint16(0)
+	for _, f := range EM_CP_PP_ETH.Faults {
+		if f.Mask == 0 || f.Mask&(f.Mask-1) != 0 || seen&f.Mask != 0 {
+			t.Errorf("Fault %s has mask %#x, want a single new bit", f.Name,
+				f.Mask)
+		}
+		seen |= f.Mask
+	}
+}
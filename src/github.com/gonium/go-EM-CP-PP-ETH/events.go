@@ -0,0 +1,193 @@
+package EM_CP_PP_ETH
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Event is a change between two consecutive refreshes of a
+// StatusCache. It is one of EVStateEvent, ErrorEvent, IOEvent and
+// AvailabilityEvent; use a type switch to tell them apart. Programs
+// that track sessions add SessionEvent.
+type Event interface {
+	// Timestamp returns the time of the refresh that saw the change.
+	Timestamp() time.Time
+	String() string
+}
+
+// EVStateEvent reports a vehicle state transition.
+type EVStateEvent struct {
+	Time     time.Time
+	Old, New EVState
+}
+
+func (e EVStateEvent) Timestamp() time.Time {
+	return e.Time
+}
+
+func (e EVStateEvent) String() string {
+	return fmt.Sprintf("EV status %s -> %s (%s)", e.Old, e.New,
+		e.New.Description())
+}
+
+// ErrorEvent reports a single error bit that was set or cleared.
+type ErrorEvent struct {
+	Time  time.Time
+	Fault *Fault
+	// Set is true if the bit was set, false if it was cleared.
+	Set bool
+	// The complete error code before and after the change.
+	Old, New Errorcode
+}
+
+func (e ErrorEvent) Timestamp() time.Time {
+	return e.Time
+}
+
+func (e ErrorEvent) String() string {
+	if e.Set {
+		return fmt.Sprintf("Error set: %s (%s)", e.Fault.Name,
+			e.Fault.Description)
+	}
+	return fmt.Sprintf("Error cleared: %s", e.Fault.Name)
+}
+
+// IOEvent reports an edge of a digital input or output.
+type IOEvent struct {
+	Time time.Time
+	// Name of the input or output, i.e. EN or CR.
+	Name string
+	// Output is true for the outputs CR, LR, VR and ER.
+	Output   bool
+	Old, New bool
+}
+
+func (e IOEvent) Timestamp() time.Time {
+	return e.Time
+}
+
+func (e IOEvent) String() string {
+	kind := "Input"
+	if e.Output {
+		kind = "Output"
+	}
+	edge := "falling"
+	if e.New {
+		edge = "rising"
+	}
+	return fmt.Sprintf("%s %s: %s edge", kind, e.Name, edge)
+}
+
+// AvailabilityEvent reports that the charging station was made
+// available or unavailable.
+type AvailabilityEvent struct {
+	Time     time.Time
+	Old, New bool
+}
+
+func (e AvailabilityEvent) Timestamp() time.Time {
+	return e.Time
+}
+
+func (e AvailabilityEvent) String() string {
+	return fmt.Sprintf("Charging station available: %t -> %t", e.Old,
+		e.New)
+}
+
+// SessionEvent reports that a charging session started or ended. It is
+// not produced by Diff but by SessionTracker.Update, see OnEvent.
+type SessionEvent struct {
+	Time    time.Time
+	Session Session
+	// Started is true at plug-in, false at unplug.
+	Started bool
+}
+
+func (e SessionEvent) Timestamp() time.Time {
+	return e.Time
+}
+
+func (e SessionEvent) String() string {
+	if e.Started {
+		return fmt.Sprintf("Session %s started", e.Session.ID)
+	}
+	return fmt.Sprintf("Session %s ended, %.2f kWh", e.Session.ID,
+		e.Session.Energy)
+}
+
+// Diff returns the events that lead from old to new, stamped with t.
+// The vehicle state comes first, followed by availability, error bits
+// in bit order and the digital I/O in the order of DiscreteInputMap.
+func Diff(old, new Status, t time.Time) []Event {
+	var events []Event
+	if old.EVStatus != new.EVStatus {
+		events = append(events, EVStateEvent{t, old.EVStatus, new.EVStatus})
+	}
+	if old.ChargingEnabled != new.ChargingEnabled {
+		events = append(events, AvailabilityEvent{t, old.ChargingEnabled,
+			new.ChargingEnabled})
+	}
+	changed := uint16(old.Errorcode ^ new.Errorcode)
+	for _, f := range Errorcode(changed).Faults() {
+		events = append(events, ErrorEvent{t, f, new.Errorcode.Has(f),
+			old.Errorcode, new.Errorcode})
+	}
+	before := reflect.ValueOf(old)
+	after := reflect.ValueOf(new)
+	for _, d := range DiscreteInputMap {
+		// The map is fixed, so the field lookup cannot fail.
+		oldField, _ := structField(before, d.Field)
+		newField, _ := structField(after, d.Field)
+		if oldField.Bool() != newField.Bool() {
+			parts := strings.Split(d.Field, ".")
+			events = append(events, IOEvent{
+				Time:   t,
+				Name:   parts[len(parts)-1],
+				Output: parts[0] == "DigitalOutputStates",
+				Old:    oldField.Bool(),
+				New:    newField.Bool(),
+			})
+		}
+	}
+	return events
+}
+
+// Subscribe returns a channel that receives the events of every
+// refresh until ctx is canceled, then it is closed. The first refresh
+// of the cache has nothing to compare with and produces no events.
+//
+// Events are delivered without blocking the refresh: if the buffer of
+// the channel is full, further events are dropped, so choose buffer
+// to cover the events of a few refreshes.
+func (sc *StatusCache) Subscribe(ctx context.Context, buffer int) <-chan Event {
+	ch := make(chan Event, buffer)
+	sc.mu.Lock()
+	if sc.subscribers == nil {
+		sc.subscribers = make(map[chan Event]struct{})
+	}
+	sc.subscribers[ch] = struct{}{}
+	sc.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		sc.mu.Lock()
+		delete(sc.subscribers, ch)
+		sc.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// publish sends events to all subscribers. The caller holds sc.mu.
+func (sc *StatusCache) publish(events []Event) {
+	for ch := range sc.subscribers {
+		for _, e := range events {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
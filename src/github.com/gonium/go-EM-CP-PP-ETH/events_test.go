@@ -0,0 +1,144 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+func TestDiff(t *testing.T) {
+	at := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	cable := EM_CP_PP_ETH.Errorcode(EM_CP_PP_ETH.ERROR_CABLE_13A)
+	fault := EM_CP_PP_ETH.Errorcode(EM_CP_PP_ETH.ERROR_STATE_F |
+		EM_CP_PP_ETH.ERROR_CONTACTOR_FAILURE)
+	for _, tc := range []struct {
+		name     string
+		old, new EM_CP_PP_ETH.Status
+		want     []EM_CP_PP_ETH.Event
+	}{
+		{
+			name: "unchanged",
+			old:  EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateA, L1Voltage: 230},
+			new:  EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateA, L1Voltage: 231},
+		},
+		{
+			name: "vehicle starts charging",
+			old: EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB,
+				DigitalInputStates: EM_CP_PP_ETH.DigiInputs{EN: true}},
+			new: EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC,
+				DigitalInputStates:  EM_CP_PP_ETH.DigiInputs{EN: true},
+				DigitalOutputStates: EM_CP_PP_ETH.DigiOutputs{CR: true, VR: true}},
+			want: []EM_CP_PP_ETH.Event{
+				EM_CP_PP_ETH.EVStateEvent{Time: at, Old: EM_CP_PP_ETH.EVStateB, New: EM_CP_PP_ETH.EVStateC},
+				EM_CP_PP_ETH.IOEvent{Time: at, Name: "CR", Output: true, New: true},
+				EM_CP_PP_ETH.IOEvent{Time: at, Name: "VR", Output: true, New: true},
+			},
+		},
+		{
+			name: "fault",
+			old: EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC,
+				Errorcode:          cable,
+				ChargingEnabled:    true,
+				DigitalInputStates: EM_CP_PP_ETH.DigiInputs{EN: true}},
+			new: EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateF,
+				Errorcode:           fault,
+				DigitalOutputStates: EM_CP_PP_ETH.DigiOutputs{ER: true}},
+			want: []EM_CP_PP_ETH.Event{
+				EM_CP_PP_ETH.EVStateEvent{Time: at, Old: EM_CP_PP_ETH.EVStateC, New: EM_CP_PP_ETH.EVStateF},
+				EM_CP_PP_ETH.AvailabilityEvent{Time: at, Old: true},
+				EM_CP_PP_ETH.ErrorEvent{Time: at, Fault: EM_CP_PP_ETH.ErrCable13A, Set: false,
+					Old: cable, New: fault},
+				EM_CP_PP_ETH.ErrorEvent{Time: at, Fault: EM_CP_PP_ETH.ErrStateF, Set: true,
+					Old: cable, New: fault},
+				EM_CP_PP_ETH.ErrorEvent{Time: at, Fault: EM_CP_PP_ETH.ErrContactorFailure, Set: true,
+					Old: cable, New: fault},
+				EM_CP_PP_ETH.IOEvent{Time: at, Name: "EN", Old: true},
+				EM_CP_PP_ETH.IOEvent{Time: at, Name: "ER", Output: true, New: true},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := EM_CP_PP_ETH.Diff(tc.old, tc.new, at)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Diff returned\n%v\nwant\n%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	device, _, client := startSimulator(t)
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	ctx, cancel := context.WithCancel(simulatortest.Context(t))
+	events := cache.Subscribe(ctx, 8)
+	if err := cache.RefreshContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB})
+	if err := cache.RefreshContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if s, ok := e.(EM_CP_PP_ETH.EVStateEvent); !ok ||
+			s.Old != EM_CP_PP_ETH.EVStateA || s.New != EM_CP_PP_ETH.EVStateB {
+			t.Errorf("Got %v, want EV status A -> B", e)
+		}
+	default:
+		t.Fatal("No event after the state change")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("Received an event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Error("Channel not closed after cancel")
+	}
+}
+
+func TestFullSubscriberDropsEvents(t *testing.T) {
+	device, _, client := startSimulator(t)
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	ctx := simulatortest.Context(t)
+	events := cache.Subscribe(ctx, 2)
+	if err := cache.RefreshContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	states := []EM_CP_PP_ETH.EVState{EM_CP_PP_ETH.EVStateB,
+		EM_CP_PP_ETH.EVStateC, EM_CP_PP_ETH.EVStateB, EM_CP_PP_ETH.EVStateA}
+	for _, state := range states {
+		device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: state})
+		refreshed := make(chan error, 1)
+		go func() { refreshed <- cache.RefreshContext(ctx) }()
+		select {
+		case err := <-refreshed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("RefreshContext blocked on a full subscriber")
+		}
+	}
+	if cache.Snapshot().Status.EVStatus != EM_CP_PP_ETH.EVStateA {
+		t.Errorf("Cache holds state %s, want A", cache.Snapshot().Status.EVStatus)
+	}
+	// The buffer holds the first two events, the others were dropped
+	for _, want := range states[:2] {
+		e := (<-events).(EM_CP_PP_ETH.EVStateEvent)
+		if e.New != want {
+			t.Errorf("Got %v, want a change to %s", e, want)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Got %v, want no further events", e)
+	default:
+	}
+}
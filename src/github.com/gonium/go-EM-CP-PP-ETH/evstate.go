@@ -0,0 +1,138 @@
+package EM_CP_PP_ETH
+
+import (
+	"fmt"
+)
+
+// EVState is the vehicle state according to IEC 61851-1 as signaled on
+// the control pilot (CP) line. The controller reports it as an ASCII
+// letter, which is also the value of the constants.
+type EVState byte
+
+const (
+	// The register held a value outside 'A' to 'F'.
+	EVStateUnknown EVState = 0
+	// No vehicle connected.
+	EVStateA EVState = 'A'
+	// Vehicle connected, not ready to charge.
+	EVStateB EVState = 'B'
+	// Vehicle connected and charging.
+	EVStateC EVState = 'C'
+	// Vehicle connected and charging, ventilation required.
+	EVStateD EVState = 'D'
+	// Short circuit between CP and PE or no supply.
+	EVStateE EVState = 'E'
+	// Charging station not available or fault.
+	EVStateF EVState = 'F'
+)
+
+// UnknownEVStateError is returned when the vehicle state register holds
+// a value that is not an IEC 61851 state.
+type UnknownEVStateError struct {
+	Raw uint16
+}
+
+func (e *UnknownEVStateError) Error() string {
+	return fmt.Sprintf("Invalid vehicle state '%d'", e.Raw)
+}
+
+// ParseEVState converts a state letter such as "C" into an EVState.
+func ParseEVState(s string) (EVState, error) {
+	if len(s) == 1 {
+		state := EVState(s[0])
+		if state.Valid() {
+			return state, nil
+		}
+	}
+	return EVStateUnknown, fmt.Errorf("Invalid vehicle state '%s'", s)
+}
+
+// Valid reports whether s is one of the states A to F.
+func (s EVState) Valid() bool {
+	return s >= EVStateA && s <= EVStateF
+}
+
+func (s EVState) String() string {
+	if !s.Valid() {
+		return "unknown"
+	}
+	return string(rune(s))
+}
+
+// Description explains the state in a few words.
+func (s EVState) Description() string {
+	switch s {
+	case EVStateA:
+		return "no vehicle connected"
+	case EVStateB:
+		return "vehicle connected"
+	case EVStateC:
+		return "charging"
+	case EVStateD:
+		return "charging, ventilation required"
+	case EVStateE:
+		return "no power or CP short circuit"
+	case EVStateF:
+		return "charging station not available"
+	}
+	return "unknown state"
+}
+
+// VehicleConnected reports whether a vehicle is plugged in and the
+// control pilot works (states B, C and D).
+func (s EVState) VehicleConnected() bool {
+	return s == EVStateB || s == EVStateC || s == EVStateD
+}
+
+// Charging reports whether the vehicle requests energy (states C and
+// D).
+func (s EVState) Charging() bool {
+	return s == EVStateC || s == EVStateD
+}
+
+// VentilationRequired reports whether the vehicle needs ventilation
+// while charging (state D).
+func (s EVState) VentilationRequired() bool {
+	return s == EVStateD
+}
+
+// Fault reports whether the control pilot signals an error (states E
+// and F) or the state is unknown.
+func (s EVState) Fault() bool {
+	return s == EVStateE || s == EVStateF || !s.Valid()
+}
+
+// MarshalText encodes the state as its letter, which is also used for
+// JSON. Invalid states are encoded as "unknown".
+func (s EVState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText accepts the letters A to F and "unknown", so every
+// marshaled state can be read back.
+func (s *EVState) UnmarshalText(text []byte) error {
+	if string(text) == EVStateUnknown.String() {
+		*s = EVStateUnknown
+		return nil
+	}
+	state, err := ParseEVState(string(text))
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+func (s *EVState) decodeRegister(raw uint32) error {
+	state := EVState(raw)
+	if raw > 0xFF || !state.Valid() {
+		*s = EVStateUnknown
+		return &UnknownEVStateError{Raw: uint16(raw)}
+	}
+	*s = state
+	return nil
+}
+
+func (s *EVState) encodeRegister() uint32 {
+	return uint32(*s)
+}
@@ -0,0 +1,60 @@
+package EM_CP_PP_ETH
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEVStateRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		state EVState
+		text  string
+		want  EVState
+	}{
+		{EVStateA, "A", EVStateA},
+		{EVStateB, "B", EVStateB},
+		{EVStateC, "C", EVStateC},
+		{EVStateD, "D", EVStateD},
+		{EVStateE, "E", EVStateE},
+		{EVStateF, "F", EVStateF},
+		{EVStateUnknown, "unknown", EVStateUnknown},
+		{EVState('X'), "unknown", EVStateUnknown},
+	} {
+		text, err := tc.state.MarshalText()
+		if err != nil || string(text) != tc.text {
+			t.Errorf("MarshalText(%d) = %q, %v, want %q", tc.state, text,
+				err, tc.text)
+			continue
+		}
+		var got EVState
+		if err := got.UnmarshalText(text); err != nil || got != tc.want {
+			t.Errorf("UnmarshalText(%q) = %d, %v, want %d", text, got, err,
+				tc.want)
+		}
+	}
+}
+
+func TestStatusJSONWithUnknownState(t *testing.T) {
+	in := Status{EVStatus: EVState('X'), ProximityCurrent: 20}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Status
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal %s: %s", data, err.Error())
+	}
+	if out.EVStatus != EVStateUnknown || out.ProximityCurrent != 20 {
+		t.Errorf("Got state %d and proximity %d, want unknown and 20",
+			out.EVStatus, out.ProximityCurrent)
+	}
+}
+
+func TestEVStateUnmarshalInvalid(t *testing.T) {
+	for _, text := range []string{"", "G", "a", "AB", "Unknown"} {
+		var state EVState
+		if err := state.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded with %s", text, state)
+		}
+	}
+}
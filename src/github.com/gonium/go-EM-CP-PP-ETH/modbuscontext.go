@@ -0,0 +1,129 @@
+package EM_CP_PP_ETH
+
+import (
+	"context"
+	"io"
+
+	"github.com/goburrow/modbus"
+)
+
+// contextClient binds a modbus.Client to a context. The vendored client
+// cannot abort a request in flight. If the client is also an io.Closer,
+// like the clients of WithReconnect, it is closed when the context ends
+// to abort the transfer; otherwise the transfer ends at the timeout of
+// the client handler. Either way a request returns only after its
+// transfer ended, so it never overlaps with the next one.
+type contextClient struct {
+	ctx    context.Context
+	client modbus.Client
+	conn   io.Closer
+}
+
+// WithContext returns a modbus.Client whose requests end with the
+// context's error when ctx is canceled or its deadline expires. For
+// prompt cancellation wrap client with WithReconnect and pass it a
+// *TCPClientHandler, whose Close does not wait for the transfer.
+//
+// The clients that WithContext returns for the same client share its
+// connection, so the Close of a canceled request also aborts the
+// transfer of a request of another context that holds the connection
+// at that moment. That request fails with a connection error and the
+// next request reconnects. Callers that must not disturb each other
+// need their own handlers.
+func WithContext(ctx context.Context, client modbus.Client) modbus.Client {
+	conn, _ := client.(io.Closer)
+	return &contextClient{ctx: ctx, client: client, conn: conn}
+}
+
+type callResult struct {
+	results []byte
+	err     error
+}
+
+func (c *contextClient) call(request func() ([]byte, error)) ([]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	done := make(chan callResult, 1)
+	go func() {
+		results, err := request()
+		done <- callResult{results, err}
+	}()
+	select {
+	case <-c.ctx.Done():
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		<-done
+		return nil, c.ctx.Err()
+	case r := <-done:
+		return r.results, r.err
+	}
+}
+
+func (c *contextClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadCoils(address, quantity)
+	})
+}
+
+func (c *contextClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadDiscreteInputs(address, quantity)
+	})
+}
+
+func (c *contextClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.WriteSingleCoil(address, value)
+	})
+}
+
+func (c *contextClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.WriteMultipleCoils(address, quantity, value)
+	})
+}
+
+func (c *contextClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadInputRegisters(address, quantity)
+	})
+}
+
+func (c *contextClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadHoldingRegisters(address, quantity)
+	})
+}
+
+func (c *contextClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.WriteSingleRegister(address, value)
+	})
+}
+
+func (c *contextClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.WriteMultipleRegisters(address, quantity, value)
+	})
+}
+
+func (c *contextClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadWriteMultipleRegisters(readAddress,
+			readQuantity, writeAddress, writeQuantity, value)
+	})
+}
+
+func (c *contextClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.MaskWriteRegister(address, andMask, orMask)
+	})
+}
+
+func (c *contextClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return c.call(func() ([]byte, error) {
+		return c.client.ReadFIFOQueue(address)
+	})
+}
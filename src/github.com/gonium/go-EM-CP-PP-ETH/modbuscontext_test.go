@@ -0,0 +1,155 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+// listener counts the connections of the simulator and can delay or
+// drop them, which the simulator itself never does.
+type listener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	accepted int
+	conns    []net.Conn
+	delay    time.Duration
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepted++
+	l.conns = append(l.conns, conn)
+	return &slowConn{Conn: conn, l: l}, nil
+}
+
+func (l *listener) setDelay(delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = delay
+}
+
+func (l *listener) connections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accepted
+}
+
+// dropAll closes the server side of all connections.
+func (l *listener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// slowConn delays the responses of the simulator by the delay of its
+// listener.
+type slowConn struct {
+	net.Conn
+	l *listener
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	c.l.mu.Lock()
+	delay := c.l.delay
+	c.l.mu.Unlock()
+	time.Sleep(delay)
+	return c.Conn.Write(b)
+}
+
+// startSimulator serves a new device on a free local port and returns
+// it with its listener and a client connected to it.
+func startSimulator(t *testing.T) (*simulator.Device, *listener, modbus.Client) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	wrapped := &listener{Listener: l}
+	station := simulatortest.Serve(t, wrapped)
+	return station.Device, wrapped, station.Client()
+}
+
+func TestCancelAbortsTransfer(t *testing.T) {
+	device, l, client := startSimulator(t)
+	commander := EM_CP_PP_ETH.NewCommander(client)
+	if _, err := commander.ReadStationMaxCurrentContext(simulatortest.Context(t)); err != nil {
+		t.Fatalf("First request: %s", err.Error())
+	}
+
+	l.setDelay(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := commander.ReadStationMaxCurrentContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Canceled request returned %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Canceled request returned after %s", elapsed)
+	}
+
+	// The next request must not read the late response of the
+	// canceled one from the old connection.
+	l.setDelay(0)
+	device.SetHoldingRegister(EM_CP_PP_ETH.HOLDING_STATION_MAX_CURRENT, 20)
+	current, err := commander.ReadStationMaxCurrentContext(simulatortest.Context(t))
+	if err != nil || current != 20 {
+		t.Errorf("Request after cancel returned %d, %v, want 20", current, err)
+	}
+	if got := l.connections(); got != 2 {
+		t.Errorf("Simulator accepted %d connections, want 2", got)
+	}
+}
+
+func TestReconnectAfterError(t *testing.T) {
+	_, l, client := startSimulator(t)
+	commander := EM_CP_PP_ETH.NewCommander(client)
+	ctx := simulatortest.Context(t)
+	if _, err := commander.ReadStationMaxCurrentContext(ctx); err != nil {
+		t.Fatalf("First request: %s", err.Error())
+	}
+	l.dropAll()
+	// Whether the request on the dropped connection fails depends on
+	// when the client notices; afterwards it must have reconnected.
+	commander.ReadStationMaxCurrentContext(ctx)
+	if current, err := commander.ReadStationMaxCurrentContext(ctx); err != nil || current != 32 {
+		t.Errorf("Request after the drop returned %d, %v, want 32", current, err)
+	}
+	if got := l.connections(); got != 2 {
+		t.Errorf("Simulator accepted %d connections, want 2", got)
+	}
+}
+
+func TestExceptionKeepsConnection(t *testing.T) {
+	_, l, client := startSimulator(t)
+	ctx := simulatortest.Context(t)
+	_, err := EM_CP_PP_ETH.WithContext(ctx, client).ReadHoldingRegisters(303, 1)
+	var modbusErr *modbus.ModbusError
+	if !errors.As(err, &modbusErr) {
+		t.Fatalf("Got %v, want a Modbus exception", err)
+	}
+	if _, err := EM_CP_PP_ETH.NewCommander(client).ReadStationMaxCurrentContext(ctx); err != nil {
+		t.Errorf("Request after the exception: %s", err.Error())
+	}
+	if got := l.connections(); got != 1 {
+		t.Errorf("Simulator accepted %d connections, want 1", got)
+	}
+}
@@ -0,0 +1,83 @@
+package EM_CP_PP_ETH
+
+import (
+	"errors"
+	"io"
+
+	"github.com/goburrow/modbus"
+)
+
+// reconnectClient closes the connection after a failed transfer. The
+// vendored TCP handler keeps a broken connection forever, but dials
+// again on the next request once it is closed, so long running
+// programs recover from a restarted or unplugged controller.
+type reconnectClient struct {
+	client modbus.Client
+	conn   io.Closer
+}
+
+// WithReconnect returns a modbus.Client that closes conn, usually the
+// *TCPClientHandler of client, after every error other than a Modbus
+// exception response. The client is an io.Closer too, so WithContext
+// closes conn to abort a canceled request.
+func WithReconnect(client modbus.Client, conn io.Closer) modbus.Client {
+	return &reconnectClient{client: client, conn: conn}
+}
+
+// Close closes the connection, the next request connects again.
+func (c *reconnectClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *reconnectClient) call(results []byte, err error) ([]byte, error) {
+	var exception *modbus.ModbusError
+	if err != nil && !errors.As(err, &exception) {
+		c.conn.Close()
+	}
+	return results, err
+}
+
+func (c *reconnectClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.call(c.client.ReadCoils(address, quantity))
+}
+
+func (c *reconnectClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.call(c.client.ReadDiscreteInputs(address, quantity))
+}
+
+func (c *reconnectClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return c.call(c.client.WriteSingleCoil(address, value))
+}
+
+func (c *reconnectClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(c.client.WriteMultipleCoils(address, quantity, value))
+}
+
+func (c *reconnectClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(c.client.ReadInputRegisters(address, quantity))
+}
+
+func (c *reconnectClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(c.client.ReadHoldingRegisters(address, quantity))
+}
+
+func (c *reconnectClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return c.call(c.client.WriteSingleRegister(address, value))
+}
+
+func (c *reconnectClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(c.client.WriteMultipleRegisters(address, quantity, value))
+}
+
+func (c *reconnectClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return c.call(c.client.ReadWriteMultipleRegisters(readAddress,
+		readQuantity, writeAddress, writeQuantity, value))
+}
+
+func (c *reconnectClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return c.call(c.client.MaskWriteRegister(address, andMask, orMask))
+}
+
+func (c *reconnectClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return c.call(c.client.ReadFIFOQueue(address))
+}
@@ -0,0 +1,216 @@
+package EM_CP_PP_ETH
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// MODBUS_LATENCY_BUCKETS are the upper bounds of the latency histogram
+// in seconds.
+var MODBUS_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1,
+	0.25, 0.5, 1, 2.5, 5}
+
+// Kinds of failed Modbus requests.
+const (
+	// The controller answered with an exception.
+	MODBUS_ERROR_EXCEPTION = "exception"
+	// The controller did not answer in time.
+	MODBUS_ERROR_TIMEOUT = "timeout"
+	// The connection failed or the response was invalid.
+	MODBUS_ERROR_TRANSPORT = "transport"
+)
+
+// modbusFunctionNames are the names of the function codes used by
+// modbus.Client.
+var modbusFunctionNames = map[byte]string{
+	modbus.FuncCodeReadCoils:                  "read_coils",
+	modbus.FuncCodeReadDiscreteInputs:         "read_discrete_inputs",
+	modbus.FuncCodeReadHoldingRegisters:       "read_holding_registers",
+	modbus.FuncCodeReadInputRegisters:         "read_input_registers",
+	modbus.FuncCodeWriteSingleCoil:            "write_single_coil",
+	modbus.FuncCodeWriteSingleRegister:        "write_single_register",
+	modbus.FuncCodeWriteMultipleCoils:         "write_multiple_coils",
+	modbus.FuncCodeWriteMultipleRegisters:     "write_multiple_registers",
+	modbus.FuncCodeMaskWriteRegister:          "mask_write_register",
+	modbus.FuncCodeReadWriteMultipleRegisters: "read_write_multiple_registers",
+	modbus.FuncCodeReadFIFOQueue:              "read_fifo_queue",
+}
+
+// ModbusFunctionName returns the snake case name of a function code,
+// i.e. "read_input_registers" for 4.
+func ModbusFunctionName(code byte) string {
+	return modbusFunctionNames[code]
+}
+
+// FunctionStats counts the requests of one function code.
+type FunctionStats struct {
+	Code     byte
+	Requests uint64
+	// Failed requests by kind, i.e. MODBUS_ERROR_TIMEOUT.
+	Errors map[string]uint64
+	// Requests per bucket of MODBUS_LATENCY_BUCKETS, not cumulative;
+	// the last element counts the requests slower than all buckets.
+	Buckets []uint64
+	// Total time of all requests.
+	Duration time.Duration
+}
+
+// ModbusStats collects the latency and the errors of the requests of
+// instrumented clients. It is safe for concurrent use.
+type ModbusStats struct {
+	mu        sync.Mutex
+	functions map[byte]*FunctionStats
+}
+
+func NewModbusStats() *ModbusStats {
+	return &ModbusStats{functions: make(map[byte]*FunctionStats)}
+}
+
+// observe records a request that took d and failed with err, if not
+// nil.
+func (s *ModbusStats) observe(code byte, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.functions[code]
+	if !ok {
+		f = &FunctionStats{
+			Code:    code,
+			Errors:  make(map[string]uint64),
+			Buckets: make([]uint64, len(MODBUS_LATENCY_BUCKETS)+1),
+		}
+		s.functions[code] = f
+	}
+	f.Requests++
+	f.Duration += d
+	bucket := sort.SearchFloat64s(MODBUS_LATENCY_BUCKETS, d.Seconds())
+	f.Buckets[bucket]++
+	if err != nil {
+		f.Errors[modbusErrorKind(err)]++
+	}
+}
+
+func modbusErrorKind(err error) string {
+	var exception *modbus.ModbusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &exception):
+		return MODBUS_ERROR_EXCEPTION
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return MODBUS_ERROR_TIMEOUT
+	}
+	return MODBUS_ERROR_TRANSPORT
+}
+
+// Functions returns a copy of the statistics of every function code
+// used so far, ordered by code.
+func (s *ModbusStats) Functions() []FunctionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []FunctionStats
+	for _, f := range s.functions {
+		c := *f
+		c.Errors = make(map[string]uint64, len(f.Errors))
+		for kind, n := range f.Errors {
+			c.Errors[kind] = n
+		}
+		c.Buckets = append([]uint64(nil), f.Buckets...)
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Code < result[j].Code
+	})
+	return result
+}
+
+// statsClient times the requests of a modbus.Client.
+type statsClient struct {
+	client modbus.Client
+	stats  *ModbusStats
+}
+
+// Instrument returns a modbus.Client that records every request of
+// client in s. Wrap the client of the handler directly, so that the
+// statistics show the time on the wire rather than the waiting of
+// other wrappers.
+func (s *ModbusStats) Instrument(client modbus.Client) modbus.Client {
+	return &statsClient{client: client, stats: s}
+}
+
+func (c *statsClient) call(code byte, request func() ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	results, err := request()
+	c.stats.observe(code, time.Since(start), err)
+	return results, err
+}
+
+func (c *statsClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadCoils, func() ([]byte, error) {
+		return c.client.ReadCoils(address, quantity)
+	})
+}
+
+func (c *statsClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadDiscreteInputs, func() ([]byte, error) {
+		return c.client.ReadDiscreteInputs(address, quantity)
+	})
+}
+
+func (c *statsClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeWriteSingleCoil, func() ([]byte, error) {
+		return c.client.WriteSingleCoil(address, value)
+	})
+}
+
+func (c *statsClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(modbus.FuncCodeWriteMultipleCoils, func() ([]byte, error) {
+		return c.client.WriteMultipleCoils(address, quantity, value)
+	})
+}
+
+func (c *statsClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadInputRegisters, func() ([]byte, error) {
+		return c.client.ReadInputRegisters(address, quantity)
+	})
+}
+
+func (c *statsClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadHoldingRegisters, func() ([]byte, error) {
+		return c.client.ReadHoldingRegisters(address, quantity)
+	})
+}
+
+func (c *statsClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeWriteSingleRegister, func() ([]byte, error) {
+		return c.client.WriteSingleRegister(address, value)
+	})
+}
+
+func (c *statsClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.call(modbus.FuncCodeWriteMultipleRegisters, func() ([]byte, error) {
+		return c.client.WriteMultipleRegisters(address, quantity, value)
+	})
+}
+
+func (c *statsClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadWriteMultipleRegisters, func() ([]byte, error) {
+		return c.client.ReadWriteMultipleRegisters(readAddress, readQuantity,
+			writeAddress, writeQuantity, value)
+	})
+}
+
+func (c *statsClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeMaskWriteRegister, func() ([]byte, error) {
+		return c.client.MaskWriteRegister(address, andMask, orMask)
+	})
+}
+
+func (c *statsClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return c.call(modbus.FuncCodeReadFIFOQueue, func() ([]byte, error) {
+		return c.client.ReadFIFOQueue(address)
+	})
+}
@@ -0,0 +1,184 @@
+package EM_CP_PP_ETH
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// Size of the Modbus application protocol header.
+	TCP_HEADER_SIZE = 7
+	// Longest Modbus TCP frame.
+	TCP_MAX_LENGTH = 260
+)
+
+// ErrConnectionClosed is returned by transfers aborted by
+// TCPClientHandler.Close.
+var ErrConnectionClosed = errors.New("Modbus connection closed")
+
+// TCPClientHandler is a Modbus TCP client handler whose Close aborts
+// the transfer in flight and the transfers waiting for it; the next
+// request connects again. The vendored handler holds its lock for the
+// whole transfer, so closing it waits until the transfer ends and
+// cannot cancel a request. TCPClientHandler embeds it for the settings
+// Address, Timeout, IdleTimeout, SlaveId and Logger and for the
+// framing.
+type TCPClientHandler struct {
+	*modbus.TCPClientHandler
+
+	// Serializes the transfers.
+	transfer sync.Mutex
+	// Guards the fields below.
+	mu   sync.Mutex
+	conn net.Conn
+	// Number of calls to Close. A transfer fails if Close was called
+	// since it started.
+	closed       uint64
+	lastActivity time.Time
+}
+
+// NewTCPClientHandler allocates a handler with the defaults of the
+// vendored handler.
+func NewTCPClientHandler(address string) *TCPClientHandler {
+	return &TCPClientHandler{
+		TCPClientHandler: modbus.NewTCPClientHandler(address),
+	}
+}
+
+func (h *TCPClientHandler) logf(format string, v ...interface{}) {
+	if h.Logger != nil {
+		h.Logger.Printf(format, v...)
+	}
+}
+
+func (h *TCPClientHandler) generation() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// Connect opens the connection unless it is open.
+func (h *TCPClientHandler) Connect() error {
+	generation := h.generation()
+	h.transfer.Lock()
+	defer h.transfer.Unlock()
+	_, err := h.connect(generation)
+	return err
+}
+
+// Close closes the connection without waiting for the transfer in
+// flight, which fails with the error of the closed connection.
+func (h *TCPClientHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed++
+	return h.drop()
+}
+
+// drop closes the connection. The caller holds h.mu.
+func (h *TCPClientHandler) drop() error {
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+// connect returns the open connection or dials a new one, after an
+// idle timeout also. It fails if Close was called since generation.
+// The caller holds h.transfer.
+func (h *TCPClientHandler) connect(generation uint64) (net.Conn, error) {
+	h.mu.Lock()
+	if h.closed != generation {
+		h.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	if h.conn != nil && h.IdleTimeout > 0 &&
+		time.Since(h.lastActivity) >= h.IdleTimeout {
+		h.logf("modbus: closing connection due to idle timeout")
+		h.drop()
+	}
+	conn := h.conn
+	h.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	dialer := net.Dialer{Timeout: h.Timeout}
+	conn, err := dialer.Dial("tcp", h.Address)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed != generation {
+		conn.Close()
+		return nil, ErrConnectionClosed
+	}
+	h.conn = conn
+	h.lastActivity = time.Now()
+	return conn, nil
+}
+
+// Send transfers a request and returns the response.
+func (h *TCPClientHandler) Send(aduRequest []byte) ([]byte, error) {
+	generation := h.generation()
+	h.transfer.Lock()
+	defer h.transfer.Unlock()
+	conn, err := h.connect(generation)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := h.exchange(conn, aduRequest)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastActivity = time.Now()
+	if err != nil {
+		if h.closed != generation {
+			return nil, ErrConnectionClosed
+		}
+		// The stream may be out of step, start over
+		h.drop()
+		return nil, err
+	}
+	return aduResponse, nil
+}
+
+// exchange writes the request to conn and reads the response.
+func (h *TCPClientHandler) exchange(conn net.Conn, aduRequest []byte) ([]byte, error) {
+	var deadline time.Time
+	if h.Timeout > 0 {
+		deadline = time.Now().Add(h.Timeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	h.logf("modbus: sending % x", aduRequest)
+	if _, err := conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	var data [TCP_MAX_LENGTH]byte
+	if _, err := io.ReadFull(conn, data[:TCP_HEADER_SIZE]); err != nil {
+		return nil, err
+	}
+	// The length counts the unit id, which is part of the header
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length <= 0 || length > TCP_MAX_LENGTH-TCP_HEADER_SIZE+1 {
+		return nil, fmt.Errorf("Invalid length %d in response header",
+			length)
+	}
+	length += TCP_HEADER_SIZE - 1
+	if _, err := io.ReadFull(conn, data[TCP_HEADER_SIZE:length]); err != nil {
+		return nil, err
+	}
+	h.logf("modbus: received % x", data[:length])
+	return data[:length], nil
+}
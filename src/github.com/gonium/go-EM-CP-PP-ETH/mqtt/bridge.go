@@ -0,0 +1,271 @@
+// Package mqtt publishes the status of a single charge controller to an
+// MQTT 3.1.1 broker and accepts commands from it. All topics are below
+// a prefix, i.e. em-cp-pp-eth/garage:
+//
+//	connection              "online" or "offline", retained; "offline"
+//	                        is also the will of the client
+//	status/<field>          value of a status field, retained
+//	event/<type>            event documents as JSON, i.e. event/ev_state
+//	set/<command>           commands current, availability and digimode
+//	ack/<command>           result of each command as JSON
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const (
+	// Topic of the connection state, below the prefix.
+	TOPIC_CONNECTION = "connection"
+	// Payloads of the connection topic.
+	PAYLOAD_ONLINE  = "online"
+	PAYLOAD_OFFLINE = "offline"
+	// Commands, published to set/<command>.
+	COMMAND_CURRENT      = "current"
+	COMMAND_AVAILABILITY = "availability"
+	COMMAND_DIGIMODE     = "digimode"
+	// Time budget of connecting to the broker and of each publication.
+	BROKER_TIMEOUT = 10 * time.Second
+	// Events buffered between two polls, further events are dropped.
+	EVENT_BUFFER = 64
+)
+
+// Bridge connects a station to a broker.
+type Bridge struct {
+	Cache     *EM_CP_PP_ETH.StatusCache
+	Commander *EM_CP_PP_ETH.Commander
+	// Prefix of all topics, without a trailing slash.
+	Prefix string
+	// QoS of all publications and of the command subscription.
+	QoS byte
+	// Time budget of a request to the controller, NewBridge sets
+	// EM_CP_PP_ETH.DEFAULT_REQUEST_TIMEOUT.
+	Timeout time.Duration
+	// Logger receives the messages of the bridge. It must not be nil,
+	// NewBridge sets a logger that discards them.
+	Logger *log.Logger
+
+	client paho.Client
+	mu     sync.Mutex
+	// Payloads last published to the status topics, published again
+	// only after a change.
+	retained map[string]string
+	tracker  *EM_CP_PP_ETH.SessionTracker
+	events   <-chan EM_CP_PP_ETH.Event
+	last     time.Time
+}
+
+// NewBridge returns a bridge for the station behind client.
+func NewBridge(client modbus.Client, station string) *Bridge {
+	b := &Bridge{
+		Cache:     EM_CP_PP_ETH.NewStatusCache(client),
+		Commander: EM_CP_PP_ETH.NewCommander(client),
+		Prefix:    "em-cp-pp-eth/" + station,
+		QoS:       1,
+		Timeout:   EM_CP_PP_ETH.DEFAULT_REQUEST_TIMEOUT,
+		Logger:    log.New(io.Discard, "", 0),
+		retained:  make(map[string]string),
+		tracker:   EM_CP_PP_ETH.NewSessionTracker(station),
+	}
+	b.tracker.OnEvent = b.publishEvent
+	return b
+}
+
+func (b *Bridge) topic(name string) string {
+	return b.Prefix + "/" + name
+}
+
+// Run connects to the broker and publishes the status of the
+// controller, polled every interval, until ctx is canceled. options
+// select the broker, the credentials and TLS; Run adds the will, the
+// protocol version and the handlers. It returns an error if the first
+// connection fails, later the client reconnects on its own. Events
+// that happen while the broker is unreachable are lost, the status
+// topics are published again on every connect.
+func (b *Bridge) Run(ctx context.Context, options *paho.ClientOptions, interval time.Duration) error {
+	options.SetProtocolVersion(4)
+	options.SetCleanSession(true)
+	options.SetAutoReconnect(true)
+	options.SetOrderMatters(false)
+	options.SetConnectTimeout(BROKER_TIMEOUT)
+	options.SetWill(b.topic(TOPIC_CONNECTION), PAYLOAD_OFFLINE, b.QoS, true)
+	options.SetOnConnectHandler(b.onConnect)
+	options.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		b.Logger.Printf("Connection to broker lost: %s", err.Error())
+	})
+
+	b.mu.Lock()
+	b.events = b.Cache.Subscribe(ctx, EVENT_BUFFER)
+	b.client = paho.NewClient(options)
+	b.mu.Unlock()
+	token := b.client.Connect()
+	if !token.WaitTimeout(BROKER_TIMEOUT) {
+		b.client.Disconnect(0)
+		return errors.New("Failed to connect to broker: timeout")
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("Failed to connect to broker: %s", err.Error())
+	}
+	defer b.disconnect()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// disconnect marks the station offline, which the will would only do
+// after an unexpected disconnect.
+func (b *Bridge) disconnect() {
+	b.publish(TOPIC_CONNECTION, PAYLOAD_OFFLINE, true)
+	b.client.Disconnect(250)
+}
+
+// onConnect runs after every connect. With a clean session the
+// subscription and the retained status are lost and set up again.
+func (b *Bridge) onConnect(client paho.Client) {
+	b.Logger.Printf("Connected to broker")
+	b.publish(TOPIC_CONNECTION, PAYLOAD_ONLINE, true)
+	token := client.Subscribe(b.topic("set/+"), b.QoS, b.handleCommand)
+	if token.WaitTimeout(BROKER_TIMEOUT) && token.Error() != nil {
+		b.Logger.Printf("Failed to subscribe to commands: %s", token.Error().Error())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retained = make(map[string]string)
+	if snapshot := b.Cache.Snapshot(); !snapshot.Time.IsZero() {
+		b.publishStatus(snapshot)
+	}
+}
+
+// refresh polls the controller and publishes the changes.
+func (b *Bridge) refresh(ctx context.Context) {
+	refreshCtx, cancel := context.WithTimeout(ctx, b.Timeout)
+	err := b.Cache.RefreshContext(refreshCtx)
+	cancel()
+	if err != nil && ctx.Err() == nil {
+		b.Logger.Printf("Poll failed: %s", err.Error())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forward()
+	snapshot := b.Cache.Snapshot()
+	if !snapshot.Time.After(b.last) {
+		return
+	}
+	b.last = snapshot.Time
+	b.tracker.Update(snapshot.Status, snapshot.Time)
+	b.publishStatus(snapshot)
+}
+
+// forward publishes the events of the cache. The caller holds b.mu.
+func (b *Bridge) forward() {
+	for {
+		select {
+		case e, ok := <-b.events:
+			if !ok {
+				b.events = nil
+				return
+			}
+			b.publishEvent(e)
+		default:
+			return
+		}
+	}
+}
+
+// publish sends payload to the topic name below the prefix. Messages
+// are dropped while the broker is unreachable.
+func (b *Bridge) publish(name, payload string, retain bool) bool {
+	if !b.client.IsConnectionOpen() {
+		return false
+	}
+	token := b.client.Publish(b.topic(name), b.QoS, retain, payload)
+	if !token.WaitTimeout(BROKER_TIMEOUT) {
+		b.Logger.Printf("Failed to publish %s: timeout", name)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		b.Logger.Printf("Failed to publish %s: %s", name, err.Error())
+		return false
+	}
+	return true
+}
+
+func (b *Bridge) publishJSON(name string, doc interface{}, retain bool) {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		b.Logger.Printf("Failed to encode %s: %s", name, err.Error())
+		return
+	}
+	b.publish(name, string(payload), retain)
+}
+
+// publishEvent sends an event to event/<type>. The caller holds b.mu,
+// also for the session events of the tracker.
+func (b *Bridge) publishEvent(e EM_CP_PP_ETH.Event) {
+	typ, doc := EM_CP_PP_ETH.NewEventDocument(e)
+	b.publishJSON("event/"+typ, doc, false)
+}
+
+// StatusTopics returns the status topics below the prefix and their
+// payloads: the values of the input registers in their unit, the
+// vehicle state, the errors and the digital I/O.
+func StatusTopics(snapshot EM_CP_PP_ETH.Snapshot) map[string]string {
+	doc := EM_CP_PP_ETH.NewStatusDocument(snapshot)
+	topics := map[string]string{
+		"status/time":                 doc.Time.Format(time.RFC3339),
+		"status/ev_state":             doc.EVState.State,
+		"status/ev_state_description": doc.EVState.Description,
+		"status/vehicle_connected":    strconv.FormatBool(doc.EVState.VehicleConnected),
+		"status/charging":             strconv.FormatBool(doc.EVState.Charging),
+		"status/charging_enabled":     strconv.FormatBool(doc.ChargingEnabled),
+		"status/error_code":           strconv.Itoa(int(doc.Errors.Code)),
+	}
+	faults, _ := json.Marshal(doc.Errors.Faults)
+	topics["status/errors"] = string(faults)
+	for name, q := range doc.Values {
+		topics["status/"+name] = strconv.FormatFloat(q.Value, 'f', -1, 64)
+	}
+	for name, state := range doc.DigitalInputs {
+		topics["status/digital_inputs/"+strings.ToLower(name)] =
+			strconv.FormatBool(state)
+	}
+	for name, state := range doc.DigitalOutputs {
+		topics["status/digital_outputs/"+strings.ToLower(name)] =
+			strconv.FormatBool(state)
+	}
+	return topics
+}
+
+// publishStatus sends the status topics that changed since the last
+// publication. The caller holds b.mu.
+func (b *Bridge) publishStatus(snapshot EM_CP_PP_ETH.Snapshot) {
+	for name, payload := range StatusTopics(snapshot) {
+		if previous, ok := b.retained[name]; ok && previous == payload {
+			continue
+		}
+		if b.publish(name, payload, true) {
+			b.retained[name] = payload
+		}
+	}
+}
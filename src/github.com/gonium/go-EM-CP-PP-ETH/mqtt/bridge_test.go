@@ -0,0 +1,270 @@
+package mqtt_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/mqtt"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+const (
+	PREFIX    = "em-cp-pp-eth/test"
+	BRIDGE_ID = "bridge"
+	// Time budget of every expected message.
+	WAIT = 5 * time.Second
+)
+
+var clients int32
+
+// startBridge runs a bridge for a simulated station until the test
+// ends. configure, if set, adjusts the bridge before it connects. It
+// returns once the bridge subscribed to its commands.
+func startBridge(t *testing.T, broker *testBroker, configure func(*mqtt.Bridge)) *simulator.Device {
+	t.Helper()
+	station := simulatortest.Start(t)
+	bridge := mqtt.NewBridge(station.Client(), "test")
+	bridge.Timeout = 2 * time.Second
+	if configure != nil {
+		configure(bridge)
+	}
+	options := paho.NewClientOptions().AddBroker(broker.URL()).
+		SetClientID(BRIDGE_ID).SetConnectRetryInterval(50 * time.Millisecond).
+		SetMaxReconnectInterval(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- bridge.Run(ctx, options, 20*time.Millisecond) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(WAIT)
+	for !broker.subscribed(BRIDGE_ID, PREFIX+"/set/+") {
+		select {
+		case err := <-done:
+			t.Fatalf("Bridge stopped: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Bridge did not subscribe to its commands")
+		}
+	}
+	return station.Device
+}
+
+// connect returns a client of the broker that is disconnected when the
+// test ends.
+func connect(t *testing.T, broker *testBroker) paho.Client {
+	t.Helper()
+	id := fmt.Sprintf("client-%d", atomic.AddInt32(&clients, 1))
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(broker.URL()).
+		SetClientID(id).SetAutoReconnect(false))
+	if token := client.Connect(); !token.WaitTimeout(WAIT) || token.Error() != nil {
+		t.Fatalf("Failed to connect to broker: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// subscribe returns the messages of filter below the prefix.
+func subscribe(t *testing.T, broker *testBroker, filter string) <-chan paho.Message {
+	t.Helper()
+	messages := make(chan paho.Message, 256)
+	token := connect(t, broker).Subscribe(PREFIX+"/"+filter, 0,
+		func(_ paho.Client, msg paho.Message) { messages <- msg })
+	if !token.WaitTimeout(WAIT) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe to %s: %v", filter, token.Error())
+	}
+	return messages
+}
+
+// publish sends payload to the topic name below the prefix.
+func publish(t *testing.T, client paho.Client, name, payload string, retain bool) {
+	t.Helper()
+	token := client.Publish(PREFIX+"/"+name, 1, retain, payload)
+	if !token.WaitTimeout(WAIT) || token.Error() != nil {
+		t.Fatalf("Failed to publish %s: %v", name, token.Error())
+	}
+}
+
+// await skips messages until one on the topic name below the prefix
+// arrives, with payload unless that is empty.
+func await(t *testing.T, messages <-chan paho.Message, name, payload string) paho.Message {
+	t.Helper()
+	timeout := time.After(WAIT)
+	var seen []string
+	for {
+		select {
+		case msg := <-messages:
+			if msg.Topic() != PREFIX+"/"+name {
+				continue
+			}
+			if payload == "" || string(msg.Payload()) == payload {
+				return msg
+			}
+			seen = append(seen, string(msg.Payload()))
+		case <-timeout:
+			t.Fatalf("No message %s %s, got %q", name, payload, seen)
+		}
+	}
+}
+
+func TestBridgeStatus(t *testing.T) {
+	broker := startBroker(t)
+	events := subscribe(t, broker, "event/#")
+	device := startBridge(t, broker, nil)
+	live := subscribe(t, broker, "status/ev_state")
+	await(t, live, "status/ev_state", "A")
+
+	// A late subscriber gets the last status from the broker
+	retained := subscribe(t, broker, "status/#")
+	want := map[string]string{
+		"status/ev_state":          "A",
+		"status/vehicle_connected": "false",
+		"status/charging_enabled":  "true",
+		"status/errors":            "[]",
+		"status/l1_voltage":        "230",
+		"status/digital_inputs/en": "false",
+	}
+	got := make(map[string]paho.Message)
+	timeout := time.After(WAIT)
+	for len(got) < len(want) {
+		select {
+		case msg := <-retained:
+			name := strings.TrimPrefix(msg.Topic(), PREFIX+"/")
+			if _, ok := want[name]; ok {
+				got[name] = msg
+			}
+		case <-timeout:
+			t.Fatalf("Got only %d of the %d status topics", len(got), len(want))
+		}
+	}
+	for name, payload := range want {
+		if msg := got[name]; string(msg.Payload()) != payload || !msg.Retained() {
+			t.Errorf("%s: '%s', retained %t, want '%s' retained", name,
+				msg.Payload(), msg.Retained(), payload)
+		}
+	}
+	connection := subscribe(t, broker, "connection")
+	if msg := await(t, connection, "connection", "online"); !msg.Retained() {
+		t.Error("connection is not retained")
+	}
+
+	status := EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB,
+		ProximityCurrent: 32}
+	if err := device.SetStatus(status); err != nil {
+		t.Fatal(err)
+	}
+	await(t, live, "status/ev_state", "B")
+	msg := await(t, events, "event/ev_state", "")
+	var doc EM_CP_PP_ETH.EVStateEventDocument
+	if err := json.Unmarshal(msg.Payload(), &doc); err != nil ||
+		doc.Old != "A" || doc.New != "B" {
+		t.Errorf("Event %s, want A to B", msg.Payload())
+	}
+}
+
+func TestBridgeWill(t *testing.T) {
+	broker := startBroker(t)
+	startBridge(t, broker, nil)
+	connection := subscribe(t, broker, "connection")
+	await(t, connection, "connection", "online")
+
+	if !broker.drop(BRIDGE_ID) {
+		t.Fatal("Bridge is not connected")
+	}
+	await(t, connection, "connection", "offline")
+	// The bridge reconnects on its own
+	await(t, connection, "connection", "online")
+}
+
+func TestBridgeCurrentCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		guard   EM_CP_PP_ETH.CurrentGuard
+		request string
+		ok      bool
+		// Value confirmed in the ack if ok, otherwise part of the error.
+		result string
+		stored uint16
+	}{
+		{"accepted", EM_CP_PP_ETH.CurrentGuard{}, "12", true, "12", 12},
+		{"above the installation limit", EM_CP_PP_ETH.CurrentGuard{}, "40", false,
+			"rejected", 10},
+		{"clamped", EM_CP_PP_ETH.CurrentGuard{Clamp: true}, "40", true, "32", 32},
+		{"configured limit", EM_CP_PP_ETH.CurrentGuard{MaxCurrent: 11}, "12",
+			false, "rejected", 10},
+		{"not a number", EM_CP_PP_ETH.CurrentGuard{}, "ten", false,
+			"Invalid current 'ten'", 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := startBroker(t)
+			acks := subscribe(t, broker, "ack/current")
+			device := startBridge(t, broker, func(b *mqtt.Bridge) {
+				b.Commander.Guard = tc.guard
+			})
+			device.SetHoldingRegister(EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT, 10)
+
+			publish(t, connect(t, broker), "set/"+mqtt.COMMAND_CURRENT,
+				tc.request, false)
+			var ack mqtt.AckDocument
+			msg := await(t, acks, "ack/current", "")
+			if err := json.Unmarshal(msg.Payload(), &ack); err != nil {
+				t.Fatalf("Invalid ack %s: %s", msg.Payload(), err.Error())
+			}
+			if ack.Command != mqtt.COMMAND_CURRENT || ack.Request != tc.request ||
+				ack.OK != tc.ok {
+				t.Errorf("Ack %s, want ok %t for %s", msg.Payload(), tc.ok,
+					tc.request)
+			}
+			switch {
+			case tc.ok && (ack.Result == nil ||
+				fmt.Sprint(ack.Result.Value) != tc.result):
+				t.Errorf("Ack %s, want the result %s", msg.Payload(), tc.result)
+			case !tc.ok && !strings.Contains(ack.Error, tc.result):
+				t.Errorf("Ack %s, want an error with '%s'", msg.Payload(),
+					tc.result)
+			}
+			got, _ := device.HoldingRegister(EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT)
+			if got != tc.stored {
+				t.Errorf("Register holds %d, want %d", got, tc.stored)
+			}
+		})
+	}
+}
+
+func TestBridgeIgnoresRetainedCommand(t *testing.T) {
+	broker := startBroker(t)
+	client := connect(t, broker)
+	publish(t, client, "set/"+mqtt.COMMAND_CURRENT, "6", true)
+	acks := subscribe(t, broker, "ack/current")
+	device := startBridge(t, broker, nil)
+
+	// The broker delivers the retained command with the subscription.
+	// The bridge handles commands concurrently, so an ack for it would
+	// arrive shortly before or after the one of the next command.
+	publish(t, client, "set/"+mqtt.COMMAND_CURRENT, "12", false)
+	msg := await(t, acks, "ack/current", "")
+	var ack mqtt.AckDocument
+	if err := json.Unmarshal(msg.Payload(), &ack); err != nil || ack.Request != "12" {
+		t.Errorf("Ack %s, want the one for 12", msg.Payload())
+	}
+	select {
+	case msg := <-acks:
+		t.Errorf("Unexpected ack %s", msg.Payload())
+	case <-time.After(200 * time.Millisecond):
+	}
+	got, _ := device.HoldingRegister(EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT)
+	if got != 12 {
+		t.Errorf("Register holds %d, want 12", got)
+	}
+}
@@ -0,0 +1,224 @@
+package mqtt_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker for the tests. It keeps
+// retained messages and sends wills, and delivers everything with
+// QoS 0. It acknowledges QoS 1 publications but does not support
+// persistent sessions or QoS 2.
+type testBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[*brokerSession]struct{}
+	retained map[string]*packets.PublishPacket
+}
+
+type brokerSession struct {
+	conn net.Conn
+	id   string
+	// Guards writes to conn.
+	mu   sync.Mutex
+	subs []string
+	will *packets.PublishPacket
+}
+
+// startBroker listens on a free local port until the test ends.
+func startBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker: %s", err.Error())
+	}
+	b := &testBroker{
+		listener: listener,
+		sessions: make(map[*brokerSession]struct{}),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+// URL returns the address for paho.ClientOptions.AddBroker.
+func (b *testBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+}
+
+// drop closes the connection of a client like a network failure
+// would, so its will is published.
+func (b *testBroker) drop(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		if s.id == id {
+			s.conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed reports whether the client id is connected and holds a
+// subscription to filter.
+func (b *testBroker) subscribed(id, filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		if s.id != id {
+			continue
+		}
+		for _, sub := range s.subs {
+			if sub == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(&brokerSession{conn: conn})
+	}
+}
+
+// matchTopic reports whether topic matches the subscription filter.
+func matchTopic(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func (s *brokerSession) write(p packets.ControlPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.Write(s.conn)
+}
+
+func (s *brokerSession) send(topic string, payload []byte, retain bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Retain = retain
+	s.write(p)
+}
+
+// deliver stores p if it is retained and sends it to all subscribers.
+func (b *testBroker) deliver(p *packets.PublishPacket) {
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p
+		}
+	}
+	var targets []*brokerSession
+	for s := range b.sessions {
+		for _, filter := range s.subs {
+			if matchTopic(filter, p.TopicName) {
+				targets = append(targets, s)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, s := range targets {
+		s.send(p.TopicName, p.Payload, false)
+	}
+}
+
+func (b *testBroker) handle(s *brokerSession) {
+	defer func() {
+		s.conn.Close()
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+		if s.will != nil {
+			b.deliver(s.will)
+		}
+	}()
+	for {
+		cp, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			if p.WillFlag {
+				will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				will.TopicName = p.WillTopic
+				will.Payload = p.WillMessage
+				will.Retain = p.WillRetain
+				s.will = will
+			}
+			b.mu.Lock()
+			s.id = p.ClientIdentifier
+			b.sessions[s] = struct{}{}
+			b.mu.Unlock()
+			s.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = make([]byte, len(p.Topics))
+			var retained []*packets.PublishPacket
+			b.mu.Lock()
+			s.subs = append(s.subs, p.Topics...)
+			for _, r := range b.retained {
+				for _, filter := range p.Topics {
+					if matchTopic(filter, r.TopicName) {
+						retained = append(retained, r)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			s.write(ack)
+			for _, r := range retained {
+				s.send(r.TopicName, r.Payload, true)
+			}
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				s.write(ack)
+			}
+			b.deliver(p)
+		case *packets.PingreqPacket:
+			s.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			// A clean disconnect discards the will
+			s.will = nil
+			return
+		}
+	}
+}
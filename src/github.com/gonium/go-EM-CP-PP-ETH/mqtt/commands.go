@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// AckDocument is published to ack/<command> after each command.
+type AckDocument struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	// Payload of the command as received.
+	Request string `json:"request"`
+	OK      bool   `json:"ok"`
+	// Value written to the controller, which may differ from the
+	// request if the current was clamped.
+	Result *EM_CP_PP_ETH.ValueDocument `json:"result,omitempty"`
+	Error  string                      `json:"error,omitempty"`
+}
+
+// handleCommand executes a message of set/<command>. The payload is
+// the plain value, i.e. 16 for the current or true for availability
+// and digimode.
+func (b *Bridge) handleCommand(_ paho.Client, msg paho.Message) {
+	command := msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:]
+	request := strings.TrimSpace(string(msg.Payload()))
+	if msg.Retained() {
+		// A retained command would be executed again on every
+		// connect.
+		b.Logger.Printf("Ignoring retained command %s %s", command, request)
+		return
+	}
+	ack := AckDocument{Command: command, Request: request}
+	ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+	defer cancel()
+	result, err := b.execute(ctx, command, request)
+	ack.Time = time.Now()
+	if err != nil {
+		b.Logger.Printf("Command %s %s failed: %s", command, request, err.Error())
+		ack.Error = err.Error()
+	} else {
+		b.Logger.Printf("%s set to %v", result.Name, result.Value)
+		ack.OK = true
+		ack.Result = &result
+		b.refresh(ctx)
+	}
+	b.publishJSON("ack/"+command, ack, false)
+}
+
+// execute writes the setting of command.
+func (b *Bridge) execute(ctx context.Context, command, request string) (EM_CP_PP_ETH.ValueDocument, error) {
+	switch command {
+	case COMMAND_CURRENT:
+		setting, _ := EM_CP_PP_ETH.LookupConfigRegister("ActualChargingCurrent")
+		requested, err := strconv.ParseUint(request, 10, 16)
+		if err != nil {
+			return EM_CP_PP_ETH.ValueDocument{}, fmt.Errorf(
+				"Invalid current '%s'", request)
+		}
+		current, err := b.Commander.WriteActualChargingCurrentContext(ctx,
+			uint16(requested))
+		if err != nil {
+			return EM_CP_PP_ETH.ValueDocument{}, err
+		}
+		return EM_CP_PP_ETH.NewValueDocument(setting, current, time.Now()), nil
+	case COMMAND_AVAILABILITY:
+		return b.writeSwitch(ctx, "ChargingEnabled", request,
+			b.Commander.WriteChargingEnabledContext)
+	case COMMAND_DIGIMODE:
+		return b.writeSwitch(ctx, "DigimodeEnabled", request,
+			b.Commander.WriteDigimodeEnabledContext)
+	}
+	return EM_CP_PP_ETH.ValueDocument{}, fmt.Errorf("Unknown command %s",
+		command)
+}
+
+// writeSwitch writes a coil setting.
+func (b *Bridge) writeSwitch(ctx context.Context, name, request string,
+	write func(context.Context, bool) error) (EM_CP_PP_ETH.ValueDocument, error) {
+	setting, _ := EM_CP_PP_ETH.LookupConfigRegister(name)
+	state, err := strconv.ParseBool(request)
+	if err != nil {
+		return EM_CP_PP_ETH.ValueDocument{}, fmt.Errorf(
+			"Invalid state '%s', expected true or false", request)
+	}
+	if err := write(ctx, state); err != nil {
+		return EM_CP_PP_ETH.ValueDocument{}, err
+	}
+	return EM_CP_PP_ETH.NewValueDocument(setting, state, time.Now()), nil
+}
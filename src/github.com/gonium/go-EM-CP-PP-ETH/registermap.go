@@ -0,0 +1,409 @@
+package EM_CP_PP_ETH
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// WordOrder describes how a value spanning two registers is laid out.
+type WordOrder int
+
+const (
+	// The first register holds the high word.
+	HighWordFirst WordOrder = iota
+	// The first register holds the low word. The controller transmits
+	// all meter values this way.
+	LowWordFirst
+)
+
+func (o WordOrder) String() string {
+	if o == LowWordFirst {
+		return "low word first"
+	}
+	return "high word first"
+}
+
+// Register describes a status value held in one or two consecutive
+// input registers.
+type Register struct {
+	// Name of the Status field the value is decoded into.
+	Field string
+	// Modbus address of the first register.
+	Address uint16
+	// Number of registers, 1 (16 bit) or 2 (32 bit).
+	Words uint16
+	// Word order of 32 bit values.
+	Order WordOrder
+	// The decoded value is the raw register value times Scale.
+	Scale float64
+	// Physical unit of the decoded value.
+	Unit        string
+	Description string
+}
+
+// RegisterMap is a list of registers that is read in a single request.
+type RegisterMap []Register
+
+// InputRegisterMap describes the status values read from the input
+// registers of the controller. Decoding, bounds checks and the
+// register documentation are all derived from this table.
+var InputRegisterMap = RegisterMap{
+	{"EVStatus", 100, 1, HighWordFirst, 1, "", "Vehicle status according to IEC 61851 (ASCII 'A' to 'F')"},
+	{"ProximityCurrent", 101, 1, HighWordFirst, 1, "A", "Current carrying capacity of the cable (PP)"},
+	// This is strange. See the web interface for the "true" value.
+	{"ChargeTimeMinutes", 102, 1, HighWordFirst, 1.0 / 60, "min", "Charging time, minutes part"},
+	{"ChargeTimeHours", 103, 1, HighWordFirst, 1, "h", "Charging time, hours part"},
+	{"DIPConfiguration", 104, 1, HighWordFirst, 1, "", "DIP switch configuration"},
+	{"FirmwareVersion", 105, 2, HighWordFirst, 1, "", "Firmware version"},
+	{"Errorcode", 107, 1, HighWordFirst, 1, "", "Error code bit field"},
+	{"L1Voltage", 108, 2, LowWordFirst, 0.01, "V", "Voltage L1"},
+	{"L2Voltage", 110, 2, LowWordFirst, 0.01, "V", "Voltage L2"},
+	{"L3Voltage", 112, 2, LowWordFirst, 0.01, "V", "Voltage L3"},
+	{"L1Current", 114, 2, LowWordFirst, 0.001, "A", "Current L1"},
+	{"L2Current", 116, 2, LowWordFirst, 0.001, "A", "Current L2"},
+	{"L3Current", 118, 2, LowWordFirst, 0.001, "A", "Current L3"},
+	{"ActivePower", 120, 2, LowWordFirst, 10, "W", "Active power"},
+	{"ReactivePower", 122, 2, LowWordFirst, 1, "var", "Reactive power"},
+	{"ApparentPower", 124, 2, LowWordFirst, 10, "VA", "Apparent power"},
+	{"PowerFactor", 126, 2, LowWordFirst, 0.001, "", "Power factor"},
+	{"Energy", 128, 2, LowWordFirst, 0.01, "kWh", "Energy meter reading"},
+	{"MaxPower", 130, 2, LowWordFirst, 10, "W", "Maximum power of the charge sequence"},
+	{"CurrentChargePower", 132, 2, LowWordFirst, 1, "kWh", "Energy of the charge sequence"},
+	{"Frequency", 134, 2, LowWordFirst, 0.01, "Hz", "Grid frequency"},
+	{"L1MaxCurrent", 136, 2, LowWordFirst, 1, "A", "Maximum current L1 of the charge sequence"},
+	{"L2MaxCurrent", 138, 2, LowWordFirst, 1, "A", "Maximum current L2 of the charge sequence"},
+	{"L3MaxCurrent", 140, 2, LowWordFirst, 1, "A", "Maximum current L3 of the charge sequence"},
+}
+
+// OptionalRegisterMap describes status values outside the documented
+// block of 100 to 141. The original client decoded register 142 as the
+// overcurrent protection, but no documentation of it is known. Each of
+// these registers is read in a request of its own, and a controller
+// that answers with an exception leaves the value at zero.
+var OptionalRegisterMap = RegisterMap{
+	{"OverCurrentProtection", 142, 1, HighWordFirst, 1, "", "Overcurrent protection"},
+}
+
+// StatusRegisters returns the registers of InputRegisterMap followed by
+// those of OptionalRegisterMap.
+func StatusRegisters() RegisterMap {
+	registers := append(RegisterMap{}, InputRegisterMap...)
+	return append(registers, OptionalRegisterMap...)
+}
+
+// DiscreteInput describes a single bit of the digital I/O state.
+type DiscreteInput struct {
+	// Name of the Status field the bit is decoded into.
+	Field       string
+	Address     uint16
+	Description string
+}
+
+// DiscreteInputMap describes the digital inputs and outputs read from
+// the discrete inputs of the controller.
+var DiscreteInputMap = []DiscreteInput{
+	{"DigitalInputStates.EN", 200, "Input EN: enable charging"},
+	{"DigitalInputStates.XR", 201, "Input XR: external release"},
+	{"DigitalInputStates.LD", 202, "Input LD: locking detection"},
+	{"DigitalInputStates.ML", 203, "Input ML: manual locking"},
+	{"DigitalOutputStates.CR", 204, "Output CR: charger ready"},
+	{"DigitalOutputStates.LR", 205, "Output LR: locking"},
+	{"DigitalOutputStates.VR", 206, "Output VR: vehicle ready"},
+	{"DigitalOutputStates.ER", 207, "Output ER: error"},
+}
+
+// Span returns the first address and the number of registers needed
+// to read all values of the map in one request.
+func (m RegisterMap) Span() (address, quantity uint16) {
+	if len(m) == 0 {
+		return 0, 0
+	}
+	first, end := m[0].Address, m[0].Address+m[0].Words
+	for _, r := range m[1:] {
+		if r.Address < first {
+			first = r.Address
+		}
+		if r.Address+r.Words > end {
+			end = r.Address + r.Words
+		}
+	}
+	return first, end - first
+}
+
+// Decode fills the fields of s from the raw register block data, which
+// must start at the address returned by Span. A value that cannot be
+// decoded does not stop the other fields from being filled; the first
+// such error is returned after all fields have been processed.
+func (m RegisterMap) Decode(data []byte, s *Status) error {
+	start, quantity := m.Span()
+	if len(data) != 2*int(quantity) {
+		return fmt.Errorf(
+			"Invalid length of register block - expected %d bytes, got %d",
+			2*quantity, len(data),
+		)
+	}
+	var valueErr error
+	target := reflect.ValueOf(s).Elem()
+	for _, r := range m {
+		raw, err := r.extract(data, start)
+		if err != nil {
+			return err
+		}
+		field, err := structField(target, r.Field)
+		if err != nil {
+			return err
+		}
+		if err := r.decode(raw, field); err != nil && valueErr == nil {
+			valueErr = fmt.Errorf("Register %d (%s): %w", r.Address,
+				r.Field, err)
+		}
+	}
+	return valueErr
+}
+
+// Encode builds the raw register block for s. It is the inverse of
+// Decode and used by the simulator.
+func (m RegisterMap) Encode(s *Status) ([]byte, error) {
+	start, quantity := m.Span()
+	data := make([]byte, 2*quantity)
+	source := reflect.ValueOf(s).Elem()
+	for _, r := range m {
+		field, err := structField(source, r.Field)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := r.encode(field)
+		if err != nil {
+			return nil, fmt.Errorf("Register %d (%s): %s", r.Address,
+				r.Field, err.Error())
+		}
+		offset := 2 * int(r.Address-start)
+		switch {
+		case r.Words == 1:
+			binary.BigEndian.PutUint16(data[offset:], uint16(raw))
+		case r.Order == LowWordFirst:
+			binary.BigEndian.PutUint16(data[offset:], uint16(raw))
+			binary.BigEndian.PutUint16(data[offset+2:], uint16(raw>>16))
+		default:
+			binary.BigEndian.PutUint32(data[offset:], raw)
+		}
+	}
+	return data, nil
+}
+
+// extract returns the raw value of r from a register block starting at
+// address start.
+func (r Register) extract(data []byte, start uint16) (uint32, error) {
+	if r.Address < start || r.Words < 1 || r.Words > 2 {
+		return 0, fmt.Errorf("Register %d (%s) is not part of the block",
+			r.Address, r.Field)
+	}
+	offset := 2 * int(r.Address-start)
+	if offset+2*int(r.Words) > len(data) {
+		return 0, fmt.Errorf(
+			"Register %d (%s) exceeds the block of %d registers",
+			r.Address, r.Field, len(data)/2)
+	}
+	value := data[offset : offset+2*int(r.Words)]
+	switch {
+	case r.Words == 1:
+		return uint32(binary.BigEndian.Uint16(value)), nil
+	case r.Order == LowWordFirst:
+		return uint32(binary.BigEndian.Uint16(value[2:4]))<<16 |
+			uint32(binary.BigEndian.Uint16(value[0:2])), nil
+	default:
+		return binary.BigEndian.Uint32(value), nil
+	}
+}
+
+// registerValue is implemented by Status field types that need more
+// than scaling to convert from and to their register representation.
+type registerValue interface {
+	decodeRegister(raw uint32) error
+	encodeRegister() uint32
+}
+
+func (r Register) decode(raw uint32, field reflect.Value) error {
+	if v, ok := field.Addr().Interface().(registerValue); ok {
+		return v.decodeRegister(raw)
+	}
+	switch field.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// Truncate like an integer division would, the epsilon only
+		// compensates for scales such as 1/60 that are not exact.
+		field.SetUint(uint64(math.Floor(float64(raw)*r.Scale + 1e-9)))
+	case reflect.Float32, reflect.Float64:
+		field.SetFloat(float64(raw) * r.Scale)
+	default:
+		return fmt.Errorf("Unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+func (r Register) encode(field reflect.Value) (uint32, error) {
+	if v, ok := field.Addr().Interface().(registerValue); ok {
+		return v.encodeRegister(), nil
+	}
+	var value float64
+	switch field.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value = float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		value = field.Float()
+	default:
+		return 0, fmt.Errorf("Unsupported field type %s", field.Type())
+	}
+	raw := math.Floor(value/r.Scale + 0.5)
+	if raw < 0 {
+		raw = 0
+	}
+	if raw > math.MaxUint32 || (r.Words == 1 && raw > math.MaxUint16) {
+		return 0, fmt.Errorf("Value %v out of range", value)
+	}
+	return uint32(raw), nil
+}
+
+// structField resolves a field name such as "DigitalInputStates.EN".
+func structField(v reflect.Value, name string) (reflect.Value, error) {
+	for _, part := range strings.Split(name, ".") {
+		parent := v.Type()
+		if parent.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%s has no field %s", parent, name)
+		}
+		if v = v.FieldByName(part); !v.IsValid() {
+			return v, fmt.Errorf("%s has no field %s", parent, name)
+		}
+	}
+	return v, nil
+}
+
+// DecodeDiscreteInputs fills the digital I/O fields of s from the bits
+// returned by a discrete input read starting at the first address of
+// DiscreteInputMap.
+func DecodeDiscreteInputs(data []byte, s *Status) error {
+	start, quantity := DiscreteInputSpan()
+	if len(data) != (int(quantity)+7)/8 {
+		return fmt.Errorf(
+			"Invalid length of discrete input block - expected %d bytes, got %d",
+			(quantity+7)/8, len(data),
+		)
+	}
+	target := reflect.ValueOf(s).Elem()
+	for _, d := range DiscreteInputMap {
+		field, err := structField(target, d.Field)
+		if err != nil {
+			return err
+		}
+		bit := d.Address - start
+		field.SetBool(data[bit/8]&(1<<(bit%8)) != 0)
+	}
+	return nil
+}
+
+// EncodeDiscreteInputs returns the digital I/O state of s as a list of
+// bits, starting at the first address of DiscreteInputMap.
+func EncodeDiscreteInputs(s *Status) ([]bool, error) {
+	start, quantity := DiscreteInputSpan()
+	bits := make([]bool, quantity)
+	source := reflect.ValueOf(s).Elem()
+	for _, d := range DiscreteInputMap {
+		field, err := structField(source, d.Field)
+		if err != nil {
+			return nil, err
+		}
+		bits[d.Address-start] = field.Bool()
+	}
+	return bits, nil
+}
+
+// DiscreteInputSpan returns the first address and the number of bits
+// needed to read all discrete inputs in one request.
+func DiscreteInputSpan() (address, quantity uint16) {
+	first, last := DiscreteInputMap[0].Address, DiscreteInputMap[0].Address
+	for _, d := range DiscreteInputMap[1:] {
+		if d.Address < first {
+			first = d.Address
+		}
+		if d.Address > last {
+			last = d.Address
+		}
+	}
+	return first, last - first + 1
+}
+
+// formatScale prints scales such as 1/60 as a fraction instead of a
+// long decimal.
+func formatScale(scale float64) string {
+	formatted := fmt.Sprintf("%g", scale)
+	if len(formatted) > 8 && scale > 0 && scale < 1 {
+		inverse := 1 / scale
+		if math.Abs(inverse-math.Round(inverse)) < 1e-9 {
+			return fmt.Sprintf("1/%.0f", inverse)
+		}
+	}
+	return formatted
+}
+
+// WriteRegisterDocumentation renders the register maps as Markdown
+// tables.
+func WriteRegisterDocumentation(out io.Writer) {
+	fmt.Fprintf(out, "# EM-CP-PP-ETH register map\n\n")
+	fmt.Fprintf(out, "Generated with `em-cp-pp-eth registers` from the "+
+		"register map in `registermap.go`.\n\n")
+	fmt.Fprintf(out, "## Input registers (function code 4)\n\n")
+	fmt.Fprintf(out, "| Address | Words | Word order | Scale | Unit | Field | Description |\n")
+	fmt.Fprintf(out, "|---|---|---|---|---|---|---|\n")
+	for _, r := range InputRegisterMap {
+		order := "-"
+		if r.Words > 1 {
+			order = r.Order.String()
+		}
+		fmt.Fprintf(out, "| %d | %d | %s | %s | %s | %s | %s |\n",
+			r.Address, r.Words, order, formatScale(r.Scale), r.Unit,
+			r.Field, r.Description)
+	}
+	fmt.Fprintf(out, "\nOptional input registers, read one by one. They are not"+
+		" documented; a controller that answers with an exception reports"+
+		" zero.\n\n")
+	fmt.Fprintf(out, "| Address | Words | Word order | Scale | Unit | Field | Description |\n")
+	fmt.Fprintf(out, "|---|---|---|---|---|---|---|\n")
+	for _, r := range OptionalRegisterMap {
+		order := "-"
+		if r.Words > 1 {
+			order = r.Order.String()
+		}
+		fmt.Fprintf(out, "| %d | %d | %s | %s | %s | %s | %s |\n",
+			r.Address, r.Words, order, formatScale(r.Scale), r.Unit,
+			r.Field, r.Description)
+	}
+	fmt.Fprintf(out, "\n## Discrete inputs (function code 2)\n\n")
+	fmt.Fprintf(out, "| Address | Field | Description |\n")
+	fmt.Fprintf(out, "|---|---|---|\n")
+	for _, d := range DiscreteInputMap {
+		fmt.Fprintf(out, "| %d | %s | %s |\n", d.Address, d.Field,
+			d.Description)
+	}
+	fmt.Fprintf(out, "\n## Holding registers (function codes 3 and 6)\n\n")
+	fmt.Fprintf(out, "| Address | Range | Unit | Default | Field | Description |\n")
+	fmt.Fprintf(out, "|---|---|---|---|---|---|\n")
+	for _, r := range ConfigurationMap {
+		if !r.Coil {
+			fmt.Fprintf(out, "| %d | %d-%d | %s | %d | %s | %s |\n",
+				r.Address, r.Min, r.Max, r.Unit, r.Default, r.Field,
+				r.Description)
+		}
+	}
+	fmt.Fprintf(out, "\n## Coils (function codes 1 and 5)\n\n")
+	fmt.Fprintf(out, "| Address | Default | Field | Description |\n")
+	fmt.Fprintf(out, "|---|---|---|---|\n")
+	for _, r := range ConfigurationMap {
+		if r.Coil {
+			fmt.Fprintf(out, "| %d | %t | %s | %s |\n", r.Address,
+				r.Default == 1, r.Field, r.Description)
+		}
+	}
+}
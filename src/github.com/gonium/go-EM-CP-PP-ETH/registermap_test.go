@@ -0,0 +1,169 @@
+package EM_CP_PP_ETH
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSpan(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		m                 RegisterMap
+		address, quantity uint16
+	}{
+		{"empty", RegisterMap{}, 0, 0},
+		{"single word", RegisterMap{{Field: "EVStatus", Address: 100, Words: 1}}, 100, 1},
+		{"unordered with a gap", RegisterMap{
+			{Field: "L1Voltage", Address: 108, Words: 2},
+			{Field: "EVStatus", Address: 100, Words: 1},
+		}, 100, 10},
+		{"input registers", InputRegisterMap, 100, 42},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			address, quantity := tc.m.Span()
+			if address != tc.address || quantity != tc.quantity {
+				t.Errorf("Span %d, %d, want %d, %d", address, quantity,
+					tc.address, tc.quantity)
+			}
+		})
+	}
+}
+
+func TestDecodeWordOrder(t *testing.T) {
+	m := RegisterMap{
+		{"FirmwareVersion", 105, 2, HighWordFirst, 1, "", ""},
+		{"L1Voltage", 107, 2, LowWordFirst, 0.01, "V", ""},
+		{"ProximityCurrent", 109, 1, HighWordFirst, 1, "A", ""},
+	}
+	data := []byte{
+		0x00, 0x01, 0x00, 0x02, // 0x00010002
+		0x59, 0xD8, 0x00, 0x00, // 0x000059D8 = 23000
+		0x00, 0x20, // 32
+	}
+	var s Status
+	if err := m.Decode(data, &s); err != nil {
+		t.Fatalf("Decode: %s", err.Error())
+	}
+	if s.FirmwareVersion != 0x00010002 || s.L1Voltage != 230 ||
+		s.ProximityCurrent != 32 {
+		t.Errorf("Decoded firmware %#x, voltage %v, proximity %d, want "+
+			"0x10002, 230 and 32", s.FirmwareVersion, s.L1Voltage,
+			s.ProximityCurrent)
+	}
+	encoded, err := m.Encode(&s)
+	if err != nil {
+		t.Fatalf("Encode: %s", err.Error())
+	}
+	if !reflect.DeepEqual(encoded, data) {
+		t.Errorf("Encoded % x, want % x", encoded, data)
+	}
+}
+
+func TestDecodeBounds(t *testing.T) {
+	start, quantity := InputRegisterMap.Span()
+	for _, tc := range []struct {
+		name string
+		m    RegisterMap
+		data []byte
+	}{
+		{"short buffer", InputRegisterMap, make([]byte, 2*quantity-1)},
+		{"long buffer", InputRegisterMap, make([]byte, 2*quantity+2)},
+		{"empty buffer", InputRegisterMap, nil},
+		{"unknown field", RegisterMap{{Field: "Missing", Address: start, Words: 1}},
+			make([]byte, 2)},
+		{"field of a scalar", RegisterMap{{Field: "ProximityCurrent.Missing",
+			Address: start, Words: 1}}, make([]byte, 2)},
+		{"three words", RegisterMap{{Field: "FirmwareVersion", Address: start,
+			Words: 3}}, make([]byte, 6)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var s Status
+			if err := tc.m.Decode(tc.data, &s); err == nil {
+				t.Error("Decode succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestExtractOutsideBlock(t *testing.T) {
+	data := make([]byte, 4)
+	for _, r := range []Register{
+		{Field: "EVStatus", Address: 99, Words: 1},
+		{Field: "L1Voltage", Address: 101, Words: 2},
+		{Field: "EVStatus", Address: 102, Words: 1},
+	} {
+		if _, err := r.extract(data, 100); err == nil {
+			t.Errorf("Register %d/%d in a block of 2 at 100: no error",
+				r.Address, r.Words)
+		}
+	}
+}
+
+func TestDecodeKeepsFieldsAfterValueError(t *testing.T) {
+	m := RegisterMap{
+		{"EVStatus", 100, 1, HighWordFirst, 1, "", ""},
+		{"ProximityCurrent", 101, 1, HighWordFirst, 1, "A", ""},
+	}
+	var s Status
+	err := m.Decode([]byte{0x00, 'X', 0x00, 20}, &s)
+	var stateErr *UnknownEVStateError
+	if !errors.As(err, &stateErr) || stateErr.Raw != 'X' {
+		t.Errorf("Got %v, want an *UnknownEVStateError for 'X'", err)
+	}
+	if s.EVStatus != EVStateUnknown || s.ProximityCurrent != 20 {
+		t.Errorf("Decoded state %s and proximity %d, want unknown and 20",
+			s.EVStatus, s.ProximityCurrent)
+	}
+}
+
+func TestEncodeOutOfRange(t *testing.T) {
+	m := RegisterMap{{"ProximityCurrent", 101, 1, HighWordFirst, 0.5, "A", ""}}
+	if _, err := m.Encode(&Status{ProximityCurrent: 40000}); err == nil {
+		t.Error("Encoded 80000 into a single register")
+	}
+}
+
+func TestStructFieldError(t *testing.T) {
+	var s Status
+	for _, name := range []string{"Missing", "DigitalInputStates.Missing",
+		"EVStatus.Missing"} {
+		if _, err := structField(reflect.ValueOf(&s).Elem(), name); err == nil {
+			t.Errorf("structField(%q) succeeded", name)
+		}
+	}
+	field, err := structField(reflect.ValueOf(&s).Elem(), "DigitalOutputStates.ER")
+	if err != nil || field.Kind() != reflect.Bool {
+		t.Errorf("structField(DigitalOutputStates.ER) = %v, %v", field, err)
+	}
+}
+
+func TestDiscreteInputs(t *testing.T) {
+	want := Status{
+		DigitalInputStates:  DigiInputs{EN: true, ML: true},
+		DigitalOutputStates: DigiOutputs{LR: true, ER: true},
+	}
+	bits, err := EncodeDiscreteInputs(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packed byte
+	for i, state := range bits {
+		if state {
+			packed |= 1 << uint(i)
+		}
+	}
+	if packed != 0xA9 {
+		t.Errorf("Encoded %08b, want 10101001", packed)
+	}
+	var got Status
+	if err := DecodeDiscreteInputs([]byte{packed}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Decoded %+v, want %+v", got, want)
+	}
+	if err := DecodeDiscreteInputs([]byte{packed, 0}, &got); err == nil {
+		t.Error("Decoded a block of two bytes")
+	}
+}
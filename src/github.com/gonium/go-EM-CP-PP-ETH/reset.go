@@ -0,0 +1,163 @@
+package EM_CP_PP_ETH
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	DEFAULT_RESET_PROBE_INTERVAL = 1 * time.Second
+	DEFAULT_RESET_DOWN_TIMEOUT   = 15 * time.Second
+	DEFAULT_RESET_UP_TIMEOUT     = 90 * time.Second
+)
+
+var (
+	// The controller did not answer before the reset was sent.
+	ErrUnreachable = errors.New("Charge controller is unreachable")
+	// The controller kept answering after the reset was sent.
+	ErrResetIgnored = errors.New("Charge controller did not go down after the reset")
+	// The controller went down but did not answer again.
+	ErrNotReturned = errors.New("Charge controller did not come back after the reset")
+)
+
+// ResetOptions control how ResetAndVerify observes the restart. Zero
+// durations select the defaults.
+type ResetOptions struct {
+	// Connection is closed after a failed probe, so the next probe
+	// connects again. Pass the *TCPClientHandler of the client;
+	// without it, the connection broken by the restart is never
+	// replaced.
+	Connection io.Closer
+	// Time between probes, also the time budget of each probe.
+	Interval time.Duration
+	// Longest wait for the controller to stop answering.
+	DownTimeout time.Duration
+	// Longest wait for the controller to answer again once it is down.
+	UpTimeout time.Duration
+}
+
+// ResetReport describes an observed restart.
+type ResetReport struct {
+	// The reset request was sent.
+	Sent time.Time
+	// First probe that failed.
+	Down time.Time
+	// First probe that succeeded after Down.
+	Up time.Time
+	// Status read after the restart.
+	Status Status
+}
+
+// Downtime is the time from sending the reset until the controller
+// answered again, with the resolution of the probe interval.
+func (r ResetReport) Downtime() time.Duration {
+	return r.Up.Sub(r.Sent)
+}
+
+// ResetAndVerify resets the controller through its web interface and
+// watches it restart.
+func (c *Commander) ResetAndVerify(host string, opts ResetOptions) (ResetReport, error) {
+	return c.ResetAndVerifyContext(context.Background(), host, opts)
+}
+
+// ResetAndVerifyContext checks that the controller answers, sends the
+// reset and probes the status until the controller stopped answering
+// and came back. The errors wrap ErrUnreachable, ErrResetIgnored and
+// ErrNotReturned unless the reset could not be sent; the report holds
+// the times observed so far.
+func (c *Commander) ResetAndVerifyContext(ctx context.Context, host string, opts ResetOptions) (ResetReport, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_RESET_PROBE_INTERVAL
+	}
+	if opts.DownTimeout <= 0 {
+		opts.DownTimeout = DEFAULT_RESET_DOWN_TIMEOUT
+	}
+	if opts.UpTimeout <= 0 {
+		opts.UpTimeout = DEFAULT_RESET_UP_TIMEOUT
+	}
+	var report ResetReport
+	if _, err := c.probe(ctx, opts); err != nil {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		return report, fmt.Errorf("%w: %s", ErrUnreachable, err.Error())
+	}
+
+	report.Sent = time.Now()
+	if err := c.HTTPHardResetContext(ctx, host); err != nil {
+		return report, fmt.Errorf("Failed to send reset: %w", err)
+	}
+
+	// Wait for the first failing probe
+	deadline := report.Sent.Add(opts.DownTimeout)
+	for {
+		if err := sleepContext(ctx, opts.Interval); err != nil {
+			return report, err
+		}
+		if _, err := c.probe(ctx, opts); err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Down = time.Now()
+			break
+		}
+		if time.Now().After(deadline) {
+			return report, fmt.Errorf("%w within %s", ErrResetIgnored,
+				opts.DownTimeout)
+		}
+	}
+
+	// Wait for the first successful probe
+	deadline = report.Down.Add(opts.UpTimeout)
+	var lastErr error
+	for {
+		status, err := c.probe(ctx, opts)
+		if err == nil {
+			report.Up = time.Now()
+			report.Status = status
+			return report, nil
+		} else if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return report, fmt.Errorf("%w within %s: %s", ErrNotReturned,
+				opts.UpTimeout, lastErr.Error())
+		}
+		if err := sleepContext(ctx, opts.Interval); err != nil {
+			return report, err
+		}
+	}
+}
+
+// probe reads the status within one interval. After a failure the
+// connection is closed, so the next probe reconnects.
+func (c *Commander) probe(ctx context.Context, opts ResetOptions) (Status, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, opts.Interval)
+	defer cancel()
+	cache := NewStatusCache(c.modbusClient)
+	err := cache.RefreshContext(probeCtx)
+	var stateErr *UnknownEVStateError
+	if errors.As(err, &stateErr) {
+		err = nil
+	}
+	if err != nil && opts.Connection != nil {
+		opts.Connection.Close()
+	}
+	return cache.Snapshot().Status, err
+}
+
+// sleepContext waits for d or until ctx is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
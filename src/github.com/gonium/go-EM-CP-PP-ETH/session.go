@@ -0,0 +1,276 @@
+package EM_CP_PP_ETH
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// DEFAULT_MAX_SESSION_POWER bounds the plausible charging power in
+	// W, a bit above 3 x 230 V x 80 A. Counter increases that would need
+	// more power are treated as jumps and not counted.
+	DEFAULT_MAX_SESSION_POWER = 60000
+	// Phase currents above this value in A mark the phase as used.
+	SESSION_PHASE_THRESHOLD = 1.0
+)
+
+// Session is a single charging session, from plugging the vehicle in to
+// unplugging it. Times that did not happen yet are zero, which JSON
+// encodes as 0001-01-01T00:00:00Z.
+type Session struct {
+	// ID is unique per station, derived from the plug-in time.
+	ID        string    `json:"id"`
+	Station   string    `json:"station,omitempty"`
+	PluggedIn time.Time `json:"plugged_in"`
+	// Start of the first charge and end of the last one, zero while
+	// the vehicle charges.
+	ChargeStart time.Time `json:"charge_start"`
+	ChargeEnd   time.Time `json:"charge_end"`
+	// Zero while the session is active.
+	Unplugged time.Time `json:"unplugged"`
+	// Time of the last sample.
+	Updated time.Time `json:"updated"`
+	// Energy delivered in kWh.
+	Energy float64 `json:"energy_kwh"`
+	// Counter readings in kWh at plug-in and at the last sample. The
+	// counter is the energy meter if one was present at plug-in,
+	// otherwise the energy of the charge sequence.
+	StartCounter float64 `json:"start_counter_kwh"`
+	EndCounter   float64 `json:"end_counter_kwh"`
+	Meter        bool    `json:"meter"`
+	// PeakPower is the highest active power seen, in W.
+	PeakPower float64 `json:"peak_power_w"`
+	// Phases that carried current in order, i.e. ["L1", "L2", "L3"].
+	Phases []string `json:"phases"`
+	// Number of counter resets, i.e. after a controller reset, and of
+	// implausible counter jumps. Energy around these events is not
+	// counted.
+	CounterResets int `json:"counter_resets"`
+	CounterJumps  int `json:"counter_jumps"`
+}
+
+// Active reports whether the vehicle is still plugged in.
+func (s Session) Active() bool {
+	return s.Unplugged.IsZero()
+}
+
+// Duration returns the time the vehicle was plugged in, up to now for
+// active sessions.
+func (s Session) Duration(now time.Time) time.Duration {
+	if s.Active() {
+		return now.Sub(s.PluggedIn)
+	}
+	return s.Unplugged.Sub(s.PluggedIn)
+}
+
+// ChargeDuration returns the time from the first charge start to the
+// last charge end.
+func (s Session) ChargeDuration() time.Duration {
+	if s.ChargeStart.IsZero() || s.ChargeEnd.IsZero() {
+		return 0
+	}
+	return s.ChargeEnd.Sub(s.ChargeStart)
+}
+
+// SessionTracker derives charging sessions from status samples in
+// time order. A session starts when the vehicle state becomes B, C or
+// D and ends with state A. The fault states E and F, which also occur
+// while the controller resets, do not end a session. SessionTracker is
+// not safe for concurrent use.
+type SessionTracker struct {
+	// Station is copied into every session.
+	Station string
+	// MaxPower in W, see DEFAULT_MAX_SESSION_POWER.
+	MaxPower float64
+	// OnEvent is called by Update with a SessionEvent when a session
+	// starts and when it ends.
+	OnEvent func(Event)
+
+	active       *Session
+	charging     bool
+	lastTime     time.Time
+	lastCharge   float32
+	lastChargeAt uint16
+}
+
+func NewSessionTracker(station string) *SessionTracker {
+	return &SessionTracker{
+		Station:  station,
+		MaxPower: DEFAULT_MAX_SESSION_POWER,
+	}
+}
+
+// Active returns a copy of the session in progress.
+func (t *SessionTracker) Active() (Session, bool) {
+	if t.active == nil {
+		return Session{}, false
+	}
+	session := *t.active
+	session.Phases = append([]string(nil), t.active.Phases...)
+	return session, true
+}
+
+// Resume continues an active session, i.e. one saved before the
+// program was restarted. Energy delivered while nobody was watching is
+// counted with the next sample, as far as it is plausible.
+func (t *SessionTracker) Resume(s Session) {
+	session := s
+	session.Phases = append([]string{}, s.Phases...)
+	t.active = &session
+	t.charging = !s.ChargeStart.IsZero() && s.ChargeEnd.IsZero()
+	t.lastTime = s.Updated
+	t.lastCharge = 0
+	t.lastChargeAt = 0
+}
+
+// Update processes the status sampled at time at. It returns the
+// session that ended with this sample, if any. Samples with an unknown
+// vehicle state are ignored.
+func (t *SessionTracker) Update(s Status, at time.Time) (Session, bool) {
+	if !s.EVStatus.Valid() {
+		return Session{}, false
+	}
+	if t.active == nil {
+		if s.EVStatus.VehicleConnected() {
+			t.start(s, at)
+		}
+		return Session{}, false
+	}
+	t.account(s, at)
+	if s.EVStatus == EVStateA {
+		if t.charging {
+			t.active.ChargeEnd = at
+		}
+		t.active.Unplugged = at
+		session, _ := t.Active()
+		t.active = nil
+		t.charging = false
+		t.emit(SessionEvent{Time: at, Session: session})
+		return session, true
+	}
+	switch {
+	case s.EVStatus.Charging() && !t.charging:
+		if t.active.ChargeStart.IsZero() {
+			t.active.ChargeStart = at
+		}
+		// Charging resumed, the end of the last charge is yet to come
+		t.active.ChargeEnd = time.Time{}
+		t.charging = true
+	case !s.EVStatus.Charging() && t.charging:
+		t.active.ChargeEnd = at
+		t.charging = false
+	}
+	return Session{}, false
+}
+
+func (t *SessionTracker) start(s Status, at time.Time) {
+	meter := s.Energy > 0
+	counter := sessionCounter(s, meter)
+	t.active = &Session{
+		ID:           fmt.Sprintf("%s-%d", t.Station, at.Unix()),
+		Station:      t.Station,
+		PluggedIn:    at,
+		StartCounter: counter,
+		EndCounter:   counter,
+		Meter:        meter,
+		Phases:       []string{},
+	}
+	t.charging = false
+	t.lastTime = at
+	t.lastCharge = s.CurrentChargePower
+	t.lastChargeAt = 60*s.ChargeTimeHours + s.ChargeTimeMinutes
+	t.account(s, at)
+	if s.EVStatus.Charging() {
+		t.active.ChargeStart = at
+		t.charging = true
+	}
+	session, _ := t.Active()
+	t.emit(SessionEvent{Time: at, Session: session, Started: true})
+}
+
+func (t *SessionTracker) emit(e Event) {
+	if t.OnEvent != nil {
+		t.OnEvent(e)
+	}
+}
+
+// account adds the counter increase since the last sample and updates
+// the peak power and the phases.
+func (t *SessionTracker) account(s Status, at time.Time) {
+	session := t.active
+	counter := sessionCounter(s, session.Meter)
+	delta := counter - session.EndCounter
+	elapsed := at.Sub(t.lastTime)
+
+	// The charge sequence restarts from zero after a controller reset,
+	// which the meter reading does not show. Unplugging ends the charge
+	// sequence, so its counters may already be cleared in that sample.
+	unplugged := s.EVStatus == EVStateA
+	chargeTime := 60*s.ChargeTimeHours + s.ChargeTimeMinutes
+	restarted := !unplugged && (s.CurrentChargePower < t.lastCharge ||
+		chargeTime < t.lastChargeAt)
+
+	switch {
+	case !session.Meter && unplugged && delta < 0:
+		delta = 0
+		counter = session.EndCounter
+	case !session.Meter && (delta < 0 || restarted):
+		session.CounterResets++
+		delta = counter
+	case session.Meter && delta < 0:
+		// A meter reading going backwards cannot be attributed.
+		session.CounterResets++
+		delta = 0
+	case restarted:
+		session.CounterResets++
+	}
+	if delta > t.plausibleIncrease(elapsed, session.Meter) {
+		session.CounterJumps++
+		delta = 0
+	}
+	session.Energy += delta
+	session.EndCounter = counter
+	session.Updated = at
+	t.lastTime = at
+	t.lastCharge = s.CurrentChargePower
+	t.lastChargeAt = chargeTime
+
+	session.PeakPower = math.Max(session.PeakPower, float64(s.ActivePower))
+	currents := []float32{s.L1Current, s.L2Current, s.L3Current}
+	for i, current := range currents {
+		phase := fmt.Sprintf("L%d", i+1)
+		if current >= SESSION_PHASE_THRESHOLD && !containsString(session.Phases, phase) {
+			session.Phases = append(session.Phases, phase)
+		}
+	}
+	sort.Strings(session.Phases)
+}
+
+// plausibleIncrease returns the largest counter increase in kWh that
+// can be explained by charging at MaxPower for elapsed, plus the
+// resolution of the counter.
+func (t *SessionTracker) plausibleIncrease(elapsed time.Duration, meter bool) float64 {
+	resolution := 1.0
+	if meter {
+		resolution = 0.1
+	}
+	return t.MaxPower/1000*elapsed.Hours() + resolution
+}
+
+func sessionCounter(s Status, meter bool) float64 {
+	if meter {
+		return float64(s.Energy)
+	}
+	return float64(s.CurrentChargePower)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+var sessionStart = time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+
+// sample is a status fed to a SessionTracker, minutes after
+// sessionStart.
+type sample struct {
+	minute int
+	state  EM_CP_PP_ETH.EVState
+	// Energy meter reading and energy of the charge sequence in kWh.
+	meter, charge float32
+	// Charging time of the charge sequence in minutes.
+	chargeTime uint16
+}
+
+func (s sample) status() EM_CP_PP_ETH.Status {
+	status := EM_CP_PP_ETH.Status{
+		EVStatus:           s.state,
+		Energy:             s.meter,
+		CurrentChargePower: s.charge,
+		ChargeTimeHours:    s.chargeTime / 60,
+		ChargeTimeMinutes:  s.chargeTime % 60,
+	}
+	if s.state.Charging() {
+		status.L1Current = 16
+		status.ActivePower = 3680
+	}
+	return status
+}
+
+func (s sample) time() time.Time {
+	return sessionStart.Add(time.Duration(s.minute) * time.Minute)
+}
+
+// track feeds the samples to tracker and returns the sessions that
+// ended.
+func track(tracker *EM_CP_PP_ETH.SessionTracker, samples []sample) []EM_CP_PP_ETH.Session {
+	var sessions []EM_CP_PP_ETH.Session
+	for _, s := range samples {
+		if session, ended := tracker.Update(s.status(), s.time()); ended {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func minute(m int) time.Time {
+	return sessionStart.Add(time.Duration(m) * time.Minute)
+}
+
+func checkEnergy(t *testing.T, session EM_CP_PP_ETH.Session, want float64) {
+	t.Helper()
+	if math.Abs(session.Energy-want) > 1e-4 {
+		t.Errorf("Energy %.4f kWh, want %.4f kWh", session.Energy, want)
+	}
+}
+
+func TestSessionCounterReset(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		samples []sample
+		energy  float64
+		resets  int
+	}{
+		{
+			// The charge sequence starts over after a controller
+			// reset, the energy before and after is added up.
+			name: "charge sequence",
+			samples: []sample{
+				{0, EM_CP_PP_ETH.EVStateB, 0, 0, 0},
+				{1, EM_CP_PP_ETH.EVStateC, 0, 0, 0},
+				{10, EM_CP_PP_ETH.EVStateC, 0, 3, 9},
+				{11, EM_CP_PP_ETH.EVStateF, 0, 0, 0},
+				{12, EM_CP_PP_ETH.EVStateC, 0, 0, 0},
+				{20, EM_CP_PP_ETH.EVStateC, 0, 2, 8},
+				{21, EM_CP_PP_ETH.EVStateA, 0, 0, 0},
+			},
+			energy: 5,
+			resets: 1,
+		},
+		{
+			// A restarted charge sequence is noticed by its charging
+			// time even if the energy has caught up already.
+			name: "charge sequence restarted unnoticed",
+			samples: []sample{
+				{0, EM_CP_PP_ETH.EVStateC, 0, 0, 0},
+				{10, EM_CP_PP_ETH.EVStateC, 0, 2, 10},
+				{20, EM_CP_PP_ETH.EVStateC, 0, 3, 5},
+				{21, EM_CP_PP_ETH.EVStateA, 0, 0, 0},
+			},
+			energy: 5,
+			resets: 1,
+		},
+		{
+			// A meter reading going backwards cannot be attributed,
+			// only the increases on either side are counted.
+			name: "meter",
+			samples: []sample{
+				{0, EM_CP_PP_ETH.EVStateC, 100, 0, 0},
+				{10, EM_CP_PP_ETH.EVStateC, 102.5, 2, 10},
+				{11, EM_CP_PP_ETH.EVStateC, 10, 2.2, 11},
+				{20, EM_CP_PP_ETH.EVStateC, 11.5, 3.7, 20},
+				{21, EM_CP_PP_ETH.EVStateA, 11.5, 0, 0},
+			},
+			energy: 4,
+			resets: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessions := track(EM_CP_PP_ETH.NewSessionTracker("test"), tc.samples)
+			if len(sessions) != 1 {
+				t.Fatalf("Got %d sessions, want 1", len(sessions))
+			}
+			checkEnergy(t, sessions[0], tc.energy)
+			if sessions[0].CounterResets != tc.resets || sessions[0].CounterJumps != 0 {
+				t.Errorf("Counted %d resets and %d jumps, want %d and 0",
+					sessions[0].CounterResets, sessions[0].CounterJumps, tc.resets)
+			}
+		})
+	}
+}
+
+func TestSessionCounterJump(t *testing.T) {
+	tracker := EM_CP_PP_ETH.NewSessionTracker("test")
+	sessions := track(tracker, []sample{
+		{0, EM_CP_PP_ETH.EVStateC, 100, 0, 0},
+		{1, EM_CP_PP_ETH.EVStateC, 100.5, 0, 1},
+		// 50 kWh in a minute would need 3 MW
+		{2, EM_CP_PP_ETH.EVStateC, 150.5, 0, 2},
+		{3, EM_CP_PP_ETH.EVStateC, 151, 0, 3},
+		{4, EM_CP_PP_ETH.EVStateA, 151, 0, 0},
+	})
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(sessions))
+	}
+	session := sessions[0]
+	checkEnergy(t, session, 1)
+	if session.CounterJumps != 1 || session.CounterResets != 0 {
+		t.Errorf("Counted %d jumps and %d resets, want 1 and 0",
+			session.CounterJumps, session.CounterResets)
+	}
+	if session.StartCounter != 100 || session.EndCounter != 151 {
+		t.Errorf("Counters %.1f to %.1f, want 100 to 151",
+			session.StartCounter, session.EndCounter)
+	}
+}
+
+func TestSessionChargePause(t *testing.T) {
+	tracker := EM_CP_PP_ETH.NewSessionTracker("test")
+	track(tracker, []sample{
+		{0, EM_CP_PP_ETH.EVStateB, 100, 0, 0},
+		{1, EM_CP_PP_ETH.EVStateC, 100, 0, 0},
+		{10, EM_CP_PP_ETH.EVStateB, 101, 0, 9},
+	})
+	paused, _ := tracker.Active()
+	if !paused.ChargeStart.Equal(minute(1)) || !paused.ChargeEnd.Equal(minute(10)) {
+		t.Errorf("Paused session charged from %s to %s, want %s to %s",
+			paused.ChargeStart, paused.ChargeEnd, minute(1), minute(10))
+	}
+
+	track(tracker, []sample{{20, EM_CP_PP_ETH.EVStateC, 101, 0, 9}})
+	resumed, _ := tracker.Active()
+	if !resumed.ChargeStart.Equal(minute(1)) || !resumed.ChargeEnd.IsZero() {
+		t.Errorf("Resumed session charged from %s to %s, want %s to zero",
+			resumed.ChargeStart, resumed.ChargeEnd, minute(1))
+	}
+
+	sessions := track(tracker, []sample{
+		{30, EM_CP_PP_ETH.EVStateB, 102, 0, 19},
+		{40, EM_CP_PP_ETH.EVStateA, 102, 0, 0},
+	})
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(sessions))
+	}
+	session := sessions[0]
+	if !session.ChargeStart.Equal(minute(1)) || !session.ChargeEnd.Equal(minute(30)) ||
+		!session.Unplugged.Equal(minute(40)) {
+		t.Errorf("Session charged from %s to %s, unplugged %s, want %s, %s and %s",
+			session.ChargeStart, session.ChargeEnd, session.Unplugged,
+			minute(1), minute(30), minute(40))
+	}
+	if got := session.ChargeDuration(); got != 29*time.Minute {
+		t.Errorf("Charge duration %s, want 29m", got)
+	}
+	checkEnergy(t, session, 2)
+}
+
+func TestSessionResume(t *testing.T) {
+	before := EM_CP_PP_ETH.NewSessionTracker("test")
+	track(before, []sample{
+		{0, EM_CP_PP_ETH.EVStateB, 100, 0, 0},
+		{1, EM_CP_PP_ETH.EVStateC, 100, 0, 0},
+		{10, EM_CP_PP_ETH.EVStateC, 101.5, 1.5, 9},
+	})
+	saved, ok := before.Active()
+	if !ok {
+		t.Fatal("No active session before the restart")
+	}
+
+	// The program restarts 20 minutes later; the vehicle charged in
+	// the meantime.
+	after := EM_CP_PP_ETH.NewSessionTracker("test")
+	after.Resume(saved)
+	if got, _ := after.Active(); !reflect.DeepEqual(got, saved) {
+		t.Errorf("Resumed session\n%+v\nwant\n%+v", got, saved)
+	}
+	sessions := track(after, []sample{
+		{30, EM_CP_PP_ETH.EVStateC, 104, 4, 29},
+		{40, EM_CP_PP_ETH.EVStateB, 105, 5, 39},
+		{41, EM_CP_PP_ETH.EVStateA, 105, 0, 0},
+	})
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(sessions))
+	}
+	session := sessions[0]
+	if session.ID != saved.ID || !session.PluggedIn.Equal(minute(0)) ||
+		!session.ChargeStart.Equal(minute(1)) || !session.ChargeEnd.Equal(minute(40)) {
+		t.Errorf("Session %s plugged in %s, charged from %s to %s, "+
+			"want %s, %s, %s to %s", session.ID, session.PluggedIn,
+			session.ChargeStart, session.ChargeEnd, saved.ID, minute(0),
+			minute(1), minute(40))
+	}
+	checkEnergy(t, session, 5)
+	if session.CounterResets != 0 || session.CounterJumps != 0 {
+		t.Errorf("Counted %d resets and %d jumps, want none",
+			session.CounterResets, session.CounterJumps)
+	}
+}
+
+func TestSessionResumeImplausibleGap(t *testing.T) {
+	before := EM_CP_PP_ETH.NewSessionTracker("test")
+	track(before, []sample{{0, EM_CP_PP_ETH.EVStateC, 100, 0, 0}})
+	saved, _ := before.Active()
+
+	// Two minutes cannot explain 30 kWh, the gap is dropped
+	after := EM_CP_PP_ETH.NewSessionTracker("test")
+	after.Resume(saved)
+	sessions := track(after, []sample{
+		{2, EM_CP_PP_ETH.EVStateC, 130, 0, 2},
+		{3, EM_CP_PP_ETH.EVStateA, 130.5, 0, 0},
+	})
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(sessions))
+	}
+	checkEnergy(t, sessions[0], 0.5)
+	if sessions[0].CounterJumps != 1 {
+		t.Errorf("Counted %d jumps, want 1", sessions[0].CounterJumps)
+	}
+}
+
+func TestSessionPhases(t *testing.T) {
+	tracker := EM_CP_PP_ETH.NewSessionTracker("a")
+	charging := EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC, L3Current: 16}
+	tracker.Update(charging, minute(0))
+	charging.L1Current = 16
+	tracker.Update(charging, minute(1))
+	charging.L2Current = 16
+	tracker.Update(charging, minute(2))
+	session, ended := tracker.Update(EM_CP_PP_ETH.Status{
+		EVStatus: EM_CP_PP_ETH.EVStateA}, minute(3))
+	if want := []string{"L1", "L2", "L3"}; !ended ||
+		!reflect.DeepEqual(session.Phases, want) {
+		t.Errorf("Phases %v, want %v", session.Phases, want)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	tracker := EM_CP_PP_ETH.NewSessionTracker("test")
+	var events []EM_CP_PP_ETH.SessionEvent
+	tracker.OnEvent = func(e EM_CP_PP_ETH.Event) {
+		events = append(events, e.(EM_CP_PP_ETH.SessionEvent))
+	}
+	sessions := track(tracker, []sample{
+		{0, EM_CP_PP_ETH.EVStateA, 100, 0, 0},
+		{1, EM_CP_PP_ETH.EVStateC, 100, 0, 0},
+		{10, EM_CP_PP_ETH.EVStateF, 101, 1, 9},
+		{11, EM_CP_PP_ETH.EVStateA, 101, 0, 0},
+		{20, EM_CP_PP_ETH.EVStateB, 101, 0, 0},
+	})
+	if len(events) != 3 || len(sessions) != 1 {
+		t.Fatalf("Got %d events and %d sessions, want 3 and 1", len(events),
+			len(sessions))
+	}
+	for i, want := range []struct {
+		time    time.Time
+		started bool
+		id      string
+	}{
+		{minute(1), true, sessions[0].ID},
+		{minute(11), false, sessions[0].ID},
+		{minute(20), true, "test-" + strconv.FormatInt(minute(20).Unix(), 10)},
+	} {
+		e := events[i]
+		if !e.Time.Equal(want.time) || e.Started != want.started ||
+			e.Session.ID != want.id {
+			t.Errorf("Event %d is %s at %s, want started %t of %s at %s", i, e,
+				e.Time, want.started, want.id, want.time)
+		}
+	}
+	if !reflect.DeepEqual(events[1].Session, sessions[0]) {
+		t.Errorf("Ended event carries\n%+v\nwant\n%+v", events[1].Session,
+			sessions[0])
+	}
+
+	// Resuming a saved session is not a start
+	resumed := EM_CP_PP_ETH.NewSessionTracker("test")
+	resumed.OnEvent = tracker.OnEvent
+	active, _ := tracker.Active()
+	resumed.Resume(active)
+	if len(events) != 3 {
+		t.Errorf("Resume sent %v", events[3:])
+	}
+}
@@ -0,0 +1,247 @@
+// Package simulator provides an in-process stand-in for the Phoenix
+// Contact EM-CP-PP-ETH charge controller. It serves the same register
+// map as the real device over Modbus TCP, so StatusCache and Commander
+// can be exercised without a wallbox on the desk.
+package simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// Device holds the register contents of a simulated charge controller.
+// All methods are safe for concurrent use, so tests can change values
+// while a client is polling.
+type Device struct {
+	mu               sync.Mutex
+	inputRegisters   map[uint16]uint16
+	holdingRegisters map[uint16]uint16
+	coils            map[uint16]bool
+	discreteInputs   map[uint16]bool
+}
+
+// NewDevice returns a simulated controller in an idle state: no vehicle
+// connected and the configuration at factory settings. The device
+// serves the registers of the status and configuration maps; reads
+// outside them are answered with an "illegal data address" exception,
+// just like the real device does.
+func NewDevice() *Device {
+	d := &Device{
+		inputRegisters:   make(map[uint16]uint16),
+		holdingRegisters: make(map[uint16]uint16),
+		coils:            make(map[uint16]bool),
+		discreteInputs:   make(map[uint16]bool),
+	}
+	start, quantity := EM_CP_PP_ETH.InputRegisterMap.Span()
+	for i := uint16(0); i < quantity; i++ {
+		d.inputRegisters[start+i] = 0
+	}
+	for _, r := range EM_CP_PP_ETH.OptionalRegisterMap {
+		for i := uint16(0); i < r.Words; i++ {
+			d.inputRegisters[r.Address+i] = 0
+		}
+	}
+	start, quantity = EM_CP_PP_ETH.DiscreteInputSpan()
+	for i := uint16(0); i < quantity; i++ {
+		d.discreteInputs[start+i] = false
+	}
+	for _, r := range EM_CP_PP_ETH.ConfigurationMap {
+		if r.Coil {
+			d.coils[r.Address] = r.Default == 1
+		} else {
+			d.holdingRegisters[r.Address] = r.Default
+		}
+	}
+
+	err := d.SetStatus(EM_CP_PP_ETH.Status{
+		EVStatus:         EM_CP_PP_ETH.EVStateA,
+		ProximityCurrent: 32,
+		FirmwareVersion:  0x00010000,
+		L1Voltage:        230,
+		L2Voltage:        230,
+		L3Voltage:        230,
+		Frequency:        50,
+		L1MaxCurrent:     16,
+		L2MaxCurrent:     16,
+		L3MaxCurrent:     16,
+	})
+	if err != nil {
+		// The idle status is constant, so this is a broken register map
+		panic(fmt.Sprintf("simulator: cannot encode the idle status: %s",
+			err.Error()))
+	}
+	return d
+}
+
+// SetStatus encodes the given status into the input registers and
+// discrete inputs, using the register map StatusCache decodes. The
+// ActualChargingCurrent field is ignored; use SetHoldingRegister for
+// register 300 instead.
+func (d *Device) SetStatus(s EM_CP_PP_ETH.Status) error {
+	regs, err := EM_CP_PP_ETH.InputRegisterMap.Encode(&s)
+	if err != nil {
+		return err
+	}
+	optional := make(map[uint16]uint16)
+	for _, r := range EM_CP_PP_ETH.OptionalRegisterMap {
+		m := EM_CP_PP_ETH.RegisterMap{r}
+		words, err := m.Encode(&s)
+		if err != nil {
+			return err
+		}
+		for i := uint16(0); i < r.Words; i++ {
+			optional[r.Address+i] = binary.BigEndian.Uint16(words[2*i:])
+		}
+	}
+	bits, err := EM_CP_PP_ETH.EncodeDiscreteInputs(&s)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start, quantity := EM_CP_PP_ETH.InputRegisterMap.Span()
+	for i := uint16(0); i < quantity; i++ {
+		d.inputRegisters[start+i] = binary.BigEndian.Uint16(regs[2*i:])
+	}
+	for address, value := range optional {
+		// Skip the registers removed by RemoveInputRegister.
+		if _, ok := d.inputRegisters[address]; ok {
+			d.inputRegisters[address] = value
+		}
+	}
+	start, _ = EM_CP_PP_ETH.DiscreteInputSpan()
+	for i, state := range bits {
+		d.discreteInputs[start+uint16(i)] = state
+	}
+	return nil
+}
+
+// SetInputRegister overwrites a single input register. Only addresses
+// of the simulated register map are accepted.
+func (d *Device) SetInputRegister(address, value uint16) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.inputRegisters[address]; !ok {
+		return fmt.Errorf("Input register %d is not mapped", address)
+	}
+	d.inputRegisters[address] = value
+	return nil
+}
+
+// RemoveInputRegister unmaps an input register, so reads that include
+// it are answered with an "illegal data address" exception. Use it to
+// emulate firmware without the registers of OptionalRegisterMap.
+func (d *Device) RemoveInputRegister(address uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inputRegisters, address)
+}
+
+// SetDiscreteInput overwrites a single discrete input.
+func (d *Device) SetDiscreteInput(address uint16, state bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.discreteInputs[address]; !ok {
+		return fmt.Errorf("Discrete input %d is not mapped", address)
+	}
+	d.discreteInputs[address] = state
+	return nil
+}
+
+// HoldingRegister returns the current value of a holding register.
+func (d *Device) HoldingRegister(address uint16) (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, ok := d.holdingRegisters[address]
+	if !ok {
+		return 0, fmt.Errorf("Holding register %d is not mapped", address)
+	}
+	return value, nil
+}
+
+// SetHoldingRegister overwrites a single holding register.
+func (d *Device) SetHoldingRegister(address, value uint16) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.holdingRegisters[address]; !ok {
+		return fmt.Errorf("Holding register %d is not mapped", address)
+	}
+	d.holdingRegisters[address] = value
+	return nil
+}
+
+// Coil returns the current state of a coil.
+func (d *Device) Coil(address uint16) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.coils[address]
+	if !ok {
+		return false, fmt.Errorf("Coil %d is not mapped", address)
+	}
+	return state, nil
+}
+
+// SetCoil overwrites a single coil.
+func (d *Device) SetCoil(address uint16, state bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.coils[address]; !ok {
+		return fmt.Errorf("Coil %d is not mapped", address)
+	}
+	d.coils[address] = state
+	return nil
+}
+
+// readBits collects quantity bits starting at address from table and
+// packs them LSB first, as required by function codes 1 and 2.
+func readBits(table map[uint16]bool, address, quantity uint16) ([]byte, bool) {
+	result := make([]byte, (quantity+7)/8)
+	for i := uint16(0); i < quantity; i++ {
+		state, ok := table[address+i]
+		if !ok {
+			return nil, false
+		}
+		if state {
+			result[i/8] |= 1 << (i % 8)
+		}
+	}
+	return result, true
+}
+
+// readWords collects quantity registers starting at address from table
+// in big endian byte order.
+func readWords(table map[uint16]uint16, address, quantity uint16) ([]byte, bool) {
+	result := make([]byte, 2*quantity)
+	for i := uint16(0); i < quantity; i++ {
+		value, ok := table[address+i]
+		if !ok {
+			return nil, false
+		}
+		binary.BigEndian.PutUint16(result[2*i:], value)
+	}
+	return result, true
+}
+
+// mappedBits and mappedWords report whether all addresses in [address, address+quantity)
+// exist in the given table.
+func mappedBits(table map[uint16]bool, address, quantity uint16) bool {
+	for i := uint16(0); i < quantity; i++ {
+		if _, ok := table[address+i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func mappedWords(table map[uint16]uint16, address, quantity uint16) bool {
+	for i := uint16(0); i < quantity; i++ {
+		if _, ok := table[address+i]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,352 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const (
+	// Power factor of a charging on-board charger.
+	chargingPowerFactor = 0.99
+	// Voltage drop per amp, models the impedance of the supply line.
+	lineResistance = 0.02
+	// The vehicle keeps drawing at least this current per phase while
+	// tapering, until the battery is full.
+	minTaperCurrent = 1.0
+	// Longest interval the meter model integrates in one go.
+	integrationStep = 10 * time.Second
+)
+
+// vehicle is the part of the simulation that scenario steps control.
+type vehicle struct {
+	state             EM_CP_PP_ETH.EVState
+	errors            uint16
+	proximityCurrent  uint16
+	phases            int
+	vehicleMaxCurrent float32
+	batteryCapacity   float32
+	soc               float32
+	taperSoC          float32
+	voltage           float32
+	energy            float32
+}
+
+// Player replays a Scenario against a Device. Between the scripted
+// steps it models a vehicle charging from the offered current: the
+// energy counter ramps up, the battery fills and the current tapers
+// off near the end. The offered current is read back from holding
+// register 300 and coil 402, so writes done through a Commander take
+// effect in the simulation.
+type Player struct {
+	// Loop restarts the scenario after the last step.
+	Loop bool
+	// Logger receives the step comments if set.
+	Logger *log.Logger
+
+	device   *Device
+	scenario *Scenario
+	elapsed  time.Duration
+	next     int
+	vehicle  vehicle
+	// Meter values of the current charge sequence.
+	chargeTime  time.Duration
+	sessionWh   float64
+	maxPower    float32
+	maxCurrents [3]float32
+}
+
+// NewPlayer prepares the replay of scenario on device. The device is
+// updated with the state at offset zero.
+func NewPlayer(device *Device, scenario *Scenario) (*Player, error) {
+	p := &Player{
+		device:   device,
+		scenario: scenario,
+	}
+	if err := p.rewind(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Player) rewind() error {
+	p.elapsed = 0
+	p.next = 0
+	p.vehicle = vehicle{
+		state:             EM_CP_PP_ETH.EVStateA,
+		proximityCurrent:  32,
+		phases:            3,
+		vehicleMaxCurrent: 16,
+		batteryCapacity:   50,
+		soc:               20,
+		taperSoC:          80,
+		voltage:           230,
+	}
+	p.resetChargeSequence()
+	p.applySteps()
+	return p.publish()
+}
+
+func (p *Player) resetChargeSequence() {
+	p.chargeTime = 0
+	p.sessionWh = 0
+	p.maxPower = 0
+	p.maxCurrents = [3]float32{}
+}
+
+// Elapsed returns the simulated time since the start of the scenario.
+func (p *Player) Elapsed() time.Duration {
+	return p.elapsed
+}
+
+// Done reports whether all steps have been applied.
+func (p *Player) Done() bool {
+	return p.next >= len(p.scenario.Steps)
+}
+
+// Advance moves the simulation forward by dt of simulated time. Steps
+// that fall into the interval are applied at their exact offset, so
+// the result does not depend on how Advance is called. It returns an
+// error if the device cannot represent the simulated status.
+func (p *Player) Advance(dt time.Duration) error {
+	target := p.elapsed + dt
+	for p.next < len(p.scenario.Steps) &&
+		p.scenario.Steps[p.next].At.Duration <= target {
+		p.integrate(p.scenario.Steps[p.next].At.Duration - p.elapsed)
+		p.applySteps()
+	}
+	p.integrate(target - p.elapsed)
+	return p.publish()
+}
+
+// Run replays the scenario in real time, compressed by speed: with a
+// speed of 60 one minute of the scenario passes per second. The device
+// is updated every tick. Run returns when the scenario is done (unless
+// Loop is set), the context is canceled or the device cannot be
+// updated.
+func (p *Player) Run(ctx context.Context, speed float64, tick time.Duration) error {
+	if speed <= 0 {
+		return fmt.Errorf("Invalid speed %f", speed)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			err := p.Advance(time.Duration(float64(now.Sub(last)) * speed))
+			if err != nil {
+				return err
+			}
+			last = now
+			if p.Done() && p.elapsed >= p.scenario.Length() {
+				if !p.Loop {
+					return nil
+				}
+				p.logf("restarting scenario '%s'", p.scenario.Name)
+				if err := p.rewind(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (p *Player) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+	}
+}
+
+// applySteps applies all steps due at the current offset.
+func (p *Player) applySteps() {
+	for p.next < len(p.scenario.Steps) &&
+		p.scenario.Steps[p.next].At.Duration <= p.elapsed {
+		step := p.scenario.Steps[p.next]
+		p.next++
+		if step.Comment != "" {
+			p.logf("%s: %s", step.At, step.Comment)
+		}
+		v := &p.vehicle
+		if step.State != EM_CP_PP_ETH.EVStateUnknown {
+			if step.State == EM_CP_PP_ETH.EVStateA {
+				// Unplugging ends the charge sequence.
+				p.resetChargeSequence()
+			}
+			v.state = step.State
+		}
+		if step.Errors != nil {
+			v.errors = 0
+			for _, name := range *step.Errors {
+				fault, _ := EM_CP_PP_ETH.LookupFault(name)
+				v.errors |= fault.Mask
+			}
+		}
+		if step.ProximityCurrent != nil {
+			v.proximityCurrent = *step.ProximityCurrent
+		}
+		if step.Phases != nil {
+			v.phases = *step.Phases
+		}
+		if step.VehicleMaxCurrent != nil {
+			v.vehicleMaxCurrent = *step.VehicleMaxCurrent
+		}
+		if step.BatteryCapacity != nil {
+			v.batteryCapacity = *step.BatteryCapacity
+		}
+		if step.SoC != nil {
+			v.soc = *step.SoC
+		}
+		if step.TaperSoC != nil {
+			v.taperSoC = *step.TaperSoC
+		}
+		if step.Voltage != nil {
+			v.voltage = *step.Voltage
+		}
+		if step.Energy != nil {
+			v.energy = *step.Energy
+		}
+	}
+}
+
+// offeredCurrent is the current the station signals on the CP line:
+// the configured charging current, capped by the cable rating. It is
+// zero if charging has been disabled.
+func (p *Player) offeredCurrent() float32 {
+	enabled, _ := p.device.Coil(EM_CP_PP_ETH.COIL_CHARGING_ENABLED)
+	if !enabled {
+		return 0
+	}
+	current, _ := p.device.HoldingRegister(
+		EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT)
+	offered := float32(current)
+	if float32(p.vehicle.proximityCurrent) < offered {
+		offered = float32(p.vehicle.proximityCurrent)
+	}
+	return offered
+}
+
+// drawnCurrent is the current per phase the vehicle takes right now.
+func (p *Player) drawnCurrent() float32 {
+	v := &p.vehicle
+	if !v.state.Charging() || v.errors != 0 || v.soc >= 100 {
+		return 0
+	}
+	current := p.offeredCurrent()
+	if current < 6 {
+		// IEC 61851 does not allow charging below 6 A.
+		return 0
+	}
+	if v.vehicleMaxCurrent < current {
+		current = v.vehicleMaxCurrent
+	}
+	if v.soc > v.taperSoC {
+		taper := (100 - v.soc) / (100 - v.taperSoC)
+		current = minTaperCurrent + (current-minTaperCurrent)*taper
+	}
+	return current
+}
+
+// integrate advances the vehicle and meter model by dt without
+// applying any steps. Long intervals are split into slices so the
+// taper curve is followed closely even at high time compression.
+func (p *Player) integrate(dt time.Duration) {
+	for dt > 0 {
+		slice := dt
+		if slice > integrationStep {
+			slice = integrationStep
+		}
+		p.integrateSlice(slice)
+		dt -= slice
+	}
+}
+
+func (p *Player) integrateSlice(dt time.Duration) {
+	p.elapsed += dt
+	v := &p.vehicle
+	current := p.drawnCurrent()
+	if current == 0 {
+		return
+	}
+	p.chargeTime += dt
+	power := float64(current) * float64(v.voltage-lineResistance*current) *
+		chargingPowerFactor * float64(v.phases)
+	wh := power * dt.Hours()
+	p.sessionWh += wh
+	v.energy += float32(wh / 1000)
+	v.soc += float32(wh/1000) / v.batteryCapacity * 100
+	if v.soc >= 100 {
+		// The battery is full, the vehicle stops charging and
+		// returns to state B.
+		v.soc = 100
+		v.state = EM_CP_PP_ETH.EVStateB
+		p.logf("%s: battery full", p.elapsed)
+	}
+}
+
+// publish writes the current simulation state to the device registers.
+func (p *Player) publish() error {
+	v := &p.vehicle
+	current := p.drawnCurrent()
+	var currents [3]float32
+	for i := 0; i < v.phases; i++ {
+		currents[i] = current
+		if current > p.maxCurrents[i] {
+			p.maxCurrents[i] = current
+		}
+	}
+	s := EM_CP_PP_ETH.Status{
+		EVStatus:           v.state,
+		ProximityCurrent:   v.proximityCurrent,
+		ChargeTimeHours:    uint16(p.chargeTime / time.Hour),
+		ChargeTimeMinutes:  uint16(p.chargeTime % time.Hour / time.Minute),
+		FirmwareVersion:    0x00010000,
+		Errorcode:          EM_CP_PP_ETH.Errorcode(v.errors),
+		Frequency:          50,
+		Energy:             v.energy,
+		CurrentChargePower: float32(p.sessionWh / 1000),
+		L1MaxCurrent:       p.maxCurrents[0],
+		L2MaxCurrent:       p.maxCurrents[1],
+		L3MaxCurrent:       p.maxCurrents[2],
+	}
+	if v.state == EM_CP_PP_ETH.EVStateA {
+		// No cable plugged into the station.
+		s.ProximityCurrent = 0
+	}
+	voltages := []*float32{&s.L1Voltage, &s.L2Voltage, &s.L3Voltage}
+	amps := []*float32{&s.L1Current, &s.L2Current, &s.L3Current}
+	var apparent float64
+	for i := range voltages {
+		*voltages[i] = v.voltage - lineResistance*currents[i]
+		*amps[i] = currents[i]
+		apparent += float64(*voltages[i] * currents[i])
+	}
+	if apparent > 0 {
+		s.PowerFactor = chargingPowerFactor
+		s.ApparentPower = float32(apparent)
+		s.ActivePower = float32(apparent * chargingPowerFactor)
+		s.ReactivePower = float32(apparent *
+			math.Sqrt(1-chargingPowerFactor*chargingPowerFactor))
+	}
+	if s.ActivePower > p.maxPower {
+		p.maxPower = s.ActivePower
+	}
+	s.MaxPower = p.maxPower
+	enabled, _ := p.device.Coil(EM_CP_PP_ETH.COIL_CHARGING_ENABLED)
+	s.DigitalInputStates.EN = enabled
+	s.DigitalOutputStates.CR = current > 0
+	s.DigitalOutputStates.LR = v.state.VehicleConnected()
+	s.DigitalOutputStates.VR = v.state.VentilationRequired() && current > 0
+	s.DigitalOutputStates.ER = v.errors != 0 || v.state.Fault()
+	if err := p.device.SetStatus(s); err != nil {
+		return fmt.Errorf("Failed to update the device at %s: %s", p.elapsed,
+			err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package simulator
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// ResetHandler emulates config.html?reset=1 of the web interface. Like
+// the real controller it never answers the request: the Modbus server
+// drops its connections, stays offline for downtime and comes back with
+// the DefaultChargingCurrent as charging current.
+func (s *Server) ResetHandler(downtime time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.html" || r.URL.Query().Get("reset") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		go s.restart(downtime)
+		<-r.Context().Done()
+	})
+}
+
+// restart closes the server and listens on the same address again
+// after downtime.
+func (s *Server) restart(downtime time.Duration) {
+	s.mu.Lock()
+	if s.listener == nil {
+		s.mu.Unlock()
+		return
+	}
+	addr := s.listener.Addr().String()
+	s.mu.Unlock()
+	s.logf("simulator: restarting, offline for %s", downtime)
+	s.Close()
+	time.Sleep(downtime)
+	current, err := s.Device.HoldingRegister(
+		EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT)
+	if err == nil {
+		s.Device.SetHoldingRegister(
+			EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT, current)
+	}
+	if _, err := s.Start(addr); err != nil {
+		s.logf("simulator: restart failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+package simulator_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+// HTTPHardResetContext waits a second for the request that the
+// controller never answers, so the simulated downtime has to be longer
+// to be observed.
+const resetDowntime = 1500 * time.Millisecond
+
+var resetOptions = EM_CP_PP_ETH.ResetOptions{
+	Interval:    100 * time.Millisecond,
+	DownTimeout: 3 * time.Second,
+	UpTimeout:   3 * time.Second,
+}
+
+// startResettable serves a new device and its web interface, built by
+// web from the server. It returns the device, a commander connected to
+// it, the reset options and the host of the web interface.
+func startResettable(t *testing.T, web func(*simulator.Server) http.Handler) (*simulator.Device, *EM_CP_PP_ETH.Commander, EM_CP_PP_ETH.ResetOptions, string) {
+	t.Helper()
+	station := simulatortest.Start(t)
+	site := httptest.NewServer(web(station.Server))
+	t.Cleanup(site.Close)
+	opts := resetOptions
+	opts.Connection = station.Handler
+	return station.Device, EM_CP_PP_ETH.NewCommander(station.Client()), opts,
+		strings.TrimPrefix(site.URL, "http://")
+}
+
+func TestResetAndVerify(t *testing.T) {
+	device, commander, opts, host := startResettable(t,
+		func(s *simulator.Server) http.Handler {
+			return s.ResetHandler(resetDowntime)
+		})
+	device.SetHoldingRegister(EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT, 10)
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB})
+
+	report, err := commander.ResetAndVerifyContext(simulatortest.Context(t), host, opts)
+	if err != nil {
+		t.Fatalf("ResetAndVerify: %s", err.Error())
+	}
+	if !report.Sent.Before(report.Down) || !report.Down.Before(report.Up) {
+		t.Errorf("Sent %s, down %s, up %s, want them in order", report.Sent,
+			report.Down, report.Up)
+	}
+	if report.Downtime() < resetDowntime {
+		t.Errorf("Downtime %s, want at least %s", report.Downtime(), resetDowntime)
+	}
+	if report.Status.EVStatus != EM_CP_PP_ETH.EVStateB {
+		t.Errorf("Status after the restart has state %s, want B",
+			report.Status.EVStatus)
+	}
+	current, err := commander.ReadActualChargingCurrentContext(simulatortest.Context(t))
+	if err != nil || current != 10 {
+		t.Errorf("ActualChargingCurrent after the restart %d, %v, want 10",
+			current, err)
+	}
+}
+
+func TestResetAndVerifyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Web interface of the simulator
+		web func(*simulator.Server) http.Handler
+		// Called before the reset
+		setup func(*simulator.Server)
+		want  error
+		// The reset was sent and the controller went down.
+		sent, down bool
+	}{
+		{
+			name: "unreachable",
+			web: func(s *simulator.Server) http.Handler {
+				return s.ResetHandler(resetDowntime)
+			},
+			setup: func(s *simulator.Server) { s.Close() },
+			want:  EM_CP_PP_ETH.ErrUnreachable,
+		},
+		{
+			name: "reset ignored",
+			web: func(s *simulator.Server) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-r.Context().Done()
+				})
+			},
+			want: EM_CP_PP_ETH.ErrResetIgnored,
+			sent: true,
+		},
+		{
+			name: "not returned",
+			web: func(s *simulator.Server) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					s.Close()
+					<-r.Context().Done()
+				})
+			},
+			want: EM_CP_PP_ETH.ErrNotReturned,
+			sent: true,
+			down: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var server *simulator.Server
+			_, commander, opts, host := startResettable(t,
+				func(s *simulator.Server) http.Handler {
+					server = s
+					return tc.web(s)
+				})
+			opts.DownTimeout = 300 * time.Millisecond
+			opts.UpTimeout = 300 * time.Millisecond
+			if tc.setup != nil {
+				tc.setup(server)
+			}
+
+			report, err := commander.ResetAndVerifyContext(simulatortest.Context(t), host, opts)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Got %v, want %v", err, tc.want)
+			}
+			if report.Sent.IsZero() == tc.sent || report.Down.IsZero() == tc.down ||
+				!report.Up.IsZero() {
+				t.Errorf("Sent %s, down %s, up %s, want sent %t, down %t and "+
+					"not up", report.Sent, report.Down, report.Up, tc.sent, tc.down)
+			}
+		})
+	}
+}
+
+func TestHTTPHardResetClosesConnection(t *testing.T) {
+	closed := make(chan struct{})
+	site := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	site.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			close(closed)
+		}
+	}
+	site.Start()
+	t.Cleanup(site.Close)
+
+	commander := EM_CP_PP_ETH.NewCommander(nil)
+	err := commander.HTTPHardResetContext(simulatortest.Context(t),
+		strings.TrimPrefix(site.URL, "http://"))
+	if err != nil {
+		t.Fatalf("HTTPHardReset: %s", err.Error())
+	}
+	select {
+	case <-closed:
+	case <-time.After(simulatortest.WAIT_TIMEOUT):
+		t.Error("The connection of the answered reset is still open")
+	}
+}
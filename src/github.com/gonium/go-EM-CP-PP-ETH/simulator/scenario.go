@@ -0,0 +1,146 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// Scenario is a scripted charging session. Each step changes the state
+// of the simulated vehicle or installation at a fixed offset from the
+// start of the scenario; the Player computes the meter values in
+// between.
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Steps       []Step `json:"steps"`
+}
+
+// Step describes the changes that happen at a given point in time.
+// Fields that are left out keep their previous value.
+type Step struct {
+	// Offset from the start of the scenario, i.e. "90s" or "1h30m".
+	At Duration `json:"at"`
+	// Free text, shown in verbose mode.
+	Comment string `json:"comment,omitempty"`
+	// IEC 61851 vehicle state, "A" to "F".
+	State EM_CP_PP_ETH.EVState `json:"state,omitempty"`
+	// Active error flags, named like the faults in EM_CP_PP_ETH.Faults
+	// (i.e. "ContactorFailure"). An empty list clears all errors.
+	Errors *[]string `json:"errors,omitempty"`
+	// Current carrying capacity of the plugged cable in amps (13, 20,
+	// 32 or 63).
+	ProximityCurrent *uint16 `json:"proximity_current,omitempty"`
+	// Number of phases the on-board charger draws from (1 to 3).
+	Phases *int `json:"phases,omitempty"`
+	// Maximum current per phase the on-board charger accepts.
+	VehicleMaxCurrent *float32 `json:"vehicle_max_current,omitempty"`
+	// Usable battery capacity in kWh.
+	BatteryCapacity *float32 `json:"battery_capacity,omitempty"`
+	// State of charge in percent.
+	SoC *float32 `json:"soc,omitempty"`
+	// State of charge in percent above which the vehicle reduces the
+	// charging current linearly until the battery is full.
+	TaperSoC *float32 `json:"taper_soc,omitempty"`
+	// Nominal grid voltage per phase.
+	Voltage *float32 `json:"voltage,omitempty"`
+	// Reading of the energy meter in kWh.
+	Energy *float32 `json:"energy,omitempty"`
+}
+
+// Duration wraps time.Duration so scenarios can use strings like "5m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Invalid duration %s: %s", data, err.Error())
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// LoadScenario reads a scenario from a JSON file.
+func LoadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scenario, err := ParseScenario(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load scenario %s: %s", path,
+			err.Error())
+	}
+	return scenario, nil
+}
+
+// ParseScenario decodes and validates a JSON scenario.
+func ParseScenario(r io.Reader) (*Scenario, error) {
+	var scenario Scenario
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, err
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// Validate checks the steps for unknown states, error names and values
+// out of range. Steps are sorted by time.
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("Scenario has no steps")
+	}
+	sort.SliceStable(s.Steps, func(i, j int) bool {
+		return s.Steps[i].At.Duration < s.Steps[j].At.Duration
+	})
+	for i, step := range s.Steps {
+		if step.At.Duration < 0 {
+			return fmt.Errorf("Step %d: negative offset %s", i, step.At)
+		}
+		if step.Errors != nil {
+			for _, name := range *step.Errors {
+				if _, err := EM_CP_PP_ETH.LookupFault(name); err != nil {
+					return fmt.Errorf("Step %d: %s", i, err.Error())
+				}
+			}
+		}
+		if step.Phases != nil && (*step.Phases < 1 || *step.Phases > 3) {
+			return fmt.Errorf("Step %d: phases must be between 1 and 3", i)
+		}
+		if step.SoC != nil && (*step.SoC < 0 || *step.SoC > 100) {
+			return fmt.Errorf("Step %d: soc must be between 0 and 100", i)
+		}
+		if step.TaperSoC != nil && (*step.TaperSoC < 0 || *step.TaperSoC >= 100) {
+			return fmt.Errorf("Step %d: taper_soc must be between 0 and 100", i)
+		}
+		if step.BatteryCapacity != nil && *step.BatteryCapacity <= 0 {
+			return fmt.Errorf("Step %d: battery_capacity must be positive", i)
+		}
+	}
+	return nil
+}
+
+// Length returns the offset of the last step.
+func (s *Scenario) Length() time.Duration {
+	return s.Steps[len(s.Steps)-1].At.Duration
+}
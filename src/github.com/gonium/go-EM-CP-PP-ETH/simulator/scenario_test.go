@@ -0,0 +1,233 @@
+package simulator_test
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+// sessionSummary holds the parts of a Session a scenario determines,
+// as offsets from the start of the scenario.
+type sessionSummary struct {
+	PluggedIn, ChargeStart, ChargeEnd, Unplugged time.Duration
+	Phases                                       []string
+	// Energy in kWh, compared with a tolerance of 1 %.
+	Energy float64
+}
+
+// replay plays the scenario in steps of one minute. After every step
+// the status is read through a StatusCache and fed to a
+// SessionTracker. It returns the vehicle states seen, the state and
+// error events as "<offset> <change>" and the sessions that ended.
+func replay(t *testing.T, name string) ([]string, []string, []sessionSummary) {
+	scenario, err := simulator.LoadScenario(filepath.Join("scenarios", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	station := simulatortest.Start(t)
+	device, client := station.Device, station.Client()
+	player, err := simulator.NewPlayer(device, scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	ctx := simulatortest.Context(t)
+	events := cache.Subscribe(ctx, 64)
+	tracker := EM_CP_PP_ETH.NewSessionTracker("sim")
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	offset := func(at time.Time) time.Duration {
+		if at.IsZero() {
+			return 0
+		}
+		return at.Sub(start)
+	}
+
+	var states, changes []string
+	var sessions []sessionSummary
+	for {
+		if err := cache.RefreshContext(ctx); err != nil {
+			t.Fatalf("Refresh at %s: %s", player.Elapsed(), err.Error())
+		}
+		status := cache.Snapshot().Status
+		if len(states) == 0 || states[len(states)-1] != status.EVStatus.String() {
+			states = append(states, status.EVStatus.String())
+		}
+	drain:
+		for {
+			select {
+			case e := <-events:
+				switch e := e.(type) {
+				case EM_CP_PP_ETH.EVStateEvent:
+					changes = append(changes, fmt.Sprintf("%s %s->%s",
+						player.Elapsed(), e.Old, e.New))
+				case EM_CP_PP_ETH.ErrorEvent:
+					edge := "cleared"
+					if e.Set {
+						edge = "set"
+					}
+					changes = append(changes, fmt.Sprintf("%s %s %s",
+						player.Elapsed(), edge, e.Fault.Name))
+				}
+			default:
+				break drain
+			}
+		}
+		if s, ended := tracker.Update(status, start.Add(player.Elapsed())); ended {
+			sessions = append(sessions, sessionSummary{
+				PluggedIn:   offset(s.PluggedIn),
+				ChargeStart: offset(s.ChargeStart),
+				ChargeEnd:   offset(s.ChargeEnd),
+				Unplugged:   offset(s.Unplugged),
+				Phases:      s.Phases,
+				Energy:      s.Energy,
+			})
+		}
+		if player.Done() && player.Elapsed() >= scenario.Length() {
+			break
+		}
+		if err := player.Advance(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, active := tracker.Active(); active {
+		t.Error("Session still active at the end of the scenario")
+	}
+	return states, changes, sessions
+}
+
+func TestScenarios(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		states   string
+		changes  []string
+		sessions []sessionSummary
+	}{
+		{
+			name:   "full-session",
+			states: "A B C B A",
+			changes: []string{
+				"2m0s A->B",
+				"3m0s B->C",
+				// The battery is full, the vehicle stops by itself
+				"3h8m0s C->B",
+				"5h10m0s B->A",
+			},
+			sessions: []sessionSummary{
+				{2 * time.Minute, 3 * time.Minute, 188 * time.Minute,
+					310 * time.Minute, []string{"L1", "L2", "L3"}, 18},
+			},
+		},
+		{
+			name:   "cable-change",
+			states: "A B C B A B D B A",
+			changes: []string{
+				"1m0s A->B",
+				"2m0s B->C",
+				"30m0s C->B",
+				"31m0s B->A",
+				"33m0s A->B",
+				"34m0s B->D",
+				"1h30m0s D->B",
+				"1h32m0s B->A",
+			},
+			sessions: []sessionSummary{
+				{1 * time.Minute, 2 * time.Minute, 30 * time.Minute,
+					31 * time.Minute, []string{"L1", "L2", "L3"}, 4.1},
+				{33 * time.Minute, 34 * time.Minute, 90 * time.Minute,
+					92 * time.Minute, []string{"L1", "L2", "L3"}, 10.2},
+			},
+		},
+		{
+			name:   "contactor-failure",
+			states: "A B C B A",
+			changes: []string{
+				"1m0s A->B",
+				"2m0s B->C",
+				"15m0s set ContactorFailure",
+				"17m0s C->B",
+				"20m0s B->A",
+				"25m0s cleared ContactorFailure",
+			},
+			sessions: []sessionSummary{
+				{1 * time.Minute, 2 * time.Minute, 17 * time.Minute,
+					20 * time.Minute, []string{"L1"}, 0.79},
+			},
+		},
+		{
+			name:   "state-f-fault",
+			states: "A B C F B C B A",
+			changes: []string{
+				"1m0s A->B",
+				"2m0s B->C",
+				"20m0s C->F",
+				"20m0s set StateF",
+				"22m0s F->B",
+				"22m0s cleared StateF",
+				"23m0s B->C",
+				"1h0m0s C->B",
+				"1h5m0s B->A",
+			},
+			// The fault interrupts the charge but not the session
+			sessions: []sessionSummary{
+				{1 * time.Minute, 2 * time.Minute, 60 * time.Minute,
+					65 * time.Minute, []string{"L1", "L2", "L3"}, 10},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			states, changes, sessions := replay(t, tc.name)
+			if got := strings.Join(states, " "); got != tc.states {
+				t.Errorf("EV states %s, want %s", got, tc.states)
+			}
+			if !reflect.DeepEqual(changes, tc.changes) {
+				t.Errorf("Events\n%s\nwant\n%s", strings.Join(changes, "\n"),
+					strings.Join(tc.changes, "\n"))
+			}
+			if len(sessions) != len(tc.sessions) {
+				t.Fatalf("Got %d sessions %+v, want %d", len(sessions),
+					sessions, len(tc.sessions))
+			}
+			for i, got := range sessions {
+				want := tc.sessions[i]
+				energy := got.Energy
+				got.Energy, want.Energy = 0, 0
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Session %d: %+v, want %+v", i, got, want)
+				}
+				if math.Abs(energy-tc.sessions[i].Energy) > tc.sessions[i].Energy/100 {
+					t.Errorf("Session %d: %.3f kWh, want %.3f kWh", i, energy,
+						tc.sessions[i].Energy)
+				}
+			}
+		})
+	}
+}
+
+func TestPlayerDeviceError(t *testing.T) {
+	// The voltage of the second step does not fit into the registers
+	scenario, err := simulator.ParseScenario(strings.NewReader(`{"name": "overvoltage",
+		"steps": [{"at": "0s", "state": "A"}, {"at": "1m", "voltage": 1e8}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	player, err := simulator.NewPlayer(simulator.NewDevice(), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := player.Advance(time.Minute); err == nil ||
+		!strings.HasPrefix(err.Error(), "Failed to update the device at 1m0s") {
+		t.Errorf("Advance returned %v, want an error of the device", err)
+	}
+	err = player.Run(simulatortest.Context(t), 60, 10*time.Millisecond)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to update the device") {
+		t.Errorf("Run returned %v, want an error of the device", err)
+	}
+}
@@ -0,0 +1,297 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const (
+	// Modbus Application Protocol header: transaction id, protocol id,
+	// length and unit id.
+	mbapHeaderSize = 7
+	mbapMaxLength  = 260
+)
+
+// Server answers Modbus TCP requests from the register contents of a
+// Device.
+type Server struct {
+	Device *Device
+	// SlaveId restricts the server to a single unit id. Zero accepts
+	// every unit id, which is handy because the real controller ships
+	// with unit id 180 but is often reconfigured.
+	SlaveId byte
+	// Logger receives a line per request if set.
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a server for the given device.
+func NewServer(device *Device) *Server {
+	return &Server{
+		Device: device,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves requests
+// until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Start listens on addr and serves requests in the background. It
+// returns the address actually bound, so ":0" can be used in tests.
+func (s *Server) Start(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	go s.serve(l)
+	return l.Addr().String(), nil
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	return s.serve(l)
+}
+
+// serve accepts connections on l until Close replaces it. Connections
+// are added to s.wg under s.mu, so Close waits for every handler it did
+// not see yet.
+func (s *Server) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		s.mu.Lock()
+		if s.listener != l {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close stops the listener, drops all client connections and waits for
+// the connection handlers to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+		s.listener = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	var frame [mbapMaxLength]byte
+	for {
+		if _, err := io.ReadFull(conn, frame[:mbapHeaderSize]); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(frame[4:6]))
+		if length < 2 || length > mbapMaxLength-mbapHeaderSize+1 {
+			s.logf("simulator: dropping connection, invalid length %d", length)
+			return
+		}
+		if _, err := io.ReadFull(conn, frame[mbapHeaderSize:mbapHeaderSize+length-1]); err != nil {
+			return
+		}
+		unit := frame[6]
+		if s.SlaveId != 0 && unit != s.SlaveId {
+			// A gateway would answer with exception 11, the
+			// controller itself just stays silent.
+			s.logf("simulator: ignoring request for unit %d", unit)
+			continue
+		}
+		functionCode := frame[mbapHeaderSize]
+		request := frame[mbapHeaderSize+1 : mbapHeaderSize+length-1]
+		response, exception := s.execute(functionCode, request)
+		if exception != 0 {
+			s.logf("simulator: function %d % x -> exception %d",
+				functionCode, request, exception)
+			functionCode |= 0x80
+			response = []byte{exception}
+		} else {
+			s.logf("simulator: function %d % x -> % x",
+				functionCode, request, response)
+		}
+
+		adu := make([]byte, mbapHeaderSize+1+len(response))
+		copy(adu[0:4], frame[0:4])
+		binary.BigEndian.PutUint16(adu[4:6], uint16(2+len(response)))
+		adu[6] = unit
+		adu[mbapHeaderSize] = functionCode
+		copy(adu[mbapHeaderSize+1:], response)
+		if _, err := conn.Write(adu); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a single request PDU against the device. It returns the
+// response data or a non-zero Modbus exception code.
+func (s *Server) execute(functionCode byte, data []byte) ([]byte, byte) {
+	if len(data) < 4 {
+		return nil, modbus.ExceptionCodeIllegalDataValue
+	}
+	address := binary.BigEndian.Uint16(data[0:2])
+	value := binary.BigEndian.Uint16(data[2:4])
+
+	d := s.Device
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch functionCode {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		if value < 1 || value > 2000 {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		table := d.coils
+		if functionCode == modbus.FuncCodeReadDiscreteInputs {
+			table = d.discreteInputs
+		}
+		bits, ok := readBits(table, address, value)
+		if !ok {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		return append([]byte{byte(len(bits))}, bits...), 0
+
+	case modbus.FuncCodeReadInputRegisters, modbus.FuncCodeReadHoldingRegisters:
+		if value < 1 || value > 125 {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		table := d.inputRegisters
+		if functionCode == modbus.FuncCodeReadHoldingRegisters {
+			table = d.holdingRegisters
+		}
+		words, ok := readWords(table, address, value)
+		if !ok {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		return append([]byte{byte(len(words))}, words...), 0
+
+	case modbus.FuncCodeWriteSingleCoil:
+		if value != 0xFF00 && value != 0x0000 {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		if !mappedBits(d.coils, address, 1) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		d.coils[address] = value == 0xFF00
+		return data[0:4], 0
+
+	case modbus.FuncCodeWriteSingleRegister:
+		if !mappedWords(d.holdingRegisters, address, 1) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		if !inRange(address, value) {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		d.holdingRegisters[address] = value
+		return data[0:4], 0
+
+	case modbus.FuncCodeWriteMultipleCoils:
+		if value < 1 || len(data) < 5 || int(data[4]) != len(data)-5 ||
+			int(data[4]) != (int(value)+7)/8 {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		if !mappedBits(d.coils, address, value) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		for i := uint16(0); i < value; i++ {
+			d.coils[address+i] = data[5+i/8]&(1<<(i%8)) != 0
+		}
+		return data[0:4], 0
+
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if value < 1 || len(data) < 5 || int(data[4]) != len(data)-5 ||
+			int(data[4]) != 2*int(value) {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		if !mappedWords(d.holdingRegisters, address, value) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		for i := uint16(0); i < value; i++ {
+			if !inRange(address+i, binary.BigEndian.Uint16(data[5+2*i:])) {
+				return nil, modbus.ExceptionCodeIllegalDataValue
+			}
+		}
+		for i := uint16(0); i < value; i++ {
+			d.holdingRegisters[address+i] =
+				binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		return data[0:4], 0
+	}
+	return nil, modbus.ExceptionCodeIllegalFunction
+}
+
+// inRange checks a holding register value against the range of the
+// configuration map, like the controller firmware does.
+func inRange(address, value uint16) bool {
+	for _, r := range EM_CP_PP_ETH.ConfigurationMap {
+		if !r.Coil && r.Address == address {
+			return r.Check(value) == nil
+		}
+	}
+	return true
+}
+
+// String describes the register map served by the simulator.
+func (s *Server) String() string {
+	inputStart, inputs := EM_CP_PP_ETH.InputRegisterMap.Span()
+	discreteStart, discretes := EM_CP_PP_ETH.DiscreteInputSpan()
+	return fmt.Sprintf("EM-CP-PP-ETH simulator (input registers %d-%d, "+
+		"discrete inputs %d-%d, %d configuration registers and coils)",
+		inputStart, inputStart+inputs-1,
+		discreteStart, discreteStart+discretes-1,
+		len(EM_CP_PP_ETH.ConfigurationMap))
+}
@@ -0,0 +1,373 @@
+package simulator_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+func TestRefreshContextDecodesStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    EM_CP_PP_ETH.Status
+		available bool
+	}{
+		{
+			name: "idle",
+			status: EM_CP_PP_ETH.Status{
+				EVStatus:         EM_CP_PP_ETH.EVStateA,
+				ProximityCurrent: 32,
+				FirmwareVersion:  0x00010000,
+				L1Voltage:        230,
+				L2Voltage:        230,
+				L3Voltage:        230,
+				Frequency:        50,
+			},
+			available: true,
+		},
+		{
+			name: "charging on three phases",
+			status: EM_CP_PP_ETH.Status{
+				EVStatus:              EM_CP_PP_ETH.EVStateC,
+				ProximityCurrent:      20,
+				ChargeTimeMinutes:     25,
+				ChargeTimeHours:       1,
+				DIPConfiguration:      5,
+				FirmwareVersion:       0x00020003,
+				L1Voltage:             229.5,
+				L2Voltage:             231.25,
+				L3Voltage:             230,
+				L1Current:             15.5,
+				L2Current:             15.75,
+				L3Current:             16,
+				ActivePower:           10950,
+				ReactivePower:         120,
+				ApparentPower:         11060,
+				PowerFactor:           0.5,
+				Energy:                1234.5,
+				MaxPower:              11040,
+				CurrentChargePower:    12,
+				Frequency:             49.75,
+				L1MaxCurrent:          16,
+				L2MaxCurrent:          16,
+				L3MaxCurrent:          16,
+				OverCurrentProtection: 3,
+				DigitalInputStates:    EM_CP_PP_ETH.DigiInputs{EN: true, ML: true},
+				DigitalOutputStates:   EM_CP_PP_ETH.DigiOutputs{CR: true, LR: true},
+			},
+			available: true,
+		},
+		{
+			name: "fault while unavailable",
+			status: EM_CP_PP_ETH.Status{
+				EVStatus:            EM_CP_PP_ETH.EVStateF,
+				ProximityCurrent:    13,
+				Errorcode:           EM_CP_PP_ETH.ERROR_STATE_F | EM_CP_PP_ETH.ERROR_CONTACTOR_FAILURE,
+				L1Voltage:           230,
+				DigitalOutputStates: EM_CP_PP_ETH.DigiOutputs{ER: true},
+			},
+			available: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			station := simulatortest.Start(t)
+			device, client := station.Device, station.Client()
+			if err := device.SetStatus(tc.status); err != nil {
+				t.Fatal(err)
+			}
+			if err := device.SetCoil(EM_CP_PP_ETH.COIL_CHARGING_ENABLED, tc.available); err != nil {
+				t.Fatal(err)
+			}
+			cache := EM_CP_PP_ETH.NewStatusCache(client)
+			if err := cache.RefreshContext(simulatortest.Context(t)); err != nil {
+				t.Fatalf("RefreshContext: %s", err.Error())
+			}
+			want := tc.status
+			want.ChargingEnabled = tc.available
+			if got := cache.Snapshot().Status; !reflect.DeepEqual(got, want) {
+				t.Errorf("Decoded status\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRefreshContextWithoutOptionalRegister(t *testing.T) {
+	station := simulatortest.Start(t)
+	device, client := station.Device, station.Client()
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB,
+		OverCurrentProtection: 7})
+	for _, r := range EM_CP_PP_ETH.OptionalRegisterMap {
+		device.RemoveInputRegister(r.Address)
+	}
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	if err := cache.RefreshContext(simulatortest.Context(t)); err != nil {
+		t.Fatalf("RefreshContext: %s", err.Error())
+	}
+	status := cache.Snapshot().Status
+	if status.EVStatus != EM_CP_PP_ETH.EVStateB || status.OverCurrentProtection != 0 {
+		t.Errorf("Got EV state %s and overcurrent protection %d, want B and 0",
+			status.EVStatus, status.OverCurrentProtection)
+	}
+}
+
+func TestCommanderRegisters(t *testing.T) {
+	writeActual := func(c *EM_CP_PP_ETH.Commander, ctx context.Context, value uint16) error {
+		result, err := c.WriteActualChargingCurrentContext(ctx, value)
+		if err == nil && result != value {
+			t.Errorf("Controller confirmed %d, want %d", result, value)
+		}
+		return err
+	}
+	for _, tc := range []struct {
+		name    string
+		address uint16
+		read    func(*EM_CP_PP_ETH.Commander, context.Context) (uint16, error)
+		write   func(*EM_CP_PP_ETH.Commander, context.Context, uint16) error
+		initial uint16
+		value   uint16
+	}{
+		{"ActualChargingCurrent", EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT,
+			(*EM_CP_PP_ETH.Commander).ReadActualChargingCurrentContext,
+			writeActual, 16, 10},
+		{"DefaultChargingCurrent", EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT,
+			(*EM_CP_PP_ETH.Commander).ReadDefaultChargingCurrentContext,
+			(*EM_CP_PP_ETH.Commander).WriteDefaultChargingCurrentContext, 16, 6},
+		{"StationMaxCurrent", EM_CP_PP_ETH.HOLDING_STATION_MAX_CURRENT,
+			(*EM_CP_PP_ETH.Commander).ReadStationMaxCurrentContext,
+			(*EM_CP_PP_ETH.Commander).WriteStationMaxCurrentContext, 32, 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			station := simulatortest.Start(t)
+			device, client := station.Device, station.Client()
+			commander := EM_CP_PP_ETH.NewCommander(client)
+			ctx := simulatortest.Context(t)
+			if got, err := tc.read(commander, ctx); err != nil || got != tc.initial {
+				t.Fatalf("Read %d, %v, want %d", got, err, tc.initial)
+			}
+			if err := tc.write(commander, ctx, tc.value); err != nil {
+				t.Fatalf("Write: %s", err.Error())
+			}
+			if got, _ := device.HoldingRegister(tc.address); got != tc.value {
+				t.Errorf("Register %d holds %d, want %d", tc.address, got, tc.value)
+			}
+			if got, err := tc.read(commander, ctx); err != nil || got != tc.value {
+				t.Errorf("Read back %d, %v, want %d", got, err, tc.value)
+			}
+		})
+	}
+}
+
+func TestCommanderCoils(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		address uint16
+		read    func(*EM_CP_PP_ETH.Commander, context.Context) (bool, error)
+		write   func(*EM_CP_PP_ETH.Commander, context.Context, bool) error
+		initial bool
+	}{
+		{"ChargingEnabled", EM_CP_PP_ETH.COIL_CHARGING_ENABLED,
+			(*EM_CP_PP_ETH.Commander).ReadChargingEnabledContext,
+			(*EM_CP_PP_ETH.Commander).WriteChargingEnabledContext, true},
+		{"DigimodeEnabled", EM_CP_PP_ETH.COIL_DIGIMODE_ENABLED,
+			(*EM_CP_PP_ETH.Commander).ReadDigimodeEnabledContext,
+			(*EM_CP_PP_ETH.Commander).WriteDigimodeEnabledContext, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			station := simulatortest.Start(t)
+			device, client := station.Device, station.Client()
+			commander := EM_CP_PP_ETH.NewCommander(client)
+			ctx := simulatortest.Context(t)
+			if got, err := tc.read(commander, ctx); err != nil || got != tc.initial {
+				t.Fatalf("Read %t, %v, want %t", got, err, tc.initial)
+			}
+			for _, state := range []bool{!tc.initial, tc.initial} {
+				if err := tc.write(commander, ctx, state); err != nil {
+					t.Fatalf("Write %t: %s", state, err.Error())
+				}
+				if got, _ := device.Coil(tc.address); got != state {
+					t.Errorf("Coil %d is %t, want %t", tc.address, got, state)
+				}
+				if got, err := tc.read(commander, ctx); err != nil || got != state {
+					t.Errorf("Read back %t, %v, want %t", got, err, state)
+				}
+			}
+		})
+	}
+}
+
+func TestCommanderReadConfiguration(t *testing.T) {
+	station := simulatortest.Start(t)
+	device, client := station.Device, station.Client()
+	device.SetHoldingRegister(EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT, 10)
+	device.SetCoil(EM_CP_PP_ETH.COIL_DIGIMODE_ENABLED, true)
+	config, err := EM_CP_PP_ETH.NewCommander(client).ReadConfigurationContext(simulatortest.Context(t))
+	if err != nil {
+		t.Fatalf("ReadConfiguration: %s", err.Error())
+	}
+	want := EM_CP_PP_ETH.Configuration{
+		ActualChargingCurrent:  16,
+		DefaultChargingCurrent: 10,
+		StationMaxCurrent:      32,
+		DigimodeEnabled:        true,
+		ChargingEnabled:        true,
+	}
+	if config != want {
+		t.Errorf("Configuration %+v, want %+v", config, want)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// run changes the device and performs the failing request.
+		run       func(*simulator.Device, modbus.Client, context.Context) error
+		exception byte
+	}{
+		{
+			name: "status register missing",
+			run: func(d *simulator.Device, client modbus.Client, ctx context.Context) error {
+				d.RemoveInputRegister(120)
+				return EM_CP_PP_ETH.NewStatusCache(client).RefreshContext(ctx)
+			},
+			exception: modbus.ExceptionCodeIllegalDataAddress,
+		},
+		{
+			name: "forced current out of range",
+			run: func(d *simulator.Device, client modbus.Client, ctx context.Context) error {
+				commander := EM_CP_PP_ETH.NewCommander(client)
+				commander.Guard.Force = true
+				_, err := commander.WriteActualChargingCurrentContext(ctx, 90)
+				return err
+			},
+			exception: modbus.ExceptionCodeIllegalDataValue,
+		},
+		{
+			name: "register outside the map",
+			run: func(d *simulator.Device, client modbus.Client, ctx context.Context) error {
+				_, err := EM_CP_PP_ETH.WithContext(ctx, client).ReadHoldingRegisters(303, 1)
+				return err
+			},
+			exception: modbus.ExceptionCodeIllegalDataAddress,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			station := simulatortest.Start(t)
+			device, client := station.Device, station.Client()
+			err := tc.run(device, client, simulatortest.Context(t))
+			var modbusErr *modbus.ModbusError
+			if !errors.As(err, &modbusErr) {
+				t.Fatalf("Got %v, want a Modbus exception", err)
+			}
+			if modbusErr.ExceptionCode != tc.exception {
+				t.Errorf("Got exception %d, want %d", modbusErr.ExceptionCode,
+					tc.exception)
+			}
+			// The connection is usable after an exception
+			_, err = EM_CP_PP_ETH.NewCommander(client).ReadStationMaxCurrentContext(simulatortest.Context(t))
+			if err != nil {
+				t.Errorf("Request after the exception failed: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestCurrentGuard(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		guard  EM_CP_PP_ETH.CurrentGuard
+		value  uint16
+		stored uint16
+		// Expected limit of the *CurrentLimitError, 0 for none.
+		limit uint16
+	}{
+		{"within limits", EM_CP_PP_ETH.CurrentGuard{}, 12, 12, 0},
+		{"above the measured phase maximum", EM_CP_PP_ETH.CurrentGuard{}, 20, 20, 0},
+		{"above the installation limit", EM_CP_PP_ETH.CurrentGuard{}, 40, 16, 32},
+		{"below the minimum", EM_CP_PP_ETH.CurrentGuard{}, 5, 16, 6},
+		{"configured limit", EM_CP_PP_ETH.CurrentGuard{MaxCurrent: 10}, 12, 16, 10},
+		{"clamped", EM_CP_PP_ETH.CurrentGuard{Clamp: true}, 40, 32, 0},
+		{"clamped up", EM_CP_PP_ETH.CurrentGuard{Clamp: true}, 2, 6, 0},
+		{"forced", EM_CP_PP_ETH.CurrentGuard{Force: true}, 40, 40, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			station := simulatortest.Start(t)
+			device, client := station.Device, station.Client()
+			commander := EM_CP_PP_ETH.NewCommander(client)
+			commander.Guard = tc.guard
+			_, err := commander.WriteActualChargingCurrentContext(simulatortest.Context(t), tc.value)
+			var limitErr *EM_CP_PP_ETH.CurrentLimitError
+			switch {
+			case tc.limit == 0 && err != nil:
+				t.Errorf("Write %d: %s", tc.value, err.Error())
+			case tc.limit != 0 && !errors.As(err, &limitErr):
+				t.Errorf("Write %d: got %v, want a *CurrentLimitError", tc.value, err)
+			case tc.limit != 0 && limitErr.Limit != tc.limit:
+				t.Errorf("Write %d: limit %d, want %d", tc.value, limitErr.Limit, tc.limit)
+			}
+			got, _ := device.HoldingRegister(EM_CP_PP_ETH.HOLDING_ACTUAL_CHARGING_CURRENT)
+			if got != tc.stored {
+				t.Errorf("Register holds %d, want %d", got, tc.stored)
+			}
+		})
+	}
+}
+
+func TestDefaultCurrentGuard(t *testing.T) {
+	station := simulatortest.Start(t)
+	device, client := station.Device, station.Client()
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB,
+		ProximityCurrent: 20})
+	commander := EM_CP_PP_ETH.NewCommander(client)
+	ctx := simulatortest.Context(t)
+
+	// The cable rating limits the current setpoint, but not the one
+	// taking effect after the next reset
+	var limitErr *EM_CP_PP_ETH.CurrentLimitError
+	if _, err := commander.WriteActualChargingCurrentContext(ctx, 25); !errors.As(err, &limitErr) ||
+		limitErr.Limit != 20 {
+		t.Errorf("Write ActualChargingCurrent 25: got %v, want the cable limit of 20 A", err)
+	}
+	if err := commander.WriteDefaultChargingCurrentContext(ctx, 25); err != nil {
+		t.Errorf("Write DefaultChargingCurrent 25: %s", err.Error())
+	}
+	if err := commander.WriteDefaultChargingCurrentContext(ctx, 40); !errors.As(err, &limitErr) ||
+		limitErr.Limit != 32 {
+		t.Errorf("Write DefaultChargingCurrent 40: got %v, want the installation limit of 32 A", err)
+	}
+	if got, _ := device.HoldingRegister(EM_CP_PP_ETH.HOLDING_DEFAULT_CHARGING_CURRENT); got != 25 {
+		t.Errorf("DefaultChargingCurrent holds %d, want 25", got)
+	}
+}
+
+func TestCloseWhileConnecting(t *testing.T) {
+	server := simulator.NewServer(simulator.NewDevice())
+	address, err := server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start simulator: %s", err.Error())
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := net.Dial("tcp", address); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	server.Close()
+	wg.Wait()
+	if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+		conn.Close()
+		t.Error("The closed server accepted a connection")
+	}
+}
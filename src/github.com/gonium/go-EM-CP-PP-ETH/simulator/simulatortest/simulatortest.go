@@ -0,0 +1,96 @@
+// Package simulatortest serves simulated charge controllers to tests.
+package simulatortest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator"
+)
+
+const (
+	// Response timeout of the handler of a Station.
+	RESPONSE_TIMEOUT = 2 * time.Second
+	// Time budget of Context.
+	CONTEXT_TIMEOUT = 10 * time.Second
+	// Time WaitFor waits for its condition.
+	WAIT_TIMEOUT = 2 * time.Second
+)
+
+// Station is a simulated controller, served until the test ends.
+type Station struct {
+	Device *simulator.Device
+	Server *simulator.Server
+	// Address of the server, host:port.
+	Address string
+	// Handler connects to the server with the first request and is
+	// closed when the test ends.
+	Handler *EM_CP_PP_ETH.TCPClientHandler
+}
+
+// Start serves a new device on a free local port.
+func Start(t testing.TB) *Station {
+	t.Helper()
+	device := simulator.NewDevice()
+	server := simulator.NewServer(device)
+	address, err := server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start simulator: %s", err.Error())
+	}
+	return newStation(t, device, server, address)
+}
+
+// Serve serves a new device on l, i.e. a listener that delays or drops
+// connections.
+func Serve(t testing.TB, l net.Listener) *Station {
+	t.Helper()
+	device := simulator.NewDevice()
+	server := simulator.NewServer(device)
+	go server.Serve(l)
+	return newStation(t, device, server, l.Addr().String())
+}
+
+func newStation(t testing.TB, device *simulator.Device,
+	server *simulator.Server, address string) *Station {
+	t.Cleanup(func() { server.Close() })
+	handler := EM_CP_PP_ETH.NewTCPClientHandler(address)
+	handler.Timeout = RESPONSE_TIMEOUT
+	t.Cleanup(func() { handler.Close() })
+	return &Station{
+		Device:  device,
+		Server:  server,
+		Address: address,
+		Handler: handler,
+	}
+}
+
+// Client returns a client of the station that reconnects after
+// connection errors.
+func (s *Station) Client() modbus.Client {
+	return EM_CP_PP_ETH.WithReconnect(modbus.NewClient(s.Handler), s.Handler)
+}
+
+// Context returns a context that ends after CONTEXT_TIMEOUT or with the
+// test.
+func Context(t testing.TB) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// WaitFor polls cond until it holds and fails the test if it does not
+// within WAIT_TIMEOUT.
+func WaitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,16 +1,13 @@
 package EM_CP_PP_ETH
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/goburrow/modbus"
 	"io"
-)
-
-const (
-	// Expected length of status array message
-	LEN_INPUT_REGISTER_STATUS_BYTES          = 84
-	LEN_DISCRETE_INPUT_REGISTER_STATUS_BYTES = 1
+	"sync"
+	"time"
 )
 
 const (
@@ -24,24 +21,8 @@ const (
 	DIGITAL_OUTPUT_ER = 1 << 7
 )
 
-const (
-	ERROR_CABLE_13A_20A     = 1 << 0
-	ERROR_CABLE_13A         = 1 << 1
-	ERROR_INVALID_PP        = 1 << 2
-	ERROR_INVALID_CP        = 1 << 3
-	ERROR_STATE_F           = 1 << 4
-	ERROR_LOCKING           = 1 << 5
-	ERROR_UNLOCKING         = 1 << 6
-	ERROR_LD_FAILURE        = 1 << 7
-	ERROR_OVERCURRENT       = 1 << 8
-	ERROR_COM_MEASUREMENT   = 1 << 9
-	ERROR_STATE_D_REJECTED  = 1 << 10
-	ERROR_CONTACTOR_FAILURE = 1 << 11
-	ERROR_CP_NO_DIODE       = 1 << 12
-)
-
 type Status struct {
-	EVStatus              string
+	EVStatus              EVState
 	ProximityCurrent      uint16
 	ChargeTimeMinutes     uint16
 	ChargeTimeHours       uint16
@@ -69,6 +50,8 @@ type Status struct {
 	DigitalInputStates    DigiInputs
 	DigitalOutputStates   DigiOutputs
 	ActualChargingCurrent uint16
+	// Availability of the charging station (coil ChargingEnabled).
+	ChargingEnabled bool
 }
 
 type DigiInputs struct {
@@ -85,257 +68,261 @@ type DigiOutputs struct {
 	ER bool
 }
 
-type Errorcode struct {
-	OK                    bool
-	Cable13A_20A          bool
-	Cable13A              bool
-	InvalidPP             bool
-	InvalidCP             bool
-	StateF                bool
-	Locking               bool
-	Unlocking             bool
-	FailureLD             bool
-	Overcurrent           bool
-	ComMeasurementFailure bool
-	RejectedStateD        bool
-	ContactorFailure      bool
-	CPNoDiode             bool
-}
+// DEFAULT_STALE_AFTER is the age after which a snapshot of a new
+// StatusCache is marked stale.
+const DEFAULT_STALE_AFTER = 30 * time.Second
 
+// DEFAULT_REQUEST_TIMEOUT is the time budget of a request to the
+// controller in the API server and the MQTT bridge.
+const DEFAULT_REQUEST_TIMEOUT = 10 * time.Second
+
+// StatusCache holds the last status read from the controller. It is
+// safe for concurrent use: one goroutine may Poll while others take
+// snapshots.
 type StatusCache struct {
 	modbusClient modbus.Client
-	Status       Status
+	// Snapshots older than StaleAfter are marked stale, zero disables
+	// the check. Set it before the cache is shared.
+	StaleAfter time.Duration
+
+	mu          sync.RWMutex
+	status      Status
+	updated     time.Time
+	lastErr     error
+	subscribers map[chan Event]struct{}
+}
+
+// Snapshot is an immutable copy of the cache content.
+type Snapshot struct {
+	Status Status
+	// Time of the refresh that produced Status, zero if the cache was
+	// never refreshed.
+	Time time.Time
+	// Err is the error of the most recent refresh, nil if it succeeded.
+	// A failed refresh keeps the previous Status.
+	Err error
+	// Stale is set if the cache was never refreshed or Time is older
+	// than the StaleAfter limit of the cache.
+	Stale bool
 }
 
 func NewStatusCache(client modbus.Client) *StatusCache {
 	return &StatusCache{
 		modbusClient: client,
-		Status:       Status{},
+		StaleAfter:   DEFAULT_STALE_AFTER,
+	}
+}
+
+// Snapshot returns a copy of the current cache content.
+func (sc *StatusCache) Snapshot() Snapshot {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	stale := sc.updated.IsZero() ||
+		(sc.StaleAfter > 0 && time.Since(sc.updated) > sc.StaleAfter)
+	return Snapshot{
+		Status: sc.status,
+		Time:   sc.updated,
+		Err:    sc.lastErr,
+		Stale:  stale,
 	}
 }
 
 // Refreshes the cache with the current settings/values of the charge
 // controller. This is a multi-stage process because of the way the
 // modbus interface works. By calling Refresh() you trigger various
-// steps to read the status and fill the cache.
+// steps to read the status and fill the cache. The new values become
+// visible to Snapshot at once, after all steps are done.
+//
+// If the vehicle state register holds an unknown value, the remaining
+// values are still refreshed and an error wrapping an
+// *UnknownEVStateError is returned at the end.
 func (sc *StatusCache) Refresh() (err error) {
+	return sc.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh but gives up as soon as ctx is canceled
+// or its deadline expires. The returned error then wraps ctx.Err() and
+// the cache keeps its previous values.
+func (sc *StatusCache) RefreshContext(ctx context.Context) (err error) {
+	sc.mu.RLock()
+	status := sc.status
+	sc.mu.RUnlock()
+
+	status, err = sc.read(ctx, status)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var stateErr *UnknownEVStateError
+	if err == nil || errors.As(err, &stateErr) {
+		now := time.Now()
+		if !sc.updated.IsZero() {
+			sc.publish(Diff(sc.status, status, now))
+		}
+		sc.status = status
+		sc.updated = now
+	}
+	sc.lastErr = err
+	return err
+}
+
+// Poll refreshes the cache every interval until ctx is canceled, which
+// is also returned. Each refresh may take at most one interval. Errors
+// do not stop polling; they are reported in the snapshot.
+func (sc *StatusCache) Poll(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, interval)
+		sc.RefreshContext(refreshCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// read fills a copy of status from the controller.
+func (sc *StatusCache) read(ctx context.Context, status Status) (Status, error) {
 
 	// 1. Parse Input Registers.
-	results, err := sc.readInputRegisterStatus()
+	results, err := sc.readInputRegisterStatus(ctx)
 	if err != nil {
-		return err
+		return status, err
 	}
-	err = sc.parseInputRegisterStatus(results)
-	if err != nil {
-		return fmt.Errorf("Failed to parse input register status results: %s", err.Error())
+	var stateErr *UnknownEVStateError
+	decodeErr := parseInputRegisterStatus(results, &status)
+	if decodeErr != nil && !errors.As(decodeErr, &stateErr) {
+		return status, fmt.Errorf("Failed to parse input register status results: %s", decodeErr.Error())
+	}
+
+	// 2. Read the optional registers.
+	for _, r := range OptionalRegisterMap {
+		if err := sc.readOptionalRegister(ctx, r, &status); err != nil {
+			return status, err
+		}
 	}
 
-	// 2. Parse Discrete Registers.
-	results, err = sc.readDiscreteInputStatus()
+	// 3. Parse Discrete Registers.
+	results, err = sc.readDiscreteInputStatus(ctx)
 	if err != nil {
-		return err
+		return status, err
+	}
+	err = DecodeDiscreteInputs(results, &status)
+	if err != nil {
+		return status, fmt.Errorf("Failed to parse discrete register status results: %s", err.Error())
 	}
-	err = sc.parseDiscreteInputStatus(results)
+
+	// 4. Read the availability.
+	results, err = WithContext(ctx, sc.modbusClient).ReadCoils(COIL_CHARGING_ENABLED, 1)
 	if err != nil {
-		return fmt.Errorf("Failed to parse discrete register status results: %s", err.Error())
+		return status, fmt.Errorf("Modbus com error: %w", err)
 	}
+	if len(results) != 1 {
+		return status, fmt.Errorf("Invalid response length %d", len(results))
+	}
+	status.ChargingEnabled = results[0]&1 != 0
 
-	//	// 3. Add the actual charging current
+	//	// 5. Add the actual charging current
 	//	result, err := sc.ReadActualChargingCurrent()
 	//	if err != nil {
 	//		return err
 	//	}
-	//	sc.Status.ActualChargingCurrent = result
+	//	status.ActualChargingCurrent = result
 
-	return nil
+	return status, decodeErr
 }
 
-func (sc *StatusCache) readDiscreteInputStatus() (results []byte, err error) {
-	results, err = sc.modbusClient.ReadDiscreteInputs(200, 8)
+func (sc *StatusCache) readDiscreteInputStatus(ctx context.Context) (results []byte, err error) {
+	address, quantity := DiscreteInputSpan()
+	results, err = WithContext(ctx, sc.modbusClient).ReadDiscreteInputs(address, quantity)
 	if err != nil {
-		return results, fmt.Errorf("Modbus com error: %s", err.Error())
+		return results, fmt.Errorf("Modbus com error: %w", err)
 	}
 	return results, nil
 }
 
-func checkByteMaskAndSet(state byte, mask byte) bool {
-	if (state & mask) != 0 {
-		return true
-	} else {
-		return false
-	}
-}
-
-func checkUint16MaskAndSet(state uint16, mask uint16) bool {
-	if (state & mask) != 0 {
-		return true
-	} else {
-		return false
-	}
-}
-
-func (sc *StatusCache) parseDiscreteInputStatus(input []byte) (err error) {
-
-	if len(input) != LEN_DISCRETE_INPUT_REGISTER_STATUS_BYTES {
-		return fmt.Errorf(
-			"Invalid length of status byte array - expected %d, got %d",
-			LEN_DISCRETE_INPUT_REGISTER_STATUS_BYTES, len(input),
-		)
-	}
-
-	state := input[0]
-	sc.Status.DigitalInputStates.EN = checkByteMaskAndSet(state, DIGITAL_INPUT_EN)
-	sc.Status.DigitalInputStates.XR = checkByteMaskAndSet(state, DIGITAL_INPUT_XR)
-	sc.Status.DigitalInputStates.LD = checkByteMaskAndSet(state, DIGITAL_INPUT_LD)
-	sc.Status.DigitalInputStates.ML = checkByteMaskAndSet(state, DIGITAL_INPUT_ML)
-	sc.Status.DigitalOutputStates.CR = checkByteMaskAndSet(state, DIGITAL_OUTPUT_CR)
-	sc.Status.DigitalOutputStates.LR = checkByteMaskAndSet(state, DIGITAL_OUTPUT_LR)
-	sc.Status.DigitalOutputStates.VR = checkByteMaskAndSet(state, DIGITAL_OUTPUT_VR)
-	sc.Status.DigitalOutputStates.ER = checkByteMaskAndSet(state, DIGITAL_OUTPUT_ER)
-
-	return nil
-}
-
-func (sc *StatusCache) readInputRegisterStatus() (results []byte, err error) {
-	results, err = sc.modbusClient.ReadInputRegisters(100, 42)
+func (sc *StatusCache) readInputRegisterStatus(ctx context.Context) (results []byte, err error) {
+	address, quantity := InputRegisterMap.Span()
+	results, err = WithContext(ctx, sc.modbusClient).ReadInputRegisters(address, quantity)
 	if err != nil {
-		return results, fmt.Errorf("Modbus com error: %s", err.Error())
+		return results, fmt.Errorf("Modbus com error: %w", err)
 	}
 	return results, nil
 }
 
-func (sc *StatusCache) parseInputRegisterStatus(input []byte) (err error) {
-	if len(input) != LEN_INPUT_REGISTER_STATUS_BYTES {
-		return fmt.Errorf(
-			"Invalid length of status byte array - expected %d, got %d",
-			LEN_INPUT_REGISTER_STATUS_BYTES, len(input),
-		)
+// readOptionalRegister reads a register of OptionalRegisterMap into s.
+// An exception response, i.e. illegal data address on firmware without
+// the register, leaves the field at zero.
+func (sc *StatusCache) readOptionalRegister(ctx context.Context, r Register, s *Status) error {
+	m := RegisterMap{r}
+	address, quantity := m.Span()
+	results, err := WithContext(ctx, sc.modbusClient).ReadInputRegisters(address, quantity)
+	var exception *modbus.ModbusError
+	if errors.As(err, &exception) {
+		return nil
 	}
-
-	// Extract vehicle status
-	vehiclestate := binary.BigEndian.Uint16(input[0:2])
-	switch vehiclestate {
-	case 65:
-		sc.Status.EVStatus = "A"
-	case 66:
-		sc.Status.EVStatus = "B"
-	case 67:
-		sc.Status.EVStatus = "C"
-	case 68:
-		sc.Status.EVStatus = "D"
-	case 69:
-		sc.Status.EVStatus = "E"
-	case 70:
-		sc.Status.EVStatus = "F"
-	default:
-		return fmt.Errorf("Invalid vehicle state '%d'", vehiclestate)
+	if err != nil {
+		return fmt.Errorf("Modbus com error: %w", err)
 	}
-
-	sc.Status.ProximityCurrent = binary.BigEndian.Uint16(input[2:4])
-	// This is strange. See the web interface for the "true" value.
-	sc.Status.ChargeTimeMinutes = binary.BigEndian.Uint16(input[4:6]) / 60
-	sc.Status.ChargeTimeHours = binary.BigEndian.Uint16(input[6:8])
-	sc.Status.DIPConfiguration = binary.BigEndian.Uint16(input[8:10])
-	sc.Status.FirmwareVersion = binary.BigEndian.Uint32(input[10:14])
-
-	state := binary.BigEndian.Uint16(input[14:16])
-	if state == 0 {
-		sc.Status.Errorcode.OK = true
-	} else {
-		sc.Status.Errorcode.OK = false
+	if err := m.Decode(results, s); err != nil {
+		return fmt.Errorf("Failed to parse register %d: %s", r.Address,
+			err.Error())
 	}
-	sc.Status.Errorcode.Cable13A_20A = checkUint16MaskAndSet(state, ERROR_CABLE_13A_20A)
-	sc.Status.Errorcode.Cable13A = checkUint16MaskAndSet(state, ERROR_CABLE_13A)
-	sc.Status.Errorcode.InvalidPP = checkUint16MaskAndSet(state, ERROR_INVALID_PP)
-	sc.Status.Errorcode.InvalidCP = checkUint16MaskAndSet(state, ERROR_INVALID_CP)
-	sc.Status.Errorcode.StateF = checkUint16MaskAndSet(state, ERROR_STATE_F)
-	sc.Status.Errorcode.Locking = checkUint16MaskAndSet(state, ERROR_LOCKING)
-	sc.Status.Errorcode.Unlocking = checkUint16MaskAndSet(state, ERROR_UNLOCKING)
-	sc.Status.Errorcode.FailureLD = checkUint16MaskAndSet(state, ERROR_LD_FAILURE)
-	sc.Status.Errorcode.Overcurrent = checkUint16MaskAndSet(state, ERROR_OVERCURRENT)
-	sc.Status.Errorcode.ComMeasurementFailure = checkUint16MaskAndSet(state, ERROR_COM_MEASUREMENT)
-	sc.Status.Errorcode.RejectedStateD = checkUint16MaskAndSet(state, ERROR_STATE_D_REJECTED)
-	sc.Status.Errorcode.ContactorFailure = checkUint16MaskAndSet(state, ERROR_CONTACTOR_FAILURE)
-	sc.Status.Errorcode.CPNoDiode = checkUint16MaskAndSet(state,
-		ERROR_CP_NO_DIODE)
-
-	sc.Status.L1Voltage =
-		float32(binary.BigEndian.Uint32(sc.swapWords(input[16:20]))) / 100
-	sc.Status.L2Voltage = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[20:24]))) / 100
-	sc.Status.L3Voltage = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[24:28]))) / 100
-	sc.Status.L1Current = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[28:32]))) / 1000
-	sc.Status.L2Current = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[32:36]))) / 1000
-	sc.Status.L3Current = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[36:40]))) / 1000
-	sc.Status.ActivePower = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[40:44]))) * 10
-	sc.Status.ReactivePower = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[44:48])))
-	sc.Status.ApparentPower = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[48:52]))) * 10
-	sc.Status.PowerFactor = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[52:56]))) / 1000
-	sc.Status.Energy =
-		float32(binary.BigEndian.Uint32(sc.swapWords(input[56:60]))) / 100
-	sc.Status.MaxPower = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[60:64]))) * 10
-	sc.Status.CurrentChargePower = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[64:68])))
-	sc.Status.Frequency = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[68:72]))) / 100
-	sc.Status.L1MaxCurrent = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[72:76])))
-	sc.Status.L2MaxCurrent = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[76:80])))
-	sc.Status.L3MaxCurrent = float32(
-		binary.BigEndian.Uint32(sc.swapWords(input[80:84])))
-	sc.Status.OverCurrentProtection = binary.BigEndian.Uint16(input[84:86])
-
 	return nil
 }
 
-func (sc StatusCache) swapWords(data []byte) []byte {
-	// TODO: Proper error handling needed.
-	if len(data) != 4 {
-		return data
+// parseInputRegisterStatus decodes the input registers into s and keeps
+// the values that are not read from the input registers.
+func parseInputRegisterStatus(input []byte, s *Status) (err error) {
+	var status Status
+	var stateErr *UnknownEVStateError
+	err = InputRegisterMap.Decode(input, &status)
+	if err != nil && !errors.As(err, &stateErr) {
+		return err
 	}
-
-	data_r := make([]byte, 0)
-	data_r = append(data_r, data[2:4]...)
-	data_r = append(data_r, data[0:2]...)
-
-	return data_r
+	status.DigitalInputStates = s.DigitalInputStates
+	status.DigitalOutputStates = s.DigitalOutputStates
+	status.ActualChargingCurrent = s.ActualChargingCurrent
+	status.ChargingEnabled = s.ChargingEnabled
+	*s = status
+	return err
 }
 
-func (sc StatusCache) WriteFormattedStatus(out io.Writer) {
-	fmt.Fprintf(out, "EV status: %s\n", sc.Status.EVStatus)
-	fmt.Fprintf(out, "Proximity Current: %d A\n", sc.Status.ProximityCurrent)
-	fmt.Fprintf(out, "Charge time: %d:%d\n", sc.Status.ChargeTimeHours,
-		sc.Status.ChargeTimeMinutes)
-	fmt.Fprintf(out, "DIP configuration: %d\n", sc.Status.DIPConfiguration)
-	fmt.Fprintf(out, "Firmware Version: %d\n", sc.Status.FirmwareVersion)
-	fmt.Fprintf(out, "Error state: %+v\n", sc.Status.Errorcode)
-	fmt.Fprintf(out, "Voltage [V]: L1 %.2f L2 %.2f, L3 %.2f\n", sc.Status.L1Voltage,
-		sc.Status.L2Voltage, sc.Status.L3Voltage)
-	fmt.Fprintf(out, "Current [A]: L1 %.2f, L2 %.2f, L3 %.2f\n", sc.Status.L1Current,
-		sc.Status.L2Current, sc.Status.L3Current)
-	fmt.Fprintf(out, "Active power [W]: %.2f\n", sc.Status.ActivePower)
-	fmt.Fprintf(out, "Reactive power [W]: %.2f\n", sc.Status.ReactivePower)
-	fmt.Fprintf(out, "Apparent power [VA]: %.2f\n", sc.Status.ApparentPower)
-	fmt.Fprintf(out, "Power factor: %.2f\n", sc.Status.PowerFactor)
-	fmt.Fprintf(out, "Energy [kWh]: %.2f\n", sc.Status.Energy)
-	fmt.Fprintf(out, "Max Power (charge sequence) [W]: %.2f\n", sc.Status.MaxPower)
-	fmt.Fprintf(out, "Energy (charge sequence) [kWh]: %.2f\n", sc.Status.CurrentChargePower)
-	fmt.Fprintf(out, "Frequency [Hz]: %.2f\n", sc.Status.Frequency)
-	fmt.Fprintf(out, "Max Current [A]: L1 %.2f, L2 %.2f, L3 %.2f\n", sc.Status.L1MaxCurrent,
-		sc.Status.L2MaxCurrent, sc.Status.L3MaxCurrent)
-	fmt.Fprintf(out, "Overcurrent protection: %d\n", sc.Status.OverCurrentProtection)
+// WriteFormattedStatus prints the cached status for humans.
+func (sc *StatusCache) WriteFormattedStatus(out io.Writer) {
+	status := sc.Snapshot().Status
+	fmt.Fprintf(out, "EV status: %s (%s)\n", status.EVStatus,
+		status.EVStatus.Description())
+	fmt.Fprintf(out, "Proximity Current: %d A\n", status.ProximityCurrent)
+	fmt.Fprintf(out, "Charge time: %d:%02d\n", status.ChargeTimeHours,
+		status.ChargeTimeMinutes)
+	fmt.Fprintf(out, "DIP configuration: %d\n", status.DIPConfiguration)
+	fmt.Fprintf(out, "Firmware Version: %d\n", status.FirmwareVersion)
+	fmt.Fprintf(out, "Error state: %s\n", status.Errorcode)
+	for _, f := range status.Errorcode.Faults() {
+		fmt.Fprintf(out, "  %s (%s): %s. %s.\n", f.Name, f.Severity,
+			f.Description, f.Action)
+	}
+	fmt.Fprintf(out, "Voltage [V]: L1 %.2f L2 %.2f, L3 %.2f\n", status.L1Voltage,
+		status.L2Voltage, status.L3Voltage)
+	fmt.Fprintf(out, "Current [A]: L1 %.2f, L2 %.2f, L3 %.2f\n", status.L1Current,
+		status.L2Current, status.L3Current)
+	fmt.Fprintf(out, "Active power [W]: %.2f\n", status.ActivePower)
+	fmt.Fprintf(out, "Reactive power [W]: %.2f\n", status.ReactivePower)
+	fmt.Fprintf(out, "Apparent power [VA]: %.2f\n", status.ApparentPower)
+	fmt.Fprintf(out, "Power factor: %.2f\n", status.PowerFactor)
+	fmt.Fprintf(out, "Energy [kWh]: %.2f\n", status.Energy)
+	fmt.Fprintf(out, "Max Power (charge sequence) [W]: %.2f\n", status.MaxPower)
+	fmt.Fprintf(out, "Energy (charge sequence) [kWh]: %.2f\n", status.CurrentChargePower)
+	fmt.Fprintf(out, "Frequency [Hz]: %.2f\n", status.Frequency)
+	fmt.Fprintf(out, "Max Current [A]: L1 %.2f, L2 %.2f, L3 %.2f\n", status.L1MaxCurrent,
+		status.L2MaxCurrent, status.L3MaxCurrent)
+	fmt.Fprintf(out, "Overcurrent protection: %d\n", status.OverCurrentProtection)
 	fmt.Fprintf(out, "Digital inputs: %+v\n",
-		sc.Status.DigitalInputStates)
+		status.DigitalInputStates)
 	fmt.Fprintf(out, "Digital outputs: %+v\n",
-		sc.Status.DigitalOutputStates)
+		status.DigitalOutputStates)
+	fmt.Fprintf(out, "Charging station available: %t\n",
+		status.ChargingEnabled)
 }
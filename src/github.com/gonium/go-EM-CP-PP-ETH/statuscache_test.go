@@ -0,0 +1,116 @@
+package EM_CP_PP_ETH_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/simulator/simulatortest"
+)
+
+func TestSnapshotBeforeRefresh(t *testing.T) {
+	_, _, client := startSimulator(t)
+	snapshot := EM_CP_PP_ETH.NewStatusCache(client).Snapshot()
+	if !snapshot.Stale || !snapshot.Time.IsZero() || snapshot.Err != nil {
+		t.Errorf("Snapshot of a new cache: stale %t, time %s, error %v, "+
+			"want stale, zero time and no error", snapshot.Stale,
+			snapshot.Time, snapshot.Err)
+	}
+}
+
+func TestStaleAfterFailedRefresh(t *testing.T) {
+	device, _, client := startSimulator(t)
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	cache.StaleAfter = 50 * time.Millisecond
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB})
+	if err := cache.RefreshContext(simulatortest.Context(t)); err != nil {
+		t.Fatalf("RefreshContext: %s", err.Error())
+	}
+	fresh := cache.Snapshot()
+	if fresh.Stale || fresh.Err != nil {
+		t.Fatalf("Snapshot after refresh: stale %t, error %v", fresh.Stale,
+			fresh.Err)
+	}
+
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC})
+	start, _ := EM_CP_PP_ETH.InputRegisterMap.Span()
+	device.RemoveInputRegister(start)
+	if err := cache.RefreshContext(simulatortest.Context(t)); err == nil {
+		t.Fatal("RefreshContext succeeded without the status registers")
+	}
+	failed := cache.Snapshot()
+	if failed.Err == nil || failed.Status.EVStatus != EM_CP_PP_ETH.EVStateB ||
+		!failed.Time.Equal(fresh.Time) {
+		t.Errorf("Snapshot after a failed refresh: error %v, state %s, "+
+			"time %s, want the error and state B of %s", failed.Err,
+			failed.Status.EVStatus, failed.Time, fresh.Time)
+	}
+	time.Sleep(2 * cache.StaleAfter)
+	if !cache.Snapshot().Stale {
+		t.Error("Snapshot is not stale after StaleAfter")
+	}
+}
+
+func TestStaleAfterDisabled(t *testing.T) {
+	_, _, client := startSimulator(t)
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	cache.StaleAfter = 0
+	if err := cache.RefreshContext(simulatortest.Context(t)); err != nil {
+		t.Fatalf("RefreshContext: %s", err.Error())
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cache.Snapshot().Stale {
+		t.Error("Snapshot is stale with StaleAfter 0")
+	}
+}
+
+func TestRefreshWithUnknownState(t *testing.T) {
+	device, _, client := startSimulator(t)
+	device.SetStatus(EM_CP_PP_ETH.Status{ProximityCurrent: 20})
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	err := cache.RefreshContext(simulatortest.Context(t))
+	var stateErr *EM_CP_PP_ETH.UnknownEVStateError
+	if !errors.As(err, &stateErr) {
+		t.Fatalf("Got %v, want an *UnknownEVStateError", err)
+	}
+	snapshot := cache.Snapshot()
+	if snapshot.Stale || snapshot.Status.ProximityCurrent != 20 {
+		t.Errorf("Snapshot: stale %t, proximity %d, want fresh and 20",
+			snapshot.Stale, snapshot.Status.ProximityCurrent)
+	}
+}
+
+func TestPollRecoversFromErrors(t *testing.T) {
+	device, l, client := startSimulator(t)
+	cache := EM_CP_PP_ETH.NewStatusCache(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- cache.Poll(ctx, 50*time.Millisecond) }()
+
+	simulatortest.WaitFor(t, "the first refresh", func() bool {
+		return !cache.Snapshot().Time.IsZero()
+	})
+	// Refreshes that take longer than the interval fail
+	l.setDelay(200 * time.Millisecond)
+	simulatortest.WaitFor(t, "a failed refresh", func() bool {
+		return errors.Is(cache.Snapshot().Err, context.DeadlineExceeded)
+	})
+	l.setDelay(0)
+	device.SetStatus(EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateB})
+	simulatortest.WaitFor(t, "the recovery", func() bool {
+		s := cache.Snapshot()
+		return s.Err == nil && s.Status.EVStatus == EM_CP_PP_ETH.EVStateB
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Poll returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Poll did not return after cancel")
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+// Recorder feeds status samples of one station into a SessionTracker
+// and keeps samples, the session in progress and completed sessions in
+// a Store. It is not safe for concurrent use.
+type Recorder struct {
+	Store   *Store
+	Tracker *EM_CP_PP_ETH.SessionTracker
+	// Minimum time between stored samples, zero stores every sample.
+	SampleInterval time.Duration
+
+	lastSample time.Time
+}
+
+// NewRecorder creates a recorder for station and resumes the session
+// that was in progress when the previous recorder stopped.
+func NewRecorder(st *Store, station string) (*Recorder, error) {
+	tracker := EM_CP_PP_ETH.NewSessionTracker(station)
+	active, ok, err := st.LoadActive(station)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		tracker.Resume(active)
+	}
+	return &Recorder{Store: st, Tracker: tracker}, nil
+}
+
+// Record processes the status sampled at time at. It returns the
+// session that ended with this sample, if any. The tracker sees the
+// sample even if it cannot be stored; the error of the sample is
+// returned after the session was saved.
+func (r *Recorder) Record(s EM_CP_PP_ETH.Status, at time.Time) (*EM_CP_PP_ETH.Session, error) {
+	var sampleErr error
+	if r.lastSample.IsZero() || at.Sub(r.lastSample) >= r.SampleInterval {
+		sampleErr = r.Store.AppendSample(Sample{Time: at,
+			Station: r.Tracker.Station, Status: s})
+		if sampleErr == nil {
+			r.lastSample = at
+		}
+	}
+	var ended *EM_CP_PP_ETH.Session
+	var err error
+	if completed, ok := r.Tracker.Update(s, at); ok {
+		ended = &completed
+		err = r.Store.CompleteSession(completed)
+	} else if active, ok := r.Tracker.Active(); ok {
+		err = r.Store.SaveActive(active)
+	}
+	if err != nil {
+		return ended, err
+	}
+	return ended, sampleErr
+}
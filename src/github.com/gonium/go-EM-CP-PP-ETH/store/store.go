@@ -0,0 +1,452 @@
+// Package store keeps charging sessions and status samples in plain
+// files, so no database has to be installed next to the charge
+// controller. Records are appended as JSON lines to one file per UTC
+// day:
+//
+//	<dir>/sessions/2006-01-02.jsonl  completed sessions, by unplug time
+//	<dir>/samples/2006-01-02.jsonl   status samples, by sample time
+//	<dir>/active/<station>.json      session in progress, per station
+//
+// Every append is synced to disk. A record that was cut off by a crash
+// is dropped when the file is next appended to and skipped when it is
+// read. Other records that cannot be decoded are skipped by queries and
+// reported to the Logger of the store. Retention removes whole day
+// files.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+)
+
+const (
+	SESSION_DIR = "sessions"
+	SAMPLE_DIR  = "samples"
+	ACTIVE_DIR  = "active"
+	DAY_FORMAT  = "2006-01-02"
+)
+
+// Sample is the status of a station at a point in time.
+type Sample struct {
+	Time    time.Time           `json:"time"`
+	Station string              `json:"station,omitempty"`
+	Status  EM_CP_PP_ETH.Status `json:"status"`
+}
+
+// Query selects records. Zero values do not restrict the result.
+type Query struct {
+	// Records at or after From and before To. Sessions match if they
+	// overlap the range.
+	From, To time.Time
+	Station  string
+}
+
+func (q Query) matchStation(station string) bool {
+	return q.Station == "" || q.Station == station
+}
+
+func (q Query) matchTime(t time.Time) bool {
+	return (q.From.IsZero() || !t.Before(q.From)) &&
+		(q.To.IsZero() || t.Before(q.To))
+}
+
+func (q Query) matchSession(s EM_CP_PP_ETH.Session) bool {
+	if !q.matchStation(s.Station) {
+		return false
+	}
+	end := s.Unplugged
+	if end.IsZero() {
+		end = s.Updated
+	}
+	return (q.From.IsZero() || !end.Before(q.From)) &&
+		(q.To.IsZero() || s.PluggedIn.Before(q.To))
+}
+
+// Retention limits how long records are kept, zero keeps them forever.
+type Retention struct {
+	Sessions time.Duration
+	Samples  time.Duration
+}
+
+// Store is a directory of session and sample files. It is safe for
+// concurrent use within one process.
+type Store struct {
+	// Logger receives a line per record skipped by a query if set.
+	// Set it before the store is shared.
+	Logger *log.Logger
+
+	dir     string
+	mu      sync.Mutex
+	skipped uint64
+}
+
+// Open creates the directory layout below dir if needed.
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{SESSION_DIR, SAMPLE_DIR, ACTIVE_DIR} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create store: %s", err.Error())
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the directory of the store.
+func (st *Store) Dir() string {
+	return st.dir
+}
+
+// Skipped returns the number of records queries have skipped because
+// they could not be decoded.
+func (st *Store) Skipped() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.skipped
+}
+
+// skip reports a record that cannot be decoded.
+func (st *Store) skip(path string, number int, err error) {
+	st.mu.Lock()
+	st.skipped++
+	st.mu.Unlock()
+	if st.Logger != nil {
+		st.Logger.Printf("store: skipping %s:%d: %s", path, number,
+			err.Error())
+	}
+}
+
+// AppendSession stores a completed session.
+func (st *Store) AppendSession(s EM_CP_PP_ETH.Session) error {
+	if s.Active() {
+		return fmt.Errorf("Session %s is still active", s.ID)
+	}
+	return st.append(SESSION_DIR, s.Unplugged, s)
+}
+
+// AppendSample stores a status sample.
+func (st *Store) AppendSample(s Sample) error {
+	return st.append(SAMPLE_DIR, s.Time, s)
+}
+
+// Sessions returns the completed sessions matching q, ordered by plug-in
+// time.
+func (st *Store) Sessions(q Query) ([]EM_CP_PP_ETH.Session, error) {
+	var sessions []EM_CP_PP_ETH.Session
+	// A session ends after it started, so earlier files cannot hold a
+	// session that overlaps the range. Later files can.
+	err := st.scan(SESSION_DIR, q.From, time.Time{}, func(line []byte) error {
+		var s EM_CP_PP_ETH.Session
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		if q.matchSession(s) {
+			sessions = append(sessions, s)
+		}
+		return nil
+	})
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].PluggedIn.Before(sessions[j].PluggedIn)
+	})
+	return sessions, err
+}
+
+// Samples returns the samples matching q in the order they were
+// appended.
+func (st *Store) Samples(q Query) ([]Sample, error) {
+	var samples []Sample
+	err := st.scan(SAMPLE_DIR, q.From, q.To, func(line []byte) error {
+		var s Sample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		if q.matchStation(s.Station) && q.matchTime(s.Time) {
+			samples = append(samples, s)
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// SaveActive replaces the saved session in progress of its station.
+// The file is replaced atomically, a crash leaves either the old or the
+// new session.
+func (st *Store) SaveActive(s EM_CP_PP_ETH.Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	path := st.activePath(s.Station)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".active-*")
+	if err != nil {
+		return fmt.Errorf("Failed to save active session: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save active session: %s", err.Error())
+	}
+	return nil
+}
+
+// LoadActive returns the saved session in progress of station.
+func (st *Store) LoadActive(station string) (EM_CP_PP_ETH.Session, bool, error) {
+	var s EM_CP_PP_ETH.Session
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, err := os.ReadFile(st.activePath(station))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, false, nil
+	} else if err != nil {
+		return s, false, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, false, fmt.Errorf("Invalid active session of station '%s': %s",
+			station, err.Error())
+	}
+	return s, true, nil
+}
+
+// ClearActive removes the saved session in progress of station.
+func (st *Store) ClearActive(station string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	err := os.Remove(st.activePath(station))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// CompleteSession appends a completed session and removes it as the
+// active session of its station.
+func (st *Store) CompleteSession(s EM_CP_PP_ETH.Session) error {
+	if err := st.AppendSession(s); err != nil {
+		return err
+	}
+	return st.ClearActive(s.Station)
+}
+
+// Prune removes the day files that are entirely older than the
+// retention allows at time now. It returns the number of removed
+// files.
+func (st *Store) Prune(r Retention, now time.Time) (int, error) {
+	removed := 0
+	for _, kind := range []struct {
+		sub string
+		age time.Duration
+	}{{SESSION_DIR, r.Sessions}, {SAMPLE_DIR, r.Samples}} {
+		if kind.age <= 0 {
+			continue
+		}
+		limit := now.Add(-kind.age)
+		days, err := st.days(kind.sub)
+		if err != nil {
+			return removed, err
+		}
+		st.mu.Lock()
+		for _, day := range days {
+			if day.AddDate(0, 0, 1).After(limit) {
+				break
+			}
+			err = os.Remove(st.dayPath(kind.sub, day))
+			if err != nil {
+				break
+			}
+			removed++
+		}
+		st.mu.Unlock()
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (st *Store) dayPath(sub string, day time.Time) string {
+	return filepath.Join(st.dir, sub, day.UTC().Format(DAY_FORMAT)+".jsonl")
+}
+
+func (st *Store) activePath(station string) string {
+	return filepath.Join(st.dir, ACTIVE_DIR, fileName(station)+".json")
+}
+
+// fileName maps a station name to a file name. Names are escaped, so
+// different stations never share a file, "a/b" becomes "a%2Fb". The
+// empty name becomes "%", which is not the escaped form of any name.
+func fileName(station string) string {
+	if station == "" {
+		return "%"
+	}
+	return url.PathEscape(station)
+}
+
+// append writes record as one line to the day file of t and syncs it.
+func (st *Store) append(sub string, t time.Time, record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	path := st.dayPath(sub, t)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", path, err.Error())
+	}
+	defer f.Close()
+	size, err := Repair(f)
+	if err != nil {
+		return fmt.Errorf("Failed to repair %s: %s", path, err.Error())
+	}
+	if _, err := f.WriteAt(line, size); err != nil {
+		return fmt.Errorf("Failed to append to %s: %s", path, err.Error())
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync %s: %s", path, err.Error())
+	}
+	if size == 0 {
+		// Make the new file itself durable.
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Repair truncates a line that was cut off by a crash from the end of
+// f, which must be opened for reading and writing. It returns the new
+// size of the file.
+func Repair(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	last := make([]byte, 1)
+	if size == 0 {
+		return 0, nil
+	}
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+	// Search backwards for the end of the last complete record.
+	chunk := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(chunk[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	return end, f.Truncate(end)
+}
+
+// days returns the days of the files in sub in ascending order.
+func (st *Store) days(sub string) ([]time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(st.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".jsonl")
+		day, err := time.Parse(DAY_FORMAT, name)
+		if e.IsDir() || name == e.Name() || err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// scan calls fn for every complete record in the day files of sub that
+// may hold records between from and to. Records fn fails to decode are
+// skipped; only errors reading the files end the scan.
+func (st *Store) scan(sub string, from, to time.Time, fn func([]byte) error) error {
+	days, err := st.days(sub)
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if !from.IsZero() && !day.AddDate(0, 0, 1).After(from) {
+			continue
+		}
+		if !to.IsZero() && !day.Before(to) {
+			break
+		}
+		if err := st.scanFile(st.dayPath(sub, day), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *Store) scanFile(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything after the last newline is a record that was cut
+			// off by a crash.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			st.skip(path, number, err)
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
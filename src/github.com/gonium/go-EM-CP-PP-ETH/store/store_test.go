@@ -0,0 +1,444 @@
+package store_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonium/go-EM-CP-PP-ETH"
+	"github.com/gonium/go-EM-CP-PP-ETH/store"
+)
+
+var day = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+func openStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRepair(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"empty", "", ""},
+		{"complete", "{\"a\":1}\n{\"b\":2}\n", "{\"a\":1}\n{\"b\":2}\n"},
+		{"partial last line", "{\"a\":1}\n{\"b\":", "{\"a\":1}\n"},
+		{"only a partial line", "{\"a\":1", ""},
+		{"partial line longer than a chunk", "{\"a\":1}\n" + long, "{\"a\":1}\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.jsonl")
+			writeFile(t, path, tc.content)
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			size, err := store.Repair(f)
+			if err != nil {
+				t.Fatalf("Repair: %s", err.Error())
+			}
+			if got := readFile(t, path); got != tc.want || size != int64(len(tc.want)) {
+				t.Errorf("Repaired to %q with size %d, want %q", got, size, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendAfterCrash(t *testing.T) {
+	st := openStore(t)
+	first := store.Sample{Time: day.Add(time.Hour), Station: "a"}
+	second := store.Sample{Time: day.Add(2 * time.Hour), Station: "a"}
+	if err := st.AppendSample(first); err != nil {
+		t.Fatal(err)
+	}
+	// A crash cut off the next record
+	path := filepath.Join(st.Dir(), store.SAMPLE_DIR, "2024-05-01.jsonl")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2024-05-01T01:30:00Z","sta`)
+	f.Close()
+
+	// The partial record is not read back
+	samples, err := st.Samples(store.Query{})
+	if err != nil || len(samples) != 1 {
+		t.Fatalf("Got %d samples, %v, want 1", len(samples), err)
+	}
+	if err := st.AppendSample(second); err != nil {
+		t.Fatal(err)
+	}
+	samples, err = st.Samples(store.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || !samples[0].Time.Equal(first.Time) ||
+		!samples[1].Time.Equal(second.Time) {
+		t.Errorf("Got %+v, want the samples of 01:00 and 02:00", samples)
+	}
+	if st.Skipped() != 0 {
+		t.Errorf("Skipped %d records, want none", st.Skipped())
+	}
+}
+
+func TestQuerySkipsBadRecords(t *testing.T) {
+	st := openStore(t)
+	var logged bytes.Buffer
+	st.Logger = log.New(&logged, "", 0)
+	for i := 0; i < 3; i++ {
+		at := day.Add(time.Duration(i) * time.Hour)
+		if err := st.AppendSample(store.Sample{Time: at, Station: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			path := filepath.Join(st.Dir(), store.SAMPLE_DIR, "2024-05-01.jsonl")
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(`{"time":"yesterday"}` + "\n")
+			f.Close()
+		}
+	}
+	samples, err := st.Samples(store.Query{})
+	if err != nil {
+		t.Fatalf("Samples: %s", err.Error())
+	}
+	if len(samples) != 3 {
+		t.Errorf("Got %d samples, want 3", len(samples))
+	}
+	if st.Skipped() != 1 {
+		t.Errorf("Skipped %d records, want 1", st.Skipped())
+	}
+	if !strings.Contains(logged.String(), "2024-05-01.jsonl:3") {
+		t.Errorf("Logged %q, want the position of the bad record", logged.String())
+	}
+}
+
+func TestSampleWithUnknownState(t *testing.T) {
+	st := openStore(t)
+	sample := store.Sample{Time: day, Station: "a",
+		Status: EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVState('X')}}
+	if err := st.AppendSample(sample); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := st.Samples(store.Query{})
+	if err != nil || len(samples) != 1 || st.Skipped() != 0 {
+		t.Fatalf("Got %d samples, %v, %d skipped, want 1", len(samples),
+			err, st.Skipped())
+	}
+	if samples[0].Status.EVStatus != EM_CP_PP_ETH.EVStateUnknown {
+		t.Errorf("Read state %s, want unknown", samples[0].Status.EVStatus)
+	}
+}
+
+func TestSamplesAcrossDays(t *testing.T) {
+	st := openStore(t)
+	times := []time.Time{
+		day.Add(23*time.Hour + 59*time.Minute),
+		day.Add(24 * time.Hour),
+		day.Add(36 * time.Hour),
+		day.Add(48*time.Hour + time.Minute),
+	}
+	for i, at := range times {
+		station := "a"
+		if i == 2 {
+			station = "b"
+		}
+		if err := st.AppendSample(store.Sample{Time: at, Station: station}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		query store.Query
+		want  []time.Time
+	}{
+		{"all", store.Query{}, times},
+		{"range", store.Query{From: day.Add(23 * time.Hour),
+			To: day.Add(48 * time.Hour)}, times[:3]},
+		{"from is inclusive", store.Query{From: times[1]}, times[1:]},
+		{"to is exclusive", store.Query{To: times[2]}, times[:2]},
+		{"station", store.Query{Station: "b"}, times[2:3]},
+		{"station and range", store.Query{Station: "a",
+			From: day.Add(24 * time.Hour)}, []time.Time{times[1], times[3]}},
+		{"empty", store.Query{From: day.Add(72 * time.Hour)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			samples, err := st.Samples(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []time.Time
+			for _, s := range samples {
+				got = append(got, s.Time)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got samples of %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func session(station string, from, to time.Duration) EM_CP_PP_ETH.Session {
+	return EM_CP_PP_ETH.Session{
+		ID:        station + "-" + from.String(),
+		Station:   station,
+		PluggedIn: day.Add(from),
+		Unplugged: day.Add(to),
+		Updated:   day.Add(to),
+		Phases:    []string{},
+	}
+}
+
+func TestSessionsAcrossDays(t *testing.T) {
+	st := openStore(t)
+	// Stored by unplug time: the first session is in the file of the
+	// second day.
+	overnight := session("a", 23*time.Hour, 25*time.Hour)
+	morning := session("a", 9*time.Hour, 10*time.Hour)
+	other := session("b", 26*time.Hour, 27*time.Hour)
+	for _, s := range []EM_CP_PP_ETH.Session{overnight, morning, other} {
+		if err := st.AppendSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.AppendSession(EM_CP_PP_ETH.Session{ID: "active"}); err == nil {
+		t.Error("Stored an active session")
+	}
+	for _, tc := range []struct {
+		name  string
+		query store.Query
+		want  []string
+	}{
+		{"all, by plug-in time", store.Query{},
+			[]string{morning.ID, overnight.ID, other.ID}},
+		{"overlap with the evening", store.Query{From: day.Add(22 * time.Hour),
+			To: day.Add(23*time.Hour + 30*time.Minute)}, []string{overnight.ID}},
+		{"overlap with the next morning", store.Query{From: day.Add(24 * time.Hour)},
+			[]string{overnight.ID, other.ID}},
+		{"station", store.Query{Station: "b"}, []string{other.ID}},
+		{"before", store.Query{To: day.Add(9 * time.Hour)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessions, err := st.Sessions(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range sessions {
+				got = append(got, s.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got sessions %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSaveActive(t *testing.T) {
+	st := openStore(t)
+	if _, ok, err := st.LoadActive("a"); ok || err != nil {
+		t.Fatalf("LoadActive of an empty store: %t, %v", ok, err)
+	}
+	first := session("a", time.Hour, 2*time.Hour)
+	first.Unplugged = time.Time{}
+	first.Energy = 1.5
+	if err := st.SaveActive(first); err != nil {
+		t.Fatal(err)
+	}
+	// A crash while saving the next state leaves a temporary file
+	// behind, the saved session is not affected.
+	activeDir := filepath.Join(st.Dir(), store.ACTIVE_DIR)
+	writeFile(t, filepath.Join(activeDir, ".active-crashed"), `{"id":"a-`)
+	got, ok, err := st.LoadActive("a")
+	if err != nil || !ok || !reflect.DeepEqual(got, first) {
+		t.Fatalf("LoadActive returned %+v, %t, %v, want %+v", got, ok, err, first)
+	}
+
+	second := first
+	second.Energy = 3
+	second.Updated = day.Add(3 * time.Hour)
+	if err := st.SaveActive(second); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _ = st.LoadActive("a")
+	if !reflect.DeepEqual(got, second) {
+		t.Errorf("LoadActive returned %+v, want %+v", got, second)
+	}
+	entries, err := os.ReadDir(activeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{".active-crashed", "a.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Active directory holds %v, want %v", names, want)
+	}
+
+	if err := st.ClearActive("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := st.LoadActive("a"); ok {
+		t.Error("Session still active after ClearActive")
+	}
+}
+
+func TestRecorderResumesSession(t *testing.T) {
+	st := openStore(t)
+	charging := EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC, Energy: 100}
+	recorder, err := store.NewRecorder(st, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record(charging, day)
+	charging.Energy = 101
+	recorder.Record(charging, day.Add(10*time.Minute))
+
+	// The program restarts
+	recorder, err = store.NewRecorder(st, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, ok := recorder.Tracker.Active()
+	if !ok || active.Energy != 1 || !active.PluggedIn.Equal(day) {
+		t.Fatalf("Resumed %+v, %t, want the session of %s with 1 kWh",
+			active, ok, day)
+	}
+	charging.Energy = 102
+	recorder.Record(charging, day.Add(20*time.Minute))
+	completed, err := recorder.Record(EM_CP_PP_ETH.Status{
+		EVStatus: EM_CP_PP_ETH.EVStateA, Energy: 102}, day.Add(21*time.Minute))
+	if err != nil || completed == nil || completed.Energy != 2 {
+		t.Fatalf("Completed %+v, %v, want a session with 2 kWh", completed, err)
+	}
+	if _, ok, _ := st.LoadActive("a"); ok {
+		t.Error("Completed session is still saved as active")
+	}
+	sessions, err := st.Sessions(store.Query{Station: "a"})
+	if err != nil || len(sessions) != 1 || sessions[0].ID != completed.ID {
+		t.Errorf("Stored %+v, %v, want the completed session", sessions, err)
+	}
+}
+
+func TestActiveStationNames(t *testing.T) {
+	st := openStore(t)
+	names := []string{"a/b", "a_b", "a b", "..", "", "%"}
+	for i, name := range names {
+		s := session(name, time.Hour, 2*time.Hour)
+		s.Unplugged = time.Time{}
+		s.Energy = float64(i)
+		if err := st.SaveActive(s); err != nil {
+			t.Fatalf("SaveActive(%q): %s", name, err.Error())
+		}
+	}
+	for i, name := range names {
+		got, ok, err := st.LoadActive(name)
+		if err != nil || !ok || got.Station != name || got.Energy != float64(i) {
+			t.Errorf("LoadActive(%q) returned %+v, %t, %v", name, got, ok, err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(st.Dir(), store.ACTIVE_DIR))
+	if err != nil || len(entries) != len(names) {
+		t.Errorf("Active directory holds %d files, %v, want %d", len(entries),
+			err, len(names))
+	}
+}
+
+func TestRecorderSampleError(t *testing.T) {
+	st := openStore(t)
+	recorder, err := store.NewRecorder(st, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Samples cannot be stored, sessions can
+	samples := filepath.Join(st.Dir(), store.SAMPLE_DIR)
+	if err := os.RemoveAll(samples); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, samples, "")
+
+	charging := EM_CP_PP_ETH.Status{EVStatus: EM_CP_PP_ETH.EVStateC, Energy: 100}
+	if _, err := recorder.Record(charging, day); err == nil {
+		t.Error("Record returned no error for the sample")
+	}
+	if active, ok := recorder.Tracker.Active(); !ok || !active.PluggedIn.Equal(day) {
+		t.Fatalf("Tracker has %+v, %t, want the session of %s", active, ok, day)
+	}
+	if _, ok, _ := st.LoadActive("a"); !ok {
+		t.Error("Session in progress was not saved")
+	}
+	completed, err := recorder.Record(EM_CP_PP_ETH.Status{
+		EVStatus: EM_CP_PP_ETH.EVStateA, Energy: 101}, day.Add(time.Hour))
+	if err == nil || completed == nil || completed.Energy != 1 {
+		t.Fatalf("Completed %+v, %v, want a session with 1 kWh and an error",
+			completed, err)
+	}
+	sessions, err := st.Sessions(store.Query{Station: "a"})
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("Stored %+v, %v, want the completed session", sessions, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	st := openStore(t)
+	for i := 0; i < 5; i++ {
+		at := day.AddDate(0, 0, i).Add(12 * time.Hour)
+		if err := st.AppendSample(store.Sample{Time: at}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.AppendSession(session("a", time.Duration(i)*24*time.Hour,
+			time.Duration(i)*24*time.Hour+time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := day.AddDate(0, 0, 4).Add(12 * time.Hour)
+	// Samples older than May 3, 12:00 go: the files of May 1 and 2
+	// end before, the file of May 3 does not.
+	removed, err := st.Prune(store.Retention{Samples: 48 * time.Hour}, now)
+	if err != nil || removed != 2 {
+		t.Fatalf("Prune removed %d files, %v, want 2", removed, err)
+	}
+	samples, _ := st.Samples(store.Query{})
+	if len(samples) != 3 || !samples[0].Time.Equal(day.AddDate(0, 0, 2).Add(12*time.Hour)) {
+		t.Errorf("Kept %d samples starting %v, want 3 from May 3", len(samples), samples)
+	}
+	if sessions, _ := st.Sessions(store.Query{}); len(sessions) != 5 {
+		t.Errorf("Kept %d sessions, want all 5", len(sessions))
+	}
+
+	removed, err = st.Prune(store.Retention{Sessions: 24 * time.Hour,
+		Samples: 48 * time.Hour}, now)
+	if err != nil || removed != 3 {
+		t.Errorf("Prune removed %d files, %v, want 3", removed, err)
+	}
+}